@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"xf/internal/backup"
+	"xf/internal/config"
+)
+
+// runBackup is "xf backup": upload an encrypted archive to BACKUP_URL now,
+// as xf serve does every BACKUP_HOURS, or with -decrypt turn a downloaded
+// archive back into a .tar.gz for restoring.
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	decrypt := fs.String("decrypt", "", "decrypt this downloaded archive instead of making one")
+	out := fs.String("o", "", "with -decrypt, the output file (default the archive name without .enc)")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("usage: xf backup [-decrypt file [-o file]]")
+	}
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
+	}
+	if *decrypt != "" {
+		return decryptBackup(cfg, *decrypt, *out)
+	}
+	if cfg.BackupURL == "" {
+		return errors.New("BACKUP_URL and BACKUP_KEY are not set")
+	}
+	store, err := openStore(cfg, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	runner, err := backupRunner(cfg, store)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	name, size, err := runner.Run(ctx, time.Now())
+	if name != "" {
+		fmt.Printf("uploaded %s (%d bytes)\n", name, size)
+	}
+	return err
+}
+
+func decryptBackup(cfg config.Config, path, out string) error {
+	key, err := backup.ParseKey(cfg.BackupKey)
+	if err != nil {
+		return fmt.Errorf("BACKUP_KEY: %w", err)
+	}
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	plain, err := backup.Decrypt(key, sealed)
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		out = strings.TrimSuffix(path, ".enc")
+	}
+	if out == path {
+		return errors.New("-o is required when the archive name doesn't end in .enc")
+	}
+	if err := os.WriteFile(out, plain, 0o600); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s; it holds data.json for \"xf import\" and the attachments/ and archive/ directories\n", out)
+	return nil
+}
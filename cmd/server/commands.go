@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"xf/internal/accounting"
+	"xf/internal/alert"
+	"xf/internal/config"
+	"xf/internal/db"
+	"xf/internal/logging"
+	"xf/internal/reminder"
+	"xf/internal/web"
+)
+
+const usage = `Usage: xf <command> [flags]
+
+Commands:
+  serve       run the web panel, scheduler and send queue (default)
+  scan        scan subscriptions once and send the reminders that are due
+  export      write all data as JSON
+  accounting  write a month's renewals as CSV for the accounting tool
+  import      replace all data with an export
+  user        add, list or remove panel users, reset a password or set a role
+  doctor      check the configuration, data file, mail and templates
+  seed        add made-up customers and subscriptions for a demo, or remove them
+  whmcs       import clients and services from WHMCS and update expiry dates
+  ldap        import contacts from an LDAP directory as customers
+  backup      upload an encrypted backup to BACKUP_URL now, or decrypt one
+  version     print the version, commit and build date
+
+Every command takes -config and -db. Run "xf <command> -h" for its flags.
+`
+
+// commonFlags are the flags every command takes.
+type commonFlags struct {
+	configPath string
+	// vars maps the flags that override a setting to its variable.
+	vars map[string]string
+}
+
+func addCommonFlags(fs *flag.FlagSet) *commonFlags {
+	c := &commonFlags{vars: map[string]string{}}
+	fs.StringVar(&c.configPath, "config", "", "YAML or TOML config file; environment variables override its values")
+	c.setting(fs, "db", "DATABASE_PATH", "database file")
+	return c
+}
+
+// setting adds a flag that overrides the variable key.
+func (c *commonFlags) setting(fs *flag.FlagSet, name, key, usage string) {
+	c.vars[name] = key
+	fs.String(name, "", fmt.Sprintf("%s (overrides %s)", usage, key))
+}
+
+// load reads the configuration, with the setting flags given taking
+// precedence, so they are validated along with the rest, and sets up
+// logging by it.
+func (c *commonFlags) load(fs *flag.FlagSet) (config.Config, error) {
+	overrides := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		if key, ok := c.vars[f.Name]; ok {
+			overrides[key] = f.Value.String()
+		}
+	})
+	cfg, err := config.Load(c.configPath, overrides)
+	if err != nil {
+		return cfg, err
+	}
+	err = logging.Setup(logging.Options{
+		Format:     cfg.LogFormat,
+		Level:      cfg.LogLevel,
+		File:       cfg.LogFile,
+		MaxSize:    int64(cfg.LogMaxSizeMB) << 20,
+		MaxAge:     time.Duration(cfg.LogMaxAgeDays) * 24 * time.Hour,
+		MaxBackups: cfg.LogMaxBackups,
+	})
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// flagGiven reports whether the flag was set on the command line.
+func flagGiven(fs *flag.FlagSet, name string) bool {
+	given := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// openStore opens the database. Commands that change data pass exclusive:
+// they take the scheduler lock and refuse while a running server holds it,
+// so an import or restore never lands in the middle of a scan.
+func openStore(cfg config.Config, exclusive bool) (*db.Store, error) {
+	store, err := db.Open(cfg.DatabasePath)
+	if err != nil {
+		return nil, err
+	}
+	if !exclusive {
+		return store, nil
+	}
+	held, err := store.AcquireSchedulerLock()
+	if err == nil && !held {
+		err = fmt.Errorf("%s is in use by a running xf serve; stop it first or use the HTTP API", cfg.DatabasePath)
+	}
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// runScan is "xf scan [-threshold N] [-dry-run]": one scan by the
+// reminder rules, or of everything expiring within N days like the
+// panel's manual scan. Queued reminders are then sent before it exits.
+func runScan(args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	threshold := fs.Int("threshold", 0, "remind every subscription expiring within this many days instead of following the rules")
+	dryRun := fs.Bool("dry-run", false, "list the reminders that would be sent without queueing them")
+	fs.Parse(args)
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(cfg, !*dryRun)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	service := web.NewReminderService(cfg, store)
+	service.Hooks = reminderHooks
+	started := time.Now()
+	scanCtx, runID := ctx, 0
+	if !*dryRun {
+		scanCtx, runID = service.StartRun(ctx)
+	}
+	var res reminder.Result
+	if flagGiven(fs, "threshold") {
+		res, err = service.SendNow(scanCtx, *threshold, started, *dryRun)
+	} else {
+		res, err = service.ScanAndSend(scanCtx, started, *dryRun)
+	}
+	if !*dryRun {
+		if err := service.RecordRun(runID, db.TriggerCLI, started, time.Now(), res, err); err != nil {
+			fmt.Fprintf(os.Stderr, "scan history error: %v\n", err)
+		}
+	}
+	printResult(os.Stdout, res, *dryRun)
+	if err != nil || *dryRun || res.Queued == 0 {
+		return err
+	}
+
+	sender, _, err := newMailChain(cfg)
+	if err != nil {
+		return err
+	}
+	mailer, err := limitSender(cfg, store, sender)
+	if err != nil {
+		return err
+	}
+	notifier := alert.Notifier{Mailer: mailer, To: cfg.AdminEmail, WebhookURL: cfg.AlertWebhookURL, WebhookSecret: cfg.AlertWebhookSecret, Chats: alertChats(cfg)}
+	dispatcher, err := newDispatcher(cfg, store, mailer, notifier)
+	if err != nil {
+		return err
+	}
+	if !dispatcher.Enabled() {
+		fmt.Println("mail is not configured; reminders stay queued")
+		return nil
+	}
+	if err := store.RequeueInterrupted(); err != nil {
+		return err
+	}
+	fmt.Printf("processed %d queued emails\n", dispatcher.Drain(ctx))
+	return ctx.Err()
+}
+
+func printResult(w io.Writer, res reminder.Result, dryRun bool) {
+	if dryRun {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		for _, p := range res.Planned {
+			fmt.Fprintf(tw, "%s\t%s\t%d days\t%s\n", p.CustomerEmail, p.ProductName, p.DaysLeft, p.Subject)
+		}
+		tw.Flush()
+		fmt.Fprintf(w, "dry run: %d subscriptions checked, %d reminders would be queued, %d skipped, %d failed\n",
+			res.Total, len(res.Planned), res.Skipped, res.Failed)
+	} else {
+		fmt.Fprintf(w, "%d subscriptions checked: %d queued, %d skipped, %d failed\n", res.Total, res.Queued, res.Skipped, res.Failed)
+	}
+	for _, failure := range res.Failures {
+		fmt.Fprintf(w, "failed: %s\n", failure)
+	}
+}
+
+// runExport is "xf export [-o file]".
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	out := fs.String("o", "", "output file (default standard output)")
+	fs.Parse(args)
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(cfg, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if *out == "" {
+		return store.Export(os.Stdout)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := store.Export(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runAccounting is "xf accounting [-month 2026-10] [-o file]": a month's
+// renewals as CSV, with the columns set on the settings page. The default
+// is last month, the batch finance usually closes.
+func runAccounting(args []string) error {
+	fs := flag.NewFlagSet("accounting", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	month := fs.String("month", "", "month to export as YYYY-MM (default last month)")
+	out := fs.String("o", "", "output file (default standard output)")
+	fs.Parse(args)
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
+	}
+	if *month == "" {
+		now := time.Now().In(cfg.TimeZone)
+		*month = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, cfg.TimeZone).AddDate(0, -1, 0).Format("2006-01")
+	}
+	store, err := openStore(cfg, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	entries, err := accounting.Batch(store, *month, cfg.TimeZone)
+	if err != nil {
+		return err
+	}
+	export, err := store.GetAccountingExport()
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		return accounting.Write(os.Stdout, entries, export, cfg.TimeZone)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := accounting.Write(f, entries, export, cfg.TimeZone); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d renewals from %s written to %s\n", len(entries), *month, *out)
+	return nil
+}
+
+// runImport is "xf import [-replace] file", reading standard input for "-".
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	replace := fs.Bool("replace", false, "overwrite a database that already has customers or subscriptions")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: xf import [-replace] <file|->")
+	}
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
+	}
+	var in io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	store, err := openStore(cfg, true)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := store.Import(in, *replace); err != nil {
+		return err
+	}
+	fmt.Printf("imported into %s\n", cfg.DatabasePath)
+	return nil
+}
+
+// runUser is "xf user add|passwd|list|remove|role". Passwords are read from
+// the first line of standard input so they don't show up in ps. passwd
+// resets a forgotten password; the user must change it on next login.
+func runUser(args []string) error {
+	const userUsage = "usage: xf user add [-role viewer]|passwd|remove <name>, xf user role <name> admin|viewer, or xf user list"
+	if len(args) == 0 {
+		return errors.New(userUsage)
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("user "+action, flag.ExitOnError)
+	common := addCommonFlags(fs)
+	role := fs.String("role", db.RoleAdmin, "role of the new user: admin, or viewer for read-only access")
+	fs.Parse(args[1:])
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
+	}
+	switch {
+	case action == "list" && fs.NArg() == 0:
+		store, err := openStore(cfg, false)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		users, err := store.ListUsers()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, u := range users {
+			note := ""
+			if u.MustChangePassword {
+				note = "(must change password)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", u.Name, u.RoleName(), u.CreatedAt, note)
+		}
+		return w.Flush()
+	case action == "add" && fs.NArg() == 1:
+		name := fs.Arg(0)
+		store, err := openStore(cfg, true)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		password, err := readPassword(name)
+		if err != nil {
+			return err
+		}
+		if err := store.AddUser(name, password, *role, time.Now()); err != nil {
+			return err
+		}
+		fmt.Printf("added %s user %s\n", *role, name)
+		return nil
+	case action == "passwd" && fs.NArg() == 1:
+		name := fs.Arg(0)
+		store, err := openStore(cfg, true)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		password, err := readPassword(name)
+		if err != nil {
+			return err
+		}
+		if err := store.ResetPassword(name, password); err != nil {
+			return err
+		}
+		fmt.Printf("reset the password of %s; it must be changed on next login\n", name)
+		return nil
+	case action == "remove" && fs.NArg() == 1:
+		store, err := openStore(cfg, true)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		if err := store.RemoveUser(fs.Arg(0)); err != nil {
+			return err
+		}
+		fmt.Printf("removed user %s\n", fs.Arg(0))
+		return nil
+	case action == "role" && fs.NArg() == 2:
+		store, err := openStore(cfg, true)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		if err := store.SetRole(fs.Arg(0), fs.Arg(1)); err != nil {
+			return err
+		}
+		fmt.Printf("%s is now a %s\n", fs.Arg(0), fs.Arg(1))
+		return nil
+	}
+	return errors.New(userUsage)
+}
+
+// readPassword reads the first line of standard input.
+func readPassword(name string) (string, error) {
+	fmt.Fprintf(os.Stderr, "Password for %s: ", name)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && (err != io.EOF || password == "") {
+		return "", fmt.Errorf("read password: %w", err)
+	}
+	return strings.TrimRight(password, "\r\n"), nil
+}
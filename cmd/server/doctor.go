@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"xf/internal/config"
+	"xf/internal/db"
+	"xf/internal/email"
+	"xf/internal/notify"
+	"xf/internal/reminder"
+	"xf/internal/web"
+)
+
+// doctorTimeout bounds each connection check.
+const doctorTimeout = 30 * time.Second
+
+// tzdataProbe is a zone every complete time zone database has; TZ=UTC
+// alone would not show the database is missing.
+const tzdataProbe = "Asia/Shanghai"
+
+// doctorReport prints one line per check and counts the failures.
+type doctorReport struct {
+	w      io.Writer
+	checks int
+	failed int
+}
+
+func (r *doctorReport) line(status, name, detail string) {
+	r.checks++
+	fmt.Fprintf(r.w, "%-4s  %-16s %s\n", status, name, detail)
+}
+
+func (r *doctorReport) pass(name, detail string) { r.line("PASS", name, detail) }
+
+func (r *doctorReport) skip(name, reason string) { r.line("SKIP", name, reason) }
+
+func (r *doctorReport) fail(name string, err error) {
+	r.failed++
+	r.line("FAIL", name, err.Error())
+}
+
+// note adds detail to the previous check without counting as one.
+func (r *doctorReport) note(detail string) {
+	fmt.Fprintf(r.w, "%-4s  %-16s %s\n", "", "", detail)
+}
+
+// runDoctor is "xf doctor": check the configuration, time zone data, the
+// data file, mail delivery, templates and reminder rules, and print a
+// report for support. It exits non-zero if any check fails.
+func runDoctor(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	smtp := fs.Bool("smtp", true, "connect to the SMTP servers and log in")
+	fs.Parse(args)
+	r := &doctorReport{w: os.Stdout}
+
+	cfg, err := common.load(fs)
+	var invalid *config.ValidationError
+	switch {
+	case err == nil:
+		source := "environment"
+		if common.configPath != "" {
+			source = common.configPath
+		}
+		r.pass("config", source)
+	case errors.As(err, &invalid):
+		// Carry on: most settings are still usable.
+		for _, problem := range invalid.Problems {
+			r.fail("config", errors.New(problem))
+		}
+	default:
+		r.fail("config", err)
+		return doctorResult(r)
+	}
+
+	doctorTimeZone(r, cfg)
+	store := doctorStore(r, cfg)
+	if *smtp {
+		doctorMail(r, cfg)
+	} else {
+		r.skip("mail", "-smtp=false")
+	}
+	doctorChats(r, cfg)
+	doctorWHMCS(r, cfg)
+	doctorGoogleCalendar(r, cfg)
+	doctorCalDAV(r, cfg)
+	doctorLDAP(r, cfg)
+	doctorBackup(r, cfg, store)
+	if store == nil {
+		r.skip("templates", "needs the data file")
+		r.skip("rules", "needs the data file")
+	} else {
+		defer store.Close()
+		doctorTemplates(r, cfg, store)
+		doctorRules(r, store)
+	}
+	return doctorResult(r)
+}
+
+func doctorResult(r *doctorReport) error {
+	if r.failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", r.failed, r.checks)
+	}
+	fmt.Fprintf(r.w, "all %d checks passed\n", r.checks)
+	return nil
+}
+
+func doctorTimeZone(r *doctorReport, cfg config.Config) {
+	if _, err := time.LoadLocation(tzdataProbe); err != nil {
+		r.fail("timezone data", fmt.Errorf("no time zone database (%v); install tzdata or set ZONEINFO", err))
+	} else {
+		r.pass("timezone data", "found")
+	}
+	if cfg.TimeZone == nil {
+		r.fail("timezone", errors.New("TZ is invalid, see config above"))
+		return
+	}
+	r.pass("timezone", fmt.Sprintf("%s, now %s", cfg.TimeZone, time.Now().In(cfg.TimeZone).Format("2006-01-02 15:04 MST")))
+}
+
+// doctorStore checks the data file can be read, parsed and written, and
+// returns it open for the later checks, or nil.
+func doctorStore(r *doctorReport, cfg config.Config) *db.Store {
+	path := cfg.DatabasePath
+	dir := filepath.Dir(path)
+	probe, err := os.CreateTemp(dir, ".xf-doctor-*")
+	if err != nil {
+		r.fail("data directory", err)
+	} else {
+		probe.Close()
+		os.Remove(probe.Name())
+		r.pass("data directory", dir+" is writable")
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		r.skip("data file", path+" does not exist yet; xf serve creates it")
+		return nil
+	}
+	// Opening for writing checks the permission without changing the file.
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		r.fail("data file", err)
+		return nil
+	}
+	f.Close()
+	store, err := openStore(cfg, false)
+	if err != nil {
+		r.fail("data file", err)
+		return nil
+	}
+	size, err := store.Size()
+	if err != nil {
+		store.Close()
+		r.fail("data file", err)
+		return nil
+	}
+	r.pass("data file", fmt.Sprintf("%s, %d bytes, %d customers, %d subscriptions, %d queued emails",
+		path, size.FileBytes, size.Records["customers"], size.Records["subscriptions"], size.Records["outbox"]))
+	if holder, err := store.SchedulerLockHolder(); err == nil && holder != "" {
+		r.note("scheduler lock held by " + holder)
+	}
+	return store
+}
+
+// doctorMail builds the configured senders and, for SMTP, connects and
+// logs in without sending anything.
+func doctorMail(r *doctorReport, cfg config.Config) {
+	sender, err := newSender(cfg)
+	if err != nil {
+		r.fail("mail", err)
+		return
+	}
+	if !sender.Enabled() {
+		r.fail("mail", errors.New("mail is not configured; reminders stay queued"))
+		return
+	}
+	verify := func(name string, sender email.Sender) {
+		mailer, ok := sender.(email.Mailer)
+		if !ok {
+			r.skip(name, fmt.Sprintf("MAIL_PROVIDER=%s has no connection check", cfg.MailProvider))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+		defer cancel()
+		if err := mailer.Verify(ctx); err != nil {
+			r.fail(name, fmt.Errorf("%s:%d: %w", mailer.Host, mailer.Port, err))
+			return
+		}
+		r.pass(name, fmt.Sprintf("%s:%d accepts the login", mailer.Host, mailer.Port))
+	}
+	verify("mail", sender)
+	failover, err := newFailover(cfg, sender)
+	if err != nil {
+		r.fail("mail secondary", err)
+	} else if failover != nil {
+		verify("mail secondary", failover.Secondary)
+	}
+}
+
+// doctorChats checks the chat services' credentials.
+func doctorChats(r *doctorReport, cfg config.Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	if cfg.TelegramBotToken != "" {
+		telegram := notify.Telegram{Token: cfg.TelegramBotToken, APIURL: cfg.TelegramAPIURL}
+		if err := telegram.Verify(ctx); err != nil {
+			r.fail("telegram", err)
+		} else {
+			r.pass("telegram", "the bot token is accepted")
+		}
+	}
+	if cfg.WeComCorpID != "" {
+		wecom := &notify.WeCom{CorpID: cfg.WeComCorpID, AgentID: cfg.WeComAgentID, Secret: cfg.WeComSecret, APIURL: cfg.WeComAPIURL}
+		if err := wecom.Verify(ctx); err != nil {
+			r.fail("wecom", err)
+		} else {
+			r.pass("wecom", "the corp ID and secret are accepted")
+		}
+	}
+	if cfg.MatrixHomeserver != "" {
+		matrix := notify.Matrix{HomeserverURL: cfg.MatrixHomeserver, Token: cfg.MatrixToken}
+		if err := matrix.Verify(ctx, cfg.MatrixRoomID); err != nil {
+			r.fail("matrix", err)
+		} else {
+			r.pass("matrix", "the access token is accepted and the account has joined the room")
+		}
+	}
+}
+
+// doctorGoogleCalendar checks the Google OAuth credential and calendar.
+func doctorGoogleCalendar(r *doctorReport, cfg config.Config) {
+	if cfg.GoogleCalendarID == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	if err := googleCalendar(cfg).Verify(ctx); err != nil {
+		r.fail("google calendar", err)
+	} else {
+		r.pass("google calendar", "the refresh token is accepted and the calendar can be read")
+	}
+}
+
+// doctorCalDAV checks the CalDAV credential and collection.
+func doctorCalDAV(r *doctorReport, cfg config.Config) {
+	client := calDAVClient(cfg)
+	if !client.Enabled() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	if err := client.Verify(ctx); err != nil {
+		r.fail("caldav", err)
+	} else {
+		r.pass("caldav", "the collection can be read")
+	}
+}
+
+// doctorLDAP checks that the bind to the directory succeeds.
+func doctorLDAP(r *doctorReport, cfg config.Config) {
+	client := ldapSyncer(cfg, nil).Client
+	if !client.Enabled() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	if err := client.Verify(ctx); err != nil {
+		r.fail("ldap", err)
+	} else {
+		r.pass("ldap", "the bind succeeded")
+	}
+}
+
+// doctorBackup checks that the backup destination can be listed, and
+// notes the last scheduled backup.
+func doctorBackup(r *doctorReport, cfg config.Config, store *db.Store) {
+	if cfg.BackupURL == "" {
+		return
+	}
+	runner, err := backupRunner(cfg, nil)
+	if err != nil {
+		r.fail("backup", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	names, err := runner.Destination.List(ctx)
+	if err != nil {
+		r.fail("backup", err)
+		return
+	}
+	r.pass("backup", fmt.Sprintf("the destination can be listed, %d files", len(names)))
+	if store == nil {
+		return
+	}
+	status, err := store.GetBackupStatus()
+	if err != nil {
+		return
+	}
+	if status.LastAt != "" {
+		r.note(fmt.Sprintf("last backup %s at %s", status.LastName, status.LastAt))
+	}
+	if status.ErrorAt > status.LastAt {
+		r.note(fmt.Sprintf("last attempt failed at %s: %s", status.ErrorAt, status.Error))
+	}
+}
+
+// doctorWHMCS checks the WHMCS API credential.
+func doctorWHMCS(r *doctorReport, cfg config.Config) {
+	client := whmcsClient(cfg)
+	if !client.Enabled() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	if err := client.Verify(ctx); err != nil {
+		r.fail("whmcs", err)
+	} else {
+		r.pass("whmcs", "the API credential can read clients")
+	}
+}
+
+// doctorTemplates renders every stored template against sample data, as
+// saving a template in the panel does.
+func doctorTemplates(r *doctorReport, cfg config.Config, store *db.Store) {
+	var named []db.NamedTemplate
+	for _, t := range []struct {
+		name string
+		get  func() (db.Template, error)
+	}{
+		{"reminder", store.GetTemplate},
+		{"renewal", store.GetRenewalTemplate},
+		{"trial", store.GetTrialTemplate},
+		{"combined", store.GetCombinedTemplate},
+	} {
+		tpl, err := t.get()
+		if err != nil {
+			r.fail("templates", err)
+			return
+		}
+		named = append(named, db.NamedTemplate{Name: t.name, Template: tpl})
+	}
+	stored, err := store.ListNamedTemplates()
+	if err != nil {
+		r.fail("templates", err)
+		return
+	}
+	named = append(named, stored...)
+	data := reminder.SampleData(cfg.CompanyName)
+	var problems []string
+	for _, t := range named {
+		if _, _, _, err := (web.TemplateRenderer{}).RenderTemplate(t.Template, data); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", t.Name, err))
+		}
+	}
+	if len(problems) > 0 {
+		r.fail("templates", errors.New(strings.Join(problems, "; ")))
+		return
+	}
+	r.pass("templates", fmt.Sprintf("%d templates render", len(named)))
+}
+
+// doctorRules looks for rules that can never fire and products that refer
+// to a template that no longer exists.
+func doctorRules(r *doctorReport, store *db.Store) {
+	var problems []string
+	grace, err := store.GetGraceDays()
+	if err != nil {
+		r.fail("rules", err)
+		return
+	}
+	lists := []struct {
+		name string
+		get  func() ([]int, error)
+		days bool
+	}{
+		{"reminder rules", store.GetRules, true},
+		{"trial rules", store.GetTrialRules, true},
+		{"high priority rules", store.GetHighPriorityRules, true},
+		{"hour rules", store.GetHourRules, false},
+	}
+	for _, l := range lists {
+		rules, err := l.get()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", l.name, err))
+			continue
+		}
+		sorted := append([]int(nil), rules...)
+		sort.Ints(sorted)
+		for i, rule := range sorted {
+			if i > 0 && rule == sorted[i-1] {
+				problems = append(problems, fmt.Sprintf("%s: %d is listed twice", l.name, rule))
+			}
+			if l.days && rule < -grace {
+				problems = append(problems, fmt.Sprintf("%s: %d is past the %d grace days and never fires", l.name, rule, grace))
+			}
+		}
+	}
+	products, err := store.ListProducts()
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	for _, p := range products {
+		if p.TemplateName == "" {
+			continue
+		}
+		// Reminders for it fall back to the global template.
+		if _, ok, err := store.GetNamedTemplate(p.TemplateName); err == nil && !ok {
+			problems = append(problems, fmt.Sprintf("product %q uses template %q, which does not exist", p.Name, p.TemplateName))
+		}
+	}
+	if len(problems) > 0 {
+		r.fail("rules", errors.New(strings.Join(problems, "; ")))
+		return
+	}
+	r.pass("rules", "no duplicate or unreachable rules")
+}
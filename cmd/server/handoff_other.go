@@ -0,0 +1,29 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// upgradeSignals is empty: passing the listening socket to a new process
+// is not supported on this platform.
+var upgradeSignals []os.Signal
+
+type handoff struct {
+	listener net.Listener
+}
+
+func inheritHandoff() (*handoff, error) {
+	return nil, nil
+}
+
+func (h *handoff) takeOver() error {
+	return nil
+}
+
+func startSuccessor(listener net.Listener) (func(), error) {
+	return nil, errors.New("zero-downtime restart is not supported on this platform")
+}
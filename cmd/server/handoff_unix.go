@@ -0,0 +1,139 @@
+//go:build unix
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// handoffEnv marks a process started by startSuccessor.
+const handoffEnv = "XF_HANDOFF"
+
+// handoffTimeout bounds how long the old process waits for the new one to
+// start before giving up and carrying on.
+const handoffTimeout = time.Minute
+
+// Descriptors passed to the new process after stdin, stdout and stderr.
+const (
+	listenerFD   = 3
+	startedFD    = 4
+	parentDoneFD = 5
+)
+
+// upgradeSignals start a zero-downtime restart.
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// handoff is the new process's end of a restart: the listening socket and
+// the pipes to the old process.
+type handoff struct {
+	listener   net.Listener
+	started    *os.File
+	parentDone *os.File
+}
+
+// inheritHandoff returns the handoff when this process was started by
+// startSuccessor, or nil.
+func inheritHandoff() (*handoff, error) {
+	if os.Getenv(handoffEnv) == "" {
+		return nil, nil
+	}
+	os.Unsetenv(handoffEnv)
+	f := os.NewFile(listenerFD, "listener")
+	listener, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("inherited listener: %w", err)
+	}
+	return &handoff{
+		listener:   listener,
+		started:    os.NewFile(startedFD, "started"),
+		parentDone: os.NewFile(parentDoneFD, "parent-done"),
+	}, nil
+}
+
+// takeOver tells the old process this one started, then waits until it has
+// finished its work and released the data file, or exited.
+func (h *handoff) takeOver() error {
+	_, err := io.WriteString(h.started, "started\n")
+	h.started.Close()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, h.parentDone)
+	h.parentDone.Close()
+	return err
+}
+
+// startSuccessor starts the binary on disk again with the same arguments,
+// passing it listener, and waits until it reports it started. Connections
+// queue on the shared socket from then on. Calling release lets the new
+// process load the data and serve; until then it waits, so the two never
+// write the data file at the same time.
+func startSuccessor(listener net.Listener) (release func(), err error) {
+	tcp, ok := listener.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("cannot pass on a %T", listener)
+	}
+	lf, err := tcp.File()
+	if err != nil {
+		return nil, err
+	}
+	defer lf.Close()
+	startedR, startedW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer startedR.Close()
+	doneR, doneW, err := os.Pipe()
+	if err != nil {
+		startedW.Close()
+		return nil, err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		startedW.Close()
+		doneR.Close()
+		doneW.Close()
+		return nil, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), handoffEnv+"=1")
+	cmd.ExtraFiles = []*os.File{lf, startedW, doneR}
+	err = cmd.Start()
+	startedW.Close()
+	doneR.Close()
+	if err != nil {
+		doneW.Close()
+		return nil, err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(startedR).ReadString('\n')
+		if err != nil || line != "started\n" {
+			err = fmt.Errorf("new process exited before it started")
+		}
+		result <- err
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(handoffTimeout):
+		err = fmt.Errorf("new process did not start within %s", handoffTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		doneW.Close()
+		go cmd.Wait()
+		return nil, err
+	}
+	go cmd.Wait()
+	return func() { doneW.Close() }, nil
+}
@@ -0,0 +1,8 @@
+package main
+
+import "xf/internal/reminder"
+
+// reminderHooks are called around every reminder a scan queues, whether the
+// scan is run by the scheduler, from the panel or by "xf scan". Deployments
+// that build their own binary add their hooks here.
+var reminderHooks []reminder.Hook
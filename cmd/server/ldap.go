@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// runLDAP is "xf ldap": one import from the directory, as xf serve runs
+// every LDAP_SYNC_MINUTES.
+func runLDAP(args []string) error {
+	fs := flag.NewFlagSet("ldap", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("usage: xf ldap")
+	}
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
+	}
+	if cfg.LDAPURL == "" {
+		return errors.New("LDAP_URL and LDAP_BASE_DN are not set")
+	}
+	store, err := openStore(cfg, true)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	count, err := ldapSyncer(cfg, store).Sync(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("customers: %d added, %d updated\n", count.Added, count.Updated)
+	if count.Skipped > 0 {
+		fmt.Printf("entries skipped because another entry or customer has their email: %d\n", count.Skipped)
+	}
+	return nil
+}
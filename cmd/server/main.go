@@ -1,68 +1,942 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"xf/internal/alert"
+	"xf/internal/backup"
+	"xf/internal/bounce"
+	"xf/internal/caldav"
 	"xf/internal/config"
 	"xf/internal/db"
+	"xf/internal/domain"
 	"xf/internal/email"
+	"xf/internal/gcal"
+	"xf/internal/ldap"
+	"xf/internal/logging"
+	"xf/internal/notify"
+	"xf/internal/queue"
 	"xf/internal/reminder"
+	"xf/internal/systemd"
+	"xf/internal/tlscert"
+	"xf/internal/version"
 	"xf/internal/web"
+	"xf/internal/whmcs"
+)
+
+const (
+	shutdownTimeout = 15 * time.Second
+	alertTimeout    = 30 * time.Second
 )
 
 func main() {
-	cfg, err := config.Load()
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	var err error
+	switch name {
+	case "serve":
+		serve(args)
+	case "scan":
+		err = runScan(args)
+	case "export":
+		err = runExport(args)
+	case "import":
+		err = runImport(args)
+	case "user":
+		err = runUser(args)
+	case "doctor":
+		err = runDoctor(args)
+	case "seed":
+		err = runSeed(args)
+	case "whmcs":
+		err = runWHMCS(args)
+	case "ldap":
+		err = runLDAP(args)
+	case "accounting":
+		err = runAccounting(args)
+	case "backup":
+		err = runBackup(args)
+	case "version":
+		fmt.Println("xf " + version.Get().String())
+	case "help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", name, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "xf %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// serve runs the web panel with the scheduler and the send queue. It is
+// the default command. APP_MODE=web runs only the panel and
+// APP_MODE=scheduler only the scans, send queue, bounce and reply
+// pollers, the WHMCS, Google Calendar, CalDAV, domain and certificate expiry syncs and
+// the LDAP customer import, so the two can run as separate processes on the same data file.
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	common.setting(fs, "addr", "APP_ADDR", "listen address")
+	common.setting(fs, "debug-addr", "DEBUG_ADDR", "listen address for pprof and /debug/state")
+	common.setting(fs, "scan-interval", "SCAN_INTERVAL_MINUTES", "minutes between reminder scans")
+	fs.Parse(args)
+
+	cfg, err := common.load(fs)
+	if err != nil {
+		// Not logged: the list of problems reads better unquoted.
+		fmt.Fprintf(os.Stderr, "config error: %v\n", err)
+		os.Exit(1)
+	}
+	build := version.Get()
+	slog.Info("starting xf", "version", build.Version, "commit", build.Commit, "built", build.Date, "mode", cfg.AppMode)
+	runsWeb := cfg.AppMode != "scheduler"
+	runsWorker := cfg.AppMode != "web"
+	inherited, err := inheritHandoff()
 	if err != nil {
-		log.Fatalf("config error: %v", err)
+		fatal("handoff error", err)
 	}
 
 	store, err := db.Open(cfg.DatabasePath)
 	if err != nil {
-		log.Fatalf("db error: %v", err)
+		fatal("db error", err)
 	}
 	defer store.Close()
+	// Take the scheduler lock straight away rather than on the first tick,
+	// so commands that change data see the database is in use.
+	if runsWorker {
+		if _, err := store.AcquireSchedulerLock(); err != nil {
+			slog.Error("scheduler lock error", "error", err)
+		}
+	}
 
-	mailer := email.Mailer{
-		Host: cfg.SMTPHost,
-		Port: cfg.SMTPPort,
-		User: cfg.SMTPUser,
-		Pass: cfg.SMTPPass,
-		From: cfg.SMTPFrom,
+	sender, failover, err := newMailChain(cfg)
+	if err != nil {
+		fatal("mail error", err)
+	}
+	// The sender is swapped on reload; the send limits stay in force.
+	reloadable := email.NewReloadable(sender)
+	mailer, err := limitSender(cfg, store, reloadable)
+	if err != nil {
+		fatal("mail error", err)
 	}
 
-	server, err := web.NewServer(cfg, store, mailer)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server, err := web.NewServer(ctx, cfg, store, mailer, reminderHooks)
 	if err != nil {
-		log.Fatalf("server error: %v", err)
+		fatal("server error", err)
 	}
 
-	startScheduler(cfg, store, mailer)
+	notifier := alert.Notifier{
+		Mailer:        mailer,
+		To:            cfg.AdminEmail,
+		WebhookURL:    cfg.AlertWebhookURL,
+		WebhookSecret: cfg.AlertWebhookSecret,
+		Chats:         alertChats(cfg),
+	}
+	alertFailover := func(failover *email.Failover, host string) {
+		if failover == nil {
+			return
+		}
+		failover.OnFailover = func(err error) {
+			sendAlert(ctx, notifier, "主发信通道连续失败，已切换到备用 SMTP",
+				fmt.Sprintf("最近一次错误：%v\n备用 SMTP：%s\n修复主通道后需重启服务或重新加载配置才会切回。", err, host))
+		}
+	}
+	alertFailover(failover, cfg.SMTP2Host)
 
-	log.Printf("renewal panel listening on %s", cfg.Addr)
-	if err := http.ListenAndServe(cfg.Addr, server.Routes()); err != nil {
-		log.Fatalf("listen error: %v", err)
+	if inherited != nil {
+		// Started by a zero-downtime restart: wait for the previous process
+		// to finish, then pick up what it wrote since the store was opened.
+		if err := inherited.takeOver(); err != nil {
+			fatal("handoff error", err)
+		}
+		if runsWorker {
+			if _, err := store.AcquireSchedulerLock(); err != nil {
+				slog.Error("scheduler lock error", "error", err)
+			}
+		}
+		slog.Info("took over from the previous process")
 	}
+	// ADMIN_USER and ADMIN_PASS only seed the first login.
+	if created, err := store.EnsureAdmin(cfg.AdminUser, cfg.AdminPass, time.Now()); err != nil {
+		fatal("db error", err)
+	} else if created {
+		slog.Warn("created the first panel user from ADMIN_USER and ADMIN_PASS; the password must be changed on first login", "user", cfg.AdminUser)
+	}
+
+	// The send queue, mailbox pollers and syncs stop with workCtx; scans only
+	// stop early when ctx is cancelled.
+	workCtx, stopWork := context.WithCancel(ctx)
+	defer stopWork()
+	var scans *scheduler
+	var dispatch *queue.Running
+	if runsWorker {
+		if err := store.RequeueInterrupted(); err != nil {
+			fatal("db error", err)
+		}
+		scans = startScheduler(ctx, cfg, store, mailer, notifier, reminderHooks)
+		dispatch = startDispatcher(workCtx, cfg, store, mailer, notifier)
+		startBouncePoller(workCtx, cfg, store)
+		startReplyPoller(workCtx, cfg, store)
+		startWHMCSSync(workCtx, cfg, store)
+		startGoogleCalendarSync(workCtx, cfg, store)
+		startCalDAVSync(workCtx, cfg, store)
+		startDomainSync(workCtx, cfg, store)
+		startCertCheck(workCtx, cfg, store)
+		startLDAPSync(workCtx, cfg, store)
+		startBackup(workCtx, cfg, store)
+	} else if every := systemd.WatchdogInterval(); every > 0 {
+		// Without the scan loop nothing else pings the watchdog.
+		go func() {
+			ticker := time.NewTicker(every)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					notifySystemd(systemd.Watchdog)
+				}
+			}
+		}()
+	}
+
+	var reloadMu sync.Mutex
+	server.Reload = func() error {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+		next, err := common.load(fs)
+		if err != nil {
+			return err
+		}
+		sender, failover, err := newMailChain(next)
+		if err != nil {
+			return err
+		}
+		var dispatcher queue.Dispatcher
+		if runsWorker {
+			if dispatcher, err = newDispatcher(next, store, mailer, notifier); err != nil {
+				return err
+			}
+		}
+		alertFailover(failover, next.SMTP2Host)
+		reloadable.Set(sender)
+		if dispatch != nil {
+			dispatch.Update(dispatcher)
+		} else if runsWorker && dispatcher.Enabled() {
+			// Nothing could be sent at startup, so no workers are running yet.
+			dispatch = dispatcher.Start(workCtx)
+		}
+		server.UpdateConfig(next)
+		if scans != nil {
+			// Replace a reload the scheduler hasn't picked up yet; this is
+			// the only sender, so the buffer then has room.
+			select {
+			case <-scans.reloads:
+			default:
+			}
+			scans.reloads <- next
+		}
+		if next.AppMode != cfg.AppMode || next.Addr != cfg.Addr || next.DebugAddr != cfg.DebugAddr || next.DatabasePath != cfg.DatabasePath {
+			slog.Warn("config reloaded; APP_MODE, APP_ADDR, DEBUG_ADDR and DATABASE_PATH changes need a restart")
+		} else {
+			slog.Info("config reloaded")
+		}
+		return nil
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				if err := server.Reload(); err != nil {
+					slog.Error("config reload error", "error", err)
+				}
+			}
+		}
+	}()
+
+	var listener net.Listener
+	if inherited != nil {
+		listener = inherited.listener
+	} else if runsWeb {
+		if listener, err = net.Listen("tcp", cfg.Addr); err != nil {
+			fatal("listen error", err)
+		}
+	}
+
+	// On an upgrade signal, start the new binary on the same socket and
+	// hand over once it is up. Without the panel there is no socket to
+	// hand over; the scheduler is just restarted.
+	upgrades := make(chan func())
+	if listener != nil && len(upgradeSignals) > 0 {
+		usr := make(chan os.Signal, 1)
+		signal.Notify(usr, upgradeSignals...)
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-usr:
+				}
+				slog.Info("starting new process for restart")
+				release, err := startSuccessor(listener)
+				if err != nil {
+					slog.Error("restart error", "error", err)
+					continue
+				}
+				upgrades <- release
+				return
+			}
+		}()
+	}
+
+	var httpServer *http.Server
+	if runsWeb {
+		httpServer = &http.Server{Addr: cfg.Addr, Handler: server.Routes()}
+	}
+	// The debug listener starts after a handoff so the previous process
+	// has closed it.
+	var debugServer *http.Server
+	if cfg.DebugAddr != "" {
+		debugServer = &http.Server{Addr: cfg.DebugAddr, Handler: server.DebugRoutes()}
+		go func() {
+			slog.Info("debug endpoints listening", "addr", cfg.DebugAddr)
+			if err := debugServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("debug listen error", "error", err)
+			}
+		}()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		var release func()
+		select {
+		case <-ctx.Done():
+			notifySystemd(systemd.Stopping)
+		case release = <-upgrades:
+			// Keep serving until a running scan has finished.
+			if scans != nil {
+				scans.stop()
+			}
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if httpServer != nil {
+			if err := httpServer.Shutdown(shutdownCtx); err != nil {
+				slog.Error("shutdown error", "error", err)
+			}
+		}
+		if debugServer != nil {
+			debugServer.Close()
+		}
+		if release != nil {
+			stopWork()
+			store.Close()
+			release()
+			slog.Info("handed over to the new process")
+		}
+	}()
+
+	if httpServer != nil {
+		slog.Info("renewal panel listening", "addr", cfg.Addr, "mode", cfg.AppMode)
+	} else {
+		slog.Info("running scans and the send queue without the web panel", "mode", cfg.AppMode)
+	}
+	if inherited != nil {
+		// systemd must track the new process; needs NotifyAccess=all.
+		notifySystemd(fmt.Sprintf("MAINPID=%d\n%s", os.Getpid(), systemd.Ready))
+	} else {
+		notifySystemd(systemd.Ready)
+	}
+	if httpServer != nil {
+		if err := httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("listen error", err)
+		}
+	}
+	<-stopped
+	slog.Info("renewal panel stopped")
 }
 
-func startScheduler(cfg config.Config, store *db.Store, mailer email.Mailer) {
-	ticker := time.NewTicker(time.Duration(cfg.ScanIntervalMinutes) * time.Minute)
-	renderer := web.TemplateRenderer{}
-	service := reminder.Service{
-		Store:    store,
-		Mailer:   mailer,
-		Company:  cfg.CompanyName,
-		Location: cfg.TimeZone,
-		Render:   renderer,
+// newMailChain builds the configured sender, wrapped with the failover
+// SMTP profile when one is set.
+func newMailChain(cfg config.Config) (email.Sender, *email.Failover, error) {
+	sender, err := newSender(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	failover, err := newFailover(cfg, sender)
+	if err != nil {
+		return nil, nil, err
+	}
+	if failover != nil {
+		return failover, failover, nil
+	}
+	return sender, nil, nil
+}
+
+// newSender builds the mail sender selected by MAIL_PROVIDER.
+func newSender(cfg config.Config) (email.Sender, error) {
+	switch cfg.MailProvider {
+	case "sendgrid":
+		return email.SendGrid{APIKey: cfg.SendGridAPIKey, From: cfg.SMTPFrom}, nil
+	case "mailgun":
+		return email.Mailgun{
+			Domain: cfg.MailgunDomain,
+			APIKey: cfg.MailgunAPIKey,
+			From:   cfg.SMTPFrom,
+			Region: cfg.MailgunRegion,
+		}, nil
+	case "ses":
+		return email.SES{
+			Region:           cfg.SESRegion,
+			AccessKeyID:      cfg.SESAccessKeyID,
+			SecretAccessKey:  cfg.SESSecretAccessKey,
+			SessionToken:     cfg.SESSessionToken,
+			From:             cfg.SMTPFrom,
+			ConfigurationSet: cfg.SESConfigurationSet,
+		}, nil
+	case "postmark":
+		return email.Postmark{
+			ServerToken:   cfg.PostmarkToken,
+			From:          cfg.SMTPFrom,
+			MessageStream: cfg.PostmarkStream,
+		}, nil
+	}
+	mailer := email.Mailer{
+		Host:         cfg.SMTPHost,
+		Port:         cfg.SMTPPort,
+		User:         cfg.SMTPUser,
+		Pass:         cfg.SMTPPass,
+		From:         cfg.SMTPFrom,
+		Encryption:   cfg.SMTPEncryption,
+		OAuth:        smtpOAuth(cfg),
+		EnvelopeFrom: cfg.SMTPEnvelopeFrom,
+	}
+	if cfg.DKIMKeyFile != "" {
+		dkim, err := loadDKIM(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("dkim: %w", err)
+		}
+		mailer.DKIM = dkim
+	}
+	return mailer, nil
+}
+
+// smtpOAuth returns the XOAUTH2 token source for the primary SMTP profile,
+// or nil to authenticate with SMTP_PASS.
+func smtpOAuth(cfg config.Config) *email.OAuth2 {
+	if cfg.SMTPOAuthTokenURL == "" {
+		return nil
+	}
+	return &email.OAuth2{
+		TokenURL:     cfg.SMTPOAuthTokenURL,
+		ClientID:     cfg.SMTPOAuthClientID,
+		ClientSecret: cfg.SMTPOAuthSecret,
+		RefreshToken: cfg.SMTPOAuthRefresh,
+		Scope:        cfg.SMTPOAuthScope,
+	}
+}
+
+// newFailover wraps the primary sender with the secondary SMTP profile, or
+// returns nil when SMTP_SECONDARY_HOST is not set.
+func newFailover(cfg config.Config, primary email.Sender) (*email.Failover, error) {
+	if cfg.SMTP2Host == "" {
+		return nil, nil
+	}
+	secondary := email.Mailer{
+		Host:       cfg.SMTP2Host,
+		Port:       cfg.SMTP2Port,
+		User:       cfg.SMTP2User,
+		Pass:       cfg.SMTP2Pass,
+		From:       cfg.SMTP2From,
+		Encryption: cfg.SMTP2Encryption,
+	}
+	if cfg.DKIMKeyFile != "" {
+		dkim, err := loadDKIM(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("dkim: %w", err)
+		}
+		secondary.DKIM = dkim
+	}
+	return &email.Failover{Primary: primary, Secondary: secondary, After: cfg.SMTPFailoverAfter}, nil
+}
+
+// limitSender applies MAIL_LIMIT_PER_MINUTE and MAIL_LIMIT_PER_DAY to the
+// provider, counting the last day's sends from the history.
+func limitSender(cfg config.Config, store *db.Store, sender email.Sender) (email.Sender, error) {
+	if cfg.MailLimitPerMinute <= 0 && cfg.MailLimitPerDay <= 0 {
+		return sender, nil
+	}
+	sent, err := store.SentSince(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	return email.NewRateLimited(sender, cfg.MailLimitPerMinute, cfg.MailLimitPerDay, sent), nil
+}
+
+// loadDKIM reads the signing key. The domain defaults to the one in SMTP_FROM.
+func loadDKIM(cfg config.Config) (*email.DKIM, error) {
+	keyPEM, err := os.ReadFile(cfg.DKIMKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	domain := cfg.DKIMDomain
+	if domain == "" {
+		from := cfg.SMTPFrom
+		if i := strings.LastIndex(from, "<"); i != -1 {
+			from = strings.TrimSuffix(from[i+1:], ">")
+		}
+		if i := strings.LastIndex(from, "@"); i != -1 {
+			domain = strings.TrimSpace(from[i+1:])
+		}
+	}
+	return email.NewDKIM(domain, cfg.DKIMSelector, keyPEM)
+}
+
+// scheduler controls the scan loop. Reloaded configurations sent on
+// reloads apply from the next tick.
+type scheduler struct {
+	reloads chan config.Config
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+// stop ends the loop and waits for a running scan to finish.
+func (s *scheduler) stop() {
+	close(s.quit)
+	<-s.done
+}
+
+// startScheduler runs the periodic scans, calling hooks around the
+// reminders they queue, until ctx is cancelled, which also interrupts a
+// running scan, or stop is called.
+func startScheduler(ctx context.Context, cfg config.Config, store *db.Store, mailer email.Sender, notifier alert.Notifier, hooks []reminder.Hook) *scheduler {
+	s := &scheduler{
+		reloads: make(chan config.Config, 1),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
 	}
+	interval := time.Duration(cfg.ScanIntervalMinutes) * time.Minute
+	ticker := time.NewTicker(interval)
+	service := web.NewReminderService(cfg, store)
+	service.Hooks = hooks
+	heartbeat := alert.Heartbeat{URL: cfg.HeartbeatURL}
 	go func() {
-		for range ticker.C {
-			if !mailer.Enabled() {
+		defer close(s.done)
+		defer ticker.Stop()
+		// The loop itself pings the systemd watchdog, so a scan that hangs
+		// past its timeout gets the service restarted.
+		var watchdog <-chan time.Time
+		if every := systemd.WatchdogInterval(); every > 0 {
+			watchdogTicker := time.NewTicker(every)
+			defer watchdogTicker.Stop()
+			watchdog = watchdogTicker.C
+		}
+		leader := false
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.quit:
+				return
+			case <-watchdog:
+				notifySystemd(systemd.Watchdog)
+				continue
+			case cfg = <-s.reloads:
+				interval = time.Duration(cfg.ScanIntervalMinutes) * time.Minute
+				ticker.Reset(interval)
+				service = web.NewReminderService(cfg, store)
+				service.Hooks = hooks
+				heartbeat = alert.Heartbeat{URL: cfg.HeartbeatURL}
+				continue
+			case <-ticker.C:
+			}
+			if !canSend(cfg, mailer) {
+				continue
+			}
+			// Only the instance holding the lock scans, so replicas don't
+			// send the same reminders twice.
+			held, err := store.AcquireSchedulerLock()
+			if err != nil {
+				slog.Error("scheduler lock error", "error", err)
+				pingHeartbeat(ctx, heartbeat, true, fmt.Sprintf("scheduler lock error: %v", err))
+				continue
+			}
+			if held != leader {
+				leader = held
+				if held {
+					slog.Info("scheduler lock acquired, this instance runs scans")
+				} else {
+					slog.Info("scheduler lock held by another instance, standing by")
+				}
+			}
+			if !held {
+				continue
+			}
+			if paused, _, err := store.SchedulerPaused(); err != nil || paused {
 				continue
 			}
-			if _, err := service.ScanAndSend(time.Now()); err != nil {
-				log.Printf("scan error: %v", err)
+			// A run must not overlap the next tick.
+			runCtx, cancel := context.WithTimeout(ctx, interval)
+			scanCtx, runID := service.StartRun(runCtx)
+			now := time.Now()
+			res, err := service.ScanAndSend(scanCtx, now, false)
+			if err := service.RecordRun(runID, db.TriggerScheduled, now, time.Now(), res, err); err != nil {
+				logging.From(scanCtx).Error("scan history error", "error", err)
+			}
+			if err != nil {
+				pingHeartbeat(ctx, heartbeat, true, fmt.Sprintf("scan error: %v", err))
+			} else {
+				pingHeartbeat(ctx, heartbeat, false, fmt.Sprintf("scanned %d, queued %d, renewed %d, skipped %d, failed %d",
+					res.Total, res.Queued, res.Renewed, res.Skipped, res.Failed))
+			}
+			if cfg.AlertScanFailures > 0 && res.Failed > cfg.AlertScanFailures {
+				subject := fmt.Sprintf("定时扫描失败 %d 个订阅", res.Failed)
+				sendAlert(ctx, notifier, subject, strings.Join(res.Failures, "\n"))
+			}
+			if cfg.AdminEmail != "" || len(service.AdminChats) > 0 {
+				if err := service.SendDailyDigest(runCtx, cfg.AdminEmail, now); err != nil {
+					slog.Error("digest error", "error", err)
+				}
 			}
+			if err := service.SendWeeklyForecast(runCtx, cfg.AdminEmail, now); err != nil {
+				slog.Error("forecast error", "error", err)
+			}
+			cancel()
 		}
 	}()
+	return s
+}
+
+// startDispatcher starts the send queue and returns it for reloads, or nil
+// when nothing can be sent.
+func startDispatcher(ctx context.Context, cfg config.Config, store *db.Store, mailer email.Sender, notifier alert.Notifier) *queue.Running {
+	dispatcher, err := newDispatcher(cfg, store, mailer, notifier)
+	if err != nil {
+		fatal("config error", err)
+	}
+	if !dispatcher.Enabled() {
+		return nil
+	}
+	return dispatcher.Start(ctx)
+}
+
+func newDispatcher(cfg config.Config, store *db.Store, mailer email.Sender, notifier alert.Notifier) (queue.Dispatcher, error) {
+	headers, err := email.ParseHeaders(cfg.MailHeaders)
+	if err != nil {
+		return queue.Dispatcher{}, fmt.Errorf("MAIL_HEADERS: %w", err)
+	}
+	return queue.Dispatcher{
+		Store:         store,
+		Mailer:        mailer,
+		Channels:      newChannels(cfg),
+		Workers:       cfg.SendConcurrency,
+		RatePerMinute: cfg.SendRatePerMinute,
+		Retries:       cfg.SendRetries,
+		RetryBackoff:  time.Duration(cfg.RetryBackoffSeconds) * time.Second,
+		KeepFailed:    time.Duration(cfg.OutboxKeepDays) * 24 * time.Hour,
+		SendTimeout:   time.Duration(cfg.SendTimeoutSeconds) * time.Second,
+		Location:      cfg.TimeZone,
+		AlertAfter:    cfg.AlertSendFailures,
+		Bcc:           cfg.MailBCC,
+		ReplyTo:       cfg.SMTPReplyTo,
+		PublicURL:     cfg.PublicURL,
+		TrackOpens:    cfg.TrackOpens,
+		TrackClicks:   cfg.TrackClicks,
+		Headers:       headers,
+		Archive:       cfg.MailArchive,
+		From:          cfg.SMTPFrom,
+		Alert: func(ctx context.Context, failures int, lastErr error) {
+			subject := fmt.Sprintf("邮件发送连续失败 %d 次", failures)
+			sendAlert(ctx, notifier, subject, fmt.Sprintf("最近一次错误：%v", lastErr))
+		},
+	}, nil
+}
+
+// canSend reports whether anything can deliver what a scan queues: the
+// mailer or any of the chat and SMS services.
+func canSend(cfg config.Config, mailer email.Sender) bool {
+	return mailer.Enabled() || len(newChannels(cfg)) > 0
+}
+
+// newChannels returns the configured chat and SMS services, keyed by the outbox
+// channel they deliver.
+func newChannels(cfg config.Config) map[string]email.Sender {
+	channels := map[string]email.Sender{}
+	if cfg.TelegramBotToken != "" {
+		channels[db.ChannelTelegram] = notify.Telegram{Token: cfg.TelegramBotToken, APIURL: cfg.TelegramAPIURL}
+	}
+	if cfg.SlackWebhookURL != "" {
+		channels[db.ChannelSlack] = notify.Slack{WebhookURL: cfg.SlackWebhookURL}
+	}
+	if cfg.WeComCorpID != "" {
+		channels[db.ChannelWeCom] = &notify.WeCom{CorpID: cfg.WeComCorpID, AgentID: cfg.WeComAgentID, Secret: cfg.WeComSecret, APIURL: cfg.WeComAPIURL}
+	}
+	if cfg.DingTalkWebhookURL != "" {
+		channels[db.ChannelDingTalk] = notify.DingTalk{WebhookURL: cfg.DingTalkWebhookURL, Secret: cfg.DingTalkSecret}
+	}
+	if cfg.FeishuWebhookURL != "" {
+		channels[db.ChannelFeishu] = notify.Feishu{WebhookURL: cfg.FeishuWebhookURL, Secret: cfg.FeishuSecret}
+	}
+	switch cfg.SMSProvider {
+	case "twilio":
+		channels[db.ChannelSMS] = notify.Twilio{AccountSID: cfg.TwilioSID, AuthToken: cfg.TwilioToken, From: cfg.TwilioFrom, APIURL: cfg.SMSAPIURL}
+	case "aliyun":
+		channels[db.ChannelSMS] = notify.AliyunSMS{AccessKeyID: cfg.AliyunKeyID, AccessKeySecret: cfg.AliyunKeySecret,
+			SignName: cfg.AliyunSignName, TemplateCode: cfg.AliyunTemplate, APIURL: cfg.SMSAPIURL}
+	}
+	if cfg.MatrixHomeserver != "" {
+		channels[db.ChannelMatrix] = notify.Matrix{HomeserverURL: cfg.MatrixHomeserver, Token: cfg.MatrixToken}
+	}
+	switch cfg.PushProvider {
+	case "gotify":
+		channels[db.ChannelPush] = notify.Gotify{URL: cfg.PushURL, Token: cfg.PushToken}
+	case "ntfy":
+		channels[db.ChannelPush] = notify.Ntfy{TopicURL: cfg.PushURL, Token: cfg.PushToken}
+	}
+	return channels
+}
+
+// alertChats returns the admin chats that receive alerts, the DingTalk
+// group and Matrix room, which get alerts and scan summaries but not the
+// digests, and the push service, which gets alerts and the day's expiries.
+func alertChats(cfg config.Config) []alert.Chat {
+	channels := newChannels(cfg)
+	var chats []alert.Chat
+	for _, chat := range reminder.AdminChats(cfg) {
+		chats = append(chats, alert.Chat{Name: chat.Channel, Sender: channels[chat.Channel], To: chat.To})
+	}
+	if sender, ok := channels[db.ChannelDingTalk]; ok {
+		chats = append(chats, alert.Chat{Name: db.ChannelDingTalk, Sender: sender})
+	}
+	if sender, ok := channels[db.ChannelMatrix]; ok {
+		chats = append(chats, alert.Chat{Name: db.ChannelMatrix, Sender: sender, To: cfg.MatrixRoomID})
+	}
+	if sender, ok := channels[db.ChannelPush]; ok {
+		chats = append(chats, alert.Chat{Name: cfg.PushProvider, Sender: sender})
+	}
+	return chats
+}
+
+func startBouncePoller(ctx context.Context, cfg config.Config, store *db.Store) {
+	poller := bounce.Poller{
+		Store:    store,
+		Host:     cfg.IMAPHost,
+		Port:     cfg.IMAPPort,
+		User:     cfg.IMAPUser,
+		Pass:     cfg.IMAPPass,
+		Mailbox:  cfg.IMAPMailbox,
+		TLS:      cfg.IMAPEncryption == "tls",
+		Interval: time.Duration(cfg.BouncePollMinutes) * time.Minute,
+	}
+	if !poller.Enabled() {
+		return
+	}
+	poller.Start(ctx)
+}
+
+func startReplyPoller(ctx context.Context, cfg config.Config, store *db.Store) {
+	poller := bounce.ReplyPoller{
+		Store:    store,
+		Host:     cfg.ReplyIMAPHost,
+		Port:     cfg.ReplyIMAPPort,
+		User:     cfg.ReplyIMAPUser,
+		Pass:     cfg.ReplyIMAPPass,
+		Mailbox:  cfg.ReplyIMAPMailbox,
+		TLS:      cfg.ReplyIMAPEncryption == "tls",
+		Keywords: cfg.ReplyKeywords,
+		Interval: time.Duration(cfg.ReplyPollMinutes) * time.Minute,
+	}
+	if !poller.Enabled() {
+		return
+	}
+	poller.Start(ctx)
+}
+
+func startWHMCSSync(ctx context.Context, cfg config.Config, store *db.Store) {
+	syncer := whmcs.Syncer{
+		Store:    store,
+		Client:   whmcsClient(cfg),
+		Interval: time.Duration(cfg.WHMCSSyncMinutes) * time.Minute,
+	}
+	if !syncer.Client.Enabled() {
+		return
+	}
+	syncer.Start(ctx)
+}
+
+func whmcsClient(cfg config.Config) whmcs.Client {
+	return whmcs.Client{URL: cfg.WHMCSURL, Identifier: cfg.WHMCSIdentifier, Secret: cfg.WHMCSSecret, AccessKey: cfg.WHMCSAccessKey}
+}
+
+func startGoogleCalendarSync(ctx context.Context, cfg config.Config, store *db.Store) {
+	syncer := gcal.Syncer{
+		Store:     store,
+		Client:    googleCalendar(cfg),
+		Interval:  time.Duration(cfg.GoogleSyncMinutes) * time.Minute,
+		PublicURL: cfg.PublicURL,
+		Location:  cfg.TimeZone,
+	}
+	if !syncer.Client.Enabled() {
+		return
+	}
+	syncer.Start(ctx)
+}
+
+func googleCalendar(cfg config.Config) gcal.Client {
+	return gcal.NewClient(cfg.GoogleCalendarID, cfg.GoogleClientID, cfg.GoogleClientSecret, cfg.GoogleRefreshToken, cfg.GoogleAPIURL)
+}
+
+func startCalDAVSync(ctx context.Context, cfg config.Config, store *db.Store) {
+	syncer := caldav.Syncer{
+		Store:     store,
+		Client:    calDAVClient(cfg),
+		Interval:  time.Duration(cfg.CalDAVSyncMinutes) * time.Minute,
+		PublicURL: cfg.PublicURL,
+		Location:  cfg.TimeZone,
+	}
+	if !syncer.Client.Enabled() {
+		return
+	}
+	syncer.Start(ctx)
+}
+
+func calDAVClient(cfg config.Config) caldav.Client {
+	return caldav.Client{URL: cfg.CalDAVURL, User: cfg.CalDAVUser, Pass: cfg.CalDAVPass}
+}
+
+// startDomainSync looks up the domains of domain subscriptions; with none
+// flagged it makes no requests.
+func startDomainSync(ctx context.Context, cfg config.Config, store *db.Store) {
+	domain.Syncer{
+		Store:    store,
+		Client:   domain.Client{BootstrapURL: cfg.RDAPBootstrapURL, WHOISServer: cfg.WHOISServer},
+		Interval: time.Duration(cfg.DomainSyncHours) * time.Hour,
+	}.Start(ctx)
+}
+
+// startCertCheck reads the certificates of subscriptions with a cert
+// host; with none set it makes no connections.
+func startCertCheck(ctx context.Context, cfg config.Config, store *db.Store) {
+	tlscert.Syncer{
+		Store:    store,
+		Interval: time.Duration(cfg.CertCheckHours) * time.Hour,
+		Location: cfg.TimeZone,
+	}.Start(ctx)
+}
+
+// startLDAPSync imports directory contacts every LDAP_SYNC_MINUTES; zero
+// leaves the import to "xf ldap" and the customers page.
+func startLDAPSync(ctx context.Context, cfg config.Config, store *db.Store) {
+	syncer := ldapSyncer(cfg, store)
+	if !syncer.Client.Enabled() || cfg.LDAPSyncMinutes == 0 {
+		return
+	}
+	syncer.Start(ctx)
+}
+
+func ldapSyncer(cfg config.Config, store *db.Store) ldap.Syncer {
+	return ldap.Syncer{
+		Store:    store,
+		Client:   ldap.Client{URL: cfg.LDAPURL, BindDN: cfg.LDAPBindDN, Password: cfg.LDAPBindPass, StartTLS: cfg.LDAPStartTLS},
+		BaseDN:   cfg.LDAPBaseDN,
+		Filter:   cfg.LDAPFilter,
+		OUTags:   ldap.ParseOUTags(cfg.LDAPOUTags),
+		Interval: time.Duration(cfg.LDAPSyncMinutes) * time.Minute,
+	}
+}
+
+// startBackup uploads archives every BACKUP_HOURS; with BACKUP_HOURS 0
+// backups are only made by "xf backup".
+func startBackup(ctx context.Context, cfg config.Config, store *db.Store) {
+	if cfg.BackupURL == "" || cfg.BackupHours == 0 {
+		return
+	}
+	runner, err := backupRunner(cfg, store)
+	if err != nil {
+		fatal("config error", err)
+	}
+	runner.Start(ctx)
+}
+
+func backupRunner(cfg config.Config, store *db.Store) (backup.Runner, error) {
+	key, err := backup.ParseKey(cfg.BackupKey)
+	if err != nil {
+		return backup.Runner{}, fmt.Errorf("BACKUP_KEY: %w", err)
+	}
+	destination, err := backup.Open(cfg.BackupURL, backup.S3{
+		Endpoint:        cfg.BackupS3Endpoint,
+		Region:          cfg.BackupS3Region,
+		AccessKeyID:     cfg.BackupS3AccessKeyID,
+		SecretAccessKey: cfg.BackupS3SecretKey,
+	})
+	if err != nil {
+		return backup.Runner{}, fmt.Errorf("BACKUP_URL: %w", err)
+	}
+	return backup.Runner{
+		Store:       store,
+		Destination: destination,
+		Key:         key,
+		Keep:        cfg.BackupKeep,
+		Interval:    time.Duration(cfg.BackupHours) * time.Hour,
+	}, nil
+}
+
+// fatal logs err and exits, like log.Fatalf.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+func notifySystemd(state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		slog.Error("systemd notify error", "error", err)
+	}
+}
+
+// pingHeartbeat reports a scheduled scan to the dead man's switch. A ping
+// that fails is only logged: a missing ping is what raises the alarm.
+func pingHeartbeat(ctx context.Context, heartbeat alert.Heartbeat, failed bool, text string) {
+	if !heartbeat.Enabled() {
+		return
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, alertTimeout)
+	defer cancel()
+	if err := heartbeat.Ping(pingCtx, failed, text); err != nil {
+		slog.Error("heartbeat ping error", "error", err)
+	}
+}
+
+func sendAlert(ctx context.Context, notifier alert.Notifier, subject, text string) {
+	slog.Warn("alert", "subject", subject)
+	if !notifier.Enabled() {
+		return
+	}
+	alertCtx, cancel := context.WithTimeout(ctx, alertTimeout)
+	defer cancel()
+	if err := notifier.Send(alertCtx, subject, text); err != nil {
+		slog.Error("alert error", "error", err)
+	}
 }
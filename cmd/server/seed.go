@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"xf/internal/db"
+)
+
+// Pieces the demo data is made from. Every email address is under
+// example.com, which can't receive mail, so a seeded panel with working
+// SMTP never reaches a real person.
+var (
+	seedCities   = []string{"北京", "上海", "广州", "深圳", "杭州", "成都", "南京", "武汉", "苏州", "西安", "厦门", "天津"}
+	seedWords    = []string{"云帆", "启明", "恒信", "博远", "星辰", "致远", "华创", "天成", "优联", "嘉禾", "睿达", "鼎盛", "众合", "蓝海", "新锐", "瑞丰"}
+	seedTrades   = []string{"科技", "网络", "信息技术", "电子商务", "文化传媒", "软件", "贸易", "教育科技"}
+	seedSurnames = []string{"王", "李", "张", "刘", "陈", "杨", "赵", "黄", "周", "吴", "徐", "孙", "马", "朱", "胡", "林"}
+	seedGiven    = []string{"伟", "芳", "娜", "敏", "静", "磊", "洋", "艳", "勇", "杰", "娟", "涛", "明", "超", "秀英", "建华", "晓东", "丽华"}
+	seedMailbox  = []string{"it", "ops", "admin", "finance", "tech", "service", "purchase"}
+	seedProducts = []db.Product{
+		{Name: "云服务器 2核4G", Content: "2 核 CPU、4GB 内存、60GB 系统盘，5Mbps 带宽"},
+		{Name: "云服务器 8核16G", Content: "8 核 CPU、16GB 内存、200GB 数据盘，20Mbps 带宽"},
+		{Name: "企业邮箱 20 用户", Content: "20 个邮箱账号，每个 30GB 空间，含反垃圾与归档"},
+		{Name: "SSL 证书（通配符）", Content: "OV 通配符证书，覆盖主域名及全部一级子域名"},
+		{Name: "域名 .com", Content: "一年期 .com 域名注册与解析"},
+		{Name: "CDN 流量包 1TB", Content: "国内 CDN 加速流量 1TB，一年内有效"},
+		{Name: "云数据库 MySQL", Content: "主备高可用 MySQL 8.0，4 核 8GB，每日自动备份"},
+		{Name: "对象存储 500GB", Content: "500GB 标准存储容量包"},
+		{Name: "SaaS 专业版", Content: "专业版全部功能，含 10 个席位与工作日技术支持"},
+	}
+)
+
+// runSeed is "xf seed [-customers n] [-subscriptions n] [-wipe]": fill
+// the store with made-up customers, products and subscriptions for trying
+// the panel out or designing templates, or remove them again.
+func runSeed(args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	customers := fs.Int("customers", 50, "customers to add")
+	subscriptions := fs.Int("subscriptions", 200, "subscriptions to add, spread over the customers")
+	seed := fs.Uint64("seed", 0, "random seed, for the same data every time (default random)")
+	wipe := fs.Bool("wipe", false, "remove the seeded records instead of adding more")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("usage: xf seed [-customers n] [-subscriptions n] [-seed n] [-wipe]")
+	}
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(cfg, true)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if *wipe {
+		count, err := store.WipeSeed()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("removed %d customers, %d products and %d subscriptions\n", count.Customers, count.Products, count.Subscriptions)
+		return nil
+	}
+	if *customers < 1 || *subscriptions < 0 {
+		return errors.New("-customers must be at least 1 and -subscriptions at least 0")
+	}
+	if *seed == 0 {
+		*seed = uint64(time.Now().UnixNano())
+	}
+	now := time.Now().In(cfg.TimeZone)
+	data := seedData(rand.New(rand.NewPCG(*seed, *seed)), *customers, *subscriptions, now)
+	count, err := store.AddSeed(data, now)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("added %d customers, %d products and %d subscriptions (seed %d); remove them with xf seed -wipe\n",
+		count.Customers, count.Products, count.Subscriptions, *seed)
+	return nil
+}
+
+// seedData generates the records. Expiry dates cluster in the coming
+// month, where reminders are due, with some just past and the rest over
+// the next year. The domains carry a random suffix so runs with different
+// seeds can be added side by side.
+func seedData(r *rand.Rand, customers, subscriptions int, now time.Time) db.SeedData {
+	pick := func(list []string) string { return list[r.IntN(len(list))] }
+	var data db.SeedData
+	suffix := fmt.Sprintf("%06x", r.Uint32()&0xffffff)
+	for i := 0; i < customers; i++ {
+		company := pick(seedCities) + pick(seedWords) + pick(seedTrades) + "有限公司"
+		domain := fmt.Sprintf("c%d-%s.example.com", i+1, suffix)
+		c := db.Customer{
+			Email: pick(seedMailbox) + "@" + domain,
+			Name:  company + "（" + pick(seedSurnames) + pick(seedGiven) + "）",
+		}
+		if r.IntN(5) == 0 {
+			c.SecondaryEmail = "boss@" + domain
+		}
+		if r.IntN(4) == 0 {
+			c.Contacts = []db.Contact{{Email: "finance@" + domain, Role: db.RoleBilling}}
+		}
+		data.Customers = append(data.Customers, c)
+	}
+	data.Products = append(data.Products, seedProducts...)
+	for i := 0; i < subscriptions; i++ {
+		var days int
+		switch n := r.IntN(10); {
+		case n < 1:
+			days = -r.IntN(7) - 1
+		case n < 4:
+			days = r.IntN(31)
+		default:
+			days = 31 + r.IntN(335)
+		}
+		sub := db.Subscription{
+			// Every customer gets one before any gets a second.
+			CustomerID: i % customers,
+			ProductID:  r.IntN(len(data.Products)),
+			ExpiresAt:  now.AddDate(0, 0, days).Format("2006-01-02"),
+			Kind:       db.KindPaid,
+			Priority:   db.PriorityNormal,
+		}
+		if i >= customers {
+			sub.CustomerID = r.IntN(customers)
+		}
+		switch r.IntN(10) {
+		case 0:
+			sub.Priority = db.PriorityHigh
+		case 1:
+			sub.Priority = db.PriorityLow
+		}
+		if days >= 0 && days < 15 && r.IntN(8) == 0 {
+			sub.Kind = db.KindTrial
+		}
+		if sub.Kind == db.KindPaid {
+			switch r.IntN(8) {
+			case 0:
+				sub.AutoRenewMonths = 12
+			case 1:
+				sub.AutoRenewMonths = 1
+			}
+		}
+		if r.IntN(3) == 0 {
+			sub.Note = fmt.Sprintf("合同编号 HT-%d-%04d", now.Year(), i+1)
+		}
+		data.Subscriptions = append(data.Subscriptions, sub)
+	}
+	return data
+}
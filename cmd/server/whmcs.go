@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"xf/internal/whmcs"
+)
+
+// runWHMCS is "xf whmcs": one sync from WHMCS, as xf serve runs every
+// WHMCS_SYNC_MINUTES. The first run imports everything.
+func runWHMCS(args []string) error {
+	fs := flag.NewFlagSet("whmcs", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("usage: xf whmcs")
+	}
+	cfg, err := common.load(fs)
+	if err != nil {
+		return err
+	}
+	syncer := whmcs.Syncer{Client: whmcsClient(cfg)}
+	if !syncer.Client.Enabled() {
+		return errors.New("WHMCS_URL, WHMCS_IDENTIFIER and WHMCS_SECRET are not set")
+	}
+	store, err := openStore(cfg, true)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	syncer.Store = store
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	count, err := syncer.Sync(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("customers: %d added, %d updated\n", count.CustomersAdded, count.CustomersUpdated)
+	fmt.Printf("products: %d added, %d mapped by name\n", count.ProductsAdded, count.ProductsMapped)
+	fmt.Printf("subscriptions: %d added, %d updated, %d removed\n", count.SubscriptionsAdded, count.SubscriptionsUpdated, count.SubscriptionsRemoved)
+	if count.ClientsSkipped > 0 {
+		fmt.Printf("clients skipped because another client or customer has their email: %d\n", count.ClientsSkipped)
+	}
+	return nil
+}
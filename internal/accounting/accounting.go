@@ -0,0 +1,238 @@
+// Package accounting writes completed renewals as CSV for accounting
+// tools, one calendar month per batch, with the columns each tool's
+// import expects.
+package accounting
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"xf/internal/db"
+)
+
+// DefaultColumns is the mapping used until one is saved.
+const DefaultColumns = `日期=date
+摘要=description
+客户=customer
+产品=product
+金额=amount
+币种=currency
+收款方式=method
+订阅=subscription`
+
+// Fields are the values a column can take, with what they hold.
+var Fields = []struct{ Name, Label string }{
+	{"date", "续费日期"},
+	{"month", "所属月份，如 2026-10"},
+	{"description", "摘要，如“云服务器 续费至 2027-10-31”"},
+	{"customer", "客户名称（没有时为邮箱）"},
+	{"email", "客户邮箱"},
+	{"product", "产品名称"},
+	{"note", "订阅备注第一行"},
+	{"subscription", "订阅 ID"},
+	{"old_expires_at", "原到期日"},
+	{"new_expires_at", "新到期日"},
+	{"amount", "金额，如 1200.00"},
+	{"currency", "币种"},
+	{"method", "收款方式：在线支付、自动续费或手动续费"},
+	{"payment", "Stripe 支付编号"},
+}
+
+// DateFormats are the date layouts offered, keyed by how they read.
+var DateFormats = []string{"2006-01-02", "2006/01/02", "01/02/2006", "02.01.2006"}
+
+// Column is a CSV column: its header and the field or, when Literal is
+// set, the fixed text it holds.
+type Column struct {
+	Header  string
+	Field   string
+	Literal bool
+}
+
+// ParseColumns reads "Header=field" lines; a quoted value such as
+// 科目="6001" is written as is.
+func ParseColumns(spec string) ([]Column, error) {
+	if strings.TrimSpace(spec) == "" {
+		spec = DefaultColumns
+	}
+	var columns []Column
+	for n, line := range strings.Split(spec, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		header, field, ok := strings.Cut(line, "=")
+		header, field = strings.TrimSpace(header), strings.TrimSpace(field)
+		if !ok || header == "" {
+			return nil, fmt.Errorf("第 %d 行应为“表头=字段”: %s", n+1, line)
+		}
+		if len(field) >= 2 && field[0] == '"' && field[len(field)-1] == '"' {
+			columns = append(columns, Column{Header: header, Field: field[1 : len(field)-1], Literal: true})
+			continue
+		}
+		if !knownField(field) {
+			return nil, fmt.Errorf("第 %d 行的字段未知: %s", n+1, field)
+		}
+		columns = append(columns, Column{Header: header, Field: field})
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("至少需要一列")
+	}
+	return columns, nil
+}
+
+func knownField(name string) bool {
+	for _, f := range Fields {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Month returns the bounds of a month such as "2026-10" in loc.
+func Month(month string, loc *time.Location) (time.Time, time.Time, error) {
+	start, err := time.ParseInLocation("2006-01", month, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("月份格式应为 YYYY-MM: %s", month)
+	}
+	return start, start.AddDate(0, 1, 0).Add(-time.Nanosecond), nil
+}
+
+// Entry is a renewal with the subscription it renewed, which is zero if
+// the subscription has since been deleted.
+type Entry struct {
+	db.Renewal
+	Subscription db.SubscriptionDetail
+}
+
+// Batch returns the renewals logged in month, in loc.
+func Batch(store *db.Store, month string, loc *time.Location) ([]Entry, error) {
+	from, to, err := Month(month, loc)
+	if err != nil {
+		return nil, err
+	}
+	renewals, err := store.ListRenewalsBetween(from, to)
+	if err != nil {
+		return nil, err
+	}
+	subs, err := store.ListSubscriptions()
+	if err != nil {
+		return nil, err
+	}
+	byID := map[int]db.SubscriptionDetail{}
+	for _, sub := range subs {
+		byID[sub.ID] = sub
+	}
+	entries := make([]Entry, 0, len(renewals))
+	for _, r := range renewals {
+		entries = append(entries, Entry{Renewal: r, Subscription: byID[r.SubscriptionID]})
+	}
+	return entries, nil
+}
+
+// Write writes entries as CSV with the export's columns and format.
+func Write(w io.Writer, entries []Entry, export db.AccountingExport, loc *time.Location) error {
+	columns, err := ParseColumns(export.Columns)
+	if err != nil {
+		return err
+	}
+	layout := export.DateFormat
+	if layout == "" {
+		layout = DateFormats[0]
+	}
+	var buf bytes.Buffer
+	if export.Encoding != "utf-8" {
+		buf.WriteString("\ufeff")
+	}
+	out := csv.NewWriter(&buf)
+	switch export.Delimiter {
+	case ";":
+		out.Comma = ';'
+	case "tab":
+		out.Comma = '\t'
+	}
+	// Excel and most import dialogs expect CRLF.
+	out.UseCRLF = true
+	record := make([]string, len(columns))
+	for i, c := range columns {
+		record[i] = c.Header
+	}
+	out.Write(record)
+	for _, e := range entries {
+		for i, c := range columns {
+			if c.Literal {
+				record[i] = c.Field
+			} else {
+				record[i] = e.field(c.Field, layout, loc)
+			}
+		}
+		out.Write(record)
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func (e Entry) field(name, layout string, loc *time.Location) string {
+	at, _ := time.Parse(time.RFC3339, e.At)
+	sub := e.Subscription
+	switch name {
+	case "date":
+		return at.In(loc).Format(layout)
+	case "month":
+		return at.In(loc).Format("2006-01")
+	case "description":
+		product := sub.ProductName
+		if product == "" {
+			product = "订阅 #" + strconv.Itoa(e.SubscriptionID)
+		}
+		return product + " 续费至 " + e.NewExpiresAt
+	case "customer":
+		if sub.CustomerName != "" {
+			return sub.CustomerName
+		}
+		return sub.CustomerEmail
+	case "email":
+		return sub.CustomerEmail
+	case "product":
+		return sub.ProductName
+	case "note":
+		line, _, _ := strings.Cut(strings.TrimSpace(sub.Note), "\n")
+		return strings.TrimSpace(line)
+	case "subscription":
+		return strconv.Itoa(e.SubscriptionID)
+	case "old_expires_at":
+		return e.OldExpiresAt
+	case "new_expires_at":
+		return e.NewExpiresAt
+	case "amount":
+		return e.Amount
+	case "currency":
+		return e.Currency
+	case "method":
+		return e.Method()
+	case "payment":
+		return e.Payment
+	}
+	return ""
+}
+
+// Method names how the renewal came about.
+func (e Entry) Method() string {
+	switch {
+	case e.Payment != "":
+		return "在线支付"
+	case e.Auto:
+		return "自动续费"
+	}
+	return "手动续费"
+}
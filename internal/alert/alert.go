@@ -0,0 +1,119 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"xf/internal/email"
+)
+
+// Notifier sends urgent alerts to the administrator. Alerts go out directly
+// through the mail sender and, if configured, to a webhook and admin chats,
+// bypassing the outbox since the outbox may be what is failing.
+type Notifier struct {
+	Mailer     email.Sender
+	To         string
+	WebhookURL string
+	// WebhookSecret, if set, signs webhook requests; see Sign.
+	WebhookSecret string
+	Chats         []Chat
+}
+
+// Headers of a signed webhook request.
+const (
+	TimestampHeader = "X-XF-Timestamp"
+	SignatureHeader = "X-XF-Signature"
+)
+
+// Chat is an admin chat that Sender posts alerts to; Name identifies the
+// service in errors.
+type Chat struct {
+	Name   string
+	Sender email.Sender
+	To     string
+}
+
+// Enabled reports whether there is anywhere to deliver alerts to.
+func (n Notifier) Enabled() bool {
+	return (n.To != "" && n.Mailer.Enabled()) || n.WebhookURL != "" || len(n.Chats) > 0
+}
+
+// Send delivers the alert to every configured channel and returns the
+// combined error of those that failed.
+func (n Notifier) Send(ctx context.Context, subject, text string) error {
+	var errs []error
+	if n.To != "" && n.Mailer.Enabled() {
+		body := "<p>" + strings.ReplaceAll(html.EscapeString(text), "\n", "<br/>") + "</p>"
+		msg := email.Message{To: n.To, Subject: "【告警】" + subject, HTML: body, Text: text}
+		if err := n.Mailer.SendMessage(ctx, msg); err != nil {
+			errs = append(errs, fmt.Errorf("告警邮件发送失败: %w", err))
+		}
+	}
+	if n.WebhookURL != "" {
+		if err := n.postWebhook(ctx, subject, text); err != nil {
+			errs = append(errs, fmt.Errorf("告警 Webhook 调用失败: %w", err))
+		}
+	}
+	for _, chat := range n.Chats {
+		msg := email.Message{To: chat.To, Subject: "【告警】" + subject, Text: text}
+		if err := chat.Sender.SendMessage(ctx, msg); err != nil {
+			errs = append(errs, fmt.Errorf("告警 %s 消息发送失败: %w", chat.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// postWebhook posts the alert as JSON. The id is unique per request, so a
+// receiver can drop a replayed request it has already seen.
+func (n Notifier) postWebhook(ctx context.Context, subject, text string) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(map[string]string{"id": hex.EncodeToString(id), "subject": subject, "text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.WebhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.WebhookSecret != "" {
+		timestamp := time.Now().Unix()
+		req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(SignatureHeader, Sign(n.WebhookSecret, timestamp, payload))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("状态码 %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the signature header value of a webhook body sent at
+// timestamp (Unix seconds): "sha256=" and the hex HMAC-SHA256, keyed with
+// secret, of the timestamp, a dot and the body. Signing the timestamp lets
+// receivers reject old requests replayed with a valid signature.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
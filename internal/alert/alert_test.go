@@ -0,0 +1,26 @@
+package alert
+
+import "testing"
+
+// The expected values were computed independently of Sign with
+//
+//	printf '<timestamp>.<body>' | openssl dgst -sha256 -hmac '<secret>'
+//
+// following the scheme documented in the README.
+func TestSign(t *testing.T) {
+	tests := []struct {
+		secret    string
+		timestamp int64
+		body      string
+		want      string
+	}{
+		{"whsec", 1700000000, `{"a":1}`, "sha256=8ad37ba156048ae0e0a5533c75cdf26fee88b07f93cb57ee4c80adb053012032"},
+		{"secret", 0, "", "sha256=3445798a051818ef95def46c2eb62b43d377ce6e3c29b4d0aec3da0e59577f79"},
+		{"", 1700000000, "", "sha256=c1da1b6c6b8e9da7f4bbb90f7cab0820f271ad19ccbf80c88479c4e14f37d1c6"},
+	}
+	for _, tt := range tests {
+		if got := Sign(tt.secret, tt.timestamp, []byte(tt.body)); got != tt.want {
+			t.Errorf("Sign(%q, %d, %q) = %s, want %s", tt.secret, tt.timestamp, tt.body, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FTP stores archives in Dir on an FTP server, in passive binary mode.
+// Plain FTP sends the password in the clear; the archives themselves are
+// encrypted before they leave.
+type FTP struct {
+	Addr string
+	User string
+	Pass string
+	Dir  string
+}
+
+func (f FTP) Put(ctx context.Context, name string, data []byte) error {
+	return f.session(ctx, func(c *ftpConn) error {
+		return c.transfer("STOR "+name, func(conn net.Conn) error {
+			_, err := conn.Write(data)
+			return err
+		})
+	})
+}
+
+func (f FTP) List(ctx context.Context) ([]string, error) {
+	var names []string
+	err := f.session(ctx, func(c *ftpConn) error {
+		return c.transfer("NLST", func(conn net.Conn) error {
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				if line := strings.TrimSpace(scanner.Text()); line != "" {
+					names = append(names, path.Base(line))
+				}
+			}
+			return scanner.Err()
+		})
+	})
+	return names, err
+}
+
+func (f FTP) Delete(ctx context.Context, name string) error {
+	return f.session(ctx, func(c *ftpConn) error {
+		_, err := c.cmd(250, "DELE %s", name)
+		return err
+	})
+}
+
+type ftpConn struct {
+	*textproto.Conn
+	host     string
+	deadline time.Time
+}
+
+// session logs in, changes to Dir and runs fn.
+func (f FTP) session(ctx context.Context, fn func(*ftpConn) error) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", f.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(backupTimeout)
+	}
+	conn.SetDeadline(deadline)
+	host, _, _ := net.SplitHostPort(f.Addr)
+	c := &ftpConn{Conn: textproto.NewConn(conn), host: host, deadline: deadline}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		return fmt.Errorf("FTP: %w", err)
+	}
+	user, pass := f.User, f.Pass
+	if user == "" {
+		user, pass = "anonymous", "anonymous"
+	}
+	code, err := c.cmd(0, "USER %s", user)
+	if err != nil {
+		return err
+	}
+	if code == 331 {
+		if _, err := c.cmd(230, "PASS %s", pass); err != nil {
+			return err
+		}
+	} else if code != 230 {
+		return fmt.Errorf("FTP USER: 意外的响应 %d", code)
+	}
+	if _, err := c.cmd(200, "TYPE I"); err != nil {
+		return err
+	}
+	if f.Dir != "" {
+		if _, err := c.cmd(250, "CWD %s", f.Dir); err != nil {
+			return err
+		}
+	}
+	if err := fn(c); err != nil {
+		return err
+	}
+	c.cmd(0, "QUIT")
+	return nil
+}
+
+// cmd sends a command and reads the reply, which must have code unless
+// code is 0.
+func (c *ftpConn) cmd(code int, format string, args ...any) (int, error) {
+	if err := c.PrintfLine(format, args...); err != nil {
+		return 0, err
+	}
+	got, msg, err := c.ReadResponse(code)
+	if err != nil {
+		verb, _, _ := strings.Cut(format, " ")
+		if code == 0 {
+			return got, fmt.Errorf("FTP %s: %w", verb, err)
+		}
+		return got, fmt.Errorf("FTP %s: %d %s", verb, got, msg)
+	}
+	return got, nil
+}
+
+// transfer opens a passive data connection, sends command and hands the
+// connection to fn, then waits for the transfer to complete.
+func (c *ftpConn) transfer(command string, fn func(net.Conn) error) error {
+	addr, err := c.passive()
+	if err != nil {
+		return err
+	}
+	data, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	data.SetDeadline(c.deadline)
+	if err := c.PrintfLine("%s", command); err != nil {
+		data.Close()
+		return err
+	}
+	verb, _, _ := strings.Cut(command, " ")
+	// 450 and 550 from NLST mean an empty directory on some servers.
+	if code, msg, err := c.ReadResponse(1); err != nil {
+		data.Close()
+		if verb == "NLST" && (code == 450 || code == 550) {
+			return nil
+		}
+		return fmt.Errorf("FTP %s: %d %s", verb, code, msg)
+	}
+	err = fn(data)
+	if closeErr := data.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if code, msg, err := c.ReadResponse(2); err != nil {
+		return fmt.Errorf("FTP %s: %d %s", verb, code, msg)
+	}
+	return nil
+}
+
+// passive asks for a data port with EPSV, falling back to PASV. Either
+// way the data connection goes to the control connection's host, which
+// also works behind NAT where PASV reports a private address.
+func (c *ftpConn) passive() (string, error) {
+	if err := c.PrintfLine("EPSV"); err != nil {
+		return "", err
+	}
+	if code, msg, err := c.ReadResponse(229); err == nil {
+		// 229 Entering Extended Passive Mode (|||6446|)
+		start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if start >= 0 && end > start+4 {
+			return net.JoinHostPort(c.host, msg[start+4:end]), nil
+		}
+	} else if code == 0 {
+		return "", err
+	}
+	if err := c.PrintfLine("PASV"); err != nil {
+		return "", err
+	}
+	code, msg, err := c.ReadResponse(227)
+	if err != nil {
+		return "", fmt.Errorf("FTP PASV: %d %s", code, msg)
+	}
+	// 227 Entering Passive Mode (192,168,1,2,25,46)
+	start, end := strings.Index(msg, "("), strings.Index(msg, ")")
+	if start < 0 || end < start {
+		return "", fmt.Errorf("FTP PASV: 无法解析 %q", msg)
+	}
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return "", fmt.Errorf("FTP PASV: 无法解析 %q", msg)
+	}
+	hi, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+	lo, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+	if err1 != nil || err2 != nil {
+		return "", fmt.Errorf("FTP PASV: 无法解析 %q", msg)
+	}
+	return net.JoinHostPort(c.host, strconv.Itoa(hi<<8|lo)), nil
+}
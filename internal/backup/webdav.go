@@ -0,0 +1,111 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// WebDAV stores archives in the collection at URL, such as a Nextcloud
+// folder (https://cloud.example.com/remote.php/dav/files/me/xf/).
+type WebDAV struct {
+	URL  string
+	User string
+	Pass string
+}
+
+func (d WebDAV) Put(ctx context.Context, name string, data []byte) error {
+	status, err := d.do(ctx, http.MethodPut, name, nil, data)
+	if err == nil || (status != http.StatusConflict && status != http.StatusNotFound) {
+		return err
+	}
+	// The collection doesn't exist yet: create it and try again.
+	if status, err := d.do(ctx, "MKCOL", "", nil, nil); err != nil && status != http.StatusMethodNotAllowed {
+		return err
+	}
+	_, err = d.do(ctx, http.MethodPut, name, nil, data)
+	return err
+}
+
+func (d WebDAV) List(ctx context.Context) ([]string, error) {
+	body := []byte(`<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><resourcetype/></prop></propfind>`)
+	var reply struct {
+		Responses []struct {
+			Href       string    `xml:"href"`
+			Collection *struct{} `xml:"propstat>prop>resourcetype>collection"`
+		} `xml:"response"`
+	}
+	status, err := d.do(ctx, "PROPFIND", "", &reply, body)
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, r := range reply.Responses {
+		if r.Collection != nil || strings.HasSuffix(r.Href, "/") {
+			continue
+		}
+		href, err := url.PathUnescape(r.Href)
+		if err != nil {
+			continue
+		}
+		names = append(names, path.Base(href))
+	}
+	return names, nil
+}
+
+func (d WebDAV) Delete(ctx context.Context, name string) error {
+	status, err := d.do(ctx, http.MethodDelete, name, nil, nil)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// do sends a request for name in the collection, or the collection itself
+// when name is empty, decoding an XML reply into out if given. It returns
+// the status code alongside any error.
+func (d WebDAV) do(ctx context.Context, method, name string, out any, payload []byte) (int, error) {
+	target := strings.TrimSuffix(d.URL, "/") + "/"
+	if name != "" {
+		target += url.PathEscape(name)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	if d.User != "" {
+		req.SetBasicAuth(d.User, d.Pass)
+	}
+	if method == "PROPFIND" {
+		req.Header.Set("Depth", "1")
+		req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("WebDAV %s %s: 状态码 %d", method, target, resp.StatusCode)
+	}
+	if out == nil {
+		return resp.StatusCode, nil
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if err := xml.Unmarshal(raw, out); err != nil {
+		return resp.StatusCode, fmt.Errorf("WebDAV 列表解析失败: %w", err)
+	}
+	return resp.StatusCode, nil
+}
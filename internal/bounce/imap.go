@@ -0,0 +1,241 @@
+package bounce
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLiteral bounds a single literal, i.e. one fetched message.
+const maxLiteral = 25 << 20
+
+// imapClient speaks just enough IMAP4rev1 (RFC 3501) to read and flag
+// messages in one mailbox.
+type imapClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// imapResponse is one response line with any literals it carried, which
+// appear in text as "{N}" placeholders.
+type imapResponse struct {
+	text     string
+	literals [][]byte
+}
+
+func dialIMAP(ctx context.Context, addr string, useTLS bool) (*imapClient, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if useTLS {
+		dialer := tls.Dialer{Config: &tls.Config{ServerName: host}}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c := &imapClient{conn: conn, r: bufio.NewReader(conn)}
+	greeting, err := c.readResponse()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting.text, "* OK") && !strings.HasPrefix(greeting.text, "* PREAUTH") {
+		conn.Close()
+		return nil, fmt.Errorf("imap: unexpected greeting %q", greeting.text)
+	}
+	return c, nil
+}
+
+func (c *imapClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *imapClient) Login(user, pass string) error {
+	_, err := c.command("LOGIN " + quote(user) + " " + quote(pass))
+	return err
+}
+
+func (c *imapClient) Select(mailbox string) error {
+	_, err := c.command("SELECT " + quote(mailbox))
+	return err
+}
+
+// Examine opens mailbox read-only, so reading it changes no flags, and
+// returns its UIDVALIDITY.
+func (c *imapClient) Examine(mailbox string) (int64, error) {
+	responses, err := c.command("EXAMINE " + quote(mailbox))
+	if err != nil {
+		return 0, err
+	}
+	for _, resp := range responses {
+		if _, rest, ok := strings.Cut(resp.text, "[UIDVALIDITY "); ok {
+			value, _, _ := strings.Cut(rest, "]")
+			return strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("imap EXAMINE: no UIDVALIDITY")
+}
+
+// SearchUnseen returns the UIDs of messages without the \Seen flag.
+func (c *imapClient) SearchUnseen() ([]int, error) {
+	return c.search("UNSEEN")
+}
+
+// SearchFrom returns the UIDs from first on, in ascending order.
+func (c *imapClient) SearchFrom(first int) ([]int, error) {
+	uids, err := c.search(fmt.Sprintf("UID %d:*", first))
+	// "n:*" matches the last message even when its UID is below n.
+	return slices.DeleteFunc(uids, func(uid int) bool { return uid < first }), err
+}
+
+// SearchSince returns the UIDs of messages received on or after day.
+func (c *imapClient) SearchSince(day time.Time) ([]int, error) {
+	return c.search("SINCE " + day.Format("2-Jan-2006"))
+}
+
+func (c *imapClient) search(criteria string) ([]int, error) {
+	responses, err := c.command("UID SEARCH " + criteria)
+	if err != nil {
+		return nil, err
+	}
+	var uids []int
+	for _, resp := range responses {
+		rest, ok := strings.CutPrefix(resp.text, "* SEARCH")
+		if !ok {
+			continue
+		}
+		for _, field := range strings.Fields(rest) {
+			if uid, err := strconv.Atoi(field); err == nil {
+				uids = append(uids, uid)
+			}
+		}
+	}
+	slices.Sort(uids)
+	return uids, nil
+}
+
+// Fetch returns the full message without setting \Seen.
+func (c *imapClient) Fetch(uid int) ([]byte, error) {
+	return c.fetch(uid, "BODY.PEEK[]")
+}
+
+// FetchHeader returns just the named header fields, without setting
+// \Seen.
+func (c *imapClient) FetchHeader(uid int, fields ...string) ([]byte, error) {
+	return c.fetch(uid, "BODY.PEEK[HEADER.FIELDS ("+strings.Join(fields, " ")+")]")
+}
+
+func (c *imapClient) fetch(uid int, item string) ([]byte, error) {
+	responses, err := c.command(fmt.Sprintf("UID FETCH %d (%s)", uid, item))
+	if err != nil {
+		return nil, err
+	}
+	for _, resp := range responses {
+		if strings.Contains(resp.text, " FETCH ") && len(resp.literals) > 0 {
+			return resp.literals[0], nil
+		}
+	}
+	return nil, fmt.Errorf("imap: message %d not returned", uid)
+}
+
+// MarkSeen sets \Seen so the message isn't searched again.
+func (c *imapClient) MarkSeen(uid int) error {
+	_, err := c.command(fmt.Sprintf("UID STORE %d +FLAGS.SILENT (\\Seen)", uid))
+	return err
+}
+
+func (c *imapClient) Logout() error {
+	_, err := c.command("LOGOUT")
+	return err
+}
+
+// command sends one tagged command and returns the untagged responses,
+// failing unless the tagged reply is OK.
+func (c *imapClient) command(cmd string) ([]imapResponse, error) {
+	c.tag++
+	tag := fmt.Sprintf("x%d", c.tag)
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, cmd); err != nil {
+		return nil, err
+	}
+	var responses []imapResponse
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		status, ok := strings.CutPrefix(resp.text, tag+" ")
+		if !ok {
+			responses = append(responses, resp)
+			continue
+		}
+		if !strings.HasPrefix(status, "OK") {
+			verb, _, _ := strings.Cut(cmd, " ")
+			return nil, fmt.Errorf("imap %s: %s", verb, status)
+		}
+		return responses, nil
+	}
+}
+
+// readResponse reads one response line, following any "{N}" literals to
+// the end of the logical line.
+func (c *imapClient) readResponse() (imapResponse, error) {
+	var resp imapResponse
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return resp, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		resp.text += line
+		size, ok := literalSize(line)
+		if !ok {
+			return resp, nil
+		}
+		if size > maxLiteral {
+			return resp, fmt.Errorf("imap: %d byte literal exceeds limit", size)
+		}
+		literal := make([]byte, size)
+		if _, err := io.ReadFull(c.r, literal); err != nil {
+			return resp, err
+		}
+		resp.literals = append(resp.literals, literal)
+	}
+}
+
+// literalSize parses a trailing "{N}" literal announcement.
+func literalSize(line string) (int, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false
+	}
+	open := strings.LastIndex(line, "{")
+	if open == -1 {
+		return 0, false
+	}
+	size, err := strconv.Atoi(line[open+1 : len(line)-1])
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// quote formats s as an IMAP quoted string.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
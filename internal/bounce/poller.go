@@ -0,0 +1,111 @@
+package bounce
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"xf/internal/db"
+	"xf/internal/logging"
+)
+
+const (
+	defaultInterval = 10 * time.Minute
+	pollTimeout     = 2 * time.Minute
+)
+
+// Poller reads non-delivery reports from a dedicated bounce mailbox over
+// IMAP and records them against the send history and customers. Every
+// unseen message is marked seen once read, bounce or not, so the mailbox
+// should only receive bounces.
+type Poller struct {
+	Store   *db.Store
+	Host    string
+	Port    int
+	User    string
+	Pass    string
+	Mailbox string
+	// TLS dials with implicit TLS (IMAPS, port 993); otherwise the
+	// connection is plain text.
+	TLS      bool
+	Interval time.Duration
+}
+
+// Enabled reports whether a mailbox is configured.
+func (p Poller) Enabled() bool {
+	return p.Host != "" && p.User != ""
+}
+
+// Start polls in the background until ctx is cancelled.
+func (p Poller) Start(ctx context.Context) {
+	interval := p.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if n, err := p.Poll(ctx, time.Now()); err != nil {
+				slog.Error("bounce poll error", "error", err)
+			} else if n > 0 {
+				slog.Info("bounce poll recorded bounces", "count", n)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Poll reads the unseen messages once and returns how many bounces matched
+// a send or a customer.
+func (p Poller) Poll(ctx context.Context, now time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, pollTimeout)
+	defer cancel()
+	client, err := dialIMAP(ctx, net.JoinHostPort(p.Host, strconv.Itoa(p.Port)), p.TLS)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+	if err := client.Login(p.User, p.Pass); err != nil {
+		return 0, err
+	}
+	mailbox := p.Mailbox
+	if mailbox == "" {
+		mailbox = "INBOX"
+	}
+	if err := client.Select(mailbox); err != nil {
+		return 0, err
+	}
+	uids, err := client.SearchUnseen()
+	if err != nil {
+		return 0, err
+	}
+	matched := 0
+	for _, uid := range uids {
+		raw, err := client.Fetch(uid)
+		if err != nil {
+			return matched, err
+		}
+		for _, report := range ParseReports(raw) {
+			ok, err := p.Store.RecordBounce(report.Recipient, report.Reason, now)
+			if err != nil {
+				return matched, err
+			}
+			if ok {
+				matched++
+			} else {
+				slog.Warn("bounce matches no send or customer", logging.CustomerEmail, report.Recipient)
+			}
+		}
+		if err := client.MarkSeen(uid); err != nil {
+			return matched, err
+		}
+	}
+	return matched, client.Logout()
+}
@@ -0,0 +1,178 @@
+package bounce
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"net/mail"
+	"strconv"
+	"time"
+
+	"xf/internal/db"
+	"xf/internal/logging"
+)
+
+// firstPollDays is how far back the first poll of a mailbox looks.
+const firstPollDays = 30
+
+// ReplyPoller reads customer replies to reminders from a mailbox over IMAP.
+// A reply in a reminder thread whose text says the customer has renewed is
+// flagged on the subscription for an operator to confirm. The mailbox is
+// opened read-only and no flags change, so it can be the ordinary inbox
+// replies arrive at.
+type ReplyPoller struct {
+	Store   *db.Store
+	Host    string
+	Port    int
+	User    string
+	Pass    string
+	Mailbox string
+	// TLS dials with implicit TLS (IMAPS, port 993); otherwise the
+	// connection is plain text.
+	TLS bool
+	// Keywords are the phrases that mark a reply as a renewal, matched
+	// ignoring case; empty means DefaultReplyKeywords.
+	Keywords []string
+	Interval time.Duration
+}
+
+// Enabled reports whether a mailbox is configured.
+func (p ReplyPoller) Enabled() bool {
+	return p.Host != "" && p.User != ""
+}
+
+// Start polls in the background until ctx is cancelled.
+func (p ReplyPoller) Start(ctx context.Context) {
+	interval := p.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if n, err := p.Poll(ctx, time.Now()); err != nil {
+				slog.Error("reply poll error", "error", err)
+			} else if n > 0 {
+				slog.Info("reply poll flagged renewals", "count", n)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Poll reads the messages that arrived since the last poll and returns how
+// many replies were flagged. Messages are tracked by UID rather than the
+// \Seen flag, which belongs to whoever reads the mailbox.
+func (p ReplyPoller) Poll(ctx context.Context, now time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, pollTimeout)
+	defer cancel()
+	client, err := dialIMAP(ctx, net.JoinHostPort(p.Host, strconv.Itoa(p.Port)), p.TLS)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+	if err := client.Login(p.User, p.Pass); err != nil {
+		return 0, err
+	}
+	mailbox := p.Mailbox
+	if mailbox == "" {
+		mailbox = "INBOX"
+	}
+	validity, err := client.Examine(mailbox)
+	if err != nil {
+		return 0, err
+	}
+	state, err := p.Store.GetReplyPollState()
+	if err != nil {
+		return 0, err
+	}
+	var uids []int
+	if state.Mailbox == mailbox && state.UIDValidity == validity && state.LastUID > 0 {
+		uids, err = client.SearchFrom(state.LastUID + 1)
+	} else {
+		// A new mailbox, or its UIDs were reset: start over from recent mail.
+		state = db.ReplyPollState{Mailbox: mailbox, UIDValidity: validity}
+		uids, err = client.SearchSince(now.AddDate(0, 0, -firstPollDays))
+	}
+	if err != nil {
+		return 0, err
+	}
+	flagged := 0
+	for _, uid := range uids {
+		n, err := p.read(client, uid, now)
+		flagged += n
+		if err != nil {
+			// Keep the progress so far; the failed message is retried.
+			if saveErr := p.Store.UpdateReplyPollState(state); saveErr != nil {
+				slog.Error("reply poll state error", "error", saveErr)
+			}
+			return flagged, err
+		}
+		state.LastUID = uid
+	}
+	if err := p.Store.UpdateReplyPollState(state); err != nil {
+		return flagged, err
+	}
+	return flagged, client.Logout()
+}
+
+// read checks one message and flags it on each subscription its reminder
+// thread covers if it is a renewal reply, returning how many were flagged.
+// Only the threading headers are fetched for messages outside reminder
+// threads.
+func (p ReplyPoller) read(client *imapClient, uid int, now time.Time) (int, error) {
+	header, err := client.FetchHeader(uid, "IN-REPLY-TO", "REFERENCES")
+	if err != nil {
+		return 0, err
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(append(header, "\r\n"...)))
+	if err != nil {
+		return 0, nil
+	}
+	subs, err := p.Store.ThreadSubscriptions(ThreadIDs(msg.Header))
+	if err != nil || len(subs) == 0 {
+		return 0, err
+	}
+	raw, err := client.Fetch(uid)
+	if err != nil {
+		return 0, err
+	}
+	reply, ok := ParseReply(raw)
+	if !ok {
+		return 0, nil
+	}
+	keywords := p.Keywords
+	if len(keywords) == 0 {
+		keywords = DefaultReplyKeywords
+	}
+	keyword, ok := reply.Keyword(keywords)
+	if !ok {
+		return 0, nil
+	}
+	flagged := 0
+	for _, sub := range subs {
+		added, err := p.Store.AddRenewalReply(db.RenewalReply{
+			SubscriptionID: sub.ID,
+			ExpiresAt:      sub.ExpiresAt,
+			MessageID:      reply.MessageID,
+			From:           reply.From,
+			Subject:        reply.Subject,
+			Text:           reply.Text,
+			Keyword:        keyword,
+		}, now)
+		if err != nil {
+			return flagged, err
+		}
+		if added {
+			flagged++
+			slog.Info("renewal reply flagged", logging.SubscriptionID, sub.ID, logging.CustomerEmail, reply.From, "keyword", keyword)
+		}
+	}
+	return flagged, nil
+}
@@ -0,0 +1,173 @@
+package bounce
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultReplyKeywords are the phrases in a reply taken to mean the
+// customer has renewed.
+var DefaultReplyKeywords = []string{"已续费", "已续约", "已付款", "已支付", "已转账", "已汇款", "renewed", "have paid", "payment sent"}
+
+// maxReplyText bounds the reply text kept for the operator.
+const maxReplyText = 2000
+
+// Reply is a customer's answer to a reminder.
+type Reply struct {
+	MessageID string
+	From      string
+	Subject   string
+	// Text is the reply without the quoted reminder below it.
+	Text string
+	// InReplyTo holds the Message-IDs from In-Reply-To and References.
+	InReplyTo []string
+}
+
+// ThreadIDs returns the Message-IDs a message's In-Reply-To and References
+// headers point at.
+func ThreadIDs(header mail.Header) []string {
+	return messageIDs.FindAllString(header.Get("In-Reply-To")+" "+header.Get("References"), -1)
+}
+
+var messageIDs = regexp.MustCompile(`<[^<>\s]+>`)
+
+// ParseReply reads a reply. Automatic replies such as out-of-office
+// notices yield false.
+func ParseReply(raw []byte) (Reply, bool) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return Reply{}, false
+	}
+	if auto := strings.ToLower(msg.Header.Get("Auto-Submitted")); auto != "" && auto != "no" {
+		return Reply{}, false
+	}
+	var dec mime.WordDecoder
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	from := msg.Header.Get("From")
+	if addr, err := mail.ParseAddress(from); err == nil {
+		from = addr.Address
+	}
+	text := stripQuoted(findText(textproto.MIMEHeader(msg.Header), msg.Body, 0))
+	if utf8.RuneCountInString(text) > maxReplyText {
+		text = string([]rune(text)[:maxReplyText]) + "…"
+	}
+	return Reply{
+		MessageID: strings.TrimSpace(msg.Header.Get("Message-ID")),
+		From:      from,
+		Subject:   subject,
+		Text:      text,
+		InReplyTo: ThreadIDs(msg.Header),
+	}, true
+}
+
+// Keyword returns the first of keywords found in the reply text, ignoring
+// case.
+func (r Reply) Keyword(keywords []string) (string, bool) {
+	text := strings.ToLower(r.Text)
+	for _, keyword := range keywords {
+		if keyword = strings.TrimSpace(keyword); keyword != "" && strings.Contains(text, strings.ToLower(keyword)) {
+			return keyword, true
+		}
+	}
+	return "", false
+}
+
+// findText returns the message's plain text, falling back to its HTML part
+// with the tags removed.
+func findText(header textproto.MIMEHeader, body io.Reader, depth int) string {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	switch {
+	case mediaType == "text/plain":
+		return decodePart(header, body)
+	case mediaType == "text/html":
+		return htmlText(decodePart(header, body))
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && depth < 3:
+		var fallback string
+		parts := multipart.NewReader(body, params["boundary"])
+		for i := 0; i < maxReportParts; i++ {
+			part, err := parts.NextPart()
+			if err != nil {
+				break
+			}
+			if strings.HasPrefix(part.Header.Get("Content-Disposition"), "attachment") {
+				continue
+			}
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			text := findText(part.Header, part, depth+1)
+			if partType == "text/plain" && text != "" {
+				return text
+			}
+			if fallback == "" {
+				fallback = text
+			}
+		}
+		return fallback
+	}
+	return ""
+}
+
+// decodePart undoes the transfer encoding. multipart.Reader already
+// decodes quoted-printable parts; the top-level body is done here.
+func decodePart(header textproto.MIMEHeader, body io.Reader) string {
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	raw, _ := io.ReadAll(io.LimitReader(body, 1<<20))
+	return strings.ToValidUTF8(string(raw), "�")
+}
+
+var (
+	htmlBreaks = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|<blockquote`)
+	htmlTags   = regexp.MustCompile(`<[^>]*>`)
+)
+
+func htmlText(s string) string {
+	s = htmlBreaks.ReplaceAllStringFunc(s, func(tag string) string {
+		// Keep blockquotes visible to stripQuoted as a quote marker.
+		if strings.HasPrefix(strings.ToLower(tag), "<blockquote") {
+			return "\n-----Original Message-----\n" + tag
+		}
+		return "\n"
+	})
+	return html.UnescapeString(htmlTags.ReplaceAllString(s, ""))
+}
+
+// quoteMarkers start the quoted original in the reply styles of common
+// mail clients: Gmail and Apple Mail, Outlook, Foxmail and QQ Mail.
+var quoteMarkers = regexp.MustCompile(`(?i)^(on .+ wrote:|在 .+写道[:：]?|-+\s*original message\s*-+|-+\s*原始邮件\s*-+|from:\s|发件人[:：])`)
+
+// stripQuoted cuts the reply at the first line that starts the quoted
+// original and drops "> " quoted lines, leaving what the customer wrote.
+func stripQuoted(text string) string {
+	var kept []string
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if quoteMarkers.MatchString(trimmed) {
+			break
+		}
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+		kept = append(kept, strings.TrimRight(line, " \t"))
+	}
+	return strings.TrimSpace(strings.Join(kept, "\n"))
+}
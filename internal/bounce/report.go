@@ -0,0 +1,103 @@
+package bounce
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// Report is a permanent delivery failure taken from a non-delivery report.
+type Report struct {
+	Recipient string
+	// Reason is the DSN status and diagnostic, e.g.
+	// "5.1.1 smtp; 550 5.1.1 user unknown".
+	Reason string
+}
+
+// maxReportParts bounds how many MIME parts are examined per message.
+const maxReportParts = 20
+
+// ParseReports returns the failed recipients in a bounce message. It reads
+// RFC 3464 delivery status notifications and falls back to the
+// X-Failed-Recipients header that Exim and some relays add. Delayed
+// notifications and ordinary mail yield nothing.
+func ParseReports(raw []byte) []Report {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+	if reports := findDeliveryStatus(textproto.MIMEHeader(msg.Header), msg.Body, 0); len(reports) > 0 {
+		return reports
+	}
+	var reports []Report
+	for _, addr := range strings.Split(msg.Header.Get("X-Failed-Recipients"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			reports = append(reports, Report{Recipient: addr, Reason: msg.Header.Get("Subject")})
+		}
+	}
+	return reports
+}
+
+// findDeliveryStatus walks the MIME tree looking for message/delivery-status
+// parts.
+func findDeliveryStatus(header textproto.MIMEHeader, body io.Reader, depth int) []Report {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+	switch {
+	case mediaType == "message/delivery-status":
+		return parseDeliveryStatus(body)
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && depth < 3:
+		var reports []Report
+		parts := multipart.NewReader(body, params["boundary"])
+		for i := 0; i < maxReportParts; i++ {
+			part, err := parts.NextPart()
+			if err != nil {
+				break
+			}
+			reports = append(reports, findDeliveryStatus(part.Header, part, depth+1)...)
+		}
+		return reports
+	}
+	return nil
+}
+
+// parseDeliveryStatus reads the per-message block and the per-recipient
+// blocks of a delivery-status body and keeps the failed recipients.
+func parseDeliveryStatus(body io.Reader) []Report {
+	r := textproto.NewReader(bufio.NewReader(body))
+	if _, err := r.ReadMIMEHeader(); err != nil {
+		return nil
+	}
+	var reports []Report
+	for {
+		fields, err := r.ReadMIMEHeader()
+		if len(fields) > 0 && strings.EqualFold(strings.TrimSpace(fields.Get("Action")), "failed") {
+			recipient := dsnAddress(fields.Get("Original-Recipient"))
+			if final := dsnAddress(fields.Get("Final-Recipient")); final != "" {
+				recipient = final
+			}
+			if recipient != "" {
+				reason := strings.TrimSpace(fields.Get("Status") + " " + fields.Get("Diagnostic-Code"))
+				reports = append(reports, Report{Recipient: recipient, Reason: reason})
+			}
+		}
+		if err != nil {
+			return reports
+		}
+	}
+}
+
+// dsnAddress strips the address type from a field like "rfc822; a@b.com".
+func dsnAddress(value string) string {
+	if _, addr, ok := strings.Cut(value, ";"); ok {
+		value = addr
+	}
+	return strings.Trim(strings.TrimSpace(value), "<>")
+}
@@ -0,0 +1,114 @@
+// Package caldav publishes subscription expiries as events on a CalDAV
+// server such as Nextcloud or Radicale, in one calendar per product.
+package caldav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"xf/internal/email"
+)
+
+// Client writes to the calendars under a collection of a CalDAV account,
+// e.g. https://cloud.example.com/remote.php/dav/calendars/alice/ on
+// Nextcloud or https://radicale.example.com/alice/ on Radicale.
+type Client struct {
+	URL    string
+	User   string
+	Pass   string
+	Client *http.Client
+}
+
+func (c Client) Enabled() bool {
+	return c.URL != ""
+}
+
+// CalendarURL returns the URL of the calendar named by slug.
+func (c Client) CalendarURL(slug string) string {
+	return strings.TrimRight(c.URL, "/") + "/" + slug + "/"
+}
+
+// EnsureCalendar creates the calendar at url with the display name, or
+// renames it if it exists.
+func (c Client) EnsureCalendar(ctx context.Context, url, name string) error {
+	var body bytes.Buffer
+	body.WriteString(xml.Header)
+	body.WriteString(`<C:mkcalendar xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav"><D:set><D:prop><D:displayname>`)
+	xml.EscapeText(&body, []byte(name))
+	body.WriteString(`</D:displayname><C:supported-calendar-component-set><C:comp name="VEVENT"/></C:supported-calendar-component-set></D:prop></D:set></C:mkcalendar>`)
+	status, err := c.do(ctx, "MKCALENDAR", url, "application/xml; charset=utf-8", body.Bytes())
+	if err != nil || status != http.StatusMethodNotAllowed {
+		return err
+	}
+	// 405: the calendar is already there.
+	body.Reset()
+	body.WriteString(xml.Header)
+	body.WriteString(`<D:propertyupdate xmlns:D="DAV:"><D:set><D:prop><D:displayname>`)
+	xml.EscapeText(&body, []byte(name))
+	body.WriteString(`</D:displayname></D:prop></D:set></D:propertyupdate>`)
+	_, err = c.do(ctx, "PROPPATCH", url, "application/xml; charset=utf-8", body.Bytes())
+	return err
+}
+
+// Put writes an iCalendar object to url.
+func (c Client) Put(ctx context.Context, url string, ics []byte) error {
+	_, err := c.do(ctx, http.MethodPut, url, "text/calendar; charset=utf-8", ics)
+	return err
+}
+
+// Delete removes the object at url; one that is already gone is not an
+// error.
+func (c Client) Delete(ctx context.Context, url string) error {
+	status, err := c.do(ctx, http.MethodDelete, url, "", nil)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// Verify checks the credential and that the collection exists.
+func (c Client) Verify(ctx context.Context) error {
+	body := []byte(xml.Header + `<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/></D:prop></D:propfind>`)
+	_, err := c.do(ctx, "PROPFIND", strings.TrimRight(c.URL, "/")+"/", "application/xml; charset=utf-8", body)
+	return err
+}
+
+// do sends a request and returns its status. It returns an error for
+// statuses of 300 and up, except 404 and 405, which callers check.
+func (c Client) do(ctx context.Context, method, url, contentType string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if method == "PROPFIND" {
+		req.Header.Set("Depth", "0")
+	}
+	if c.User != "" {
+		req.SetBasicAuth(c.User, c.Pass)
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusMethodNotAllowed {
+		return resp.StatusCode, &email.APIError{Provider: "CalDAV " + method, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(data))}
+	}
+	if resp.StatusCode == http.StatusNotFound && method != http.MethodDelete {
+		return resp.StatusCode, fmt.Errorf("CalDAV %s %s: not found", method, url)
+	}
+	return resp.StatusCode, nil
+}
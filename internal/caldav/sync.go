@@ -0,0 +1,249 @@
+package caldav
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"xf/internal/calendar"
+	"xf/internal/db"
+	"xf/internal/logging"
+)
+
+const (
+	defaultInterval = 15 * time.Minute
+	syncTimeout     = 10 * time.Minute
+	// timedLength is the length of the event of a subscription that
+	// expires at a time of day.
+	timedLength = 30 * time.Minute
+)
+
+// Count is what a sync changed on the server: events created, updated
+// and deleted.
+type Count struct {
+	Created, Updated, Deleted int
+}
+
+// Syncer keeps an event for every subscription's expiry on a CalDAV
+// server, in a calendar per product named after it. Publishing goes one
+// way: events edited on the server are overwritten when the subscription
+// changes.
+type Syncer struct {
+	Store    *db.Store
+	Client   Client
+	Interval time.Duration
+	// PublicURL, if set, links each event to the subscription's page.
+	PublicURL string
+	// Location is the zone of subscriptions whose customer has none.
+	Location *time.Location
+}
+
+// Start syncs in the background until ctx is cancelled.
+func (s Syncer) Start(ctx context.Context) {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if count, err := s.Sync(ctx, time.Now()); err != nil {
+				slog.Error("caldav sync error", "error", err)
+			} else if count != (Count{}) {
+				slog.Info("caldav synced", "created", count.Created, "updated", count.Updated, "deleted", count.Deleted)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Sync writes the events of new and changed subscriptions, creating their
+// product's calendar first, and deletes those of removed ones. It stops at
+// the first failed call; what was done is kept and the next sync carries
+// on.
+func (s Syncer) Sync(ctx context.Context, now time.Time) (Count, error) {
+	ctx, cancel := context.WithTimeout(ctx, syncTimeout)
+	defer cancel()
+	var count Count
+	links, err := s.Store.ListCalDAVEvents()
+	if err != nil {
+		return count, err
+	}
+	linked := map[int]db.CalDAVEvent{}
+	for _, link := range links {
+		linked[link.SubscriptionID] = link
+	}
+	subs, err := s.Store.ListSubscriptions()
+	if err != nil {
+		return count, err
+	}
+	byID := map[int]db.SubscriptionDetail{}
+	for _, sub := range subs {
+		byID[sub.ID] = sub
+	}
+
+	// Calendars are made or renamed once per sync, before the first
+	// event written to them.
+	ensured := map[int]bool{}
+	for _, sub := range subs {
+		calendarURL := s.Client.CalendarURL("xf-product-" + strconv.Itoa(sub.ProductID))
+		url := calendarURL + "xf-subscription-" + strconv.Itoa(sub.ID) + ".ics"
+		body, err := s.event(sub)
+		if err != nil {
+			logging.From(ctx).Warn("caldav event skipped", logging.SubscriptionID, sub.ID, "error", err)
+			continue
+		}
+		sum := sha256.Sum256([]byte(url + "\x00" + body))
+		hash := hex.EncodeToString(sum[:8])
+		link, ok := linked[sub.ID]
+		if ok && link.Hash == hash {
+			continue
+		}
+		if !ensured[sub.ProductID] {
+			if err := s.Client.EnsureCalendar(ctx, calendarURL, sub.ProductName); err != nil {
+				return count, err
+			}
+			ensured[sub.ProductID] = true
+		}
+		if ok && link.URL != url {
+			// The subscription moved to another product.
+			if err := s.Client.Delete(ctx, link.URL); err != nil {
+				return count, err
+			}
+		}
+		if err := s.Client.Put(ctx, url, []byte(withStamp(body, now))); err != nil {
+			return count, err
+		}
+		if ok {
+			count.Updated++
+		} else {
+			count.Created++
+		}
+		if err := s.Store.PutCalDAVEvent(db.CalDAVEvent{SubscriptionID: sub.ID, URL: url, Hash: hash}); err != nil {
+			return count, err
+		}
+	}
+
+	for id, link := range linked {
+		if _, ok := byID[id]; ok {
+			continue
+		}
+		if err := s.Client.Delete(ctx, link.URL); err != nil {
+			return count, err
+		}
+		if err := s.Store.DeleteCalDAVEvent(id); err != nil {
+			return count, err
+		}
+		count.Deleted++
+	}
+	return count, nil
+}
+
+// event returns the iCalendar object of the subscription's expiry, without
+// its DTSTAMP so that it hashes the same until the subscription changes:
+// an all-day event, or a short one at the time of day it expires.
+func (s Syncer) event(sub db.SubscriptionDetail) (string, error) {
+	var start, end string
+	if t, err := time.ParseInLocation("2006-01-02 15:04", sub.ExpiresAt, s.zone(sub)); err == nil {
+		start = "DTSTART:" + t.UTC().Format("20060102T150405Z")
+		end = "DTEND:" + t.Add(timedLength).UTC().Format("20060102T150405Z")
+	} else if day, err := time.Parse("2006-01-02", sub.ExpiresAt); err == nil {
+		start = "DTSTART;VALUE=DATE:" + day.Format("20060102")
+		end = "DTEND;VALUE=DATE:" + day.AddDate(0, 0, 1).Format("20060102")
+	} else {
+		return "", fmt.Errorf("invalid expiry %q", sub.ExpiresAt)
+	}
+	summary := fmt.Sprintf("%s 到期：%s", sub.ProductName, sub.CustomerName)
+	if sub.Kind == db.KindTrial {
+		summary += "（试用）"
+	}
+	lines := []string{
+		fmt.Sprintf("客户：%s <%s>", sub.CustomerName, sub.CustomerEmail),
+		"产品：" + sub.ProductName,
+		"到期：" + sub.ExpiresAt,
+	}
+	if sub.Note != "" {
+		lines = append(lines, "备注："+sub.Note)
+	}
+	var link string
+	if s.PublicURL != "" {
+		link = fmt.Sprintf("%s/subscriptions/%d", strings.TrimRight(s.PublicURL, "/"), sub.ID)
+		lines = append(lines, "详情："+link)
+	}
+	props := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//xf//subscription expiries//ZH",
+		"BEGIN:VEVENT",
+		fmt.Sprintf("UID:xf-subscription-%d", sub.ID),
+		start,
+		end,
+		"SUMMARY:" + escapeText(summary),
+		"DESCRIPTION:" + escapeText(strings.Join(lines, "\n")),
+	}
+	if link != "" {
+		props = append(props, "URL:"+link)
+	}
+	props = append(props, "TRANSP:TRANSPARENT", "END:VEVENT", "END:VCALENDAR")
+	var b strings.Builder
+	for _, prop := range props {
+		b.WriteString(fold(prop))
+		b.WriteString("\r\n")
+	}
+	return b.String(), nil
+}
+
+// withStamp adds the DTSTAMP that RFC 5545 requires of every event.
+func withStamp(body string, now time.Time) string {
+	return strings.Replace(body, "BEGIN:VEVENT\r\n", "BEGIN:VEVENT\r\nDTSTAMP:"+now.UTC().Format("20060102T150405Z")+"\r\n", 1)
+}
+
+// zone returns the customer's time zone, or Location if none is set.
+func (s Syncer) zone(sub db.SubscriptionDetail) *time.Location {
+	if sub.CustomerTimeZone != "" {
+		if loc, err := calendar.LoadZone(sub.CustomerTimeZone); err == nil {
+			return loc
+		}
+	}
+	if s.Location != nil {
+		return s.Location
+	}
+	return time.UTC
+}
+
+var textEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+func escapeText(value string) string {
+	return textEscaper.Replace(value)
+}
+
+// fold splits a content line into lines of at most 75 octets, without
+// breaking a UTF-8 sequence.
+func fold(line string) string {
+	var b strings.Builder
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		// The leading space counts toward the next line.
+		limit = 74
+	}
+	b.WriteString(line)
+	return b.String()
+}
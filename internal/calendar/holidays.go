@@ -0,0 +1,147 @@
+package calendar
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Holidays is a list of dates on which, like the weekend, no scheduled
+// reminders are sent.
+type Holidays []dateRange
+
+// ParseHolidays parses holidays in the same format as blackout dates: a
+// comma or newline separated list of single dates and "from~to" ranges.
+func ParseHolidays(input string) (Holidays, error) {
+	ranges, err := parseDateRanges(input)
+	if err != nil {
+		return nil, err
+	}
+	return Holidays(ranges), nil
+}
+
+func (h Holidays) Contains(t time.Time) bool {
+	day := t.Format(dateLayout)
+	for _, r := range h {
+		if r.contains(day) {
+			return true
+		}
+	}
+	return false
+}
+
+// OffDays combines the weekend and holidays.
+type OffDays struct {
+	Weekend  Weekend
+	Holidays Holidays
+}
+
+func (o OffDays) Contains(t time.Time) bool {
+	return o.Weekend.Contains(t) || o.Holidays.Contains(t)
+}
+
+// FollowingDays returns how many off days directly follow t, e.g. 2 for a
+// Friday with a Saturday/Sunday weekend, or 3 if Monday is a holiday too.
+func (o OffDays) FollowingDays(t time.Time) int {
+	n := 0
+	for o.Contains(t.AddDate(0, 0, n+1)) {
+		n++
+	}
+	return n
+}
+
+// ParseICS extracts the dates of every event in an iCalendar file and
+// returns them as ParseHolidays entries. All-day events use DTEND as the
+// exclusive end; timed events count for the day they start on.
+func ParseICS(r io.Reader) ([]string, error) {
+	lines, err := unfoldICS(r)
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	var start, end string
+	var allDay, inEvent bool
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		params := strings.Split(name, ";")
+		switch strings.ToUpper(params[0]) {
+		case "BEGIN":
+			if strings.EqualFold(value, "VEVENT") {
+				inEvent, start, end, allDay = true, "", "", false
+			}
+		case "DTSTART":
+			if inEvent {
+				start = value
+				allDay = len(value) == 8
+			}
+		case "DTEND":
+			if inEvent {
+				end = value
+			}
+		case "END":
+			if !strings.EqualFold(value, "VEVENT") || !inEvent {
+				continue
+			}
+			inEvent = false
+			entry, err := icsEntry(start, end, allDay)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func icsEntry(start, end string, allDay bool) (string, error) {
+	from, err := icsDate(start)
+	if err != nil {
+		return "", err
+	}
+	to := from
+	if allDay && end != "" {
+		last, err := icsDate(end)
+		if err != nil {
+			return "", err
+		}
+		if last = last.AddDate(0, 0, -1); last.After(from) {
+			to = last
+		}
+	}
+	if to.Equal(from) {
+		return from.Format(dateLayout), nil
+	}
+	return from.Format(dateLayout) + "~" + to.Format(dateLayout), nil
+}
+
+// icsDate reads the date part of an iCalendar DATE or DATE-TIME value.
+func icsDate(value string) (time.Time, error) {
+	if len(value) < 8 {
+		return time.Time{}, fmt.Errorf("无效的日历日期: %s", value)
+	}
+	t, err := time.Parse("20060102", value[:8])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("无效的日历日期: %s", value)
+	}
+	return t, nil
+}
+
+// unfoldICS joins continuation lines, which start with a space or tab.
+func unfoldICS(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,47 @@
+package calendar
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Weekend is the set of weekdays on which no reminders are sent.
+type Weekend map[time.Weekday]bool
+
+// ParseWeekend parses a comma separated list of ISO weekday numbers, where
+// 1 is Monday and 7 is Sunday, e.g. "6,7".
+func ParseWeekend(input string) (Weekend, error) {
+	weekend := Weekend{}
+	for _, part := range strings.Split(input, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 1 || n > 7 {
+			return nil, fmt.Errorf("无效的星期: %s", part)
+		}
+		weekend[time.Weekday(n%7)] = true
+	}
+	if len(weekend) == 7 {
+		return nil, fmt.Errorf("周末不能包含全部七天")
+	}
+	return weekend, nil
+}
+
+func (w Weekend) Contains(t time.Time) bool {
+	return w[t.Weekday()]
+}
+
+// String formats the weekend back into the ParseWeekend format.
+func (w Weekend) String() string {
+	var parts []string
+	for n := 1; n <= 7; n++ {
+		if w[time.Weekday(n%7)] {
+			parts = append(parts, strconv.Itoa(n))
+		}
+	}
+	return strings.Join(parts, ",")
+}
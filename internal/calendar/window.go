@@ -0,0 +1,111 @@
+package calendar
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// Window describes when outgoing email may be delivered: outside the daily
+// quiet hours and outside every blackout date range.
+type Window struct {
+	quietFrom int
+	quietTo   int
+	blackouts []dateRange
+}
+
+// dateRange is an inclusive range of YYYY-MM-DD dates.
+type dateRange struct {
+	from string
+	to   string
+}
+
+// ParseWindow parses quiet hours such as "22:00-08:00" (empty for none) and
+// a comma or newline separated list of blackout dates, where each entry is a
+// single date or a "2027-02-05~2027-02-12" range.
+func ParseWindow(quietHours, blackoutDates string) (Window, error) {
+	var w Window
+	quietHours = strings.TrimSpace(quietHours)
+	if quietHours != "" {
+		from, to, ok := strings.Cut(quietHours, "-")
+		if !ok {
+			return Window{}, fmt.Errorf("免打扰时段格式应为 22:00-08:00")
+		}
+		var err error
+		if w.quietFrom, err = parseClock(from); err != nil {
+			return Window{}, err
+		}
+		if w.quietTo, err = parseClock(to); err != nil {
+			return Window{}, err
+		}
+	}
+	blackouts, err := parseDateRanges(blackoutDates)
+	if err != nil {
+		return Window{}, err
+	}
+	w.blackouts = blackouts
+	return w, nil
+}
+
+// parseDateRanges parses a comma or newline separated list of single dates
+// and "from~to" ranges.
+func parseDateRanges(input string) ([]dateRange, error) {
+	var ranges []dateRange
+	entries := strings.FieldsFunc(input, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	})
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(entry, "~")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !isRange {
+			to = from
+		}
+		if _, err := time.Parse(dateLayout, from); err != nil {
+			return nil, fmt.Errorf("无效日期: %s", from)
+		}
+		if _, err := time.Parse(dateLayout, to); err != nil {
+			return nil, fmt.Errorf("无效日期: %s", to)
+		}
+		if to < from {
+			return nil, fmt.Errorf("日期范围无效: %s", entry)
+		}
+		ranges = append(ranges, dateRange{from: from, to: to})
+	}
+	return ranges, nil
+}
+
+func (d dateRange) contains(day string) bool {
+	return day >= d.from && day <= d.to
+}
+
+// Allows reports whether email may be sent at t, interpreted in t's location.
+func (w Window) Allows(t time.Time) bool {
+	day := t.Format(dateLayout)
+	for _, b := range w.blackouts {
+		if b.contains(day) {
+			return false
+		}
+	}
+	if w.quietFrom == w.quietTo {
+		return true
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if w.quietFrom < w.quietTo {
+		return minute < w.quietFrom || minute >= w.quietTo
+	}
+	return minute < w.quietFrom && minute >= w.quietTo
+}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("无效时间: %s", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,26 @@
+package calendar
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var zones sync.Map
+
+// LoadZone returns the IANA time zone with the given name, such as
+// "America/Los_Angeles". Zones are cached, since scans look one up for
+// every subscription.
+func LoadZone(name string) (*time.Location, error) {
+	name = strings.TrimSpace(name)
+	if loc, ok := zones.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "" || name == "Local" {
+		return nil, fmt.Errorf("无效时区: %s", name)
+	}
+	zones.Store(name, loc)
+	return loc, nil
+}
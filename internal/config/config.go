@@ -9,59 +9,418 @@ import (
 )
 
 type Config struct {
+	AppMode             string
+	AppEnv              string
 	Addr                string
+	DebugAddr           string
+	LogFormat           string
+	LogLevel            string
+	LogFile             string
+	LogMaxSizeMB        int
+	LogMaxAgeDays       int
+	LogMaxBackups       int
 	DatabasePath        string
 	CompanyName         string
+	PublicURL           string
+	WebhookToken        string
+	TrackOpens          bool
+	TrackClicks         bool
+	MailArchive         bool
 	ScanIntervalMinutes int
+	SendRetries         int
+	RetryBackoffSeconds int
+	OutboxKeepDays      int
+	SendConcurrency     int
+	SendRatePerMinute   int
+	SendTimeoutSeconds  int
+	AlertScanFailures   int
+	AlertSendFailures   int
+	AlertWebhookURL     string
+	AlertWebhookSecret  string
+	HeartbeatURL        string
 	TimeZone            *time.Location
 	AdminUser           string
 	AdminPass           string
+	AdminEmail          string
+	MailProvider        string
+	MailBCC             []string
+	MailHeaders         string
+	MailLimitPerMinute  int
+	MailLimitPerDay     int
+	SendGridAPIKey      string
+	MailgunDomain       string
+	MailgunAPIKey       string
+	MailgunRegion       string
+	SESRegion           string
+	SESAccessKeyID      string
+	SESSecretAccessKey  string
+	SESSessionToken     string
+	SESConfigurationSet string
+	PostmarkToken       string
+	PostmarkStream      string
 	SMTPHost            string
 	SMTPPort            int
 	SMTPUser            string
 	SMTPPass            string
 	SMTPFrom            string
+	SMTPReplyTo         string
+	SMTPEnvelopeFrom    string
+	SMTPEncryption      string
+	SMTPOAuthTokenURL   string
+	SMTPOAuthClientID   string
+	SMTPOAuthSecret     string
+	SMTPOAuthRefresh    string
+	SMTPOAuthScope      string
+	SMTP2Host           string
+	SMTP2Port           int
+	SMTP2User           string
+	SMTP2Pass           string
+	SMTP2From           string
+	SMTP2Encryption     string
+	SMTPFailoverAfter   int
+	DKIMDomain          string
+	DKIMSelector        string
+	DKIMKeyFile         string
+	IMAPHost            string
+	IMAPPort            int
+	IMAPUser            string
+	IMAPPass            string
+	IMAPMailbox         string
+	IMAPEncryption      string
+	BouncePollMinutes   int
+	TelegramBotToken    string
+	TelegramAdminChat   string
+	TelegramAPIURL      string
+	SlackWebhookURL     string
+	WeComCorpID         string
+	WeComAgentID        int
+	WeComSecret         string
+	WeComToUser         string
+	WeComAPIURL         string
+	DingTalkWebhookURL  string
+	DingTalkSecret      string
+	FeishuWebhookURL    string
+	FeishuSecret        string
+	MatrixHomeserver    string
+	MatrixToken         string
+	MatrixRoomID        string
+	SMSProvider         string
+	TwilioSID           string
+	TwilioToken         string
+	TwilioFrom          string
+	AliyunKeyID         string
+	AliyunKeySecret     string
+	AliyunSignName      string
+	AliyunTemplate      string
+	SMSAPIURL           string
+	PushProvider        string
+	PushURL             string
+	PushToken           string
+	StripeSecretKey     string
+	StripeWebhookSecret string
+	StripeAPIURL        string
+	WHMCSURL            string
+	WHMCSIdentifier     string
+	WHMCSSecret         string
+	WHMCSAccessKey      string
+	WHMCSSyncMinutes    int
+	GoogleCalendarID    string
+	GoogleClientID      string
+	GoogleClientSecret  string
+	GoogleRefreshToken  string
+	GoogleSyncMinutes   int
+	GoogleAPIURL        string
+	CalDAVURL           string
+	CalDAVUser          string
+	CalDAVPass          string
+	CalDAVSyncMinutes   int
+	DomainSyncHours     int
+	RDAPBootstrapURL    string
+	WHOISServer         string
+	CertCheckHours      int
+	LDAPURL             string
+	LDAPBindDN          string
+	LDAPBindPass        string
+	LDAPBaseDN          string
+	LDAPFilter          string
+	LDAPStartTLS        bool
+	LDAPOUTags          []string
+	LDAPSyncMinutes     int
+	BackupURL           string
+	BackupKey           string
+	BackupHours         int
+	BackupKeep          int
+	BackupS3Endpoint    string
+	BackupS3Region      string
+	BackupS3AccessKeyID string
+	BackupS3SecretKey   string
+	ReplyIMAPHost       string
+	ReplyIMAPPort       int
+	ReplyIMAPUser       string
+	ReplyIMAPPass       string
+	ReplyIMAPMailbox    string
+	ReplyIMAPEncryption string
+	ReplyPollMinutes    int
+	ReplyKeywords       []string
 }
 
-func Load() (Config, error) {
+// Load reads the configuration from the environment, falling back to the
+// YAML or TOML file at path, if any, for variables that are unset.
+// overrides, keyed by variable name, take precedence over both; they come
+// from command-line flags. Every problem found is reported at once, as a
+// *ValidationError.
+func Load(path string, overrides map[string]string) (Config, error) {
+	fileValues, fileKeys, lookupProblems = nil, map[string]bool{}, nil
+	overrideValues = overrides
+	if path != "" {
+		values, err := readFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("config file: %w", err)
+		}
+		fileValues = values
+	}
 	cfg := Config{
+		AppMode:             strings.ToLower(getEnv("APP_MODE", "all")),
+		AppEnv:              strings.ToLower(getEnv("APP_ENV", "development")),
 		Addr:                getEnv("APP_ADDR", ":8080"),
+		DebugAddr:           getEnv("DEBUG_ADDR", ""),
+		LogFormat:           strings.ToLower(getEnv("LOG_FORMAT", "text")),
+		LogLevel:            strings.ToLower(getEnv("LOG_LEVEL", "info")),
+		LogFile:             getEnv("LOG_FILE", ""),
+		LogMaxSizeMB:        getEnvInt("LOG_MAX_SIZE_MB", 10),
+		LogMaxAgeDays:       getEnvInt("LOG_MAX_AGE_DAYS", 30),
+		LogMaxBackups:       getEnvInt("LOG_MAX_BACKUPS", 5),
 		DatabasePath:        getEnv("DATABASE_PATH", "./data/panel.db"),
 		CompanyName:         getEnv("COMPANY_NAME", "YourCompany"),
+		PublicURL:           strings.TrimRight(getEnv("PUBLIC_URL", ""), "/"),
+		WebhookToken:        getEnv("WEBHOOK_TOKEN", ""),
+		TrackOpens:          getEnv("TRACK_OPENS", "false") == "true",
+		TrackClicks:         getEnv("TRACK_CLICKS", "false") == "true",
+		MailArchive:         getEnv("MAIL_ARCHIVE", "true") == "true",
 		ScanIntervalMinutes: getEnvInt("SCAN_INTERVAL_MINUTES", 15),
+		SendRetries:         getEnvInt("SEND_RETRIES", 3),
+		RetryBackoffSeconds: getEnvInt("SEND_RETRY_BACKOFF_SECONDS", 10),
+		OutboxKeepDays:      getEnvInt("OUTBOX_KEEP_DAYS", 30),
+		SendConcurrency:     getEnvInt("SEND_CONCURRENCY", 2),
+		SendRatePerMinute:   getEnvInt("SEND_RATE_PER_MINUTE", 0),
+		SendTimeoutSeconds:  getEnvInt("SEND_TIMEOUT_SECONDS", 60),
+		AlertScanFailures:   getEnvInt("ALERT_SCAN_FAILURES", 0),
+		AlertSendFailures:   getEnvInt("ALERT_SEND_FAILURES", 0),
+		AlertWebhookURL:     getEnv("ALERT_WEBHOOK_URL", ""),
+		AlertWebhookSecret:  getEnv("ALERT_WEBHOOK_SECRET", ""),
+		HeartbeatURL:        getEnv("HEARTBEAT_URL", ""),
 		AdminUser:           getEnv("ADMIN_USER", "admin"),
 		AdminPass:           getEnv("ADMIN_PASS", "admin123"),
+		AdminEmail:          getEnv("ADMIN_EMAIL", ""),
+		MailProvider:        strings.ToLower(getEnv("MAIL_PROVIDER", "smtp")),
+		MailBCC:             getEnvList("MAIL_BCC"),
+		MailHeaders:         getEnv("MAIL_HEADERS", ""),
+		MailLimitPerMinute:  getEnvInt("MAIL_LIMIT_PER_MINUTE", 0),
+		MailLimitPerDay:     getEnvInt("MAIL_LIMIT_PER_DAY", 0),
+		SendGridAPIKey:      getEnv("SENDGRID_API_KEY", ""),
+		MailgunDomain:       getEnv("MAILGUN_DOMAIN", ""),
+		MailgunAPIKey:       getEnv("MAILGUN_API_KEY", ""),
+		MailgunRegion:       strings.ToLower(getEnv("MAILGUN_REGION", "us")),
+		SESRegion:           getEnv("SES_REGION", getEnv("AWS_REGION", "")),
+		SESAccessKeyID:      getEnv("AWS_ACCESS_KEY_ID", ""),
+		SESSecretAccessKey:  getEnv("AWS_SECRET_ACCESS_KEY", ""),
+		SESSessionToken:     getEnv("AWS_SESSION_TOKEN", ""),
+		SESConfigurationSet: getEnv("SES_CONFIGURATION_SET", ""),
+		PostmarkToken:       getEnv("POSTMARK_SERVER_TOKEN", ""),
+		PostmarkStream:      getEnv("POSTMARK_MESSAGE_STREAM", ""),
 		SMTPHost:            getEnv("SMTP_HOST", ""),
 		SMTPPort:            getEnvInt("SMTP_PORT", 587),
 		SMTPUser:            getEnv("SMTP_USER", ""),
 		SMTPPass:            getEnv("SMTP_PASS", ""),
 		SMTPFrom:            getEnv("SMTP_FROM", ""),
+		SMTPReplyTo:         getEnv("SMTP_REPLY_TO", ""),
+		SMTPEnvelopeFrom:    getEnv("SMTP_ENVELOPE_FROM", ""),
+		SMTPEncryption:      strings.ToLower(getEnv("SMTP_ENCRYPTION", "")),
+		SMTPOAuthTokenURL:   getEnv("SMTP_OAUTH_TOKEN_URL", ""),
+		SMTPOAuthClientID:   getEnv("SMTP_OAUTH_CLIENT_ID", ""),
+		SMTPOAuthSecret:     getEnv("SMTP_OAUTH_CLIENT_SECRET", ""),
+		SMTPOAuthRefresh:    getEnv("SMTP_OAUTH_REFRESH_TOKEN", ""),
+		SMTPOAuthScope:      getEnv("SMTP_OAUTH_SCOPE", ""),
+		SMTP2Host:           getEnv("SMTP_SECONDARY_HOST", ""),
+		SMTP2Port:           getEnvInt("SMTP_SECONDARY_PORT", 587),
+		SMTP2User:           getEnv("SMTP_SECONDARY_USER", ""),
+		SMTP2Pass:           getEnv("SMTP_SECONDARY_PASS", ""),
+		SMTP2From:           getEnv("SMTP_SECONDARY_FROM", getEnv("SMTP_FROM", "")),
+		SMTP2Encryption:     strings.ToLower(getEnv("SMTP_SECONDARY_ENCRYPTION", "")),
+		SMTPFailoverAfter:   getEnvInt("SMTP_FAILOVER_AFTER", 3),
+		DKIMDomain:          getEnv("DKIM_DOMAIN", ""),
+		DKIMSelector:        getEnv("DKIM_SELECTOR", ""),
+		DKIMKeyFile:         getEnv("DKIM_PRIVATE_KEY_FILE", ""),
+		IMAPHost:            getEnv("IMAP_HOST", ""),
+		IMAPPort:            getEnvInt("IMAP_PORT", 993),
+		IMAPUser:            getEnv("IMAP_USER", ""),
+		IMAPPass:            getEnv("IMAP_PASS", ""),
+		IMAPMailbox:         getEnv("IMAP_MAILBOX", "INBOX"),
+		IMAPEncryption:      strings.ToLower(getEnv("IMAP_ENCRYPTION", "tls")),
+		BouncePollMinutes:   getEnvInt("BOUNCE_POLL_MINUTES", 10),
+		TelegramBotToken:    getEnv("TELEGRAM_BOT_TOKEN", ""),
+		TelegramAdminChat:   getEnv("TELEGRAM_ADMIN_CHAT_ID", ""),
+		TelegramAPIURL:      strings.TrimRight(getEnv("TELEGRAM_API_URL", ""), "/"),
+		SlackWebhookURL:     getEnv("SLACK_WEBHOOK_URL", ""),
+		WeComCorpID:         getEnv("WECOM_CORP_ID", ""),
+		WeComAgentID:        getEnvInt("WECOM_AGENT_ID", 0),
+		WeComSecret:         getEnv("WECOM_SECRET", ""),
+		WeComToUser:         getEnv("WECOM_TO_USER", "@all"),
+		WeComAPIURL:         strings.TrimRight(getEnv("WECOM_API_URL", ""), "/"),
+		DingTalkWebhookURL:  getEnv("DINGTALK_WEBHOOK_URL", ""),
+		DingTalkSecret:      getEnv("DINGTALK_SECRET", ""),
+		FeishuWebhookURL:    getEnv("FEISHU_WEBHOOK_URL", ""),
+		FeishuSecret:        getEnv("FEISHU_SECRET", ""),
+		MatrixHomeserver:    strings.TrimRight(getEnv("MATRIX_HOMESERVER_URL", ""), "/"),
+		MatrixToken:         getEnv("MATRIX_ACCESS_TOKEN", ""),
+		MatrixRoomID:        getEnv("MATRIX_ROOM_ID", ""),
+		SMSProvider:         strings.ToLower(getEnv("SMS_PROVIDER", "")),
+		TwilioSID:           getEnv("TWILIO_ACCOUNT_SID", ""),
+		TwilioToken:         getEnv("TWILIO_AUTH_TOKEN", ""),
+		TwilioFrom:          getEnv("TWILIO_FROM", ""),
+		AliyunKeyID:         getEnv("ALIYUN_ACCESS_KEY_ID", ""),
+		AliyunKeySecret:     getEnv("ALIYUN_ACCESS_KEY_SECRET", ""),
+		AliyunSignName:      getEnv("ALIYUN_SMS_SIGN_NAME", ""),
+		AliyunTemplate:      getEnv("ALIYUN_SMS_TEMPLATE_CODE", ""),
+		SMSAPIURL:           strings.TrimRight(getEnv("SMS_API_URL", ""), "/"),
+		PushProvider:        strings.ToLower(getEnv("PUSH_PROVIDER", "")),
+		PushURL:             getEnv("PUSH_URL", ""),
+		PushToken:           getEnv("PUSH_TOKEN", ""),
+		StripeSecretKey:     getEnv("STRIPE_SECRET_KEY", ""),
+		StripeWebhookSecret: getEnv("STRIPE_WEBHOOK_SECRET", ""),
+		StripeAPIURL:        strings.TrimRight(getEnv("STRIPE_API_URL", ""), "/"),
+		WHMCSURL:            strings.TrimRight(getEnv("WHMCS_URL", ""), "/"),
+		WHMCSIdentifier:     getEnv("WHMCS_IDENTIFIER", ""),
+		WHMCSSecret:         getEnv("WHMCS_SECRET", ""),
+		WHMCSAccessKey:      getEnv("WHMCS_ACCESS_KEY", ""),
+		WHMCSSyncMinutes:    getEnvInt("WHMCS_SYNC_MINUTES", 60),
+		GoogleCalendarID:    getEnv("GOOGLE_CALENDAR_ID", ""),
+		GoogleClientID:      getEnv("GOOGLE_CLIENT_ID", ""),
+		GoogleClientSecret:  getEnv("GOOGLE_CLIENT_SECRET", ""),
+		GoogleRefreshToken:  getEnv("GOOGLE_REFRESH_TOKEN", ""),
+		GoogleSyncMinutes:   getEnvInt("GOOGLE_CALENDAR_SYNC_MINUTES", 15),
+		GoogleAPIURL:        strings.TrimRight(getEnv("GOOGLE_API_URL", ""), "/"),
+		CalDAVURL:           getEnv("CALDAV_URL", ""),
+		CalDAVUser:          getEnv("CALDAV_USER", ""),
+		CalDAVPass:          getEnv("CALDAV_PASS", ""),
+		CalDAVSyncMinutes:   getEnvInt("CALDAV_SYNC_MINUTES", 15),
+		DomainSyncHours:     getEnvInt("DOMAIN_SYNC_HOURS", 24),
+		RDAPBootstrapURL:    getEnv("RDAP_BOOTSTRAP_URL", ""),
+		WHOISServer:         getEnv("WHOIS_SERVER", ""),
+		CertCheckHours:      getEnvInt("CERT_CHECK_HOURS", 12),
+		LDAPURL:             getEnv("LDAP_URL", ""),
+		LDAPBindDN:          getEnv("LDAP_BIND_DN", ""),
+		LDAPBindPass:        getEnv("LDAP_BIND_PASS", ""),
+		LDAPBaseDN:          getEnv("LDAP_BASE_DN", ""),
+		LDAPFilter:          getEnv("LDAP_FILTER", "(mail=*)"),
+		LDAPStartTLS:        getEnv("LDAP_START_TLS", "false") == "true",
+		LDAPOUTags:          getEnvList("LDAP_OU_TAGS"),
+		LDAPSyncMinutes:     getEnvInt("LDAP_SYNC_MINUTES", 60),
+		BackupURL:           getEnv("BACKUP_URL", ""),
+		BackupKey:           getEnv("BACKUP_KEY", ""),
+		BackupHours:         getEnvInt("BACKUP_HOURS", 24),
+		BackupKeep:          getEnvInt("BACKUP_KEEP", 14),
+		BackupS3Endpoint:    getEnv("BACKUP_S3_ENDPOINT", ""),
+		BackupS3Region:      getEnv("BACKUP_S3_REGION", "us-east-1"),
+		BackupS3AccessKeyID: getEnv("BACKUP_S3_ACCESS_KEY_ID", ""),
+		BackupS3SecretKey:   getEnv("BACKUP_S3_SECRET_ACCESS_KEY", ""),
+		ReplyIMAPHost:       getEnv("REPLY_IMAP_HOST", ""),
+		ReplyIMAPPort:       getEnvInt("REPLY_IMAP_PORT", 993),
+		ReplyIMAPUser:       getEnv("REPLY_IMAP_USER", ""),
+		ReplyIMAPPass:       getEnv("REPLY_IMAP_PASS", ""),
+		ReplyIMAPMailbox:    getEnv("REPLY_IMAP_MAILBOX", "INBOX"),
+		ReplyIMAPEncryption: strings.ToLower(getEnv("REPLY_IMAP_ENCRYPTION", "tls")),
+		ReplyPollMinutes:    getEnvInt("REPLY_POLL_MINUTES", 10),
+		ReplyKeywords:       getEnvList("REPLY_KEYWORDS"),
 	}
 
 	tzName := getEnv("TZ", "Asia/Shanghai")
-	loc, err := time.LoadLocation(tzName)
+	return cfg, cfg.validate(tzName)
+}
+
+// smtpEncryption validates an encryption mode, defaulting to implicit TLS
+// on port 465, the SMTPS convention, and STARTTLS on any other port.
+func smtpEncryption(key, value string, port int) (string, error) {
+	switch value {
+	case "":
+		if port == 465 {
+			return "tls", nil
+		}
+		return "starttls", nil
+	case "none", "starttls", "tls":
+		return value, nil
+	}
+	return value, fmt.Errorf("invalid %s %q: want none, starttls or tls", key, value)
+}
+
+// lookup returns the environment variable, or the config file value when
+// it is unset or empty. Either may name a file holding the value instead,
+// as KEY_FILE, for Docker and Kubernetes secrets.
+func lookup(key string) string {
+	fileKeys[key] = true
+	fileKeys[key+"_FILE"] = true
+	if val, ok := overrideValues[key]; ok {
+		return val
+	}
+	if val := os.Getenv(key); strings.TrimSpace(val) != "" {
+		if os.Getenv(key+"_FILE") != "" {
+			lookupProblems = append(lookupProblems, fmt.Sprintf("both %s and %s_FILE are set", key, key))
+		}
+		return val
+	}
+	if path := strings.TrimSpace(os.Getenv(key + "_FILE")); path != "" {
+		return readSecret(key, path)
+	}
+	if val := fileValues[key]; strings.TrimSpace(val) != "" {
+		if fileValues[key+"_FILE"] != "" {
+			lookupProblems = append(lookupProblems, fmt.Sprintf("config file: both %s and %s_FILE are set", key, key))
+		}
+		return val
+	}
+	if path := strings.TrimSpace(fileValues[key+"_FILE"]); path != "" {
+		return readSecret(key, path)
+	}
+	return ""
+}
+
+// readSecret reads a KEY_FILE value, dropping the trailing newline editors
+// and "echo" leave. A failure is kept in lookupProblems for Load to report.
+func readSecret(key, path string) string {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return cfg, fmt.Errorf("invalid TZ %q: %w", tzName, err)
+		lookupProblems = append(lookupProblems, fmt.Sprintf("%s_FILE: %v", key, err))
+		return ""
 	}
-	cfg.TimeZone = loc
-	return cfg, nil
+	return strings.TrimRight(string(data), "\r\n")
 }
 
 func getEnv(key, fallback string) string {
-	val := strings.TrimSpace(os.Getenv(key))
+	val := strings.TrimSpace(lookup(key))
 	if val == "" {
 		return fallback
 	}
 
 }
 
+// getEnvList splits a comma-separated variable, dropping empty entries.
+func getEnvList(key string) []string {
+	var out []string
+	for _, field := range strings.Split(lookup(key), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			out = append(out, field)
+		}
+	}
+	return out
+}
+
 func getEnvInt(key string, fallback int) int {
-	val := strings.TrimSpace(os.Getenv(key))
+	val := strings.TrimSpace(lookup(key))
 	if val == "" {
 		return fallback
 	}
 
 	if err != nil {
+		lookupProblems = append(lookupProblems, fmt.Sprintf("%s=%q is not a whole number", key, val))
 		return fallback
 	}
 	return parsed
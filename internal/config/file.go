@@ -0,0 +1,231 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// fileValues holds the settings read from the config file, keyed by the
+// environment variable they stand for. Environment variables override them.
+// fileKeys records the variables Load looked up, to reject unknown keys.
+// overrideValues are the values passed to Load, which win over both.
+// lookupProblems records settings that could not be read: conflicting or
+// unreadable KEY_FILE settings and numbers that don't parse.
+var (
+	fileValues     map[string]string
+	fileKeys       map[string]bool
+	overrideValues map[string]string
+	lookupProblems []string
+)
+
+// readFile loads a YAML or TOML config file, chosen by extension. Both use
+// the environment variable names as keys, either flat or nested one table
+// per prefix:
+//
+//	smtp_host: mail.example.com    # or SMTP_HOST
+//	smtp:
+//	  port: 465                    # SMTP_PORT
+//
+// Only the subset needed for that is supported: string, number and boolean
+// values, and lists, which become the comma-separated form the variables use.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]string
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		values, err = parseYAML(string(data))
+	case ".toml":
+		values, err = parseTOML(string(data))
+	default:
+		return nil, fmt.Errorf("unsupported config file type %q: want .yaml, .yml or .toml", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+// fileKey joins nested key names into the environment variable name.
+func fileKey(parts []string) string {
+	key := strings.Join(parts, "_")
+	return strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+func parseYAML(src string) (map[string]string, error) {
+	values := map[string]string{}
+	type level struct {
+		indent int
+		key    string
+	}
+	var stack []level
+	var list []string
+	listKey := ""
+	flush := func() {
+		if len(list) > 0 {
+			values[listKey] = strings.Join(list, ",")
+		}
+		listKey, list = "", nil
+	}
+	for n, line := range strings.Split(src, "\n") {
+		line = strings.TrimRight(stripComment(line), " \t\r")
+		content := strings.TrimLeft(line, " ")
+		if content == "" || content == "---" {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", n+1)
+		}
+		indent := len(line) - len(content)
+		if item, ok := strings.CutPrefix(content, "- "); ok || content == "-" {
+			if listKey == "" {
+				return nil, fmt.Errorf("line %d: list item outside a list", n+1)
+			}
+			if value := yamlScalar(item); value != "" {
+				list = append(list, value)
+			}
+			continue
+		}
+		flush()
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		name, value, ok := strings.Cut(content, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("line %d: want key: value", n+1)
+		}
+		parts := []string{}
+		for _, l := range stack {
+			parts = append(parts, l.key)
+		}
+		name = strings.Trim(strings.TrimSpace(name), `"'`)
+		key := fileKey(append(parts, name))
+		value = strings.TrimSpace(value)
+		switch {
+		case value == "":
+			// Either a nested table or a block list follows.
+			stack = append(stack, level{indent: indent, key: name})
+			listKey = key
+		case strings.HasPrefix(value, "["):
+			items, err := inlineList(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n+1, err)
+			}
+			values[key] = items
+		default:
+			values[key] = yamlScalar(value)
+		}
+	}
+	flush()
+	return values, nil
+}
+
+func parseTOML(src string) (map[string]string, error) {
+	values := map[string]string{}
+	var table []string
+	for n, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: invalid table header", n+1)
+			}
+			table = strings.Split(strings.Trim(line, "[] "), ".")
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("line %d: want key = value", n+1)
+		}
+		key := fileKey(append(append([]string{}, table...), strings.Trim(strings.TrimSpace(name), `"'`)))
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, "[") {
+			items, err := inlineList(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n+1, err)
+			}
+			values[key] = items
+			continue
+		}
+		value, err := tomlScalar(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// yamlScalar unquotes a YAML value. Double-quoted strings take Go-style
+// escapes; single-quoted ones write a quote as two.
+func yamlScalar(value string) string {
+	switch {
+	case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+		if s, err := strconv.Unquote(value); err == nil {
+			return s
+		}
+		return value[1 : len(value)-1]
+	case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+	}
+	return value
+}
+
+// tomlScalar unquotes a TOML string; numbers and booleans are kept as
+// written.
+func tomlScalar(value string) (string, error) {
+	switch {
+	case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+		s, err := strconv.Unquote(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", value)
+		}
+		return s, nil
+	case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+		return value[1 : len(value)-1], nil
+	case strings.ContainsAny(value, `"'`):
+		return "", fmt.Errorf("invalid value %s", value)
+	}
+	return value, nil
+}
+
+// inlineList turns a one-line [a, "b"] list into "a,b".
+func inlineList(value string) (string, error) {
+	if !strings.HasSuffix(value, "]") {
+		return "", fmt.Errorf("lists must be on one line")
+	}
+	var items []string
+	for _, item := range strings.Split(value[1:len(value)-1], ",") {
+		if item = yamlScalar(strings.TrimSpace(item)); item != "" {
+			items = append(items, item)
+		}
+	}
+	return strings.Join(items, ","), nil
+}
+
+// stripComment drops a # comment that is not inside a quoted string.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
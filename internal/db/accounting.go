@@ -0,0 +1,54 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// AccountingExport is how renewals are written for the accounting tool.
+// Columns holds one "Header=field" per line; Delimiter is ",", ";" or
+// "tab"; Encoding "utf-8" leaves out the byte order mark Excel needs to
+// read UTF-8.
+type AccountingExport struct {
+	Columns    string `json:"columns"`
+	Delimiter  string `json:"delimiter"`
+	DateFormat string `json:"date_format"`
+	Encoding   string `json:"encoding"`
+}
+
+func (s *Store) GetAccountingExport() (AccountingExport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var export AccountingExport
+	if value, ok := s.data.Settings["accounting_export"]; ok {
+		if err := json.Unmarshal([]byte(value), &export); err != nil {
+			return AccountingExport{}, err
+		}
+	}
+	return export, nil
+}
+
+func (s *Store) UpdateAccountingExport(export AccountingExport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload, err := json.Marshal(export)
+	if err != nil {
+		return err
+	}
+	s.data.Settings["accounting_export"] = string(payload)
+	return s.saveLocked()
+}
+
+// ListRenewalsBetween returns every subscription's renewals logged from
+// from to to inclusive, oldest first.
+func (s *Store) ListRenewalsBetween(from, to time.Time) ([]Renewal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Renewal
+	for _, r := range s.data.Renewals {
+		if at, err := time.Parse(time.RFC3339, r.At); err == nil && !at.Before(from) && !at.After(to) {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Sent messages are archived as "<path>.archive/<reference>.eml" beside the
+// data file, where reference is the send log entry's Reference.
+
+// ArchiveMessage stores the raw message sent under reference.
+func (s *Store) ArchiveMessage(reference string, raw []byte) error {
+	path, err := s.archivePath(reference)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, raw, 0o644)
+}
+
+// ReadArchivedMessage returns the raw message sent under reference,
+// reporting false if none was archived.
+func (s *Store) ReadArchivedMessage(reference string) ([]byte, bool, error) {
+	path, err := s.archivePath(reference)
+	if err != nil {
+		return nil, false, nil
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return raw, true, nil
+}
+
+// archivePath maps a reference to its file, refusing anything but the hex
+// references the queue generates.
+func (s *Store) archivePath(reference string) (string, error) {
+	if reference == "" {
+		return "", fmt.Errorf("empty archive reference")
+	}
+	for _, c := range reference {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return "", fmt.Errorf("invalid archive reference %q", reference)
+		}
+	}
+	return filepath.Join(s.path+".archive", reference+".eml"), nil
+}
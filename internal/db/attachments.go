@@ -0,0 +1,163 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Attachment is an uploaded file sent along with emails. ProductID ties it
+// to every reminder and renewal confirmation for that product's
+// subscriptions; zero means it was uploaded for a single send. The content
+// lives in "<path>.attachments/<id>" beside the data file so the JSON
+// snapshot stays small.
+type Attachment struct {
+	ID          int    `json:"id"`
+	ProductID   int    `json:"product_id"`
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	CreatedAt   string `json:"created_at"`
+}
+
+const logoSettingKey = "logo_attachment_id"
+
+// SaveAttachment stores the file and returns its record.
+func (s *Store) SaveAttachment(productID int, name, contentType string, data []byte, now time.Time) (Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if productID != 0 {
+		if _, ok := s.findProduct(productID); !ok {
+			return Attachment{}, fmt.Errorf("产品不存在")
+		}
+	}
+	att := Attachment{
+		ID:          s.nextAttachmentID(),
+		ProductID:   productID,
+		Name:        name,
+		ContentType: contentType,
+		Size:        len(data),
+		CreatedAt:   now.Format(time.RFC3339),
+	}
+	if err := os.MkdirAll(s.attachmentDir(), 0o755); err != nil {
+		return Attachment{}, err
+	}
+	if err := os.WriteFile(s.attachmentPath(att.ID), data, 0o644); err != nil {
+		return Attachment{}, err
+	}
+	s.data.Attachments = append(s.data.Attachments, att)
+	if err := s.saveLocked(); err != nil {
+		os.Remove(s.attachmentPath(att.ID))
+		return Attachment{}, err
+	}
+	return att, nil
+}
+
+// ListProductAttachments returns the files attached to a product's emails.
+func (s *Store) ListProductAttachments(productID int) ([]Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Attachment
+	for _, att := range s.data.Attachments {
+		if att.ProductID == productID && productID != 0 {
+			out = append(out, att)
+		}
+	}
+	return out, nil
+}
+
+// ReadAttachment returns the record and content of an attachment, reporting
+// false if it has since been deleted.
+func (s *Store) ReadAttachment(id int) (Attachment, []byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, att := range s.data.Attachments {
+		if att.ID != id {
+			continue
+		}
+		data, err := os.ReadFile(s.attachmentPath(id))
+		if errors.Is(err, os.ErrNotExist) {
+			return Attachment{}, nil, false, nil
+		}
+		if err != nil {
+			return Attachment{}, nil, false, err
+		}
+		return att, data, true, nil
+	}
+	return Attachment{}, nil, false, nil
+}
+
+// SetLogo makes the attachment the company logo embedded in emails,
+// deleting the previous logo file.
+func (s *Store) SetLogo(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, _ := strconv.Atoi(s.data.Settings[logoSettingKey])
+	s.data.Settings[logoSettingKey] = strconv.Itoa(id)
+	if previous == 0 || previous == id {
+		return s.saveLocked()
+	}
+	return s.deleteAttachmentsLocked(func(att Attachment) bool { return att.ID == previous })
+}
+
+// GetLogo returns the company logo, reporting false if none is set.
+func (s *Store) GetLogo() (Attachment, []byte, bool, error) {
+	s.mu.Lock()
+	id, _ := strconv.Atoi(s.data.Settings[logoSettingKey])
+	s.mu.Unlock()
+	if id == 0 {
+		return Attachment{}, nil, false, nil
+	}
+	return s.ReadAttachment(id)
+}
+
+// DeleteLogo removes the company logo.
+func (s *Store) DeleteLogo() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, _ := strconv.Atoi(s.data.Settings[logoSettingKey])
+	delete(s.data.Settings, logoSettingKey)
+	return s.deleteAttachmentsLocked(func(att Attachment) bool { return att.ID == id })
+}
+
+func (s *Store) DeleteAttachment(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deleteAttachmentsLocked(func(att Attachment) bool { return att.ID == id })
+}
+
+func (s *Store) deleteAttachmentsLocked(match func(Attachment) bool) error {
+	var kept []Attachment
+	for _, att := range s.data.Attachments {
+		if !match(att) {
+			kept = append(kept, att)
+			continue
+		}
+		if err := os.Remove(s.attachmentPath(att.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	s.data.Attachments = kept
+	return s.saveLocked()
+}
+
+func (s *Store) attachmentDir() string {
+	return s.path + ".attachments"
+}
+
+func (s *Store) attachmentPath(id int) string {
+	return filepath.Join(s.attachmentDir(), strconv.Itoa(id))
+}
+
+func (s *Store) nextAttachmentID() int {
+	max := 0
+	for _, a := range s.data.Attachments {
+		if a.ID > max {
+			max = a.ID
+		}
+	}
+	return max + 1
+}
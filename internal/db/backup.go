@@ -0,0 +1,60 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// BackupStatus is the outcome of the off-site backups: the last archive
+// uploaded and, if the latest attempt failed, when and why.
+type BackupStatus struct {
+	LastAt   string `json:"last_at,omitempty"`
+	LastName string `json:"last_name,omitempty"`
+	LastSize int64  `json:"last_size,omitempty"`
+	ErrorAt  string `json:"error_at,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (s *Store) GetBackupStatus() (BackupStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var status BackupStatus
+	if value, ok := s.data.Settings["backup"]; ok {
+		if err := json.Unmarshal([]byte(value), &status); err != nil {
+			return BackupStatus{}, err
+		}
+	}
+	return status, nil
+}
+
+// RecordBackup notes an upload of name, or with err set a failed attempt;
+// a success clears the error.
+func (s *Store) RecordBackup(name string, size int64, err error, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var status BackupStatus
+	if value, ok := s.data.Settings["backup"]; ok {
+		json.Unmarshal([]byte(value), &status)
+	}
+	if err != nil {
+		status.ErrorAt, status.Error = now.UTC().Format(time.RFC3339), err.Error()
+	} else {
+		status = BackupStatus{LastAt: now.UTC().Format(time.RFC3339), LastName: name, LastSize: size}
+	}
+	payload, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	s.data.Settings["backup"] = string(payload)
+	return s.saveLocked()
+}
+
+// FileDirs returns the directories beside the data file that Export leaves
+// out, keyed by the name a backup stores them under: the attachment
+// contents and the archived messages.
+func (s *Store) FileDirs() map[string]string {
+	return map[string]string{
+		"attachments": s.attachmentDir(),
+		"archive":     s.path + ".archive",
+	}
+}
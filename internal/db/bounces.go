@@ -0,0 +1,129 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RecordBounce applies a non-delivery report for address: the most recent
+// send to it in the history is marked bounced with reason, and customers
+// using it as their email are flagged as bouncing. It reports whether
+// either matched.
+func (s *Store) RecordBounce(address, reason string, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	matched := false
+	for i := len(s.data.Deliveries) - 1; i >= 0; i-- {
+		d := &s.data.Deliveries[i]
+		if d.Status == DeliverySent && strings.EqualFold(d.To, address) {
+			d.Status = DeliveryBounced
+			d.Error = reason
+			matched = true
+			break
+		}
+	}
+	if s.flagBouncingLocked(address, reason, now) {
+		matched = true
+	}
+	if !matched {
+		return false, nil
+	}
+	return true, s.saveLocked()
+}
+
+// FlagInvalidAddress flags customers using address as bouncing after the
+// mail server refused it outright, without touching the send history. It
+// reports whether any customer matched.
+func (s *Store) FlagInvalidAddress(address, reason string, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.flagBouncingLocked(address, reason, now) {
+		return false, nil
+	}
+	return true, s.saveLocked()
+}
+
+// ClearCustomerBounce removes the bouncing flag, e.g. after the customer
+// confirmed the address works again.
+func (s *Store) ClearCustomerBounce(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, c := range s.data.Customers {
+		if c.ID == id {
+			s.data.Customers[i].Bouncing = false
+			s.data.Customers[i].BounceReason = ""
+			s.data.Customers[i].BouncedAt = ""
+			return s.saveLocked()
+		}
+	}
+	return fmt.Errorf("客户不存在")
+}
+
+// RecordDeliveryEvent attaches an event reported by the mail API to the
+// send it belongs to, found by reference, or failing that the latest send
+// to recipient. A bounce also marks the send bounced and flags customers
+// using the address, as RecordBounce does. It reports whether a send
+// matched.
+func (s *Store) RecordDeliveryEvent(reference, recipient, event, detail string, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	index := -1
+	for i := len(s.data.Deliveries) - 1; i >= 0; i-- {
+		d := s.data.Deliveries[i]
+		if reference != "" && d.Reference == reference {
+			index = i
+			break
+		}
+		if reference == "" && d.Status == DeliverySent && strings.EqualFold(d.To, recipient) {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		return false, nil
+	}
+	d := &s.data.Deliveries[index]
+	// A late "delivered" must not hide an earlier bounce or complaint.
+	if d.Event != "" && event == EventDelivered {
+		return true, nil
+	}
+	d.Event = event
+	d.EventDetail = detail
+	d.EventAt = at.Format(time.RFC3339)
+	if event == EventBounced {
+		d.Status = DeliveryBounced
+		d.Error = detail
+		s.flagBouncingLocked(d.To, detail, at)
+	}
+	return true, s.saveLocked()
+}
+
+// ListSubscriptionDeliveries returns the subscription's send log, newest
+// first.
+func (s *Store) ListSubscriptionDeliveries(subscriptionID int) ([]Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Delivery
+	for i := len(s.data.Deliveries) - 1; i >= 0; i-- {
+		if s.data.Deliveries[i].SubscriptionID == subscriptionID {
+			out = append(out, s.data.Deliveries[i])
+		}
+	}
+	return out, nil
+}
+
+// flagBouncingLocked marks customers whose email is address as bouncing and
+// reports whether there were any.
+func (s *Store) flagBouncingLocked(address, reason string, now time.Time) bool {
+	flagged := false
+	for i, c := range s.data.Customers {
+		if strings.EqualFold(c.Email, address) {
+			s.data.Customers[i].Bouncing = true
+			s.data.Customers[i].BounceReason = reason
+			s.data.Customers[i].BouncedAt = now.Format(time.RFC3339)
+			flagged = true
+		}
+	}
+	return flagged
+}
@@ -0,0 +1,46 @@
+package db
+
+// CalDAVEvent links a subscription to the iCalendar object of its expiry on
+// the CalDAV server. URL is where the object was written, which moves to
+// another calendar with the subscription's product, and Hash a digest of
+// its content, so the sync only writes objects that changed. The link
+// outlives the subscription until the sync has deleted the object.
+type CalDAVEvent struct {
+	SubscriptionID int    `json:"subscription_id"`
+	URL            string `json:"url"`
+	Hash           string `json:"hash"`
+}
+
+// ListCalDAVEvents returns every subscription's CalDAV object link.
+func (s *Store) ListCalDAVEvents() ([]CalDAVEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]CalDAVEvent(nil), s.data.CalDAVEvents...), nil
+}
+
+// PutCalDAVEvent adds or replaces the subscription's CalDAV object link.
+func (s *Store) PutCalDAVEvent(event CalDAVEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range s.data.CalDAVEvents {
+		if e.SubscriptionID == event.SubscriptionID {
+			s.data.CalDAVEvents[i] = event
+			return s.saveLocked()
+		}
+	}
+	s.data.CalDAVEvents = append(s.data.CalDAVEvents, event)
+	return s.saveLocked()
+}
+
+// DeleteCalDAVEvent drops the subscription's CalDAV object link.
+func (s *Store) DeleteCalDAVEvent(subscriptionID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range s.data.CalDAVEvents {
+		if e.SubscriptionID == subscriptionID {
+			s.data.CalDAVEvents = append(s.data.CalDAVEvents[:i], s.data.CalDAVEvents[i+1:]...)
+			return s.saveLocked()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValidateCertHost checks a host to read a certificate from: a host name
+// or IP address, with an optional port.
+func ValidateCertHost(host string) error {
+	name := host
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("端口格式错误: %s", host)
+		}
+		name = h
+	}
+	if net.ParseIP(name) != nil {
+		return nil
+	}
+	// Unlike a domain, a host may be a single label on the intranet.
+	if len(name) > 253 {
+		return fmt.Errorf("主机名格式错误: %s", host)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("主机名格式错误: %s", host)
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return fmt.Errorf("主机名格式错误: %s", host)
+			}
+		}
+	}
+	return nil
+}
+
+// SetSubscriptionCertHost sets the host whose certificate expiry the
+// subscription's expiry follows; an empty one stops the checks.
+func (s *Store) SetSubscriptionCertHost(id int, host string) error {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if host != "" {
+		if err := ValidateCertHost(host); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sub := range s.data.Subscriptions {
+		if sub.ID != id {
+			continue
+		}
+		if host != "" && (sub.Domain != "" || sub.WHMCSID != 0) {
+			return fmt.Errorf("订阅的到期日已跟随域名或 WHMCS，不能再跟随证书")
+		}
+		if sub.CertHost != host {
+			s.data.Subscriptions[i].CertCheckedAt = ""
+			s.data.Subscriptions[i].CertExpiresAt = ""
+			s.data.Subscriptions[i].CertError = ""
+		}
+		s.data.Subscriptions[i].CertHost = host
+		return s.saveLocked()
+	}
+	return fmt.Errorf("订阅不存在")
+}
+
+// RecordCertCheck records a check of the subscription's certificate: its
+// expiry, if it was read, and the problem found, if any. When newExpires
+// differs from oldExpires the expiry moves to it, unless it was changed
+// here in the meantime; it reports whether it moved.
+func (s *Store) RecordCertCheck(id int, oldExpires, newExpires, certExpires, errText string, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sub := range s.data.Subscriptions {
+		if sub.ID != id {
+			continue
+		}
+		s.data.Subscriptions[i].CertCheckedAt = now.Format(time.RFC3339)
+		s.data.Subscriptions[i].CertError = errText
+		if certExpires != "" {
+			s.data.Subscriptions[i].CertExpiresAt = certExpires
+		}
+		moved := false
+		if newExpires != "" && newExpires != oldExpires && sub.ExpiresAt == oldExpires {
+			s.recordExpiryLocked(id, oldExpires, newExpires, now)
+			s.data.Subscriptions[i].ExpiresAt = newExpires
+			moved = true
+		}
+		return moved, s.saveLocked()
+	}
+	return false, fmt.Errorf("订阅不存在")
+}
@@ -1,9 +1,11 @@
 package db
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sort"
@@ -11,19 +13,31 @@ import (
 	"time"
 )
 
+// Template is an email template. Text is an optional plain-text version;
+// when empty the text part is derived from the rendered HTML. ReplyTo
+// overrides SMTP_REPLY_TO for emails using this template.
 type Template struct {
 	Subject string `json:"subject"`
 	HTML    string `json:"html"`
+	Text    string `json:"text,omitempty"`
+	ReplyTo string `json:"reply_to,omitempty"`
+	// Headers holds extra header fields, one "Name: value" per line.
+	Headers string `json:"headers,omitempty"`
 }
 
 var defaultRules = []int{30, 7, 1, 0}
 
+var defaultTrialRules = []int{3, 1, 0}
+
+const defaultGraceDays = 1
+
 var defaultTemplate = Template{
 	Subject: "【续费提醒】{{ .Product.Name }} 将在 {{ .Product.ExpiresAt }} 到期",
 	HTML: `<p>Hi {{ if .Customer.Name }}{{ .Customer.Name }}{{ else }}{{ .Customer.Email }}{{ end }},</p>
 <p>你的产品 <b>{{ .Product.Name }}</b> 将在 <b>{{ .Product.ExpiresAt }}</b> 到期。</p>
 <p>距离到期还剩 <b>{{ .DaysLeft }}</b> 天。</p>
 {{ if .Product.Content }}<p>备注：{{ .Product.Content }}</p>{{ end }}
+{{ if .Subscription.PaymentLink }}<p><a href="{{ .Subscription.PaymentLink }}">在线支付续费</a>，支付成功后到期日自动顺延。</p>{{ end }}
 <hr/>
 <p>如需继续续费使用，请登录续费管理面板或联系 support@example.com。</p>
 <p>— {{ .Company }}</p>
@@ -42,10 +56,68 @@ var defaultRenewalTemplate = Template{
 `,
 }
 
+var defaultTrialTemplate = Template{
+	Subject: "【试用即将结束】{{ .Product.Name }} 试用将在 {{ .Product.ExpiresAt }} 到期",
+	HTML: `<p>Hi {{ if .Customer.Name }}{{ .Customer.Name }}{{ else }}{{ .Customer.Email }}{{ end }},</p>
+<p>感谢试用 <b>{{ .Product.Name }}</b>！你的试用将在 <b>{{ .Product.ExpiresAt }}</b> 结束，还剩 <b>{{ .DaysLeft }}</b> 天。</p>
+<p>升级为正式版即可保留现有配置与数据，并继续享受完整功能。</p>
+{{ if .Product.Content }}<p>{{ .Product.Content }}</p>{{ end }}
+<hr/>
+<p>如需升级或有任何疑问，请联系 support@example.com。</p>
+<p>— {{ .Company }}</p>
+`,
+}
+
+var defaultCombinedTemplate = Template{
+	Subject: "【续费提醒】你有 {{ len .Items }} 个产品即将到期",
+	HTML: `<p>Hi {{ if .Customer.Name }}{{ .Customer.Name }}{{ else }}{{ .Customer.Email }}{{ end }},</p>
+<p>你的以下产品即将到期：</p>
+<table>
+<tr><th align="left">产品</th><th align="left">到期日</th><th align="left">剩余天数</th><th align="left">续费</th></tr>
+{{ range .Items }}<tr><td>{{ .Product.Name }}</td><td>{{ .Product.ExpiresAt }}</td><td>{{ .DaysLeft }}</td><td>{{ if .Subscription.PaymentLink }}<a href="{{ .Subscription.PaymentLink }}">在线支付</a>{{ end }}</td></tr>
+{{ end }}</table>
+<hr/>
+<p>如需继续续费使用，请登录续费管理面板或联系 support@example.com。</p>
+<p>— {{ .Company }}</p>
+`,
+}
+
+// SendWindow holds the raw quiet-hours and blackout-date settings; see
+// calendar.ParseWindow for the format.
+type SendWindow struct {
+	QuietHours    string `json:"quiet_hours"`
+	BlackoutDates string `json:"blackout_dates"`
+}
+
+const (
+	WeekendShiftNone   = ""
+	WeekendShiftBefore = "before"
+	WeekendShiftAfter  = "after"
+)
+
+// BusinessDays controls what happens to reminders that fall on a weekend or
+// holiday: they are either sent on the last workday before it or held until
+// the next workday. Weekend uses the calendar.ParseWeekend format and
+// Holidays the calendar.ParseHolidays format.
+type BusinessDays struct {
+	WeekendShift string `json:"weekend_shift"`
+	Weekend      string `json:"weekend"`
+	Holidays     string `json:"holidays"`
+}
+
+var defaultBusinessDays = BusinessDays{WeekendShift: WeekendShiftNone, Weekend: "6,7"}
+
 type Store struct {
 	path string
-	mu   sync.Mutex
+	mu   storeLock
 	data snapshot
+	// seen is the data file as last read or written by this process.
+	seen os.FileInfo
+
+	// scanRunSeq is the last scan run ID handed out.
+	scanRunSeq    int
+	lockMu        sync.Mutex
+	schedulerLock *os.File
 }
 
 type snapshot struct {
@@ -53,44 +125,413 @@ type snapshot struct {
 	Products      []Product         `json:"products"`
 	Subscriptions []Subscription    `json:"subscriptions"`
 	Settings      map[string]string `json:"settings"`
-	DailySends    []DailySend       `json:"daily_sends"`
+	RuleSends     []RuleSend        `json:"rule_sends"`
+	Outbox        []OutboxEmail     `json:"outbox"`
+	Deliveries    []Delivery        `json:"deliveries"`
+	ScanRuns      []ScanRun         `json:"scan_runs"`
+	Renewals      []Renewal         `json:"renewals"`
+	Confirms      []RenewalConfirm  `json:"renewal_confirms"`
+	Attachments   []Attachment      `json:"attachments"`
+	Threads       []ReminderThread  `json:"reminder_threads"`
+	Users         []User            `json:"users,omitempty"`
+	Events        []CalendarEvent   `json:"calendar_events,omitempty"`
+	CalDAVEvents  []CalDAVEvent     `json:"caldav_events,omitempty"`
+	Feed          []FeedEvent       `json:"feed_events,omitempty"`
+	Replies       []RenewalReply    `json:"renewal_replies,omitempty"`
+	Pushes        []ExpiryPush      `json:"expiry_pushes,omitempty"`
 }
 
-type DailySend struct {
+// RuleSend records that the reminder for one rule was sent for a
+// subscription's expiry date, so each rule goes out once per renewal cycle.
+// Hourly marks Rule as an hour-based rule rather than a day-based one.
+type RuleSend struct {
 	SubscriptionID int    `json:"subscription_id"`
-	SentDate       string `json:"sent_date"`
+	ExpiresAt      string `json:"expires_at"`
+	Rule           int    `json:"rule"`
+	Hourly         bool   `json:"hourly,omitempty"`
 	SentAt         string `json:"sent_at"`
 }
 
+// ReminderThread lists the Message-IDs of the reminders queued for one
+// subscription's expiry date, oldest first, so each reminder can reply to
+// the earlier ones and mail clients show them as one conversation.
+type ReminderThread struct {
+	SubscriptionID int      `json:"subscription_id"`
+	ExpiresAt      string   `json:"expires_at"`
+	MessageIDs     []string `json:"message_ids"`
+}
+
+const (
+	OutboxPending = "pending"
+	OutboxSending = "sending"
+	OutboxFailed  = "failed"
+)
+
+// Chat channels an outbox message can go to instead of email.
+const (
+	ChannelTelegram = "telegram"
+	ChannelSlack    = "slack"
+	ChannelWeCom    = "wecom"
+	ChannelDingTalk = "dingtalk"
+	ChannelFeishu   = "feishu"
+	ChannelSMS      = "sms"
+	ChannelPush     = "push"
+	ChannelMatrix   = "matrix"
+)
+
+type OutboxEmail struct {
+	ID             int      `json:"id"`
+	SubscriptionID int      `json:"subscription_id"`
+	To             string   `json:"to"`
+	Cc             []string `json:"cc,omitempty"`
+	ReplyTo        string   `json:"reply_to,omitempty"`
+	Subject        string   `json:"subject"`
+	HTML           string   `json:"html"`
+	Text           string   `json:"text,omitempty"`
+	AttachmentIDs  []int    `json:"attachment_ids,omitempty"`
+	MessageID      string   `json:"message_id,omitempty"`
+	// Headers holds extra header fields, e.g. List-Unsubscribe.
+	Headers       map[string]string `json:"headers,omitempty"`
+	Status        string            `json:"status"`
+	Attempts      int               `json:"attempts"`
+	NextAttemptAt string            `json:"next_attempt_at"`
+	LastError     string            `json:"last_error"`
+	CreatedAt     string            `json:"created_at"`
+	FailedAt      string            `json:"failed_at,omitempty"`
+	// TimeZone is the recipient's zone, in which the send window applies;
+	// empty uses TZ.
+	TimeZone string `json:"time_zone,omitempty"`
+	// Channel is the chat service the message goes to, with To the chat
+	// where the service needs one; empty means email.
+	Channel string `json:"channel,omitempty"`
+}
+
+// DeliverySuppressed marks a send the provider refused because the
+// recipient is on its inactive list; unlike a plain failure it needs the
+// address fixed or reactivated rather than another attempt.
+// DeliveryBounced marks a send the relay accepted that later came back as a
+// non-delivery report.
+const (
+	DeliverySent       = "sent"
+	DeliveryFailed     = "failed"
+	DeliverySuppressed = "suppressed"
+	DeliveryBounced    = "bounced"
+)
+
+// Delivery is one line of the send log used for the admin digest. Date is
+// the local calendar day the entry belongs to. Reference is the ID the mail
+// API echoes back in delivery event webhooks; Event is the latest such
+// event (one of the Event* values) with its detail and time. FailureClass
+// is the email.Classify class of a failed send's Error.
+type Delivery struct {
+	SubscriptionID int    `json:"subscription_id"`
+	To             string `json:"to"`
+	Subject        string `json:"subject"`
+	Status         string `json:"status"`
+	Error          string `json:"error"`
+	FailureClass   string `json:"failure_class,omitempty"`
+	Date           string `json:"date"`
+	At             string `json:"at"`
+	Reference      string `json:"reference,omitempty"`
+	Event          string `json:"event,omitempty"`
+	EventDetail    string `json:"event_detail,omitempty"`
+	EventAt        string `json:"event_at,omitempty"`
+	// OpenedAt is when the tracking pixel was first loaded and Opens how
+	// many times it was.
+	OpenedAt string `json:"opened_at,omitempty"`
+	Opens    int    `json:"opens,omitempty"`
+	// Links are the original targets of the links rewritten for click
+	// tracking, indexed by the number in the redirect URL. ClickedAt is the
+	// first click and ClickedLinks the distinct targets clicked.
+	Links        []string `json:"links,omitempty"`
+	ClickedAt    string   `json:"clicked_at,omitempty"`
+	Clicks       int      `json:"clicks,omitempty"`
+	ClickedLinks []string `json:"clicked_links,omitempty"`
+	// Archived means a copy of the message is kept under Reference.
+	Archived bool `json:"archived,omitempty"`
+	// Channel is the chat service the message went to; empty means email.
+	Channel string `json:"channel,omitempty"`
+}
+
+// Delivery events reported by the mail API after it accepted a message.
+const (
+	EventDelivered  = "delivered"
+	EventBounced    = "bounced"
+	EventComplained = "complained"
+)
+
+const (
+	TriggerScheduled = "scheduled"
+	TriggerManual    = "manual"
+	TriggerCLI       = "cli"
+)
+
+// maxScanRuns bounds the scan history kept in the store.
+const maxScanRuns = 200
+
+// ScanRun is one entry of the scan history shown on the dashboard.
+type ScanRun struct {
+	ID         int      `json:"id"`
+	Trigger    string   `json:"trigger"`
+	StartedAt  string   `json:"started_at"`
+	FinishedAt string   `json:"finished_at"`
+	Total      int      `json:"total"`
+	Queued     int      `json:"queued"`
+	Skipped    int      `json:"skipped"`
+	Failed     int      `json:"failed"`
+	Failures   []string `json:"failures"`
+	Error      string   `json:"error"`
+}
+
 type Customer struct {
-	ID        int    `json:"id"`
-	Email     string `json:"email"`
-	Name      string `json:"name"`
-	CreatedAt string `json:"created_at"`
+	ID             int    `json:"id"`
+	Email          string `json:"email"`
+	Name           string `json:"name"`
+	SecondaryEmail string `json:"secondary_email"`
+	// CCEmails lists addresses, comma or newline separated, copied on every
+	// email to the customer.
+	CCEmails string `json:"cc_emails"`
+	// Contacts are further addresses with the role they serve; the reminder
+	// roles setting decides which of them receive customer emails.
+	Contacts []Contact `json:"contacts,omitempty"`
+	// TimeZone is the IANA zone the customer is in, such as
+	// "America/Los_Angeles". Days until expiry and the send window are
+	// counted there; empty uses TZ.
+	TimeZone string `json:"time_zone,omitempty"`
+	// TelegramChatID is the Telegram chat that also receives the customer's
+	// reminders when a bot is configured; empty sends them by email only.
+	TelegramChatID string `json:"telegram_chat_id,omitempty"`
+	// Phone is the mobile number that gets SMS reminders, for the rules
+	// that send them; empty sends none.
+	Phone string `json:"phone,omitempty"`
+	// WHMCSID is the WHMCS client the customer was imported from; zero for
+	// customers entered here.
+	WHMCSID int `json:"whmcs_id,omitempty"`
+	// LDAPDN is the directory entry the customer was imported from; the
+	// LDAP import then owns Name, Department and Tags.
+	LDAPDN     string `json:"ldap_dn,omitempty"`
+	Department string `json:"department,omitempty"`
+	// ExternalID is the customer's key in the system that upserts it
+	// through the bulk API.
+	ExternalID string `json:"external_id,omitempty"`
+	// Tags group customers, for filtering the customer list.
+	Tags []string `json:"tags,omitempty"`
+	// OptedOut is set when the customer unsubscribed from reminders, either
+	// through the List-Unsubscribe link or by an admin.
+	OptedOut   bool   `json:"opted_out,omitempty"`
+	OptedOutAt string `json:"opted_out_at,omitempty"`
+	// Bouncing is set when a non-delivery report came back for Email;
+	// BounceReason holds the reported status and diagnostic.
+	Bouncing     bool   `json:"bouncing,omitempty"`
+	BounceReason string `json:"bounce_reason,omitempty"`
+	BouncedAt    string `json:"bounced_at,omitempty"`
+	CreatedAt    string `json:"created_at"`
+}
+
+// Contact roles. RolePrimary stands for the customer's Email, which has no
+// Contact entry.
+const (
+	RolePrimary   = "primary"
+	RoleBilling   = "billing"
+	RoleTechnical = "technical"
+)
+
+// Contact is an extra customer address and the role it serves.
+type Contact struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
 }
 
 type Product struct {
-	ID        int    `json:"id"`
-	Name      string `json:"name"`
-	Content   string `json:"content"`
-	CreatedAt string `json:"created_at"`
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	// TemplateName selects a named reminder template; empty uses the
+	// global one.
+	TemplateName string `json:"template_name"`
+	// Operators are the staff responsible for the product, as DingTalk
+	// mobile numbers or user IDs separated by commas; DingTalk scan
+	// summaries @-mention them when the product's subscriptions come up.
+	Operators string `json:"operators,omitempty"`
+	// StripePriceID is the Stripe price a renewal is paid at, e.g.
+	// price_1Nx...; empty means the product has no payment links.
+	// RenewalMonths is how far a payment extends the expiry; zero is 12.
+	StripePriceID string `json:"stripe_price_id,omitempty"`
+	RenewalMonths int    `json:"renewal_months,omitempty"`
+	// WHMCSProducts are the WHMCS product IDs whose services sync to
+	// subscriptions of this product.
+	WHMCSProducts []int `json:"whmcs_products,omitempty"`
+	// Domain marks a domain registration product: its subscriptions
+	// follow the registry expiry of the domain in their Domain field, or
+	// in their note if that is empty.
+	Domain bool `json:"domain,omitempty"`
+	// Price is what a renewal for RenewalMonths costs, as a decimal such
+	// as "1200.00", in Currency (empty is CNY). Reminders carry a PDF
+	// quote for products with a price when quotes are turned on.
+	Price    string `json:"price,omitempty"`
+	Currency string `json:"currency,omitempty"`
+	// ExternalID is the product's key in the system that upserts it
+	// through the bulk API.
+	ExternalID string `json:"external_id,omitempty"`
+	CreatedAt  string `json:"created_at"`
+}
+
+const (
+	KindPaid  = "paid"
+	KindTrial = "trial"
+)
+
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
+// PriorityRank orders priorities for listing, highest first. An empty
+// priority counts as normal.
+func PriorityRank(priority string) int {
+	switch priority {
+	case PriorityHigh:
+		return 0
+	case PriorityLow:
+		return 2
+	default:
+		return 1
+	}
 }
 
 type Subscription struct {
-	ID         int    `json:"id"`
-	CustomerID int    `json:"customer_id"`
-	ProductID  int    `json:"product_id"`
-	ExpiresAt  string `json:"expires_at"`
-	Note       string `json:"note"`
+	ID         int `json:"id"`
+	CustomerID int `json:"customer_id"`
+	ProductID  int `json:"product_id"`
+	// ExpiresAt is a date ("2006-01-02") or, for subscriptions that expire
+	// at a specific hour, a local date and time ("2006-01-02 15:04").
+	ExpiresAt    string `json:"expires_at"`
+	Note         string `json:"note"`
+	SnoozedUntil string `json:"snoozed_until"`
+	Priority     string `json:"priority"`
+	// Kind is KindTrial or KindPaid; empty counts as paid.
+	Kind string `json:"kind"`
+	// AutoRenewMonths is the billing cycle used to advance the expiry once
+	// it passes; zero means the subscription is renewed by hand.
+	AutoRenewMonths int `json:"auto_renew_months"`
+	// PaymentLink is the Stripe payment link that renews the subscription
+	// from PaymentLinkFor, the expiry it was created for; a link for an
+	// older expiry is stale and replaced by the next reminder.
+	PaymentLink    string `json:"payment_link,omitempty"`
+	PaymentLinkID  string `json:"payment_link_id,omitempty"`
+	PaymentLinkFor string `json:"payment_link_for,omitempty"`
+	// WHMCSID is the WHMCS service the subscription is synced from; its
+	// expiry follows the service's next due date.
+	WHMCSID int `json:"whmcs_id,omitempty"`
+	// Domain is the domain whose registry expiry the expiry follows,
+	// looked up over RDAP or WHOIS. DomainCheckedAt is the last lookup,
+	// DomainExpiresAt the expiry the registry reported and DomainError
+	// why the last lookup failed.
+	Domain          string `json:"domain,omitempty"`
+	DomainCheckedAt string `json:"domain_checked_at,omitempty"`
+	DomainExpiresAt string `json:"domain_expires_at,omitempty"`
+	DomainError     string `json:"domain_error,omitempty"`
+	// CertHost is the host, with an optional port (default 443), whose
+	// TLS certificate expiry the expiry follows. CertCheckedAt is the last
+	// check, CertExpiresAt the certificate's NotAfter and CertError why the
+	// check failed, or what is wrong with a certificate that was read,
+	// such as a name that doesn't match the host.
+	CertHost      string `json:"cert_host,omitempty"`
+	CertCheckedAt string `json:"cert_checked_at,omitempty"`
+	CertExpiresAt string `json:"cert_expires_at,omitempty"`
+	CertError     string `json:"cert_error,omitempty"`
+	// ExternalID is the subscription's key in the system that upserts it
+	// through the bulk API.
+	ExternalID string `json:"external_id,omitempty"`
 	CreatedAt  string `json:"created_at"`
 }
 
+// ExpiresDate returns the date part of ExpiresAt.
+func (s Subscription) ExpiresDate() string {
+	if len(s.ExpiresAt) > 10 {
+		return s.ExpiresAt[:10]
+	}
+	return s.ExpiresAt
+}
+
+// ExpiresTime returns the optional time of day of ExpiresAt, or "".
+func (s Subscription) ExpiresTime() string {
+	if len(s.ExpiresAt) > 11 {
+		return s.ExpiresAt[11:]
+	}
+	return ""
+}
+
+// Renewal logs one change of a subscription's expiry date.
+type Renewal struct {
+	SubscriptionID int    `json:"subscription_id"`
+	OldExpiresAt   string `json:"old_expires_at"`
+	NewExpiresAt   string `json:"new_expires_at"`
+	Auto           bool   `json:"auto"`
+	// Payment is the Stripe Checkout Session that paid for the renewal.
+	Payment string `json:"payment,omitempty"`
+	// Amount is what the renewal brought in, as a decimal in Currency:
+	// the amount paid for Stripe payments, otherwise the product price
+	// for the months added. Empty when the product has no price.
+	Amount   string `json:"amount,omitempty"`
+	Currency string `json:"currency,omitempty"`
+	At       string `json:"at"`
+}
+
+// RenewalConfirm records a queued renewal confirmation. Key is the
+// idempotency key of the form post that triggered it, if any.
+type RenewalConfirm struct {
+	SubscriptionID int    `json:"subscription_id"`
+	Key            string `json:"key"`
+	ExpiresAt      string `json:"expires_at"`
+	At             string `json:"at"`
+}
+
 type SubscriptionDetail struct {
 	Subscription
-	CustomerName   string
-	CustomerEmail  string
-	ProductName    string
-	ProductContent string
+	CustomerName           string
+	CustomerEmail          string
+	CustomerSecondaryEmail string
+	CustomerCC             string
+	CustomerContacts       []Contact
+	CustomerOptedOut       bool
+	CustomerBouncing       bool
+	CustomerTimeZone       string
+	CustomerTelegramChatID string
+	CustomerPhone          string
+	ProductName            string
+	ProductContent         string
+	ProductTemplate        string
+	ProductStripePriceID   string
+	ProductRenewalMonths   int
+	ProductDomain          bool
+	ProductPrice           string
+	ProductCurrency        string
+	// ReplyPending is set while a customer reply saying the subscription
+	// was renewed awaits confirmation; reminders hold off meanwhile.
+	ReplyPending bool
+}
+
+// NamedTemplate is a reminder template that products can refer to by name.
+type NamedTemplate struct {
+	Name string `json:"name"`
+	Template
+}
+
+// Escalation copies reminders to the customer's secondary contact and the
+// account manager once a subscription has gone AfterReminders reminders
+// without being renewed. Zero disables escalation.
+type Escalation struct {
+	AfterReminders int    `json:"after_reminders"`
+	ManagerEmail   string `json:"manager_email"`
+}
+
+// Forecast configures the opt-in weekly expiring-soon email. Recipients is
+// a comma-separated list; empty means the admin email.
+type Forecast struct {
+	Enabled    bool   `json:"enabled"`
+	Recipients string `json:"recipients"`
 }
 
 func Open(path string) (*Store, error) {
@@ -101,11 +542,15 @@ func Open(path string) (*Store, error) {
 		}
 	}
 	store := &Store{path: path}
-	if err := store.load(); err != nil {
+	store.mu.store = store
+	f, err := os.OpenFile(path+".data.lock", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
 		return nil, err
 	}
-	if store.data.Settings == nil {
-		store.data.Settings = map[string]string{}
+	store.mu.file = f
+	if err := store.load(); err != nil {
+		f.Close()
+		return nil, err
 	}
 	if _, err := store.GetRules(); err != nil {
 		return nil, err
@@ -116,37 +561,108 @@ func Open(path string) (*Store, error) {
 	if _, err := store.GetRenewalTemplate(); err != nil {
 		return nil, err
 	}
+	if _, err := store.GetCombinedTemplate(); err != nil {
+		return nil, err
+	}
+	if _, err := store.GetTrialTemplate(); err != nil {
+		return nil, err
+	}
 	return store, nil
 }
 
+// Reload replaces the in-memory data with the data file, e.g. after
+// another process wrote it.
+func (s *Store) Reload() error {
+	return s.load()
+}
+
 func (s *Store) Close() error {
-	return nil
+	err := s.releaseSchedulerLock()
+	s.mu.Mutex.Lock()
+	defer s.mu.Mutex.Unlock()
+	if s.mu.file != nil {
+		s.mu.file.Close()
+		s.mu.file = nil
+	}
+	return err
 }
 
 func (s *Store) load() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.readLocked()
+}
+
+// readLocked replaces the in-memory data with the data file.
+func (s *Store) readLocked() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.data = snapshot{Settings: map[string]string{}}
+		return s.saveLocked()
+	}
+	if err != nil {
+		return err
+	}
 	data, err := os.ReadFile(s.path)
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			s.data = snapshot{Settings: map[string]string{}}
-			return s.saveLocked()
-		}
 		return err
 	}
-	if len(data) == 0 {
-		s.data = snapshot{Settings: map[string]string{}}
-		return nil
+	// Decode into a fresh snapshot: decoding over the old one would keep
+	// fields the file leaves out.
+	next := snapshot{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &next); err != nil {
+			return err
+		}
+	}
+	if next.Settings == nil {
+		next.Settings = map[string]string{}
+	}
+	s.data = next
+	s.seen = info
+	return nil
+}
+
+// refreshLocked rereads the data file if another process has written it
+// since this one last read or wrote it.
+func (s *Store) refreshLocked() {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return
+	}
+	if s.seen != nil && os.SameFile(s.seen, info) && s.seen.Size() == info.Size() && s.seen.ModTime().Equal(info.ModTime()) {
+		return
+	}
+	if err := s.readLocked(); err != nil {
+		slog.Error("db reload error", "path", s.path, "error", err)
 	}
-	return json.Unmarshal(data, &s.data)
 }
 
+// saveLocked writes the data to a temporary file and renames it over the
+// data file, so another process never reads a half-written file.
 func (s *Store) saveLocked() error {
 	payload, err := json.MarshalIndent(s.data, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(s.path, payload, 0o644)
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, payload, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		// A data file mounted on its own can't be replaced; write it in
+		// place instead.
+		os.Remove(tmp)
+		if err := os.WriteFile(s.path, payload, 0o644); err != nil {
+			return err
+		}
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.seen = info
+	return nil
 }
 
 func (s *Store) GetRules() ([]int, error) {
@@ -177,187 +693,561 @@ func (s *Store) UpdateRules(rules []int) error {
 	return s.saveLocked()
 }
 
-func (s *Store) GetTemplate() (Template, error) {
-	return s.getTemplate("email_template", defaultTemplate)
+// GetTrialRules returns the rules used for trial subscriptions instead of
+// the regular ones.
+func (s *Store) GetTrialRules() ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if value, ok := s.data.Settings["trial_rules"]; ok {
+		var rules []int
+		if err := json.Unmarshal([]byte(value), &rules); err == nil && len(rules) > 0 {
+			return rules, nil
+		}
+	}
+	return defaultTrialRules, nil
 }
 
-func (s *Store) GetRenewalTemplate() (Template, error) {
-	return s.getTemplate("renewal_confirm_template", defaultRenewalTemplate)
+func (s *Store) UpdateTrialRules(rules []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	s.data.Settings["trial_rules"] = string(payload)
+	return s.saveLocked()
 }
 
-func (s *Store) UpdateTemplate(tpl Template) error {
-	return s.setTemplate("email_template", tpl)
+// GetHourRules returns the hour-based rules applied to subscriptions whose
+// expiry has a time of day; there are none by default.
+func (s *Store) GetHourRules() ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rules []int
+	if value, ok := s.data.Settings["hour_rules"]; ok {
+		if err := json.Unmarshal([]byte(value), &rules); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
 }
 
-func (s *Store) UpdateRenewalTemplate(tpl Template) error {
-	return s.setTemplate("renewal_confirm_template", tpl)
+func (s *Store) UpdateHourRules(rules []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	s.data.Settings["hour_rules"] = string(payload)
+	return s.saveLocked()
 }
 
-func (s *Store) getTemplate(key string, fallback Template) (Template, error) {
+// GetHighPriorityRules returns the extra rules applied to high-priority
+// subscriptions on top of the regular ones; there are none by default.
+func (s *Store) GetHighPriorityRules() ([]int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if value, ok := s.data.Settings[key]; ok {
-		var tpl Template
-		if err := json.Unmarshal([]byte(value), &tpl); err == nil && tpl.Subject != "" {
-			return tpl, nil
+	var rules []int
+	if value, ok := s.data.Settings["high_priority_rules"]; ok {
+		if err := json.Unmarshal([]byte(value), &rules); err != nil {
+			return nil, err
 		}
 	}
-	payload, _ := json.Marshal(fallback)
-	s.data.Settings[key] = string(payload)
-	if err := s.saveLocked(); err != nil {
-		return Template{}, err
-	}
-	return fallback, nil
+	return rules, nil
 }
 
-func (s *Store) setTemplate(key string, tpl Template) error {
+func (s *Store) UpdateHighPriorityRules(rules []int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	payload, err := json.Marshal(tpl)
+	payload, err := json.Marshal(rules)
 	if err != nil {
 		return err
 	}
-	s.data.Settings[key] = string(payload)
+	s.data.Settings["high_priority_rules"] = string(payload)
 	return s.saveLocked()
 }
 
-func (s *Store) ListCustomers() ([]Customer, error) {
+func (s *Store) GetSendWindow() (SendWindow, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	out := append([]Customer(nil), s.data.Customers...)
-	sort.Slice(out, func(i, j int) bool { return out[i].ID > out[j].ID })
-	return out, nil
+	var window SendWindow
+	if value, ok := s.data.Settings["send_window"]; ok {
+		if err := json.Unmarshal([]byte(value), &window); err != nil {
+			return SendWindow{}, err
+		}
+	}
+	return window, nil
 }
 
-func (s *Store) CreateCustomer(email, name string, now time.Time) error {
+func (s *Store) UpdateSendWindow(window SendWindow) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for _, c := range s.data.Customers {
-		if c.Email == email {
-			return fmt.Errorf("邮箱已存在")
-		}
+	payload, err := json.Marshal(window)
+	if err != nil {
+		return err
 	}
-	nextID := s.nextCustomerID()
-	s.data.Customers = append(s.data.Customers, Customer{
-		ID:        nextID,
-		Email:     email,
-		Name:      name,
-		CreatedAt: now.Format(time.RFC3339),
-	})
+	s.data.Settings["send_window"] = string(payload)
 	return s.saveLocked()
 }
 
-func (s *Store) GetCustomer(id int) (Customer, error) {
+func (s *Store) GetBusinessDays() (BusinessDays, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for _, c := range s.data.Customers {
-		if c.ID == id {
-			return c, nil
+	days := defaultBusinessDays
+	if value, ok := s.data.Settings["business_days"]; ok {
+		if err := json.Unmarshal([]byte(value), &days); err != nil {
+			return BusinessDays{}, err
 		}
 	}
-	return Customer{}, fmt.Errorf("客户不存在")
+	return days, nil
 }
 
-func (s *Store) DeleteCustomer(id int) error {
+func (s *Store) UpdateBusinessDays(days BusinessDays) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	var customers []Customer
-	for _, c := range s.data.Customers {
-		if c.ID != id {
-			customers = append(customers, c)
-		}
-	}
-	s.data.Customers = customers
-	var subs []Subscription
-	for _, sub := range s.data.Subscriptions {
-		if sub.CustomerID != id {
-			subs = append(subs, sub)
-		}
+	payload, err := json.Marshal(days)
+	if err != nil {
+		return err
 	}
-	s.data.Subscriptions = subs
+	s.data.Settings["business_days"] = string(payload)
 	return s.saveLocked()
 }
 
-func (s *Store) ListProducts() ([]Product, error) {
+func (s *Store) GetEscalation() (Escalation, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	out := append([]Product(nil), s.data.Products...)
-	sort.Slice(out, func(i, j int) bool { return out[i].ID > out[j].ID })
-	return out, nil
+	var escalation Escalation
+	if value, ok := s.data.Settings["escalation"]; ok {
+		if err := json.Unmarshal([]byte(value), &escalation); err != nil {
+			return Escalation{}, err
+		}
+	}
+	return escalation, nil
 }
 
-func (s *Store) CreateProduct(name, content string, now time.Time) error {
+func (s *Store) UpdateEscalation(escalation Escalation) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for _, p := range s.data.Products {
-		if p.Name == name {
-			return fmt.Errorf("产品名称已存在")
-		}
+	payload, err := json.Marshal(escalation)
+	if err != nil {
+		return err
 	}
-	nextID := s.nextProductID()
-	s.data.Products = append(s.data.Products, Product{
-		ID:        nextID,
-		Name:      name,
-		Content:   content,
-		CreatedAt: now.Format(time.RFC3339),
-	})
+	s.data.Settings["escalation"] = string(payload)
 	return s.saveLocked()
 }
 
-func (s *Store) GetProduct(id int) (Product, error) {
+func (s *Store) GetForecast() (Forecast, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for _, p := range s.data.Products {
-		if p.ID == id {
-			return p, nil
+	var forecast Forecast
+	if value, ok := s.data.Settings["forecast"]; ok {
+		if err := json.Unmarshal([]byte(value), &forecast); err != nil {
+			return Forecast{}, err
 		}
 	}
-	return Product{}, fmt.Errorf("产品不存在")
+	return forecast, nil
 }
 
-func (s *Store) DeleteProduct(id int) error {
+func (s *Store) UpdateForecast(forecast Forecast) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for _, sub := range s.data.Subscriptions {
-		if sub.ProductID == id {
-			return fmt.Errorf("产品已被订阅，无法删除")
-		}
-	}
-	var products []Product
-	for _, p := range s.data.Products {
-		if p.ID != id {
-			products = append(products, p)
-		}
+	payload, err := json.Marshal(forecast)
+	if err != nil {
+		return err
 	}
-	s.data.Products = products
+	s.data.Settings["forecast"] = string(payload)
 	return s.saveLocked()
 }
 
-func (s *Store) ListSubscriptions() ([]SubscriptionDetail, error) {
+// GetReminderRoles returns the contact roles customer emails go to. The
+// default is the primary email only.
+func (s *Store) GetReminderRoles() ([]string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	var out []SubscriptionDetail
-	for _, sub := range s.data.Subscriptions {
-		customer, _ := s.findCustomer(sub.CustomerID)
-		product, _ := s.findProduct(sub.ProductID)
-		out = append(out, SubscriptionDetail{
-			Subscription:   sub,
-			CustomerName:   customer.Name,
-			CustomerEmail:  customer.Email,
-			ProductName:    product.Name,
-			ProductContent: product.Content,
-		})
+	if value, ok := s.data.Settings["reminder_roles"]; ok {
+		var roles []string
+		if err := json.Unmarshal([]byte(value), &roles); err == nil && len(roles) > 0 {
+			return roles, nil
+		}
 	}
-	sort.Slice(out, func(i, j int) bool { return out[i].ID > out[j].ID })
-	return out, nil
+	return []string{RolePrimary}, nil
 }
 
-func (s *Store) CreateSubscription(customerID, productID int, expiresAt, note string, now time.Time) error {
+func (s *Store) UpdateReminderRoles(roles []string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if _, ok := s.findCustomer(customerID); !ok {
-		return fmt.Errorf("客户不存在")
-	}
+	payload, err := json.Marshal(roles)
+	if err != nil {
+		return err
+	}
+	s.data.Settings["reminder_roles"] = string(payload)
+	return s.saveLocked()
+}
+
+// GetGraceDays returns how many days after expiry reminders keep going out.
+func (s *Store) GetGraceDays() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if value, ok := s.data.Settings["grace_days"]; ok {
+		var days int
+		if err := json.Unmarshal([]byte(value), &days); err == nil && days >= 0 {
+			return days, nil
+		}
+	}
+	return defaultGraceDays, nil
+}
+
+func (s *Store) UpdateGraceDays(days int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload, err := json.Marshal(days)
+	if err != nil {
+		return err
+	}
+	s.data.Settings["grace_days"] = string(payload)
+	return s.saveLocked()
+}
+
+func (s *Store) GetTemplate() (Template, error) {
+	return s.getTemplate("email_template", defaultTemplate)
+}
+
+func (s *Store) GetRenewalTemplate() (Template, error) {
+	return s.getTemplate("renewal_confirm_template", defaultRenewalTemplate)
+}
+
+func (s *Store) GetTrialTemplate() (Template, error) {
+	return s.getTemplate("trial_email_template", defaultTrialTemplate)
+}
+
+func (s *Store) GetCombinedTemplate() (Template, error) {
+	return s.getTemplate("combined_email_template", defaultCombinedTemplate)
+}
+
+func (s *Store) UpdateTemplate(tpl Template) error {
+	return s.setTemplate("email_template", tpl)
+}
+
+func (s *Store) UpdateRenewalTemplate(tpl Template) error {
+	return s.setTemplate("renewal_confirm_template", tpl)
+}
+
+func (s *Store) UpdateTrialTemplate(tpl Template) error {
+	return s.setTemplate("trial_email_template", tpl)
+}
+
+func (s *Store) UpdateCombinedTemplate(tpl Template) error {
+	return s.setTemplate("combined_email_template", tpl)
+}
+
+func (s *Store) ListNamedTemplates() ([]NamedTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	templates := s.namedTemplatesLocked()
+	out := make([]NamedTemplate, 0, len(templates))
+	for name, tpl := range templates {
+		out = append(out, NamedTemplate{Name: name, Template: tpl})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// GetNamedTemplate reports false if no template has the given name.
+func (s *Store) GetNamedTemplate(name string) (Template, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tpl, ok := s.namedTemplatesLocked()[name]
+	return tpl, ok, nil
+}
+
+// SaveNamedTemplate creates or replaces the template with the given name.
+func (s *Store) SaveNamedTemplate(name string, tpl Template) error {
+	if name == "" || tpl.Subject == "" {
+		return fmt.Errorf("模板名称和主题不能为空")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	templates := s.namedTemplatesLocked()
+	templates[name] = tpl
+	return s.setNamedTemplatesLocked(templates)
+}
+
+func (s *Store) DeleteNamedTemplate(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.data.Products {
+		if p.TemplateName == name {
+			return fmt.Errorf("模板已被产品 %s 使用，无法删除", p.Name)
+		}
+	}
+	templates := s.namedTemplatesLocked()
+	delete(templates, name)
+	return s.setNamedTemplatesLocked(templates)
+}
+
+func (s *Store) namedTemplatesLocked() map[string]Template {
+	templates := map[string]Template{}
+	if value, ok := s.data.Settings["named_templates"]; ok {
+		_ = json.Unmarshal([]byte(value), &templates)
+	}
+	return templates
+}
+
+func (s *Store) setNamedTemplatesLocked(templates map[string]Template) error {
+	payload, err := json.Marshal(templates)
+	if err != nil {
+		return err
+	}
+	s.data.Settings["named_templates"] = string(payload)
+	return s.saveLocked()
+}
+
+func (s *Store) getTemplate(key string, fallback Template) (Template, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if value, ok := s.data.Settings[key]; ok {
+		var tpl Template
+		if err := json.Unmarshal([]byte(value), &tpl); err == nil && tpl.Subject != "" {
+			return tpl, nil
+		}
+	}
+	payload, _ := json.Marshal(fallback)
+	s.data.Settings[key] = string(payload)
+	if err := s.saveLocked(); err != nil {
+		return Template{}, err
+	}
+	return fallback, nil
+}
+
+func (s *Store) setTemplate(key string, tpl Template) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload, err := json.Marshal(tpl)
+	if err != nil {
+		return err
+	}
+	s.data.Settings[key] = string(payload)
+	return s.saveLocked()
+}
+
+func (s *Store) ListCustomers() ([]Customer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := append([]Customer(nil), s.data.Customers...)
+	sort.Slice(out, func(i, j int) bool { return out[i].ID > out[j].ID })
+	return out, nil
+}
+
+func (s *Store) CreateCustomer(email, name string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.data.Customers {
+		if c.Email == email {
+			return fmt.Errorf("邮箱已存在")
+		}
+	}
+	nextID := s.nextCustomerID()
+	s.data.Customers = append(s.data.Customers, Customer{
+		ID:        nextID,
+		Email:     email,
+		Name:      name,
+		CreatedAt: now.Format(time.RFC3339),
+	})
+	return s.saveLocked()
+}
+
+func (s *Store) GetCustomer(id int) (Customer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.data.Customers {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return Customer{}, fmt.Errorf("客户不存在")
+}
+
+func (s *Store) UpdateCustomer(id int, name, secondaryEmail, ccEmails string, contacts []Contact, timeZone, telegramChatID, phone string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, c := range s.data.Customers {
+		if c.ID == id {
+			s.data.Customers[i].Name = name
+			s.data.Customers[i].SecondaryEmail = secondaryEmail
+			s.data.Customers[i].CCEmails = ccEmails
+			s.data.Customers[i].Contacts = contacts
+			s.data.Customers[i].TimeZone = timeZone
+			s.data.Customers[i].TelegramChatID = telegramChatID
+			s.data.Customers[i].Phone = phone
+			return s.saveLocked()
+		}
+	}
+	return fmt.Errorf("客户不存在")
+}
+
+// SetCustomerOptOut records whether the customer has unsubscribed from
+// reminders.
+func (s *Store) SetCustomerOptOut(id int, optedOut bool, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, c := range s.data.Customers {
+		if c.ID == id {
+			s.data.Customers[i].OptedOut = optedOut
+			s.data.Customers[i].OptedOutAt = ""
+			if optedOut {
+				s.data.Customers[i].OptedOutAt = now.Format(time.RFC3339)
+			}
+			return s.saveLocked()
+		}
+	}
+	return fmt.Errorf("客户不存在")
+}
+
+func (s *Store) DeleteCustomer(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var customers []Customer
+	for _, c := range s.data.Customers {
+		if c.ID != id {
+			customers = append(customers, c)
+		}
+	}
+	s.data.Customers = customers
+	var subs []Subscription
+	for _, sub := range s.data.Subscriptions {
+		if sub.CustomerID != id {
+			subs = append(subs, sub)
+		}
+	}
+	s.data.Subscriptions = subs
+	return s.saveLocked()
+}
+
+func (s *Store) ListProducts() ([]Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := append([]Product(nil), s.data.Products...)
+	sort.Slice(out, func(i, j int) bool { return out[i].ID > out[j].ID })
+	return out, nil
+}
+
+func (s *Store) CreateProduct(name, content string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.data.Products {
+		if p.Name == name {
+			return fmt.Errorf("产品名称已存在")
+		}
+	}
+	nextID := s.nextProductID()
+	s.data.Products = append(s.data.Products, Product{
+		ID:        nextID,
+		Name:      name,
+		Content:   content,
+		CreatedAt: now.Format(time.RFC3339),
+	})
+	return s.saveLocked()
+}
+
+func (s *Store) GetProduct(id int) (Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.data.Products {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return Product{}, fmt.Errorf("产品不存在")
+}
+
+// SetProductTemplate assigns a named template to the product; an empty name
+// falls back to the global template.
+func (s *Store) SetProductTemplate(id int, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.namedTemplatesLocked()[name]; name != "" && !ok {
+		return fmt.Errorf("模板不存在")
+	}
+	for i, p := range s.data.Products {
+		if p.ID == id {
+			s.data.Products[i].TemplateName = name
+			return s.saveLocked()
+		}
+	}
+	return fmt.Errorf("产品不存在")
+}
+
+func (s *Store) SetProductOperators(id int, operators string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, p := range s.data.Products {
+		if p.ID == id {
+			s.data.Products[i].Operators = operators
+			return s.saveLocked()
+		}
+	}
+	return fmt.Errorf("产品不存在")
+}
+
+func (s *Store) DeleteProduct(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sub := range s.data.Subscriptions {
+		if sub.ProductID == id {
+			return fmt.Errorf("产品已被订阅，无法删除")
+		}
+	}
+	var products []Product
+	for _, p := range s.data.Products {
+		if p.ID != id {
+			products = append(products, p)
+		}
+	}
+	s.data.Products = products
+	return s.deleteAttachmentsLocked(func(att Attachment) bool { return att.ProductID == id })
+}
+
+func (s *Store) ListSubscriptions() ([]SubscriptionDetail, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []SubscriptionDetail
+	for _, sub := range s.data.Subscriptions {
+		customer, _ := s.findCustomer(sub.CustomerID)
+		product, _ := s.findProduct(sub.ProductID)
+		out = append(out, SubscriptionDetail{
+			Subscription:           sub,
+			CustomerName:           customer.Name,
+			CustomerEmail:          customer.Email,
+			CustomerSecondaryEmail: customer.SecondaryEmail,
+			CustomerCC:             customer.CCEmails,
+			CustomerContacts:       customer.Contacts,
+			CustomerOptedOut:       customer.OptedOut,
+			CustomerBouncing:       customer.Bouncing,
+			CustomerTimeZone:       customer.TimeZone,
+			CustomerTelegramChatID: customer.TelegramChatID,
+			CustomerPhone:          customer.Phone,
+			ProductName:            product.Name,
+			ProductContent:         product.Content,
+			ProductTemplate:        product.TemplateName,
+			ProductStripePriceID:   product.StripePriceID,
+			ProductRenewalMonths:   product.RenewalMonths,
+			ProductDomain:          product.Domain,
+			ProductPrice:           product.Price,
+			ProductCurrency:        product.Currency,
+			ReplyPending:           s.replyPendingLocked(sub.ID, sub.ExpiresAt),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID > out[j].ID })
+	return out, nil
+}
+
+func (s *Store) CreateSubscription(customerID, productID int, expiresAt, note, kind string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.findCustomer(customerID); !ok {
+		return fmt.Errorf("客户不存在")
+	}
 	if _, ok := s.findProduct(productID); !ok {
 		return fmt.Errorf("产品不存在")
 	}
@@ -368,43 +1258,321 @@ func (s *Store) CreateSubscription(customerID, productID int, expiresAt, note st
 		ProductID:  productID,
 		ExpiresAt:  expiresAt,
 		Note:       note,
+		Kind:       kind,
 		CreatedAt:  now.Format(time.RFC3339),
 	})
+	s.recordFeedLocked(FeedEvent{Type: FeedCreated, SubscriptionID: nextID, ExpiresAt: expiresAt}, now)
 	return s.saveLocked()
 }
 
-func (s *Store) GetSubscription(id int) (SubscriptionDetail, error) {
+func (s *Store) GetSubscription(id int) (SubscriptionDetail, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sub := range s.data.Subscriptions {
+		if sub.ID == id {
+			customer, _ := s.findCustomer(sub.CustomerID)
+			product, _ := s.findProduct(sub.ProductID)
+			return SubscriptionDetail{
+				Subscription:           sub,
+				CustomerName:           customer.Name,
+				CustomerEmail:          customer.Email,
+				CustomerSecondaryEmail: customer.SecondaryEmail,
+				CustomerCC:             customer.CCEmails,
+				CustomerContacts:       customer.Contacts,
+				CustomerOptedOut:       customer.OptedOut,
+				CustomerBouncing:       customer.Bouncing,
+				CustomerTimeZone:       customer.TimeZone,
+				CustomerTelegramChatID: customer.TelegramChatID,
+				CustomerPhone:          customer.Phone,
+				ProductName:            product.Name,
+				ProductContent:         product.Content,
+				ProductTemplate:        product.TemplateName,
+				ProductStripePriceID:   product.StripePriceID,
+				ProductRenewalMonths:   product.RenewalMonths,
+				ProductDomain:          product.Domain,
+				ProductPrice:           product.Price,
+				ProductCurrency:        product.Currency,
+				ReplyPending:           s.replyPendingLocked(sub.ID, sub.ExpiresAt),
+			}, nil
+		}
+	}
+	return SubscriptionDetail{}, fmt.Errorf("订阅不存在")
+}
+
+func (s *Store) UpdateSubscription(id int, expiresAt, note string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sub := range s.data.Subscriptions {
+		if sub.ID == id {
+			s.setExpiryLocked(i, expiresAt, now)
+			s.data.Subscriptions[i].Note = note
+			return s.saveLocked()
+		}
+	}
+	return fmt.Errorf("订阅不存在")
+}
+
+// setExpiryLocked moves the expiry of the i-th subscription set by hand or
+// by another system. Moving it a month or more is taken as a renewal
+// settled outside and logged; shorter moves are corrections.
+func (s *Store) setExpiryLocked(i int, expiresAt string, now time.Time) {
+	sub := s.data.Subscriptions[i]
+	s.recordExpiryLocked(sub.ID, sub.ExpiresAt, expiresAt, now)
+	if monthsBetween(sub.ExpiresAt, expiresAt) > 0 {
+		amount, currency := s.renewalAmountLocked(sub, expiresAt)
+		s.data.Renewals = append(s.data.Renewals, Renewal{
+			SubscriptionID: sub.ID,
+			OldExpiresAt:   sub.ExpiresAt,
+			NewExpiresAt:   expiresAt,
+			Amount:         amount,
+			Currency:       currency,
+			At:             now.Format(time.RFC3339),
+		})
+	}
+	s.data.Subscriptions[i].ExpiresAt = expiresAt
+}
+
+// SnoozeSubscription suppresses reminders until the given date; an empty
+// date clears the snooze.
+func (s *Store) SnoozeSubscription(id int, until string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sub := range s.data.Subscriptions {
+		if sub.ID == id {
+			s.data.Subscriptions[i].SnoozedUntil = until
+			return s.saveLocked()
+		}
+	}
+	return fmt.Errorf("订阅不存在")
+}
+
+// SetProductStripe sets the Stripe price renewals of the product are paid
+// at and how many months a payment adds.
+func (s *Store) SetProductStripe(id int, priceID string, months int) error {
+	if months < 0 {
+		return fmt.Errorf("续费月数不能为负数")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, p := range s.data.Products {
+		if p.ID == id {
+			s.data.Products[i].StripePriceID = priceID
+			s.data.Products[i].RenewalMonths = months
+			return s.saveLocked()
+		}
+	}
+	return fmt.Errorf("产品不存在")
+}
+
+// SetPaymentLink stores the Stripe payment link created for the
+// subscription's expiry forExpires.
+func (s *Store) SetPaymentLink(id int, link, linkID, forExpires string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sub := range s.data.Subscriptions {
+		if sub.ID == id {
+			s.data.Subscriptions[i].PaymentLink = link
+			s.data.Subscriptions[i].PaymentLinkID = linkID
+			s.data.Subscriptions[i].PaymentLinkFor = forExpires
+			return s.saveLocked()
+		}
+	}
+	return fmt.Errorf("订阅不存在")
+}
+
+// SubscriptionByPaymentLink returns the ID of the subscription whose
+// current payment link is linkID.
+func (s *Store) SubscriptionByPaymentLink(linkID string) (int, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	for _, sub := range s.data.Subscriptions {
+		if linkID != "" && sub.PaymentLinkID == linkID {
+			return sub.ID, true
+		}
+	}
+	return 0, false
+}
+
+// PaymentApplied reports whether the Stripe payment already renewed a
+// subscription.
+func (s *Store) PaymentApplied(payment string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.data.Renewals {
+		if r.Payment == payment {
+			return true
+		}
+	}
+	return false
+}
+
+// PaidRenewSubscription moves the expiry from oldExpires to newExpires for
+// the Stripe payment, logs the renewal and drops the used payment link. It
+// reports false without changing anything when the payment was already
+// recorded, since Stripe may deliver an event more than once, and fails if
+// the expiry was changed in the meantime.
+func (s *Store) PaidRenewSubscription(id int, oldExpires, newExpires, payment, amount, currency string, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.data.Renewals {
+		if r.Payment == payment {
+			return false, nil
+		}
+	}
+	for i, sub := range s.data.Subscriptions {
+		if sub.ID != id {
+			continue
+		}
+		if sub.ExpiresAt != oldExpires {
+			return false, fmt.Errorf("订阅到期日已变更")
+		}
+		s.data.Subscriptions[i].ExpiresAt = newExpires
+		s.data.Subscriptions[i].PaymentLink = ""
+		s.data.Subscriptions[i].PaymentLinkID = ""
+		s.data.Subscriptions[i].PaymentLinkFor = ""
+		s.data.Renewals = append(s.data.Renewals, Renewal{
+			SubscriptionID: id,
+			OldExpiresAt:   oldExpires,
+			NewExpiresAt:   newExpires,
+			Auto:           true,
+			Payment:        payment,
+			Amount:         amount,
+			Currency:       currency,
+			At:             now.Format(time.RFC3339),
+		})
+		s.recordExpiryLocked(id, oldExpires, newExpires, now)
+		return true, s.saveLocked()
+	}
+	return false, fmt.Errorf("订阅不存在")
+}
+
+func (s *Store) SetSubscriptionKind(id int, kind string) error {
+	if kind != KindPaid && kind != KindTrial {
+		return fmt.Errorf("无效订阅类型: %s", kind)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sub := range s.data.Subscriptions {
 		if sub.ID == id {
-			customer, _ := s.findCustomer(sub.CustomerID)
-			product, _ := s.findProduct(sub.ProductID)
-			return SubscriptionDetail{
-				Subscription:   sub,
-				CustomerName:   customer.Name,
-				CustomerEmail:  customer.Email,
-				ProductName:    product.Name,
-				ProductContent: product.Content,
-			}, nil
+			s.data.Subscriptions[i].Kind = kind
+			return s.saveLocked()
 		}
 	}
-	return SubscriptionDetail{}, fmt.Errorf("订阅不存在")
+	return fmt.Errorf("订阅不存在")
 }
 
-func (s *Store) UpdateSubscription(id int, expiresAt, note string) error {
+func (s *Store) SetPriority(id int, priority string) error {
+	switch priority {
+	case PriorityLow, PriorityNormal, PriorityHigh:
+	default:
+		return fmt.Errorf("无效优先级: %s", priority)
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	for i, sub := range s.data.Subscriptions {
 		if sub.ID == id {
-			s.data.Subscriptions[i].ExpiresAt = expiresAt
-			s.data.Subscriptions[i].Note = note
+			s.data.Subscriptions[i].Priority = priority
+			return s.saveLocked()
+		}
+	}
+	return fmt.Errorf("订阅不存在")
+}
+
+// SetAutoRenew sets the auto-renew cycle in months; zero turns it off.
+func (s *Store) SetAutoRenew(id, months int) error {
+	if months < 0 {
+		return fmt.Errorf("续费周期不能为负数")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sub := range s.data.Subscriptions {
+		if sub.ID == id {
+			s.data.Subscriptions[i].AutoRenewMonths = months
 			return s.saveLocked()
 		}
 	}
 	return fmt.Errorf("订阅不存在")
 }
 
+// AutoRenewSubscription moves the expiry from oldExpires to newExpires and
+// logs the renewal. It fails if the expiry was changed in the meantime, so
+// a concurrent manual edit is never overwritten.
+func (s *Store) AutoRenewSubscription(id int, oldExpires, newExpires string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sub := range s.data.Subscriptions {
+		if sub.ID != id {
+			continue
+		}
+		if sub.ExpiresAt != oldExpires {
+			return fmt.Errorf("订阅到期日已变更")
+		}
+		s.data.Subscriptions[i].ExpiresAt = newExpires
+		amount, currency := s.renewalAmountLocked(sub, newExpires)
+		s.data.Renewals = append(s.data.Renewals, Renewal{
+			SubscriptionID: id,
+			OldExpiresAt:   oldExpires,
+			NewExpiresAt:   newExpires,
+			Auto:           true,
+			Amount:         amount,
+			Currency:       currency,
+			At:             now.Format(time.RFC3339),
+		})
+		s.recordExpiryLocked(id, oldExpires, newExpires, now)
+		return s.saveLocked()
+	}
+	return fmt.Errorf("订阅不存在")
+}
+
+// ClaimRenewalConfirm records that a confirmation for the subscription's new
+// expiry is being sent. It reports false when one was already recorded for
+// the same idempotency key or the same subscription and expiry, so each
+// renewal sends at most one confirmation.
+func (s *Store) ClaimRenewalConfirm(subscriptionID int, key, expiresAt string, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.data.Confirms {
+		if (key != "" && c.Key == key) || (c.SubscriptionID == subscriptionID && c.ExpiresAt == expiresAt) {
+			return false, nil
+		}
+	}
+	s.data.Confirms = append(s.data.Confirms, RenewalConfirm{
+		SubscriptionID: subscriptionID,
+		Key:            key,
+		ExpiresAt:      expiresAt,
+		At:             now.Format(time.RFC3339),
+	})
+	return true, s.saveLocked()
+}
+
+// ReleaseRenewalConfirm drops a claim whose confirmation could not be
+// queued, so a retry can send it.
+func (s *Store) ReleaseRenewalConfirm(subscriptionID int, expiresAt string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var confirms []RenewalConfirm
+	for _, c := range s.data.Confirms {
+		if c.SubscriptionID != subscriptionID || c.ExpiresAt != expiresAt {
+			confirms = append(confirms, c)
+		}
+	}
+	s.data.Confirms = confirms
+	return s.saveLocked()
+}
+
+// ListRenewals returns the renewal log of a subscription, newest first.
+func (s *Store) ListRenewals(subscriptionID int) ([]Renewal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Renewal
+	for i := len(s.data.Renewals) - 1; i >= 0; i-- {
+		if s.data.Renewals[i].SubscriptionID == subscriptionID {
+			out = append(out, s.data.Renewals[i])
+		}
+	}
+	return out, nil
+}
+
 func (s *Store) DeleteSubscription(id int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -424,29 +1592,401 @@ func (s *Store) CountStats() (customers, products, subs int, err error) {
 	return len(s.data.Customers), len(s.data.Products), len(s.data.Subscriptions), nil
 }
 
-func (s *Store) ListDueSubscriptions() ([]SubscriptionDetail, error) {
+// StoreSize is how many records of each kind the store holds in memory and
+// the size of the data file, for diagnosing memory growth.
+type StoreSize struct {
+	FileBytes int64          `json:"file_bytes"`
+	Records   map[string]int `json:"records"`
+}
+
+func (s *Store) Size() (StoreSize, error) {
+	s.mu.Lock()
+	size := StoreSize{Records: map[string]int{
+		"customers":        len(s.data.Customers),
+		"products":         len(s.data.Products),
+		"subscriptions":    len(s.data.Subscriptions),
+		"settings":         len(s.data.Settings),
+		"rule_sends":       len(s.data.RuleSends),
+		"outbox":           len(s.data.Outbox),
+		"deliveries":       len(s.data.Deliveries),
+		"scan_runs":        len(s.data.ScanRuns),
+		"renewals":         len(s.data.Renewals),
+		"renewal_confirms": len(s.data.Confirms),
+		"attachments":      len(s.data.Attachments),
+		"reminder_threads": len(s.data.Threads),
+		"renewal_replies":  len(s.data.Replies),
+		"expiry_pushes":    len(s.data.Pushes),
+		"users":            len(s.data.Users),
+		"calendar_events":  len(s.data.Events),
+		"caldav_events":    len(s.data.CalDAVEvents),
+		"feed_events":      len(s.data.Feed),
+	}}
+	s.mu.Unlock()
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return size, err
+	}
+	size.FileBytes = info.Size()
+	return size, nil
+}
+
+func (s *Store) ListDueSubscriptions(ctx context.Context) ([]SubscriptionDetail, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	return s.ListSubscriptions()
 }
 
-func (s *Store) HasDailySend(subscriptionID int, date string) (bool, error) {
+func (s *Store) HasRuleSend(subscriptionID int, expiresAt string, rule int, hourly bool) (bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for _, send := range s.data.DailySends {
-		if send.SubscriptionID == subscriptionID && send.SentDate == date {
+	for _, send := range s.data.RuleSends {
+		if send.SubscriptionID == subscriptionID && send.ExpiresAt == expiresAt && send.Rule == rule && send.Hourly == hourly {
 			return true, nil
 		}
 	}
 	return false, nil
 }
 
-func (s *Store) RecordDailySend(subscriptionID int, date string, now time.Time) error {
+// CountRuleSends returns how many reminders went out for the subscription's
+// given expiry date.
+func (s *Store) CountRuleSends(subscriptionID int, expiresAt string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, send := range s.data.RuleSends {
+		if send.SubscriptionID == subscriptionID && send.ExpiresAt == expiresAt {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *Store) RecordRuleSend(subscriptionID int, expiresAt string, rule int, hourly bool, now time.Time) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.data.DailySends = append(s.data.DailySends, DailySend{
+	s.data.RuleSends = append(s.data.RuleSends, RuleSend{
 		SubscriptionID: subscriptionID,
-		SentDate:       date,
+		ExpiresAt:      expiresAt,
+		Rule:           rule,
+		Hourly:         hourly,
 		SentAt:         now.Format(time.RFC3339),
 	})
+	s.recordFeedLocked(FeedEvent{Type: FeedExpiring, SubscriptionID: subscriptionID, ExpiresAt: expiresAt, Rule: rule, Hourly: hourly}, now)
+	return s.saveLocked()
+}
+
+// ThreadMessageIDs returns the Message-IDs of the reminders already queued
+// for the subscription's expiry date, oldest first.
+func (s *Store) ThreadMessageIDs(subscriptionID int, expiresAt string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, thread := range s.data.Threads {
+		if thread.SubscriptionID == subscriptionID && thread.ExpiresAt == expiresAt {
+			return append([]string(nil), thread.MessageIDs...), nil
+		}
+	}
+	return nil, nil
+}
+
+// AddThreadMessage appends a queued reminder's Message-ID to the thread for
+// the subscription's expiry date.
+func (s *Store) AddThreadMessage(subscriptionID int, expiresAt, messageID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, thread := range s.data.Threads {
+		if thread.SubscriptionID == subscriptionID && thread.ExpiresAt == expiresAt {
+			s.data.Threads[i].MessageIDs = append(s.data.Threads[i].MessageIDs, messageID)
+			return s.saveLocked()
+		}
+	}
+	s.data.Threads = append(s.data.Threads, ReminderThread{
+		SubscriptionID: subscriptionID,
+		ExpiresAt:      expiresAt,
+		MessageIDs:     []string{messageID},
+	})
+	return s.saveLocked()
+}
+
+func (s *Store) GetSetting(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.Settings[key], nil
+}
+
+func (s *Store) SetSetting(key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Settings[key] = value
+	return s.saveLocked()
+}
+
+// SchedulerPaused reports whether automated scans are paused and since when.
+func (s *Store) SchedulerPaused() (bool, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.Settings["scheduler_paused"] == "1", s.data.Settings["scheduler_paused_at"], nil
+}
+
+func (s *Store) SetSchedulerPaused(paused bool, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if paused {
+		s.data.Settings["scheduler_paused"] = "1"
+		s.data.Settings["scheduler_paused_at"] = now.Format(time.RFC3339)
+	} else {
+		delete(s.data.Settings, "scheduler_paused")
+		delete(s.data.Settings, "scheduler_paused_at")
+	}
+	return s.saveLocked()
+}
+
+func (s *Store) RecordDelivery(d Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Deliveries = append(s.data.Deliveries, d)
+	return s.saveLocked()
+}
+
+// SentSince returns when each email recorded as sent since the given time
+// went out. Chat messages don't count.
+func (s *Store) SentSince(since time.Time) ([]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []time.Time
+	for _, d := range s.data.Deliveries {
+		if (d.Status != DeliverySent && d.Status != DeliveryBounced) || d.Channel != "" {
+			continue
+		}
+		if at, err := time.Parse(time.RFC3339, d.At); err == nil && at.After(since) {
+			out = append(out, at)
+		}
+	}
+	return out, nil
+}
+
+// RecordFailure logs a failed delivery unless the same error was already
+// logged for the subscription that day, so repeated scans don't flood the log.
+func (s *Store) RecordFailure(d Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.data.Deliveries {
+		if existing.Status == DeliveryFailed && existing.SubscriptionID == d.SubscriptionID &&
+			existing.Date == d.Date && existing.Error == d.Error {
+			return nil
+		}
+	}
+	d.Status = DeliveryFailed
+	s.data.Deliveries = append(s.data.Deliveries, d)
+	return s.saveLocked()
+}
+
+func (s *Store) ListDeliveries(date string) ([]Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Delivery
+	for _, d := range s.data.Deliveries {
+		if d.Date == date {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+// ListDeliveriesBetween returns the sends logged from from through to,
+// oldest first.
+func (s *Store) ListDeliveriesBetween(from, to time.Time) ([]Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Delivery
+	for _, d := range s.data.Deliveries {
+		if at, err := time.Parse(time.RFC3339, d.At); err == nil && !at.Before(from) && !at.After(to) {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+// RecordScanRun appends a run to the history, dropping the oldest beyond maxScanRuns.
+func (s *Store) RecordScanRun(run ScanRun) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if run.ID == 0 {
+		run.ID = s.nextScanRunIDLocked()
+	}
+	s.data.ScanRuns = append(s.data.ScanRuns, run)
+	if len(s.data.ScanRuns) > maxScanRuns {
+		s.data.ScanRuns = append([]ScanRun(nil), s.data.ScanRuns[len(s.data.ScanRuns)-maxScanRuns:]...)
+	}
+	return s.saveLocked()
+}
+
+// ReserveScanRunID returns the ID for a scan that is about to start, so its
+// log lines can name the run before RecordScanRun stores it.
+func (s *Store) ReserveScanRunID() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextScanRunIDLocked()
+}
+
+func (s *Store) nextScanRunIDLocked() int {
+	// Runs are stored as they finish, so a later ID may come first.
+	for _, run := range s.data.ScanRuns {
+		s.scanRunSeq = max(s.scanRunSeq, run.ID)
+	}
+	s.scanRunSeq++
+	return s.scanRunSeq
+}
+
+// ListScanRuns returns up to limit runs, newest first.
+func (s *Store) ListScanRuns(limit int) ([]ScanRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []ScanRun
+	for i := len(s.data.ScanRuns) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, s.data.ScanRuns[i])
+	}
+	return out, nil
+}
+
+func (s *Store) EnqueueEmail(ctx context.Context, msg OutboxEmail, now time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg.ID = s.nextOutboxID()
+	msg.Status = OutboxPending
+	msg.Attempts = 0
+	msg.NextAttemptAt = now.Format(time.RFC3339)
+	msg.CreatedAt = now.Format(time.RFC3339)
+	s.data.Outbox = append(s.data.Outbox, msg)
+	return s.saveLocked()
+}
+
+// ClaimOutboxEmail marks the oldest pending message that is due, and that
+// allow accepts unless it is nil, as sending and returns it, so concurrent
+// workers never pick up the same message.
+func (s *Store) ClaimOutboxEmail(ctx context.Context, now time.Time, allow func(OutboxEmail) bool) (OutboxEmail, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return OutboxEmail{}, false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, msg := range s.data.Outbox {
+		if msg.Status != OutboxPending {
+			continue
+		}
+		if next, err := time.Parse(time.RFC3339, msg.NextAttemptAt); err == nil && next.After(now) {
+			continue
+		}
+		if allow != nil && !allow(msg) {
+			continue
+		}
+		s.data.Outbox[i].Status = OutboxSending
+		s.data.Outbox[i].Attempts++
+		if err := s.saveLocked(); err != nil {
+			return OutboxEmail{}, false, err
+		}
+		return s.data.Outbox[i], true, nil
+	}
+	return OutboxEmail{}, false, nil
+}
+
+func (s *Store) CompleteOutboxEmail(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var outbox []OutboxEmail
+	for _, msg := range s.data.Outbox {
+		if msg.ID != id {
+			outbox = append(outbox, msg)
+		}
+	}
+	s.data.Outbox = outbox
+	return s.saveLocked()
+}
+
+func (s *Store) RetryOutboxEmail(id int, lastError string, next time.Time) error {
+	return s.updateOutboxEmail(id, func(msg *OutboxEmail) {
+		msg.Status = OutboxPending
+		msg.LastError = lastError
+		msg.NextAttemptAt = next.Format(time.RFC3339)
+	})
+}
+
+// DeferOutboxEmail puts a claimed message back until next without counting
+// the claim as a delivery attempt, e.g. when a send limit was reached.
+func (s *Store) DeferOutboxEmail(id int, reason string, next time.Time) error {
+	return s.updateOutboxEmail(id, func(msg *OutboxEmail) {
+		msg.Status = OutboxPending
+		msg.Attempts--
+		msg.LastError = reason
+		msg.NextAttemptAt = next.Format(time.RFC3339)
+	})
+}
+
+func (s *Store) FailOutboxEmail(id int, lastError string, now time.Time) error {
+	return s.updateOutboxEmail(id, func(msg *OutboxEmail) {
+		msg.Status = OutboxFailed
+		msg.LastError = lastError
+		msg.FailedAt = now.Format(time.RFC3339)
+	})
+}
+
+// PruneFailedOutbox removes the messages that failed before cutoff and
+// returns how many it removed. Messages sent successfully leave the outbox
+// at once, with the delivery log as their record. Messages that failed
+// before failure times were recorded count from when they were queued.
+func (s *Store) PruneFailedOutbox(cutoff time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var outbox []OutboxEmail
+	for _, msg := range s.data.Outbox {
+		at := msg.FailedAt
+		if at == "" {
+			at = msg.CreatedAt
+		}
+		if t, err := time.Parse(time.RFC3339, at); msg.Status == OutboxFailed && err == nil && t.Before(cutoff) {
+			continue
+		}
+		outbox = append(outbox, msg)
+	}
+	removed := len(s.data.Outbox) - len(outbox)
+	if removed == 0 {
+		return 0, nil
+	}
+	s.data.Outbox = outbox
+	return removed, s.saveLocked()
+}
+
+func (s *Store) updateOutboxEmail(id int, update func(*OutboxEmail)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.data.Outbox {
+		if s.data.Outbox[i].ID == id {
+			update(&s.data.Outbox[i])
+			return s.saveLocked()
+		}
+	}
+	return fmt.Errorf("邮件不存在")
+}
+
+// RequeueInterrupted puts messages that were mid-delivery when the process
+// stopped back into the pending state. Only the process that sends the
+// queue calls it, before it starts sending.
+func (s *Store) RequeueInterrupted() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for i := range s.data.Outbox {
+		if s.data.Outbox[i].Status == OutboxSending {
+			s.data.Outbox[i].Status = OutboxPending
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
 	return s.saveLocked()
 }
 
@@ -480,6 +2020,16 @@ func (s *Store) nextSubscriptionID() int {
 	return max + 1
 }
 
+func (s *Store) nextOutboxID() int {
+	max := 0
+	for _, c := range s.data.Outbox {
+		if c.ID > max {
+			max = c.ID
+		}
+	}
+	return max + 1
+}
+
 func (s *Store) findCustomer(id int) (Customer, bool) {
 	for _, c := range s.data.Customers {
 		if c.ID == id {
@@ -489,6 +2039,15 @@ func (s *Store) findCustomer(id int) (Customer, bool) {
 	return Customer{}, false
 }
 
+func (s *Store) findSubscription(id int) (Subscription, bool) {
+	for _, sub := range s.data.Subscriptions {
+		if sub.ID == id {
+			return sub, true
+		}
+	}
+	return Subscription{}, false
+}
+
 func (s *Store) findProduct(id int) (Product, bool) {
 	for _, p := range s.data.Products {
 		if p.ID == id {
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DomainName returns the domain the subscription's expiry follows: its
+// Domain, or for a domain product the first line of its note when that is
+// a domain name. It is empty for subscriptions that aren't domains, and
+// for those synced from WHMCS or following a certificate, whose expiry
+// follows that instead.
+func (d SubscriptionDetail) DomainName() string {
+	if d.WHMCSID != 0 || d.CertHost != "" {
+		return ""
+	}
+	if d.Domain != "" {
+		return d.Domain
+	}
+	if !d.ProductDomain {
+		return ""
+	}
+	name, _, _ := strings.Cut(strings.TrimSpace(d.Note), "\n")
+	name = strings.ToLower(strings.TrimSpace(name))
+	if ValidateDomain(name) != nil {
+		return ""
+	}
+	return name
+}
+
+// ValidateDomain checks that name looks like a registered domain name in
+// ASCII form, such as example.com or xn--fiqs8s.cn.
+func ValidateDomain(name string) error {
+	labels := strings.Split(name, ".")
+	if len(name) > 253 || len(labels) < 2 {
+		return fmt.Errorf("域名格式错误: %s", name)
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("域名格式错误: %s", name)
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return fmt.Errorf("域名格式错误: %s（中文域名请填写 xn-- 开头的形式）", name)
+			}
+		}
+	}
+	return nil
+}
+
+// SetSubscriptionDomain sets the domain the subscription's expiry follows;
+// an empty one stops the lookups, unless its product is a domain product.
+func (s *Store) SetSubscriptionDomain(id int, domain string) error {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if domain != "" {
+		if err := ValidateDomain(domain); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sub := range s.data.Subscriptions {
+		if sub.ID == id {
+			if domain != "" && sub.CertHost != "" {
+				return fmt.Errorf("订阅已跟随证书 %s 的到期日，请先清除证书主机", sub.CertHost)
+			}
+			if sub.Domain != domain {
+				s.data.Subscriptions[i].DomainCheckedAt = ""
+				s.data.Subscriptions[i].DomainExpiresAt = ""
+				s.data.Subscriptions[i].DomainError = ""
+			}
+			s.data.Subscriptions[i].Domain = domain
+			return s.saveLocked()
+		}
+	}
+	return fmt.Errorf("订阅不存在")
+}
+
+// SetProductDomain marks the product as a domain registration product, or
+// not.
+func (s *Store) SetProductDomain(id int, domain bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, p := range s.data.Products {
+		if p.ID == id {
+			s.data.Products[i].Domain = domain
+			return s.saveLocked()
+		}
+	}
+	return fmt.Errorf("产品不存在")
+}
+
+// RecordDomainCheck records a lookup of the subscription's domain: the
+// registry expiry, or the error it failed with. When newExpires differs
+// from oldExpires the expiry moves to it, unless it was changed here in
+// the meantime; it reports whether it moved.
+func (s *Store) RecordDomainCheck(id int, oldExpires, newExpires, registryExpires, errText string, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sub := range s.data.Subscriptions {
+		if sub.ID != id {
+			continue
+		}
+		s.data.Subscriptions[i].DomainCheckedAt = now.Format(time.RFC3339)
+		s.data.Subscriptions[i].DomainError = errText
+		if registryExpires != "" {
+			s.data.Subscriptions[i].DomainExpiresAt = registryExpires
+		}
+		moved := false
+		if newExpires != "" && newExpires != oldExpires && sub.ExpiresAt == oldExpires {
+			s.recordExpiryLocked(id, oldExpires, newExpires, now)
+			s.data.Subscriptions[i].ExpiresAt = newExpires
+			moved = true
+		}
+		return moved, s.saveLocked()
+	}
+	return false, fmt.Errorf("订阅不存在")
+}
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Export writes the whole data file as indented JSON, the format Import
+// reads back. Attachment contents and archived messages live beside the
+// data file and are not included.
+func (s *Store) Export(w io.Writer) error {
+	s.mu.Lock()
+	payload, err := json.MarshalIndent(s.data, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(payload, '\n'))
+	return err
+}
+
+// Import replaces all data with an Export dump. Unless replace is set it
+// refuses to overwrite a store that already has customers or
+// subscriptions.
+func (s *Store) Import(r io.Reader, replace bool) error {
+	var data snapshot
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&data); err != nil {
+		return fmt.Errorf("导入文件格式错误: %w", err)
+	}
+	if data.Settings == nil {
+		data.Settings = map[string]string{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !replace && (len(s.data.Customers) > 0 || len(s.data.Subscriptions) > 0) {
+		return fmt.Errorf("数据文件已有客户或订阅，确认覆盖请使用 -replace")
+	}
+	s.data = data
+	return s.saveLocked()
+}
@@ -0,0 +1,93 @@
+package db
+
+import "time"
+
+// Feed event types, as the API names them.
+const (
+	FeedCreated  = "subscription.created"
+	FeedRenewed  = "subscription.renewed"
+	FeedExpiring = "subscription.expiring"
+)
+
+// maxFeedEvents bounds the event feed kept in the store; a poller that
+// falls further behind misses the oldest events.
+const maxFeedEvents = 5000
+
+// FeedEvent is an entry of the event feed that no-code tools poll. IDs
+// increase, so the last one seen is the cursor for the next poll.
+// ExpiresAt is the expiry the event is about: the new one for a renewal,
+// whose previous one is OldExpiresAt, and the one reminded of for an
+// expiring subscription, with the reminder rule that fired.
+type FeedEvent struct {
+	ID             int    `json:"id"`
+	Type           string `json:"type"`
+	SubscriptionID int    `json:"subscription_id"`
+	ExpiresAt      string `json:"expires_at"`
+	OldExpiresAt   string `json:"old_expires_at,omitempty"`
+	Rule           int    `json:"rule,omitempty"`
+	Hourly         bool   `json:"hourly,omitempty"`
+	At             string `json:"at"`
+}
+
+// ListFeedEvents returns up to limit events after the cursor since,
+// oldest first. A negative since returns the latest limit events instead.
+func (s *Store) ListFeedEvents(since, limit int, types []string) ([]FeedEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	want := map[string]bool{}
+	for _, t := range types {
+		want[t] = true
+	}
+	var out []FeedEvent
+	for _, e := range s.data.Feed {
+		if e.ID > since && (len(want) == 0 || want[e.Type]) {
+			out = append(out, e)
+		}
+	}
+	if since < 0 && len(out) > limit {
+		return out[len(out)-limit:], nil
+	}
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// ListFeedEventsBetween returns the events of the given type recorded from
+// from through to, oldest first.
+func (s *Store) ListFeedEventsBetween(eventType string, from, to time.Time) ([]FeedEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []FeedEvent
+	for _, e := range s.data.Feed {
+		if e.Type != eventType {
+			continue
+		}
+		if at, err := time.Parse(time.RFC3339, e.At); err == nil && !at.Before(from) && !at.After(to) {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// recordFeedLocked appends an event to the feed, dropping the oldest
+// beyond maxFeedEvents. The caller saves.
+func (s *Store) recordFeedLocked(event FeedEvent, now time.Time) {
+	event.ID = 1
+	if n := len(s.data.Feed); n > 0 {
+		event.ID = s.data.Feed[n-1].ID + 1
+	}
+	event.At = now.Format(time.RFC3339)
+	s.data.Feed = append(s.data.Feed, event)
+	if len(s.data.Feed) > maxFeedEvents {
+		s.data.Feed = append([]FeedEvent(nil), s.data.Feed[len(s.data.Feed)-maxFeedEvents:]...)
+	}
+}
+
+// recordExpiryLocked records a renewal when an expiry moved later; moving
+// it earlier is a correction, not a renewal.
+func (s *Store) recordExpiryLocked(id int, oldExpires, newExpires string, now time.Time) {
+	if newExpires > oldExpires {
+		s.recordFeedLocked(FeedEvent{Type: FeedRenewed, SubscriptionID: id, ExpiresAt: newExpires, OldExpiresAt: oldExpires}, now)
+	}
+}
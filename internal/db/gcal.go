@@ -0,0 +1,92 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// googleSyncedKey is the setting holding when the Google Calendar sync last
+// read the calendar's changes.
+const googleSyncedKey = "google_calendar_synced_at"
+
+// CalendarEvent links a subscription to the Google Calendar event of its
+// expiry. ExpiresAt is the expiry the event was last written or read with,
+// and Hash a digest of the rest of its content, so the sync only writes
+// events that changed. The link outlives the subscription until the sync
+// has deleted the event.
+type CalendarEvent struct {
+	SubscriptionID int    `json:"subscription_id"`
+	EventID        string `json:"event_id"`
+	ExpiresAt      string `json:"expires_at"`
+	Hash           string `json:"hash"`
+}
+
+// ListCalendarEvents returns every subscription's event link.
+func (s *Store) ListCalendarEvents() ([]CalendarEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]CalendarEvent(nil), s.data.Events...), nil
+}
+
+// PutCalendarEvent adds or replaces the subscription's event link.
+func (s *Store) PutCalendarEvent(event CalendarEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range s.data.Events {
+		if e.SubscriptionID == event.SubscriptionID {
+			s.data.Events[i] = event
+			return s.saveLocked()
+		}
+	}
+	s.data.Events = append(s.data.Events, event)
+	return s.saveLocked()
+}
+
+// DeleteCalendarEvent drops the subscription's event link.
+func (s *Store) DeleteCalendarEvent(subscriptionID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range s.data.Events {
+		if e.SubscriptionID == subscriptionID {
+			s.data.Events = append(s.data.Events[:i], s.data.Events[i+1:]...)
+			return s.saveLocked()
+		}
+	}
+	return nil
+}
+
+// MoveExpiry changes the subscription's expiry from oldExpires to
+// newExpires, as the event's date was moved in the calendar. It fails if
+// the expiry was changed here in the meantime, which wins.
+func (s *Store) MoveExpiry(id int, oldExpires, newExpires string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sub := range s.data.Subscriptions {
+		if sub.ID != id {
+			continue
+		}
+		if sub.ExpiresAt != oldExpires {
+			return fmt.Errorf("订阅到期日已变更")
+		}
+		s.recordExpiryLocked(id, oldExpires, newExpires, now)
+		s.data.Subscriptions[i].ExpiresAt = newExpires
+		return s.saveLocked()
+	}
+	return fmt.Errorf("订阅不存在")
+}
+
+// GoogleCalendarSyncedAt returns when the calendar's changes were last
+// read, or the zero time before the first sync.
+func (s *Store) GoogleCalendarSyncedAt() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	at, _ := time.Parse(time.RFC3339, s.data.Settings[googleSyncedKey])
+	return at
+}
+
+func (s *Store) SetGoogleCalendarSyncedAt(at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Settings[googleSyncedKey] = at.UTC().Format(time.RFC3339)
+	return s.saveLocked()
+}
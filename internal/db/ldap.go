@@ -0,0 +1,136 @@
+package db
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// LDAPContact is a directory entry worth a customer.
+type LDAPContact struct {
+	DN         string
+	Email      string
+	Name       string
+	Department string
+	Tags       []string
+}
+
+// LDAPCount is what SyncLDAP changed. Skipped counts entries sharing an
+// email with another entry or customer, which are left out.
+type LDAPCount struct {
+	Added, Updated, Skipped int
+}
+
+// SyncLDAP brings the customers imported from the directory in line with
+// contacts, in one write. An entry is matched by DN, then by email, so
+// customers entered here before the first import are linked rather than
+// duplicated. Customers whose entry is gone are kept: they may still have
+// subscriptions to renew.
+func (s *Store) SyncLDAP(contacts []LDAPContact, now time.Time) (LDAPCount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var count LDAPCount
+	for _, contact := range contacts {
+		email := strings.TrimSpace(contact.Email)
+		if email == "" || contact.DN == "" {
+			continue
+		}
+		tags := normalizeTags(contact.Tags)
+		i := s.ldapCustomerLocked(contact.DN, email)
+		if i < 0 && s.emailTakenLocked(email, 0) {
+			count.Skipped++
+			continue
+		}
+		if i < 0 {
+			s.data.Customers = append(s.data.Customers, Customer{
+				ID:         s.nextCustomerID(),
+				Email:      email,
+				Name:       contact.Name,
+				LDAPDN:     contact.DN,
+				Department: contact.Department,
+				Tags:       tags,
+				CreatedAt:  now.Format(time.RFC3339),
+			})
+			count.Added++
+			continue
+		}
+		c := &s.data.Customers[i]
+		changed := c.LDAPDN != contact.DN || c.Department != contact.Department || !slices.Equal(c.Tags, tags)
+		if c.Email != email && !s.emailTakenLocked(email, c.ID) {
+			c.Email = email
+			changed = true
+		}
+		// A WHMCS client keeps the name WHMCS has for it.
+		if contact.Name != "" && c.WHMCSID == 0 && c.Name != contact.Name {
+			c.Name = contact.Name
+			changed = true
+		}
+		c.LDAPDN, c.Department, c.Tags = contact.DN, contact.Department, tags
+		if changed {
+			count.Updated++
+		}
+	}
+	if count.Added == 0 && count.Updated == 0 {
+		return count, nil
+	}
+	return count, s.saveLocked()
+}
+
+// ldapCustomerLocked returns the index of the customer linked to the
+// directory entry, or with its email, or -1.
+func (s *Store) ldapCustomerLocked(dn, email string) int {
+	for i, c := range s.data.Customers {
+		if strings.EqualFold(c.LDAPDN, dn) {
+			return i
+		}
+	}
+	for i, c := range s.data.Customers {
+		if c.LDAPDN == "" && strings.EqualFold(c.Email, email) {
+			return i
+		}
+	}
+	return -1
+}
+
+// SetCustomerTags replaces the customer's tags.
+func (s *Store) SetCustomerTags(id int, tags []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, c := range s.data.Customers {
+		if c.ID == id {
+			s.data.Customers[i].Tags = normalizeTags(tags)
+			return s.saveLocked()
+		}
+	}
+	return fmt.Errorf("客户不存在")
+}
+
+// HasTag reports whether the customer carries tag, ignoring case.
+func (c Customer) HasTag(tag string) bool {
+	for _, t := range c.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTags reads tags separated by commas, either width.
+func ParseTags(input string) []string {
+	return normalizeTags(strings.FieldsFunc(input, func(r rune) bool { return r == ',' || r == '，' }))
+}
+
+// normalizeTags trims tags and drops empty and repeated ones, keeping the
+// order so an unchanged import compares equal.
+func normalizeTags(tags []string) []string {
+	var out []string
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || slices.ContainsFunc(out, func(t string) bool { return strings.EqualFold(t, tag) }) {
+			continue
+		}
+		out = append(out, tag)
+	}
+	return out
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// storeLock guards the in-memory data. Processes sharing the data file,
+// such as a web panel and a separate scheduler, also hold an exclusive
+// lock on "<path>.data.lock" while they read or change it, and Lock
+// rereads the file first if another process has written it, so each
+// change starts from the latest data.
+type storeLock struct {
+	sync.Mutex
+	store *Store
+	file  *os.File
+}
+
+func (l *storeLock) Lock() {
+	l.Mutex.Lock()
+	if l.file == nil {
+		return
+	}
+	if err := lockFile(l.file); err != nil {
+		// Still usable by this process alone.
+		return
+	}
+	l.store.refreshLocked()
+}
+
+func (l *storeLock) Unlock() {
+	if l.file != nil {
+		releaseFile(l.file)
+	}
+	l.Mutex.Unlock()
+}
+
+// AcquireSchedulerLock tries to make this instance the one that runs
+// scheduled scans. The JSON store takes an exclusive lock on "<path>.lock"
+// and keeps it until Close or process exit, so a standby replica on the same
+// volume takes over once the holder goes away. Every instance keeps its own
+// copy of the data in memory, so a freshly acquired lock reloads the file to
+// pick up what the previous holder wrote. A SQL backend would implement this
+// with an advisory lock instead.
+func (s *Store) AcquireSchedulerLock() (bool, error) {
+	s.lockMu.Lock()
+	defer s.lockMu.Unlock()
+	if s.schedulerLock != nil {
+		return true, nil
+	}
+	f, ok, err := tryLockFile(s.path + ".lock")
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := s.load(); err != nil {
+		unlockFile(f)
+		return false, err
+	}
+	host, _ := os.Hostname()
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "%s pid=%d\n", host, os.Getpid())
+	}
+	s.schedulerLock = f
+	return true, nil
+}
+
+// HoldsSchedulerLock reports whether this instance runs scheduled scans.
+func (s *Store) HoldsSchedulerLock() bool {
+	s.lockMu.Lock()
+	defer s.lockMu.Unlock()
+	return s.schedulerLock != nil
+}
+
+// SchedulerLockHolder returns the host and process ID the instance that
+// holds the scheduler lock wrote into the lock file, or "" if no instance
+// holds it. A holder that crashed leaves its line behind but not its lock,
+// so unless this instance is the holder the lock is tried without waiting
+// first, and a free lock's stale line is cleared.
+func (s *Store) SchedulerLockHolder() (string, error) {
+	s.lockMu.Lock()
+	defer s.lockMu.Unlock()
+	path := s.path + ".lock"
+	if s.schedulerLock == nil {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return "", nil
+		}
+		f, free, err := tryLockFile(path)
+		if err != nil {
+			return "", err
+		}
+		if free {
+			f.Truncate(0)
+			return "", unlockFile(f)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (s *Store) releaseSchedulerLock() error {
+	s.lockMu.Lock()
+	defer s.lockMu.Unlock()
+	if s.schedulerLock == nil {
+		return nil
+	}
+	// Clear the holder's line so it isn't reported once the lock is free.
+	s.schedulerLock.Truncate(0)
+	err := unlockFile(s.schedulerLock)
+	s.schedulerLock = nil
+	return err
+}
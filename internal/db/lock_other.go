@@ -0,0 +1,28 @@
+//go:build !unix
+
+package db
+
+import "os"
+
+// tryLockFile has no cross-process exclusion on this platform; a single
+// instance always gets the lock.
+func tryLockFile(path string) (*os.File, bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, false, err
+	}
+	return f, true, nil
+}
+
+// lockFile has no cross-process exclusion on this platform either.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func releaseFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return f.Close()
+}
@@ -0,0 +1,38 @@
+package db
+
+import "time"
+
+// ExpiryPush records that a subscription was pushed to the admin's phone
+// on the day its expiry date falls, so each expiry is pushed once however
+// often the scanner runs that day.
+type ExpiryPush struct {
+	SubscriptionID int    `json:"subscription_id"`
+	ExpiresAt      string `json:"expires_at"`
+	PushedAt       string `json:"pushed_at"`
+}
+
+// HasExpiryPush reports whether the subscription's expiry date was pushed.
+func (s *Store) HasExpiryPush(subscriptionID int, expiresAt string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, push := range s.data.Pushes {
+		if push.SubscriptionID == subscriptionID && push.ExpiresAt == expiresAt {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RecordExpiryPushes records that the expiry dates of subs were pushed.
+func (s *Store) RecordExpiryPushes(subs []SubscriptionDetail, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sub := range subs {
+		s.data.Pushes = append(s.data.Pushes, ExpiryPush{
+			SubscriptionID: sub.ID,
+			ExpiresAt:      sub.ExpiresAt,
+			PushedAt:       now.Format(time.RFC3339),
+		})
+	}
+	return s.saveLocked()
+}
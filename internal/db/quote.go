@@ -0,0 +1,155 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultCurrency is the currency of a price without one.
+const DefaultCurrency = "CNY"
+
+// QuoteSettings controls the PDF quote attached to reminders. Payment is
+// printed at the bottom: bank account, payee, what to put in the
+// reference.
+type QuoteSettings struct {
+	Enabled bool   `json:"enabled"`
+	Payment string `json:"payment"`
+}
+
+func (s *Store) GetQuoteSettings() (QuoteSettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var settings QuoteSettings
+	if value, ok := s.data.Settings["quote"]; ok {
+		if err := json.Unmarshal([]byte(value), &settings); err != nil {
+			return QuoteSettings{}, err
+		}
+	}
+	return settings, nil
+}
+
+func (s *Store) UpdateQuoteSettings(settings QuoteSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	s.data.Settings["quote"] = string(payload)
+	return s.saveLocked()
+}
+
+// SetProductPrice sets the renewal price of the product and the months it
+// pays for; an empty price takes the product out of quotes.
+func (s *Store) SetProductPrice(id int, price, currency string, months int) error {
+	if months < 0 {
+		return fmt.Errorf("续费月数不能为负数")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, p := range s.data.Products {
+		if p.ID == id {
+			s.data.Products[i].Price = price
+			s.data.Products[i].Currency = currency
+			s.data.Products[i].RenewalMonths = months
+			return s.saveLocked()
+		}
+	}
+	return fmt.Errorf("产品不存在")
+}
+
+var (
+	priceRe    = regexp.MustCompile(`^\d{1,12}(\.\d{1,2})?$`)
+	currencyRe = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+// ParsePrice checks a price such as "1200" or "99.5" and returns it with
+// two decimals.
+func ParsePrice(input string) (string, error) {
+	input = strings.ReplaceAll(strings.TrimSpace(input), ",", "")
+	if !priceRe.MatchString(input) {
+		return "", fmt.Errorf("价格格式错误: %s", input)
+	}
+	return FormatCents(PriceCents(input), ""), nil
+}
+
+// ParseCurrency checks an ISO 4217 code such as CNY or USD; empty is
+// DefaultCurrency.
+func ParseCurrency(input string) (string, error) {
+	code := strings.ToUpper(strings.TrimSpace(input))
+	if code == "" {
+		return DefaultCurrency, nil
+	}
+	if !currencyRe.MatchString(code) {
+		return "", fmt.Errorf("币种须为三位字母代码，如 CNY、USD: %s", input)
+	}
+	return code, nil
+}
+
+// PriceCents returns a price checked by ParsePrice in hundredths.
+func PriceCents(price string) int64 {
+	whole, frac, _ := strings.Cut(price, ".")
+	units, _ := strconv.ParseInt(whole, 10, 64)
+	frac = (frac + "00")[:2]
+	cents, _ := strconv.ParseInt(frac, 10, 64)
+	return units*100 + cents
+}
+
+// FormatCents writes an amount in hundredths with thousands separators
+// when sep is set, as in "1,200.00".
+func FormatCents(cents int64, sep string) string {
+	whole := strconv.FormatInt(cents/100, 10)
+	if sep != "" {
+		for i := len(whole) - 3; i > 0; i -= 3 {
+			whole = whole[:i] + sep + whole[i:]
+		}
+	}
+	return fmt.Sprintf("%s.%02d", whole, cents%100)
+}
+
+// renewalAmountLocked prices moving sub's expiry to newExpires at its
+// product's price, pro rata for the months added against the product's
+// renewal months.
+func (s *Store) renewalAmountLocked(sub Subscription, newExpires string) (string, string) {
+	product, ok := s.findProduct(sub.ProductID)
+	months := monthsBetween(sub.ExpiresAt, newExpires)
+	if !ok || product.Price == "" || months <= 0 {
+		return "", ""
+	}
+	period := int64(product.RenewalMonths)
+	if period <= 0 {
+		period = 12
+	}
+	cents := (PriceCents(product.Price)*int64(months) + period/2) / period
+	currency := product.Currency
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	return FormatCents(cents, ""), currency
+}
+
+// monthsBetween counts the whole calendar months from one expiry to a
+// later one, by date; it is zero or less when to isn't a month later.
+func monthsBetween(from, to string) int {
+	a, errA := time.Parse("2006-01-02", firstN(from, 10))
+	b, errB := time.Parse("2006-01-02", firstN(to, 10))
+	if errA != nil || errB != nil {
+		return 0
+	}
+	months := (b.Year()-a.Year())*12 + int(b.Month()-a.Month())
+	if b.Day() < a.Day() {
+		months--
+	}
+	return months
+}
+
+func firstN(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
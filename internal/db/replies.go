@@ -0,0 +1,188 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Renewal reply statuses.
+const (
+	ReplyPending   = "pending"
+	ReplyConfirmed = "confirmed"
+	ReplyDismissed = "dismissed"
+)
+
+// RenewalReply is a customer's reply to a reminder that reads as if the
+// subscription was renewed, held for an operator to confirm. ExpiresAt is
+// the expiry date the reminder was about; Keyword is what matched.
+type RenewalReply struct {
+	ID             int    `json:"id"`
+	SubscriptionID int    `json:"subscription_id"`
+	ExpiresAt      string `json:"expires_at"`
+	MessageID      string `json:"message_id"`
+	From           string `json:"from"`
+	Subject        string `json:"subject"`
+	Text           string `json:"text"`
+	Keyword        string `json:"keyword"`
+	ReceivedAt     string `json:"received_at"`
+	Status         string `json:"status"`
+	ResolvedAt     string `json:"resolved_at,omitempty"`
+}
+
+// ReplyListItem is a pending reply with the names the list shows.
+type ReplyListItem struct {
+	RenewalReply
+	CustomerName string
+	ProductName  string
+}
+
+// ReplyPollState is how far the reply mailbox has been read: messages up
+// to LastUID are done, as long as the mailbox keeps its UIDValidity.
+type ReplyPollState struct {
+	Mailbox     string `json:"mailbox"`
+	UIDValidity int64  `json:"uid_validity"`
+	LastUID     int    `json:"last_uid"`
+}
+
+func (s *Store) GetReplyPollState() (ReplyPollState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var state ReplyPollState
+	if value, ok := s.data.Settings["reply_poll"]; ok {
+		if err := json.Unmarshal([]byte(value), &state); err != nil {
+			return ReplyPollState{}, err
+		}
+	}
+	return state, nil
+}
+
+func (s *Store) UpdateReplyPollState(state ReplyPollState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	s.data.Settings["reply_poll"] = string(payload)
+	return s.saveLocked()
+}
+
+// ThreadSubscriptions returns the subscriptions whose reminders for their
+// current expiry date include one of messageIDs; a combined reminder
+// covers several. Replies to reminders for an earlier expiry date, which
+// has since been renewed, match nothing.
+func (s *Store) ThreadSubscriptions(messageIDs []string) ([]Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := map[string]bool{}
+	for _, id := range messageIDs {
+		ids[id] = true
+	}
+	var out []Subscription
+	for _, thread := range s.data.Threads {
+		if !slices.ContainsFunc(thread.MessageIDs, func(id string) bool { return ids[id] }) {
+			continue
+		}
+		if sub, ok := s.findSubscription(thread.SubscriptionID); ok && sub.ExpiresAt == thread.ExpiresAt {
+			out = append(out, sub)
+		}
+	}
+	return out, nil
+}
+
+// AddRenewalReply flags reply for confirmation. It reports false without
+// adding anything if the same message was already taken for the
+// subscription.
+func (s *Store) AddRenewalReply(reply RenewalReply, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.data.Replies {
+		if reply.MessageID != "" && r.MessageID == reply.MessageID && r.SubscriptionID == reply.SubscriptionID {
+			return false, nil
+		}
+	}
+	max := 0
+	for _, r := range s.data.Replies {
+		if r.ID > max {
+			max = r.ID
+		}
+	}
+	reply.ID = max + 1
+	reply.Status = ReplyPending
+	if reply.ReceivedAt == "" {
+		reply.ReceivedAt = now.Format(time.RFC3339)
+	}
+	s.data.Replies = append(s.data.Replies, reply)
+	return true, s.saveLocked()
+}
+
+// ListSubscriptionReplies returns the subscription's replies, newest first.
+func (s *Store) ListSubscriptionReplies(subscriptionID int) ([]RenewalReply, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []RenewalReply
+	for _, r := range s.data.Replies {
+		if r.SubscriptionID == subscriptionID {
+			out = append(out, r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID > out[j].ID })
+	return out, nil
+}
+
+// ListPendingReplies returns the replies awaiting confirmation, oldest
+// first. A reply is moot once its subscription's expiry date has moved on,
+// however it was renewed.
+func (s *Store) ListPendingReplies() ([]ReplyListItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []ReplyListItem
+	for _, r := range s.data.Replies {
+		if r.Status != ReplyPending {
+			continue
+		}
+		sub, ok := s.findSubscription(r.SubscriptionID)
+		if !ok || sub.ExpiresAt != r.ExpiresAt {
+			continue
+		}
+		customer, _ := s.findCustomer(sub.CustomerID)
+		product, _ := s.findProduct(sub.ProductID)
+		out = append(out, ReplyListItem{RenewalReply: r, CustomerName: customer.Name, ProductName: product.Name})
+	}
+	return out, nil
+}
+
+// ResolveReply confirms or dismisses a pending reply.
+func (s *Store) ResolveReply(id int, status string, now time.Time) error {
+	if status != ReplyConfirmed && status != ReplyDismissed {
+		return fmt.Errorf("无效的处理结果")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range s.data.Replies {
+		if r.ID != id {
+			continue
+		}
+		if r.Status != ReplyPending {
+			return fmt.Errorf("该回复已处理")
+		}
+		s.data.Replies[i].Status = status
+		s.data.Replies[i].ResolvedAt = now.Format(time.RFC3339)
+		return s.saveLocked()
+	}
+	return fmt.Errorf("回复不存在")
+}
+
+// replyPendingLocked reports whether a reply for the subscription's
+// expiry date awaits confirmation.
+func (s *Store) replyPendingLocked(subscriptionID int, expiresAt string) bool {
+	for _, r := range s.data.Replies {
+		if r.SubscriptionID == subscriptionID && r.ExpiresAt == expiresAt && r.Status == ReplyPending {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// seedKey is the setting that lists the records AddSeed created, so
+// WipeSeed removes those and nothing entered by hand.
+const seedKey = "seed_ids"
+
+type seedIDs struct {
+	Customers     []int `json:"customers"`
+	Products      []int `json:"products"`
+	Subscriptions []int `json:"subscriptions"`
+}
+
+// SeedData is generated demo data. A subscription's CustomerID and
+// ProductID are indexes into Customers and Products; IDs are assigned on
+// insert.
+type SeedData struct {
+	Customers     []Customer
+	Products      []Product
+	Subscriptions []Subscription
+}
+
+// SeedCount is how many records AddSeed added or WipeSeed removed.
+type SeedCount struct {
+	Customers, Products, Subscriptions int
+}
+
+// AddSeed inserts the demo data in one write. A product whose name is
+// already taken is reused rather than added; a customer whose email is
+// taken is an error.
+func (s *Store) AddSeed(data SeedData, now time.Time) (SeedCount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, err := s.seedIDsLocked()
+	if err != nil {
+		return SeedCount{}, err
+	}
+	emails := map[string]bool{}
+	for _, c := range s.data.Customers {
+		emails[c.Email] = true
+	}
+	var count SeedCount
+	created := now.Format(time.RFC3339)
+
+	customerIDs := make([]int, len(data.Customers))
+	for i, c := range data.Customers {
+		if emails[c.Email] {
+			return SeedCount{}, fmt.Errorf("邮箱已存在: %s", c.Email)
+		}
+		emails[c.Email] = true
+		c.ID = s.nextCustomerID()
+		c.CreatedAt = created
+		s.data.Customers = append(s.data.Customers, c)
+		customerIDs[i] = c.ID
+		ids.Customers = append(ids.Customers, c.ID)
+		count.Customers++
+	}
+	productIDs := make([]int, len(data.Products))
+	for i, p := range data.Products {
+		if existing, ok := s.findProductByName(p.Name); ok {
+			productIDs[i] = existing.ID
+			continue
+		}
+		p.ID = s.nextProductID()
+		p.CreatedAt = created
+		s.data.Products = append(s.data.Products, p)
+		productIDs[i] = p.ID
+		ids.Products = append(ids.Products, p.ID)
+		count.Products++
+	}
+	for _, sub := range data.Subscriptions {
+		if sub.CustomerID < 0 || sub.CustomerID >= len(customerIDs) || sub.ProductID < 0 || sub.ProductID >= len(productIDs) {
+			return SeedCount{}, fmt.Errorf("订阅引用的客户或产品不存在")
+		}
+		sub.ID = s.nextSubscriptionID()
+		sub.CustomerID = customerIDs[sub.CustomerID]
+		sub.ProductID = productIDs[sub.ProductID]
+		sub.CreatedAt = created
+		s.data.Subscriptions = append(s.data.Subscriptions, sub)
+		ids.Subscriptions = append(ids.Subscriptions, sub.ID)
+		count.Subscriptions++
+	}
+	payload, err := json.Marshal(ids)
+	if err != nil {
+		return SeedCount{}, err
+	}
+	s.data.Settings[seedKey] = string(payload)
+	return count, s.saveLocked()
+}
+
+// WipeSeed removes every record AddSeed created, the subscriptions of
+// seeded customers and products, and the emails still queued for them.
+func (s *Store) WipeSeed() (SeedCount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, err := s.seedIDsLocked()
+	if err != nil {
+		return SeedCount{}, err
+	}
+	customers := idSet(ids.Customers)
+	products := idSet(ids.Products)
+	subs := idSet(ids.Subscriptions)
+	var count SeedCount
+
+	keptSubs := s.data.Subscriptions[:0]
+	removed := map[int]bool{}
+	for _, sub := range s.data.Subscriptions {
+		if subs[sub.ID] || customers[sub.CustomerID] || products[sub.ProductID] {
+			removed[sub.ID] = true
+			count.Subscriptions++
+			continue
+		}
+		keptSubs = append(keptSubs, sub)
+	}
+	s.data.Subscriptions = keptSubs
+	keptCustomers := s.data.Customers[:0]
+	for _, c := range s.data.Customers {
+		if customers[c.ID] {
+			count.Customers++
+			continue
+		}
+		keptCustomers = append(keptCustomers, c)
+	}
+	s.data.Customers = keptCustomers
+	keptProducts := s.data.Products[:0]
+	for _, p := range s.data.Products {
+		if products[p.ID] {
+			count.Products++
+			continue
+		}
+		keptProducts = append(keptProducts, p)
+	}
+	s.data.Products = keptProducts
+	keptOutbox := s.data.Outbox[:0]
+	for _, msg := range s.data.Outbox {
+		if removed[msg.SubscriptionID] && (msg.Status == OutboxPending || msg.Status == OutboxSending) {
+			continue
+		}
+		keptOutbox = append(keptOutbox, msg)
+	}
+	s.data.Outbox = keptOutbox
+	delete(s.data.Settings, seedKey)
+	return count, s.saveLocked()
+}
+
+func (s *Store) seedIDsLocked() (seedIDs, error) {
+	var ids seedIDs
+	if value, ok := s.data.Settings[seedKey]; ok {
+		if err := json.Unmarshal([]byte(value), &ids); err != nil {
+			return seedIDs{}, err
+		}
+	}
+	return ids, nil
+}
+
+func (s *Store) findProductByName(name string) (Product, bool) {
+	for _, p := range s.data.Products {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Product{}, false
+}
+
+func idSet(ids []int) map[int]bool {
+	set := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
@@ -0,0 +1,56 @@
+package db
+
+import "encoding/json"
+
+const slackTemplateKey = "slack_template"
+
+// SlackTemplate holds the text templates for Slack messages, kept apart
+// from the email templates since Slack takes its own mrkdwn markup rather
+// than HTML. Scan renders a scan summary and HighPriority the alert posted
+// when a high-priority subscription is sent a reminder. An empty field
+// uses the default.
+type SlackTemplate struct {
+	Scan         string `json:"scan"`
+	HighPriority string `json:"high_priority"`
+}
+
+var defaultSlackTemplate = SlackTemplate{
+	Scan: `*{{ .Company }}* {{ if eq .Trigger "manual" }}手动{{ else if eq .Trigger "cli" }}命令行{{ else }}定时{{ end }}扫描（{{ .StartedAt }}）
+检查 {{ .Total }} 个订阅：入队 {{ .Queued }}，跳过 {{ .Skipped }}，失败 {{ .Failed }}{{ if .Renewed }}，自动续费 {{ .Renewed }}{{ end }}
+{{ if .Error }}:x: 扫描出错：{{ .Error }}
+{{ end }}{{ range .Failures }}• {{ . }}
+{{ end }}`,
+	HighPriority: `:rotating_light: *高优先级订阅{{ if lt .DaysLeft 0 }}已过期{{ else }}即将到期{{ end }}*
+{{ .Customer.Name }}（{{ .Customer.Email }}）的 {{ .Product.Name }} 于 {{ .Subscription.ExpiresAt }} 到期{{ if ge .DaysLeft 0 }}，剩余 {{ .DaysLeft }} 天{{ end }}，续费提醒已加入发送队列。{{ if .URL }}
+<{{ .URL }}|查看订阅>{{ end }}`,
+}
+
+// GetSlackTemplate returns the Slack templates with the defaults filled in.
+func (s *Store) GetSlackTemplate() (SlackTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var tpl SlackTemplate
+	if value, ok := s.data.Settings[slackTemplateKey]; ok {
+		if err := json.Unmarshal([]byte(value), &tpl); err != nil {
+			return SlackTemplate{}, err
+		}
+	}
+	if tpl.Scan == "" {
+		tpl.Scan = defaultSlackTemplate.Scan
+	}
+	if tpl.HighPriority == "" {
+		tpl.HighPriority = defaultSlackTemplate.HighPriority
+	}
+	return tpl, nil
+}
+
+func (s *Store) UpdateSlackTemplate(tpl SlackTemplate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload, err := json.Marshal(tpl)
+	if err != nil {
+		return err
+	}
+	s.data.Settings[slackTemplateKey] = string(payload)
+	return s.saveLocked()
+}
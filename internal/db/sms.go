@@ -0,0 +1,78 @@
+package db
+
+import "encoding/json"
+
+const (
+	smsTemplateKey = "sms_template"
+	smsRulesKey    = "sms_rules"
+)
+
+// SMSTemplate holds the text templates for SMS reminders, which are kept
+// short since a message over 70 Chinese characters is split and billed as
+// several. Reminder renders the reminder for paid subscriptions and Trial
+// the one for trials. An empty field uses the default.
+type SMSTemplate struct {
+	Reminder string `json:"reminder"`
+	Trial    string `json:"trial"`
+}
+
+var defaultSMSTemplate = SMSTemplate{
+	Reminder: `【{{ .Company }}】{{ .Customer.Name }}您好，您的{{ .Product.Name }}{{ if gt (len .Items) 1 }}等{{ len .Items }}项服务{{ end }}{{ if lt .DaysLeft 0 }}已于{{ .Subscription.ExpiresAt }}到期{{ else if eq .DaysLeft 0 }}今天到期{{ else }}将于{{ .Subscription.ExpiresAt }}到期{{ end }}，请及时续费。`,
+	Trial:    `【{{ .Company }}】{{ .Customer.Name }}您好，您的{{ .Product.Name }}试用{{ if lt .DaysLeft 0 }}已结束{{ else if eq .DaysLeft 0 }}今天结束{{ else }}将于{{ .Subscription.ExpiresAt }}结束{{ end }}，如需继续使用请联系我们开通。`,
+}
+
+// GetSMSTemplate returns the SMS templates with the defaults filled in.
+func (s *Store) GetSMSTemplate() (SMSTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var tpl SMSTemplate
+	if value, ok := s.data.Settings[smsTemplateKey]; ok {
+		if err := json.Unmarshal([]byte(value), &tpl); err != nil {
+			return SMSTemplate{}, err
+		}
+	}
+	if tpl.Reminder == "" {
+		tpl.Reminder = defaultSMSTemplate.Reminder
+	}
+	if tpl.Trial == "" {
+		tpl.Trial = defaultSMSTemplate.Trial
+	}
+	return tpl, nil
+}
+
+func (s *Store) UpdateSMSTemplate(tpl SMSTemplate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload, err := json.Marshal(tpl)
+	if err != nil {
+		return err
+	}
+	s.data.Settings[smsTemplateKey] = string(payload)
+	return s.saveLocked()
+}
+
+// GetSMSRules returns the day rules at which customers with a phone number
+// get an SMS reminder; there are none by default. A rule that is also an
+// email rule sends both, one that is only an SMS rule sends the SMS alone.
+func (s *Store) GetSMSRules() ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rules []int
+	if value, ok := s.data.Settings[smsRulesKey]; ok {
+		if err := json.Unmarshal([]byte(value), &rules); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+func (s *Store) UpdateSMSRules(rules []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	s.data.Settings[smsRulesKey] = string(payload)
+	return s.saveLocked()
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"slices"
+	"time"
+)
+
+// RecordOpen notes that the email sent with reference was opened. It
+// reports whether the reference matched a send log entry.
+func (s *Store) RecordOpen(reference string, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.data.Deliveries) - 1; i >= 0; i-- {
+		d := &s.data.Deliveries[i]
+		if d.Reference != reference {
+			continue
+		}
+		if d.OpenedAt == "" {
+			d.OpenedAt = at.Format(time.RFC3339)
+		}
+		d.Opens++
+		return true, s.saveLocked()
+	}
+	return false, nil
+}
+
+// ClickTarget returns the original target of link n of the email sent with
+// reference without recording a click, or false when there is no such link.
+func (s *Store) ClickTarget(reference string, n int) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.data.Deliveries) - 1; i >= 0; i-- {
+		d := s.data.Deliveries[i]
+		if d.Reference != reference {
+			continue
+		}
+		if n < 0 || n >= len(d.Links) {
+			return "", false, nil
+		}
+		return d.Links[n], true, nil
+	}
+	return "", false, nil
+}
+
+// RecordClick notes a click on link n of the email sent with reference and
+// returns the link's original target, or false when there is no such link.
+func (s *Store) RecordClick(reference string, n int, at time.Time) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.data.Deliveries) - 1; i >= 0; i-- {
+		d := &s.data.Deliveries[i]
+		if d.Reference != reference {
+			continue
+		}
+		if n < 0 || n >= len(d.Links) {
+			return "", false, nil
+		}
+		target := d.Links[n]
+		if d.ClickedAt == "" {
+			d.ClickedAt = at.Format(time.RFC3339)
+		}
+		d.Clicks++
+		if !slices.Contains(d.ClickedLinks, target) {
+			d.ClickedLinks = append(d.ClickedLinks, target)
+		}
+		return target, true, s.saveLocked()
+	}
+	return "", false, nil
+}
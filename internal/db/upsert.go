@@ -0,0 +1,316 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrUpsertRejected means a bulk upsert had failing items, so none of it
+// was applied.
+var ErrUpsertRejected = errors.New("部分条目有误，未做任何修改")
+
+// UpsertItem is one subscription of a bulk upsert with its customer and
+// product, each keyed by the ID the calling system has for it. Optional
+// fields left out (nil, or empty strings for Kind and Priority) keep what
+// is stored.
+type UpsertItem struct {
+	ExternalID      string         `json:"external_id"`
+	Customer        UpsertCustomer `json:"customer"`
+	Product         UpsertProduct  `json:"product"`
+	ExpiresAt       string         `json:"expires_at"`
+	Note            *string        `json:"note"`
+	Kind            string         `json:"kind"`
+	Priority        string         `json:"priority"`
+	AutoRenewMonths *int           `json:"auto_renew_months"`
+}
+
+// UpsertCustomer is matched by ExternalID, then by Email among customers
+// without one, so customers entered here are linked rather than
+// duplicated. Without an ExternalID it is matched by Email alone.
+type UpsertCustomer struct {
+	ExternalID string   `json:"external_id"`
+	Email      string   `json:"email"`
+	Name       string   `json:"name"`
+	Phone      *string  `json:"phone"`
+	Tags       []string `json:"tags"`
+}
+
+// UpsertProduct is matched by ExternalID, then by Name among products
+// without one. Without an ExternalID it is matched by Name alone.
+type UpsertProduct struct {
+	ExternalID string  `json:"external_id"`
+	Name       string  `json:"name"`
+	Content    *string `json:"content"`
+}
+
+// Upsert item statuses.
+const (
+	UpsertCreated   = "created"
+	UpsertUpdated   = "updated"
+	UpsertUnchanged = "unchanged"
+	UpsertFailed    = "error"
+)
+
+// UpsertResult is what became of one item. Status is UpsertUpdated when
+// the subscription, its customer or its product changed.
+type UpsertResult struct {
+	ExternalID     string `json:"external_id"`
+	Status         string `json:"status"`
+	SubscriptionID int    `json:"subscription_id,omitempty"`
+	CustomerID     int    `json:"customer_id,omitempty"`
+	ProductID      int    `json:"product_id,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// BulkUpsert creates or updates the subscriptions of items, with their
+// customers and products, in one write. It is all or nothing: if any item
+// fails, nothing is changed and ErrUpsertRejected is returned with the
+// results, where the other items show what would have happened. dryRun
+// does the same without failures. Expiry dates must be validated by the
+// caller.
+func (s *Store) BulkUpsert(items []UpsertItem, dryRun bool, now time.Time) ([]UpsertResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Items update records in place, so work on copies to roll back to.
+	before := s.data
+	s.data.Customers = slices.Clone(s.data.Customers)
+	s.data.Products = slices.Clone(s.data.Products)
+	s.data.Subscriptions = slices.Clone(s.data.Subscriptions)
+
+	results := make([]UpsertResult, len(items))
+	seen := map[string]bool{}
+	failed, changed := false, false
+	for i, item := range items {
+		res, err := s.upsertLocked(item, seen, now)
+		res.ExternalID = item.ExternalID
+		if err != nil {
+			res.Status, res.Error = UpsertFailed, err.Error()
+			failed = true
+		}
+		changed = changed || res.Status == UpsertCreated || res.Status == UpsertUpdated
+		results[i] = res
+	}
+	if failed {
+		s.data = before
+		return results, ErrUpsertRejected
+	}
+	if dryRun || !changed {
+		s.data = before
+		return results, nil
+	}
+	if err := s.saveLocked(); err != nil {
+		s.data = before
+		return results, err
+	}
+	return results, nil
+}
+
+func (s *Store) upsertLocked(item UpsertItem, seen map[string]bool, now time.Time) (UpsertResult, error) {
+	var res UpsertResult
+	externalID := strings.TrimSpace(item.ExternalID)
+	if externalID == "" {
+		return res, fmt.Errorf("external_id 不能为空")
+	}
+	if seen[externalID] {
+		return res, fmt.Errorf("external_id 重复")
+	}
+	seen[externalID] = true
+	switch item.Kind {
+	case "", KindPaid, KindTrial:
+	default:
+		return res, fmt.Errorf("无效订阅类型: %s", item.Kind)
+	}
+	switch item.Priority {
+	case "", PriorityLow, PriorityNormal, PriorityHigh:
+	default:
+		return res, fmt.Errorf("无效优先级: %s", item.Priority)
+	}
+	if item.AutoRenewMonths != nil && *item.AutoRenewMonths < 0 {
+		return res, fmt.Errorf("续费周期不能为负数")
+	}
+
+	customerID, customerChanged, err := s.upsertCustomerLocked(item.Customer, now)
+	if err != nil {
+		return res, fmt.Errorf("客户: %w", err)
+	}
+	productID, productChanged, err := s.upsertProductLocked(item.Product, now)
+	if err != nil {
+		return res, fmt.Errorf("产品: %w", err)
+	}
+	res.CustomerID, res.ProductID = customerID, productID
+
+	index := slices.IndexFunc(s.data.Subscriptions, func(sub Subscription) bool { return sub.ExternalID == externalID })
+	if index < 0 {
+		if item.ExpiresAt == "" {
+			return res, fmt.Errorf("新建订阅需要 expires_at")
+		}
+		sub := Subscription{
+			ID:         s.nextSubscriptionID(),
+			CustomerID: customerID,
+			ProductID:  productID,
+			ExpiresAt:  item.ExpiresAt,
+			Kind:       item.Kind,
+			Priority:   item.Priority,
+			ExternalID: externalID,
+			CreatedAt:  now.Format(time.RFC3339),
+		}
+		if item.Note != nil {
+			sub.Note = *item.Note
+		}
+		if item.AutoRenewMonths != nil {
+			sub.AutoRenewMonths = *item.AutoRenewMonths
+		}
+		s.data.Subscriptions = append(s.data.Subscriptions, sub)
+		s.recordFeedLocked(FeedEvent{Type: FeedCreated, SubscriptionID: sub.ID, ExpiresAt: sub.ExpiresAt}, now)
+		res.SubscriptionID, res.Status = sub.ID, UpsertCreated
+		return res, nil
+	}
+
+	sub := &s.data.Subscriptions[index]
+	res.SubscriptionID = sub.ID
+	changed := customerChanged || productChanged
+	if sub.CustomerID != customerID || sub.ProductID != productID {
+		sub.CustomerID, sub.ProductID = customerID, productID
+		changed = true
+	}
+	if item.ExpiresAt != "" && item.ExpiresAt != sub.ExpiresAt {
+		s.setExpiryLocked(index, item.ExpiresAt, now)
+		changed = true
+	}
+	if item.Note != nil && *item.Note != sub.Note {
+		sub.Note = *item.Note
+		changed = true
+	}
+	if item.Kind != "" && item.Kind != sub.Kind {
+		sub.Kind = item.Kind
+		changed = true
+	}
+	if item.Priority != "" && item.Priority != sub.Priority {
+		sub.Priority = item.Priority
+		changed = true
+	}
+	if item.AutoRenewMonths != nil && *item.AutoRenewMonths != sub.AutoRenewMonths {
+		sub.AutoRenewMonths = *item.AutoRenewMonths
+		changed = true
+	}
+	res.Status = UpsertUnchanged
+	if changed {
+		res.Status = UpsertUpdated
+	}
+	return res, nil
+}
+
+// upsertCustomerLocked returns the ID of the customer c stands for, added
+// or brought up to date, and whether anything changed.
+func (s *Store) upsertCustomerLocked(c UpsertCustomer, now time.Time) (int, bool, error) {
+	externalID := strings.TrimSpace(c.ExternalID)
+	email := strings.TrimSpace(c.Email)
+	if email == "" {
+		return 0, false, fmt.Errorf("邮箱不能为空")
+	}
+	index := -1
+	if externalID != "" {
+		index = slices.IndexFunc(s.data.Customers, func(cu Customer) bool { return cu.ExternalID == externalID })
+	}
+	if index < 0 {
+		index = slices.IndexFunc(s.data.Customers, func(cu Customer) bool { return strings.EqualFold(cu.Email, email) })
+		if index >= 0 && externalID != "" && s.data.Customers[index].ExternalID != "" {
+			return 0, false, fmt.Errorf("邮箱 %s 已属于外部 ID 为 %s 的客户", email, s.data.Customers[index].ExternalID)
+		}
+	}
+	if index < 0 {
+		customer := Customer{
+			ID:         s.nextCustomerID(),
+			Email:      email,
+			Name:       c.Name,
+			Tags:       normalizeTags(c.Tags),
+			ExternalID: externalID,
+			CreatedAt:  now.Format(time.RFC3339),
+		}
+		if c.Phone != nil {
+			customer.Phone = *c.Phone
+		}
+		s.data.Customers = append(s.data.Customers, customer)
+		return customer.ID, true, nil
+	}
+	customer := &s.data.Customers[index]
+	changed := false
+	if customer.ExternalID != externalID && externalID != "" {
+		customer.ExternalID = externalID
+		changed = true
+	}
+	if customer.Email != email {
+		if s.emailTakenLocked(email, customer.ID) {
+			return 0, false, fmt.Errorf("邮箱 %s 已被其他客户使用", email)
+		}
+		customer.Email = email
+		changed = true
+	}
+	if c.Name != "" && c.Name != customer.Name {
+		customer.Name = c.Name
+		changed = true
+	}
+	if c.Phone != nil && *c.Phone != customer.Phone {
+		customer.Phone = *c.Phone
+		changed = true
+	}
+	if tags := normalizeTags(c.Tags); c.Tags != nil && !slices.Equal(tags, customer.Tags) {
+		customer.Tags = tags
+		changed = true
+	}
+	return customer.ID, changed, nil
+}
+
+// upsertProductLocked returns the ID of the product p stands for, added or
+// brought up to date, and whether anything changed.
+func (s *Store) upsertProductLocked(p UpsertProduct, now time.Time) (int, bool, error) {
+	externalID := strings.TrimSpace(p.ExternalID)
+	name := strings.TrimSpace(p.Name)
+	index := -1
+	if externalID != "" {
+		index = slices.IndexFunc(s.data.Products, func(pr Product) bool { return pr.ExternalID == externalID })
+	}
+	if index < 0 && name != "" {
+		index = slices.IndexFunc(s.data.Products, func(pr Product) bool { return pr.Name == name })
+		if index >= 0 && externalID != "" && s.data.Products[index].ExternalID != "" {
+			return 0, false, fmt.Errorf("产品名称“%s”已属于外部 ID 为 %s 的产品", name, s.data.Products[index].ExternalID)
+		}
+	}
+	if index < 0 {
+		if name == "" {
+			return 0, false, fmt.Errorf("新建产品需要名称")
+		}
+		product := Product{
+			ID:         s.nextProductID(),
+			Name:       name,
+			ExternalID: externalID,
+			CreatedAt:  now.Format(time.RFC3339),
+		}
+		if p.Content != nil {
+			product.Content = *p.Content
+		}
+		s.data.Products = append(s.data.Products, product)
+		return product.ID, true, nil
+	}
+	product := &s.data.Products[index]
+	changed := false
+	if product.ExternalID != externalID && externalID != "" {
+		product.ExternalID = externalID
+		changed = true
+	}
+	if name != "" && name != product.Name {
+		if slices.ContainsFunc(s.data.Products, func(pr Product) bool { return pr.Name == name }) {
+			return 0, false, fmt.Errorf("产品名称“%s”已存在", name)
+		}
+		product.Name = name
+		changed = true
+	}
+	if p.Content != nil && *p.Content != product.Content {
+		product.Content = *p.Content
+		changed = true
+	}
+	return product.ID, changed, nil
+}
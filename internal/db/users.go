@@ -0,0 +1,312 @@
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// User is a panel login. Only a salted PBKDF2-SHA256 hash of the password
+// is kept. MustChangePassword is set for passwords someone else chose, the
+// first admin's from ADMIN_PASS or a reset, and cleared once the user
+// picks their own. An empty Role is RoleAdmin, for users added before
+// there were roles.
+type User struct {
+	Name               string `json:"name"`
+	PasswordHash       string `json:"password_hash"`
+	MustChangePassword bool   `json:"must_change_password,omitempty"`
+	Role               string `json:"role,omitempty"`
+	CreatedAt          string `json:"created_at"`
+}
+
+// User roles. Admins can do everything; viewers can look at every page
+// and report but change nothing except their own password.
+const (
+	RoleAdmin  = "admin"
+	RoleViewer = "viewer"
+)
+
+// passwordIterations is the PBKDF2 work factor for new hashes. Stored
+// hashes record their own, so raising it doesn't lock anyone out.
+const passwordIterations = 210000
+
+// minPasswordLength applies to passwords users choose themselves.
+const minPasswordLength = 8
+
+// ListUsers returns the panel users in the order they were added.
+func (s *Store) ListUsers() ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]User(nil), s.data.Users...), nil
+}
+
+// AddUser creates a panel login with the given role.
+func (s *Store) AddUser(name, password, role string, now time.Time) error {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.Contains(name, ":") {
+		return fmt.Errorf("用户名不能为空或包含冒号")
+	}
+	if password == "" {
+		return fmt.Errorf("密码不能为空")
+	}
+	if err := checkRole(role); err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.data.Users {
+		if u.Name == name {
+			return fmt.Errorf("用户 %s 已存在", name)
+		}
+	}
+	s.data.Users = append(s.data.Users, User{Name: name, PasswordHash: hash, Role: role, CreatedAt: now.Format(time.RFC3339)})
+	return s.saveLocked()
+}
+
+// UserRole returns the user's role; unknown users get RoleViewer, so a
+// check that fails open can't grant anything.
+func (s *Store) UserRole(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.data.Users {
+		if u.Name == name {
+			return u.RoleName()
+		}
+	}
+	return RoleViewer
+}
+
+// SetRole changes a user's role, keeping at least one admin.
+func (s *Store) SetRole(name, role string) error {
+	if err := checkRole(role); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, u := range s.data.Users {
+		if u.Name != name {
+			continue
+		}
+		if role != RoleAdmin && s.lastAdminLocked(name) {
+			return fmt.Errorf("至少需要保留一个管理员")
+		}
+		s.data.Users[i].Role = role
+		return s.saveLocked()
+	}
+	return fmt.Errorf("用户 %s 不存在", name)
+}
+
+// RoleName returns u's role, RoleAdmin when none is set.
+func (u User) RoleName() string {
+	if u.Role == "" {
+		return RoleAdmin
+	}
+	return u.Role
+}
+
+func checkRole(role string) error {
+	if role != RoleAdmin && role != RoleViewer {
+		return fmt.Errorf("无效角色: %s", role)
+	}
+	return nil
+}
+
+// lastAdminLocked reports whether name is the only admin.
+func (s *Store) lastAdminLocked(name string) bool {
+	for _, u := range s.data.Users {
+		if u.Name != name && u.RoleName() == RoleAdmin {
+			return false
+		}
+	}
+	return true
+}
+
+// EnsureAdmin creates the first login from ADMIN_USER and ADMIN_PASS when
+// there are no users yet, to be changed on first login. It reports whether
+// it did.
+func (s *Store) EnsureAdmin(name, password string, now time.Time) (bool, error) {
+	s.mu.Lock()
+	empty := len(s.data.Users) == 0
+	s.mu.Unlock()
+	if !empty {
+		return false, nil
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.data.Users) > 0 {
+		return false, nil
+	}
+	s.data.Users = []User{{Name: name, PasswordHash: hash, MustChangePassword: true, Role: RoleAdmin, CreatedAt: now.Format(time.RFC3339)}}
+	return true, s.saveLocked()
+}
+
+// ResetPassword sets a user's password without the current one, for an
+// administrator. The user must change it on next login.
+func (s *Store) ResetPassword(name, password string) error {
+	if password == "" {
+		return fmt.Errorf("密码不能为空")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.data.Users {
+		if s.data.Users[i].Name == name {
+			s.data.Users[i].PasswordHash = hash
+			s.data.Users[i].MustChangePassword = true
+			return s.saveLocked()
+		}
+	}
+	return fmt.Errorf("用户 %s 不存在", name)
+}
+
+// ChangePassword replaces a user's own password after checking the
+// current one.
+func (s *Store) ChangePassword(name, current, next string) error {
+	if len([]rune(next)) < minPasswordLength {
+		return fmt.Errorf("新密码至少 %d 位", minPasswordLength)
+	}
+	if next == current {
+		return fmt.Errorf("新密码不能与当前密码相同")
+	}
+	if !s.CheckUser(name, current) {
+		return fmt.Errorf("当前密码错误")
+	}
+	hash, err := hashPassword(next)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.data.Users {
+		if s.data.Users[i].Name == name {
+			s.data.Users[i].PasswordHash = hash
+			s.data.Users[i].MustChangePassword = false
+			return s.saveLocked()
+		}
+	}
+	return fmt.Errorf("用户 %s 不存在", name)
+}
+
+// MustChangePassword reports whether the user still has to replace a
+// password someone else set.
+func (s *Store) MustChangePassword(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.data.Users {
+		if u.Name == name {
+			return u.MustChangePassword
+		}
+	}
+	return false
+}
+
+// RemoveUser deletes a panel login.
+func (s *Store) RemoveUser(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, u := range s.data.Users {
+		if u.Name == name {
+			if len(s.data.Users) == 1 {
+				return fmt.Errorf("不能删除最后一个用户")
+			}
+			if u.RoleName() == RoleAdmin && s.lastAdminLocked(name) {
+				return fmt.Errorf("不能删除最后一个管理员")
+			}
+			s.data.Users = append(s.data.Users[:i], s.data.Users[i+1:]...)
+			return s.saveLocked()
+		}
+	}
+	return fmt.Errorf("用户 %s 不存在", name)
+}
+
+// CheckUser reports whether name and password match a panel user.
+func (s *Store) CheckUser(name, password string) bool {
+	hash, ok := s.PasswordHash(name)
+	return ok && CheckPassword(hash, password)
+}
+
+// PasswordHash returns the user's stored password hash, or false if there
+// is no such user. The hash changes with every password change or reset,
+// so it can key a cache of logins that have passed CheckPassword.
+func (s *Store) PasswordHash(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.data.Users {
+		if u.Name == name {
+			return u.PasswordHash, true
+		}
+	}
+	return "", false
+}
+
+// hashPassword returns "pbkdf2-sha256$<iterations>$<salt>$<key>" with the
+// salt and key in unpadded base64.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, passwordIterations)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+// CheckPassword reports whether password matches hash, as made by
+// hashPassword.
+func CheckPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := enc.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2SHA256([]byte(password), salt, iterations), want) == 1
+}
+
+// pbkdf2SHA256 derives a 32-byte key as in RFC 8018 with HMAC-SHA256,
+// which needs only the one output block.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
@@ -0,0 +1,233 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// WHMCSData is what a WHMCS sync read: every client and every service
+// worth a subscription.
+type WHMCSData struct {
+	Clients  []WHMCSClient
+	Services []WHMCSService
+}
+
+// WHMCSClient is a WHMCS client, the customer of its services.
+type WHMCSClient struct {
+	ID    int
+	Name  string
+	Email string
+}
+
+// WHMCSService is a WHMCS service (a hosting account, server, licence...).
+// ExpiresAt is its next due date; Active is false for services that were
+// terminated or cancelled.
+type WHMCSService struct {
+	ID          int
+	ClientID    int
+	ProductID   int
+	ProductName string
+	Domain      string
+	ExpiresAt   string
+	Active      bool
+}
+
+// WHMCSCount is what SyncWHMCS changed. ClientsSkipped counts clients
+// sharing an email with another client, which are left out with their
+// services.
+type WHMCSCount struct {
+	CustomersAdded, CustomersUpdated, ClientsSkipped               int
+	ProductsAdded, ProductsMapped                                  int
+	SubscriptionsAdded, SubscriptionsUpdated, SubscriptionsRemoved int
+}
+
+// SyncWHMCS brings the customers and subscriptions imported from WHMCS in
+// line with data, in one write. A client is matched by WHMCS ID, then by
+// email, so customers entered here before the first sync are linked rather
+// than duplicated. A service goes to the product its WHMCS product is
+// mapped to, or else to the product of the same name, which is added if
+// missing and mapped for the next sync. WHMCS owns the expiry of the
+// subscriptions it created; subscriptions whose service was terminated,
+// cancelled or deleted are removed.
+func (s *Store) SyncWHMCS(data WHMCSData, now time.Time) (WHMCSCount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var count WHMCSCount
+	created := now.Format(time.RFC3339)
+
+	customerIDs := map[int]int{}
+	for _, client := range data.Clients {
+		email := strings.TrimSpace(client.Email)
+		if email == "" {
+			continue
+		}
+		i := s.whmcsCustomerLocked(client.ID, email)
+		if i < 0 && s.emailTakenLocked(email, 0) {
+			count.ClientsSkipped++
+			continue
+		}
+		if i < 0 {
+			id := s.nextCustomerID()
+			s.data.Customers = append(s.data.Customers, Customer{
+				ID:        id,
+				Email:     email,
+				Name:      client.Name,
+				WHMCSID:   client.ID,
+				CreatedAt: created,
+			})
+			customerIDs[client.ID] = id
+			count.CustomersAdded++
+			continue
+		}
+		c := &s.data.Customers[i]
+		changed := c.WHMCSID != client.ID || (client.Name != "" && c.Name != client.Name)
+		if c.Email != email && !s.emailTakenLocked(email, c.ID) {
+			c.Email = email
+			changed = true
+		}
+		c.WHMCSID = client.ID
+		if client.Name != "" {
+			c.Name = client.Name
+		}
+		customerIDs[client.ID] = c.ID
+		if changed {
+			count.CustomersUpdated++
+		}
+	}
+
+	services := map[int]WHMCSService{}
+	for _, service := range data.Services {
+		services[service.ID] = service
+	}
+	seen := map[int]bool{}
+	kept := s.data.Subscriptions[:0]
+	for _, sub := range s.data.Subscriptions {
+		if sub.WHMCSID == 0 {
+			kept = append(kept, sub)
+			continue
+		}
+		service, ok := services[sub.WHMCSID]
+		customerID, known := customerIDs[service.ClientID]
+		if !ok || !service.Active || !known || service.ExpiresAt == "" {
+			count.SubscriptionsRemoved++
+			continue
+		}
+		seen[service.ID] = true
+		productID := s.whmcsProductLocked(service, created, &count)
+		expires := service.ExpiresAt
+		if sub.ExpiresDate() == expires {
+			// Keep a time of day set here; WHMCS only has dates.
+			expires = sub.ExpiresAt
+		}
+		if sub.ExpiresAt != expires || sub.CustomerID != customerID || sub.ProductID != productID {
+			s.recordExpiryLocked(sub.ID, sub.ExpiresAt, expires, now)
+			sub.ExpiresAt, sub.CustomerID, sub.ProductID = expires, customerID, productID
+			count.SubscriptionsUpdated++
+		}
+		kept = append(kept, sub)
+	}
+	s.data.Subscriptions = kept
+	for _, service := range data.Services {
+		customerID, known := customerIDs[service.ClientID]
+		if seen[service.ID] || !service.Active || !known || service.ExpiresAt == "" {
+			continue
+		}
+		productID := s.whmcsProductLocked(service, created, &count)
+		id := s.nextSubscriptionID()
+		s.data.Subscriptions = append(s.data.Subscriptions, Subscription{
+			ID:         id,
+			CustomerID: customerID,
+			ProductID:  productID,
+			ExpiresAt:  service.ExpiresAt,
+			Note:       service.Domain,
+			WHMCSID:    service.ID,
+			CreatedAt:  created,
+		})
+		s.recordFeedLocked(FeedEvent{Type: FeedCreated, SubscriptionID: id, ExpiresAt: service.ExpiresAt}, now)
+		count.SubscriptionsAdded++
+	}
+	if count == (WHMCSCount{ClientsSkipped: count.ClientsSkipped}) {
+		return count, nil
+	}
+	return count, s.saveLocked()
+}
+
+// SetProductWHMCS maps WHMCS product IDs to the product. An ID can only be
+// mapped to one product.
+func (s *Store) SetProductWHMCS(id int, whmcsIDs []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	index := -1
+	for i, p := range s.data.Products {
+		if p.ID == id {
+			index = i
+			continue
+		}
+		for _, other := range p.WHMCSProducts {
+			for _, whmcsID := range whmcsIDs {
+				if other == whmcsID {
+					return fmt.Errorf("WHMCS 产品 %d 已关联到产品“%s”", whmcsID, p.Name)
+				}
+			}
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("产品不存在")
+	}
+	s.data.Products[index].WHMCSProducts = whmcsIDs
+	return s.saveLocked()
+}
+
+// whmcsCustomerLocked returns the index of the customer linked to the
+// WHMCS client, or with its email, or -1.
+func (s *Store) whmcsCustomerLocked(clientID int, email string) int {
+	for i, c := range s.data.Customers {
+		if c.WHMCSID == clientID {
+			return i
+		}
+	}
+	for i, c := range s.data.Customers {
+		if c.WHMCSID == 0 && strings.EqualFold(c.Email, email) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *Store) emailTakenLocked(email string, exceptID int) bool {
+	for _, c := range s.data.Customers {
+		if c.ID != exceptID && strings.EqualFold(c.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// whmcsProductLocked returns the product the service's WHMCS product maps
+// to, mapping or adding one by name the first time.
+func (s *Store) whmcsProductLocked(service WHMCSService, created string, count *WHMCSCount) int {
+	for _, p := range s.data.Products {
+		for _, id := range p.WHMCSProducts {
+			if id == service.ProductID {
+				return p.ID
+			}
+		}
+	}
+	for i, p := range s.data.Products {
+		if p.Name == service.ProductName {
+			s.data.Products[i].WHMCSProducts = append(s.data.Products[i].WHMCSProducts, service.ProductID)
+			count.ProductsMapped++
+			return p.ID
+		}
+	}
+	id := s.nextProductID()
+	s.data.Products = append(s.data.Products, Product{
+		ID:            id,
+		Name:          service.ProductName,
+		WHMCSProducts: []int{service.ProductID},
+		CreatedAt:     created,
+	})
+	count.ProductsAdded++
+	return id
+}
@@ -0,0 +1,254 @@
+// Package domain looks up the registry expiry of domain names over RDAP,
+// falling back to WHOIS for registries without RDAP, such as .cn.
+package domain
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"xf/internal/email"
+)
+
+const (
+	defaultBootstrapURL = "https://data.iana.org/rdap/dns.json"
+	defaultWHOISServer  = "whois.iana.org"
+	maxResponse         = 1 << 20
+)
+
+// ErrNotFound is returned for a domain the registry doesn't have.
+var ErrNotFound = errors.New("domain not found at the registry")
+
+// Client looks domains up. BootstrapURL is IANA's RDAP bootstrap file,
+// which maps TLDs to their registry's RDAP server, and WHOISServer the
+// server that refers TLDs to their registry's WHOIS server; both default
+// to IANA's.
+type Client struct {
+	BootstrapURL string
+	WHOISServer  string
+	Client       *http.Client
+}
+
+// Registries maps TLDs to the servers that answer for them. It is read
+// once per run and caches WHOIS referrals as they are made.
+type Registries struct {
+	rdap  map[string]string
+	whois map[string]string
+}
+
+// Registries reads the RDAP bootstrap file.
+func (c Client) Registries(ctx context.Context) (*Registries, error) {
+	url := c.BootstrapURL
+	if url == "" {
+		url = defaultBootstrapURL
+	}
+	body, err := c.get(ctx, url, "RDAP bootstrap")
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Services [][][]string `json:"services"`
+	}
+	if err := json.Unmarshal(body, &file); err != nil {
+		return nil, fmt.Errorf("RDAP bootstrap: %w", err)
+	}
+	r := &Registries{rdap: map[string]string{}, whois: map[string]string{}}
+	for _, service := range file.Services {
+		if len(service) != 2 || len(service[1]) == 0 {
+			continue
+		}
+		base := service[1][0]
+		// Prefer the https server when a registry lists several.
+		for _, u := range service[1] {
+			if strings.HasPrefix(u, "https://") {
+				base = u
+				break
+			}
+		}
+		for _, tld := range service[0] {
+			r.rdap[strings.ToLower(tld)] = strings.TrimRight(base, "/") + "/"
+		}
+	}
+	return r, nil
+}
+
+// Expiry returns when the domain's registration expires, and whether it
+// was read over RDAP or WHOIS.
+func (c Client) Expiry(ctx context.Context, registries *Registries, name string) (time.Time, string, error) {
+	tld := name[strings.LastIndex(name, ".")+1:]
+	if base, ok := registries.rdap[tld]; ok {
+		t, err := c.rdapExpiry(ctx, base, name)
+		return t, "RDAP", err
+	}
+	server, ok := registries.whois[tld]
+	if !ok {
+		response, err := c.whois(ctx, c.whoisServer(), tld)
+		if err != nil {
+			return time.Time{}, "WHOIS", err
+		}
+		server = whoisField(response, "whois")
+		registries.whois[tld] = server
+	}
+	if server == "" {
+		return time.Time{}, "WHOIS", fmt.Errorf("no RDAP or WHOIS server for .%s", tld)
+	}
+	response, err := c.whois(ctx, server, name)
+	if err != nil {
+		return time.Time{}, "WHOIS", err
+	}
+	t, err := parseWHOISExpiry(response)
+	return t, "WHOIS", err
+}
+
+func (c Client) rdapExpiry(ctx context.Context, base, name string) (time.Time, error) {
+	body, err := c.get(ctx, base+"domain/"+name, "RDAP")
+	if err != nil {
+		return time.Time{}, err
+	}
+	var domain struct {
+		Events []struct {
+			Action string `json:"eventAction"`
+			Date   string `json:"eventDate"`
+		} `json:"events"`
+	}
+	if err := json.Unmarshal(body, &domain); err != nil {
+		return time.Time{}, fmt.Errorf("RDAP: %w", err)
+	}
+	for _, event := range domain.Events {
+		if event.Action == "expiration" {
+			return time.Parse(time.RFC3339, event.Date)
+		}
+	}
+	return time.Time{}, errors.New("RDAP response has no expiration event")
+}
+
+func (c Client) get(ctx context.Context, url, what string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/rdap+json, application/json")
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && what == "RDAP" {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode >= 300 {
+		return nil, &email.APIError{Provider: what, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	return body, nil
+}
+
+func (c Client) whoisServer() string {
+	if c.WHOISServer != "" {
+		return c.WHOISServer
+	}
+	return defaultWHOISServer
+}
+
+// whois sends a query to a WHOIS server, on port 43 unless server has
+// one, and returns the response.
+func (c Client) whois(ctx context.Context, server, query string) (string, error) {
+	addr := server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		addr = net.JoinHostPort(server, "43")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return "", fmt.Errorf("WHOIS %s: %w", server, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := io.WriteString(conn, query+"\r\n"); err != nil {
+		return "", fmt.Errorf("WHOIS %s: %w", server, err)
+	}
+	body, err := io.ReadAll(io.LimitReader(conn, maxResponse))
+	if err != nil {
+		return "", fmt.Errorf("WHOIS %s: %w", server, err)
+	}
+	return string(body), nil
+}
+
+// whoisField returns the value of the first "key: value" line with the
+// key, in any case.
+func whoisField(response, key string) string {
+	scanner := bufio.NewScanner(strings.NewReader(response))
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(scanner.Text(), ":")
+		if ok && strings.EqualFold(strings.TrimSpace(k), key) {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// expiryKeys are the labels registries put the expiry under, most
+// specific first.
+var expiryKeys = []string{
+	"registry expiry date",
+	"registrar registration expiration date",
+	"expiration time",
+	"expiration date",
+	"expiry date",
+	"expire date",
+	"expires on",
+	"expires",
+	"paid-till",
+	"expire",
+}
+
+var notFound = regexp.MustCompile(`(?i)no match|not found|no entries found|no data found|status:\s*(free|available)`)
+
+var expiryLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05Z",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04:05 MST",
+	"2006-01-02",
+	"2006.01.02",
+	"2006/01/02",
+	"02-Jan-2006",
+	"02.01.2006",
+}
+
+func parseWHOISExpiry(response string) (time.Time, error) {
+	for _, key := range expiryKeys {
+		value := whoisField(response, key)
+		if value == "" {
+			continue
+		}
+		for _, layout := range expiryLayouts {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("WHOIS expiry %q is in an unknown format", value)
+	}
+	if notFound.MatchString(response) {
+		return time.Time{}, ErrNotFound
+	}
+	return time.Time{}, errors.New("WHOIS response has no expiry date")
+}
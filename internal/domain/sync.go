@@ -0,0 +1,129 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"xf/internal/db"
+	"xf/internal/logging"
+)
+
+const (
+	defaultInterval = 24 * time.Hour
+	lookupTimeout   = 30 * time.Second
+)
+
+// Count is what a sync did: domains looked up, expiries moved to the
+// registry's and lookups that failed.
+type Count struct {
+	Checked, Moved, Failed int
+}
+
+// Syncer keeps the expiry of domain subscriptions on their registry
+// expiry date, as the registry writes it.
+type Syncer struct {
+	Store    *db.Store
+	Client   Client
+	Interval time.Duration
+}
+
+// Start syncs in the background until ctx is cancelled.
+func (s Syncer) Start(ctx context.Context) {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if count, err := s.Sync(ctx, time.Now()); err != nil {
+				slog.Error("domain expiry sync error", "error", err)
+			} else if count.Moved > 0 || count.Failed > 0 {
+				slog.Info("domain expiries synced", "checked", count.Checked, "moved", count.Moved, "failed", count.Failed)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Sync looks up every domain subscription's domain and moves its expiry
+// to the registry's, keeping a time of day set here when the date is the
+// same. A failed lookup is recorded on the subscription and the others go
+// on; an expiry changed here during the lookup is left alone.
+func (s Syncer) Sync(ctx context.Context, now time.Time) (Count, error) {
+	var count Count
+	subs, err := s.Store.ListSubscriptions()
+	if err != nil {
+		return count, err
+	}
+	var registries *Registries
+	for _, sub := range subs {
+		if sub.DomainName() == "" {
+			continue
+		}
+		if registries == nil {
+			if registries, err = s.Client.Registries(ctx); err != nil {
+				return count, err
+			}
+		}
+		if err := s.check(ctx, registries, sub, now, &count); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// Check looks up one subscription's domain, as Sync does.
+func (s Syncer) Check(ctx context.Context, sub db.SubscriptionDetail, now time.Time) (Count, error) {
+	var count Count
+	if sub.DomainName() == "" {
+		return count, nil
+	}
+	registries, err := s.Client.Registries(ctx)
+	if err != nil {
+		return count, err
+	}
+	return count, s.check(ctx, registries, sub, now, &count)
+}
+
+func (s Syncer) check(ctx context.Context, registries *Registries, sub db.SubscriptionDetail, now time.Time, count *Count) error {
+	name := sub.DomainName()
+	count.Checked++
+	lookupCtx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	expiry, source, err := s.Client.Expiry(lookupCtx, registries, name)
+	cancel()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		count.Failed++
+		logging.From(ctx).Warn("domain lookup failed", logging.SubscriptionID, sub.ID, "domain", name, "error", err)
+		errText := err.Error()
+		if errors.Is(err, ErrNotFound) {
+			errText = "注册局查无此域名"
+		}
+		_, err := s.Store.RecordDomainCheck(sub.ID, sub.ExpiresAt, "", "", errText, now)
+		return err
+	}
+	registry := expiry.Format("2006-01-02")
+	expires := registry
+	if sub.ExpiresDate() == registry {
+		expires = sub.ExpiresAt
+	}
+	moved, err := s.Store.RecordDomainCheck(sub.ID, sub.ExpiresAt, expires, registry, "", now)
+	if err != nil {
+		return err
+	}
+	if moved {
+		count.Moved++
+		logging.From(ctx).Info("subscription expiry moved to the domain's registry expiry", logging.SubscriptionID, sub.ID, "domain", name, "source", source, "old_expires_at", sub.ExpiresAt, "new_expires_at", expires)
+	}
+	return nil
+}
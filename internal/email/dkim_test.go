@@ -0,0 +1,94 @@
+package email
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The canonicalization example of RFC 6376 section 3.4.5.
+func TestRelaxedCanonicalization(t *testing.T) {
+	header := "A: X\r\nB : Y\t\r\n\tZ  "
+	fields := parseHeaderFields(header)
+	var got string
+	for _, name := range []string{"A", "B"} {
+		got += relaxedHeader(name, fields[strings.ToLower(name)]) + "\r\n"
+	}
+	if want := "a:X\r\nb:Y Z\r\n"; got != want {
+		t.Errorf("relaxed header = %q, want %q", got, want)
+	}
+	body := " C \r\nD \t E\r\n\r\n\r\n"
+	if got, want := string(relaxedBody([]byte(body))), " C\r\nD E\r\n"; got != want {
+		t.Errorf("relaxed body = %q, want %q", got, want)
+	}
+	if got := relaxedBody(nil); len(got) != 0 {
+		t.Errorf("relaxed empty body = %q, want empty", got)
+	}
+}
+
+// The message of RFC 6376 appendix A, whose body hash is published in A.2.
+const dkimExample = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game. Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+func TestDKIMSign(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &DKIM{Domain: "example.com", Selector: "brisbane", Key: key}
+	signed, err := d.Sign([]byte(strings.ReplaceAll(dkimExample, "\r\n", "\n")), time.Unix(1117574938, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, rest, _ := strings.Cut(string(signed), "\r\n")
+	if rest != dkimExample {
+		t.Fatalf("signed message body = %q, want %q", rest, dkimExample)
+	}
+	value, ok := strings.CutPrefix(line, "DKIM-Signature: ")
+	if !ok {
+		t.Fatalf("first line = %q, want a DKIM-Signature header", line)
+	}
+	tags := map[string]string{}
+	for _, tag := range strings.Split(value, ";") {
+		name, v, _ := strings.Cut(strings.TrimSpace(tag), "=")
+		tags[name] = v
+	}
+	if want := "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8="; tags["bh"] != want {
+		t.Errorf("bh = %s, want %s", tags["bh"], want)
+	}
+	if want := "from:to:subject:date:message-id"; tags["h"] != want {
+		t.Errorf("h = %s, want %s", tags["h"], want)
+	}
+
+	// Verify the signature as a receiver would, over the signed fields and
+	// the signature header with an empty b= tag.
+	header, _, _ := strings.Cut(dkimExample, "\r\n\r\n")
+	fields := parseHeaderFields(header)
+	var input strings.Builder
+	for _, name := range strings.Split(tags["h"], ":") {
+		input.WriteString(relaxedHeader(name, fields[name]) + "\r\n")
+	}
+	input.WriteString(relaxedHeader("DKIM-Signature", strings.TrimSuffix(value, tags["b"])))
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(input.String()))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// defaultFailoverAfter is how many consecutive primary failures trigger the
+// switch when After is not set.
+const defaultFailoverAfter = 3
+
+// Failover sends through Primary until it fails After times in a row, then
+// switches to Secondary for good and calls OnFailover once. Errors about a
+// single recipient or a send limit don't count as failures. The switch
+// lasts until restart so a flapping relay can't bounce mail between two
+// senders.
+type Failover struct {
+	Primary    Sender
+	Secondary  Sender
+	After      int
+	OnFailover func(err error)
+
+	mu        sync.Mutex
+	failures  int
+	secondary bool
+}
+
+func (f *Failover) Enabled() bool {
+	return f.Primary.Enabled() || f.Secondary.Enabled()
+}
+
+// OnSecondary reports whether the switch to Secondary happened.
+func (f *Failover) OnSecondary() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.secondary
+}
+
+func (f *Failover) SendMessage(ctx context.Context, msg Message) error {
+	if f.OnSecondary() {
+		return f.Secondary.SendMessage(ctx, msg)
+	}
+	err := f.Primary.SendMessage(ctx, msg)
+	if !f.track(ctx, err) {
+		return err
+	}
+	if f.OnFailover != nil {
+		// The alert may itself be sent through f, so don't wait for it.
+		go f.OnFailover(err)
+	}
+	return f.Secondary.SendMessage(ctx, msg)
+}
+
+// track updates the failure streak after a primary send and reports
+// whether this failure made it switch.
+func (f *Failover) track(ctx context.Context, err error) bool {
+	var limited *RateLimitError
+	if err != nil && (ctx.Err() != nil || Classify(err) == FailureBadAddress || errors.As(err, &limited)) {
+		return false
+	}
+	after := f.After
+	if after <= 0 {
+		after = defaultFailoverAfter
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.secondary {
+		return false
+	}
+	if err == nil {
+		f.failures = 0
+		return false
+	}
+	f.failures++
+	if f.failures < after {
+		return false
+	}
+	f.secondary = true
+	return true
+}
@@ -0,0 +1,118 @@
+package email
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// maxHeaderLine is the line length RFC 5322 asks writers to stay under.
+const maxHeaderLine = 78
+
+// writeHeader appends a "Name: value" field folded to maxHeaderLine, with
+// CR and LF removed from value so a template can't inject extra headers.
+func writeHeader(b *strings.Builder, name, value string) {
+	value = sanitizeHeader(value)
+	line := name + ":"
+	for _, word := range strings.Fields(value) {
+		if len(line)+1+len(word) > maxHeaderLine && strings.TrimSpace(line) != name+":" {
+			b.WriteString(line)
+			b.WriteString("\r\n")
+			line = ""
+		}
+		line += " " + word
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+// reservedHeaders are set by the mailer itself or by dedicated features and
+// can't be configured as extra headers.
+var reservedHeaders = map[string]bool{
+	"From": true, "To": true, "Cc": true, "Bcc": true, "Reply-To": true, "Subject": true, "Date": true,
+	"Message-Id": true, "In-Reply-To": true, "References": true, "Mime-Version": true,
+	"Content-Type": true, "Content-Transfer-Encoding": true, "Content-Disposition": true,
+	"List-Unsubscribe": true, "List-Unsubscribe-Post": true, "Dkim-Signature": true, "Return-Path": true,
+}
+
+// ParseHeaders reads extra header fields given one "Name: value" per line
+// or separated by semicolons, e.g. "X-Campaign: renewal; Auto-Submitted:
+// auto-generated". Names are canonicalized; values must be printable ASCII.
+func ParseHeaders(input string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, field := range strings.FieldsFunc(input, func(r rune) bool { return r == '\n' || r == ';' }) {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(field, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("invalid header %q: want \"Name: value\"", field)
+		}
+		for _, c := range name {
+			if c <= ' ' || c > '~' || c == ':' {
+				return nil, fmt.Errorf("invalid header name %q", name)
+			}
+		}
+		if !isPrintableASCII(value) {
+			return nil, fmt.Errorf("header %s: value must be printable ASCII", name)
+		}
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if reservedHeaders[name] {
+			return nil, fmt.Errorf("header %s can't be set here", name)
+		}
+		headers[name] = value
+	}
+	return headers, nil
+}
+
+func sanitizeHeader(value string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
+
+// encodeHeader returns value as RFC 2047 encoded-words when it contains
+// anything other than printable ASCII; the encoder splits long text into
+// several words so the header can be folded between them.
+func encodeHeader(value string) string {
+	value = sanitizeHeader(value)
+	if isPrintableASCII(value) {
+		return value
+	}
+	return mime.BEncoding.Encode("utf-8", value)
+}
+
+// encodeAddress formats an address with its display name encoded, falling
+// back to the input unchanged when it doesn't parse.
+func encodeAddress(input string) string {
+	addr, err := mail.ParseAddress(input)
+	if err != nil {
+		return sanitizeHeader(input)
+	}
+	return addr.String()
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// NewMessageID returns a unique Message-ID in the sender's domain.
+func NewMessageID(from string, now time.Time) string {
+	domain := "localhost"
+	if _, d, ok := strings.Cut(extractAddress(from), "@"); ok && d != "" {
+		domain = d
+	}
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return fmt.Sprintf("<%d.%s@%s>", now.UnixNano(), hex.EncodeToString(buf), domain)
+}
@@ -1,18 +1,43 @@
 package email
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
 	"net/smtp"
 	"strings"
 	"time"
 )
 
+// Encryption modes for the SMTP connection.
+const (
+	EncryptionNone     = "none"
+	EncryptionSTARTTLS = "starttls"
+	EncryptionTLS      = "tls"
+)
+
 type Mailer struct {
 	Host string
 	Port int
 	User string
 	Pass string
 	From string
+	// Encryption is one of the Encryption* modes. STARTTLS (the default)
+	// upgrades the connection when the server offers it; TLS dials with
+	// implicit TLS, as SMTPS on port 465 requires.
+	Encryption string
+	// DKIM, when set, signs every outgoing message.
+	DKIM *DKIM
+	// OAuth, when set, authenticates User with XOAUTH2 instead of Pass.
+	OAuth *OAuth2
+	// EnvelopeFrom, when set, is the SMTP envelope sender (MAIL FROM), which
+	// receiving servers record as Return-Path and send bounces to. The From
+	// header still shows From.
+	EnvelopeFrom string
 }
 
 func (m Mailer) Enabled() bool {
@@ -20,31 +45,231 @@ func (m Mailer) Enabled() bool {
 }
 
 func (m Mailer) Send(to, subject, htmlBody string) error {
+	return m.SendContext(context.Background(), to, subject, htmlBody)
+}
+
+func (m Mailer) SendContext(ctx context.Context, to, subject, htmlBody string) error {
+	return m.SendMessage(ctx, Message{To: to, Subject: subject, HTML: htmlBody})
+}
+
+// SendMessage delivers the message over SMTP. The context bounds the whole
+// exchange: dialing honours cancellation and its deadline is applied to the
+// connection, so a stalled server can't hang a worker forever.
+func (m Mailer) SendMessage(ctx context.Context, message Message) error {
 	if !m.Enabled() {
 		return fmt.Errorf("SMTP is not configured")
 	}
 
 	addr := fmt.Sprintf("%s:%d", m.Host, m.Port)
-	auth := smtp.PlainAuth("", m.User, m.Pass, m.Host)
-	boundary := fmt.Sprintf("xf-%d", time.Now().UnixNano())
-
-	var msg bytes.Buffer
-	msg.WriteString(fmt.Sprintf("From: %s\r\n", m.From))
-	msg.WriteString(fmt.Sprintf("To: %s\r\n", to))
-	msg.WriteString(fmt.Sprintf("Subject: %s\r\n", encodeHeader(subject)))
-	msg.WriteString("MIME-Version: 1.0\r\n")
-	msg.WriteString(fmt.Sprintf("Content-Type: multipart/alternative; boundary=%q\r\n", boundary))
+	var conn net.Conn
+	var err error
+	if m.Encryption == EncryptionTLS {
+		dialer := tls.Dialer{Config: &tls.Config{ServerName: m.Host}}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok && m.startTLS() {
+		if err := client.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+			return err
+		}
+	}
+	if ok, _ := client.Extension("AUTH"); ok && m.User != "" {
+		auth, err := m.auth(ctx)
+		if err != nil {
+			return err
+		}
+		if err := client.Auth(auth); err != nil {
+			if m.OAuth != nil {
+				m.OAuth.Invalidate()
+			}
+			return err
+		}
+	}
+	if err := client.Mail(m.envelopeFrom()); err != nil {
+		return err
+	}
+	for _, rcpt := range message.recipients() {
+		if err := client.Rcpt(extractAddress(rcpt)); err != nil {
+			return &RecipientError{Address: extractAddress(rcpt), Err: err}
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	msg := m.buildMessage(message)
+	if m.DKIM != nil {
+		if msg, err = m.DKIM.Sign(msg, time.Now()); err != nil {
+			return err
+		}
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func (m Mailer) envelopeFrom() string {
+	if m.EnvelopeFrom != "" {
+		return extractAddress(m.EnvelopeFrom)
+	}
+	return extractAddress(m.From)
+}
+
+func (m Mailer) startTLS() bool {
+	return m.Encryption == "" || m.Encryption == EncryptionSTARTTLS
+}
+
+func (m Mailer) buildMessage(message Message) []byte {
+	return composeMessage(m.From, message, time.Now())
+}
+
+// Compose renders message as the RFC 5322 message the SMTP mailer would
+// send from the given address, without a DKIM signature.
+func Compose(from string, message Message, now time.Time) []byte {
+	return composeMessage(from, message, now)
+}
+
+// composeMessage renders the RFC 5322 message. Non-ASCII header text is
+// RFC 2047 encoded and bodies are quoted-printable, so the message is 7-bit
+// clean for relays that don't speak 8BITMIME. Inline images are grouped
+// with the text/HTML alternatives in a multipart/related entity, and
+// attachments wrap everything in multipart/mixed.
+func composeMessage(from string, message Message, now time.Time) []byte {
+	boundary := fmt.Sprintf("xf-%d", now.UnixNano())
+	files, inline := splitAttachments(message.Attachments)
+
+	var msg strings.Builder
+	writeHeader(&msg, "From", encodeAddress(from))
+	writeHeader(&msg, "To", encodeAddress(message.To))
+	if len(message.Cc) > 0 {
+		cc := make([]string, len(message.Cc))
+		for i, addr := range message.Cc {
+			cc[i] = encodeAddress(addr)
+		}
+		writeHeader(&msg, "Cc", strings.Join(cc, ", "))
+	}
+	if message.ReplyTo != "" {
+		writeHeader(&msg, "Reply-To", encodeAddress(message.ReplyTo))
+	}
+	writeHeader(&msg, "Subject", encodeHeader(message.Subject))
+	writeHeader(&msg, "Date", now.Format(time.RFC1123Z))
+	messageID := message.MessageID
+	if messageID == "" {
+		messageID = NewMessageID(from, now)
+	}
+	writeHeader(&msg, "Message-ID", messageID)
+	for _, name := range message.headerNames() {
+		writeHeader(&msg, name, message.Headers[name])
+	}
+	writeHeader(&msg, "MIME-Version", "1.0")
+	body := func() {
+		if len(inline) == 0 {
+			writeAlternative(&msg, boundary, message)
+			return
+		}
+		related := fmt.Sprintf("xf-related-%d", now.UnixNano())
+		writeHeader(&msg, "Content-Type", fmt.Sprintf("multipart/related; type=\"multipart/alternative\"; boundary=%q", related))
+		msg.WriteString("\r\n")
+		msg.WriteString(fmt.Sprintf("--%s\r\n", related))
+		writeAlternative(&msg, boundary, message)
+		for _, att := range inline {
+			writeAttachment(&msg, related, att)
+		}
+		msg.WriteString(fmt.Sprintf("--%s--\r\n", related))
+	}
+	if len(files) == 0 {
+		body()
+		return []byte(msg.String())
+	}
+	mixed := fmt.Sprintf("xf-mixed-%d", now.UnixNano())
+	writeHeader(&msg, "Content-Type", fmt.Sprintf("multipart/mixed; boundary=%q", mixed))
 	msg.WriteString("\r\n")
-	msg.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
-	msg.WriteString(stripHTML(htmlBody))
+	msg.WriteString(fmt.Sprintf("--%s\r\n", mixed))
+	body()
+	for _, att := range files {
+		writeAttachment(&msg, mixed, att)
+	}
+	msg.WriteString(fmt.Sprintf("--%s--\r\n", mixed))
+	return []byte(msg.String())
+}
+
+// writeAlternative appends the Content-Type header and body of a
+// multipart/alternative entity holding the text and HTML versions.
+func writeAlternative(msg *strings.Builder, boundary string, message Message) {
+	writeHeader(msg, "Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", boundary))
 	msg.WriteString("\r\n")
+	writePart(msg, boundary, "text/plain; charset=utf-8", message.PlainText())
+	writePart(msg, boundary, "text/html; charset=utf-8", message.HTML)
+	msg.WriteString(fmt.Sprintf("--%s--\r\n", boundary))
+}
+
+// writeAttachment appends one base64 encoded attachment or inline part. The
+// file name goes through mime.FormatMediaType so non-ASCII names use
+// RFC 2231.
+func writeAttachment(msg *strings.Builder, boundary string, att Attachment) {
 	msg.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-	msg.WriteString("Content-Type: text/html; charset=utf-8\r\n\r\n")
-	msg.WriteString(htmlBody)
+	contentType := mime.FormatMediaType(att.MediaType(), map[string]string{"name": att.Filename})
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	disposition := "attachment"
+	if att.ContentID != "" {
+		disposition = "inline"
+	}
+	disposition = mime.FormatMediaType(disposition, map[string]string{"filename": att.Filename})
+	writeHeader(msg, "Content-Type", contentType)
+	writeHeader(msg, "Content-Disposition", disposition)
+	if att.ContentID != "" {
+		writeHeader(msg, "Content-ID", "<"+att.ContentID+">")
+	}
+	writeHeader(msg, "Content-Transfer-Encoding", "base64")
 	msg.WriteString("\r\n")
-	msg.WriteString(fmt.Sprintf("--%s--\r\n", boundary))
+	encoded := base64.StdEncoding.EncodeToString(att.Data)
+	for len(encoded) > 76 {
+		msg.WriteString(encoded[:76])
+		msg.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	msg.WriteString(encoded)
+	msg.WriteString("\r\n")
+}
 
+// writePart appends one quoted-printable body part.
+func writePart(msg *strings.Builder, boundary, contentType, body string) {
+	msg.WriteString(fmt.Sprintf("--%s\r\n", boundary))
+	writeHeader(msg, "Content-Type", contentType)
+	writeHeader(msg, "Content-Transfer-Encoding", "quoted-printable")
+	msg.WriteString("\r\n")
+	qp := quotedprintable.NewWriter(msg)
+	qp.Write([]byte(strings.ReplaceAll(body, "\r\n", "\n")))
+	qp.Close()
+	msg.WriteString("\r\n")
 }
 
 func extractAddress(input string) string {
@@ -56,10 +281,6 @@ func extractAddress(input string) string {
 	return strings.TrimSpace(input)
 }
 
-func encodeHeader(value string) string {
-	return value
-}
-
 func stripHTML(input string) string {
 	out := strings.ReplaceAll(input, "<br>", "\n")
 	out = strings.ReplaceAll(out, "<br/>", "\n")
@@ -0,0 +1,147 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Mailgun regions. Domains created in the EU region are only reachable
+// through the EU endpoint.
+const (
+	MailgunRegionUS = "us"
+	MailgunRegionEU = "eu"
+)
+
+var mailgunEndpoints = map[string]string{
+	MailgunRegionUS: "https://api.mailgun.net",
+	MailgunRegionEU: "https://api.eu.mailgun.net",
+}
+
+// Mailgun delivers messages through the Mailgun v3 messages API.
+type Mailgun struct {
+	Domain string
+	APIKey string
+	From   string
+	// Region is one of the MailgunRegion* values; empty means US.
+	Region string
+	// Endpoint overrides the API base URL; empty derives it from Region.
+	Endpoint string
+	Client   *http.Client
+}
+
+func (g Mailgun) Enabled() bool {
+	return g.Domain != "" && g.APIKey != "" && g.From != ""
+}
+
+func (g Mailgun) SendMessage(ctx context.Context, msg Message) error {
+	if !g.Enabled() {
+		return fmt.Errorf("Mailgun is not configured")
+	}
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("from", g.From)
+	form.WriteField("to", msg.To)
+	for _, addr := range msg.Cc {
+		form.WriteField("cc", addr)
+	}
+	for _, addr := range msg.Bcc {
+		form.WriteField("bcc", addr)
+	}
+	form.WriteField("subject", msg.Subject)
+	if msg.ReplyTo != "" {
+		form.WriteField("h:Reply-To", msg.ReplyTo)
+	}
+	for _, name := range msg.headerNames() {
+		form.WriteField("h:"+name, msg.Headers[name])
+	}
+	if msg.MessageID != "" {
+		form.WriteField("h:Message-Id", msg.MessageID)
+	}
+	if msg.Reference != "" {
+		form.WriteField("v:"+ReferenceKey, msg.Reference)
+	}
+	form.WriteField("text", msg.PlainText())
+	form.WriteField("html", msg.HTML)
+	for _, att := range msg.Attachments {
+		// Mailgun derives an inline part's Content-ID from its file name.
+		field, filename := "attachment", att.Filename
+		if att.ContentID != "" {
+			field, filename = "inline", att.ContentID
+		}
+		part, err := form.CreateFormFile(field, filename)
+		if err != nil {
+			return err
+		}
+		part.Write(att.Data)
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	endpoint := g.Endpoint
+	if endpoint == "" {
+		endpoint = mailgunEndpoints[g.Region]
+	}
+	if endpoint == "" {
+		endpoint = mailgunEndpoints[MailgunRegionUS]
+	}
+	endpoint = strings.TrimRight(endpoint, "/") + "/v3/" + url.PathEscape(g.Domain) + "/messages"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("api", g.APIKey)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	client := g.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &APIError{Provider: "Mailgun", StatusCode: resp.StatusCode, Body: g.describeError(resp.StatusCode, body)}
+	}
+	return nil
+}
+
+// describeError turns a Mailgun error reply into text an operator can act
+// on. Mailgun answers with {"message": "..."} for most failures but a bare
+// "Forbidden" for a bad key, which on its own says little.
+func (g Mailgun) describeError(status int, body []byte) string {
+	var reply struct {
+		Message string `json:"message"`
+	}
+	message := string(bytes.TrimSpace(body))
+	if json.Unmarshal(body, &reply) == nil && reply.Message != "" {
+		message = reply.Message
+	}
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "API key rejected; check MAILGUN_API_KEY and that it belongs to the " + g.region() + " region"
+	case http.StatusNotFound:
+		return fmt.Sprintf("domain %q not found in the %s region: %s", g.Domain, g.region(), message)
+	case http.StatusRequestEntityTooLarge:
+		return "message too large: " + message
+	case http.StatusTooManyRequests:
+		return "rate limited: " + message
+	}
+	return message
+}
+
+func (g Mailgun) region() string {
+	if g.Region == MailgunRegionEU {
+		return "EU"
+	}
+	return "US"
+}
@@ -0,0 +1,148 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenExpiryMargin renews access tokens this long before they expire, so a
+// token doesn't lapse mid-session.
+const tokenExpiryMargin = time.Minute
+
+// OAuth2 obtains access tokens for XOAUTH2 SMTP authentication, as Microsoft
+// 365 and Gmail require once password SMTP AUTH is off. With RefreshToken set
+// it uses the refresh token grant (delegated access to a mailbox); without
+// one it uses client credentials (Microsoft 365 app-only access). Tokens are
+// cached until shortly before they expire. Share one *OAuth2 between copies
+// of a Mailer so they share the cache.
+type OAuth2 struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+	// Scope is sent with the token request when set, e.g.
+	// "https://outlook.office365.com/.default" for client credentials.
+	Scope  string
+	Client *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// Token returns a valid access token, fetching a new one when the cached
+// token is missing or about to expire.
+func (o *OAuth2) Token(ctx context.Context) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.token != "" && time.Now().Before(o.expiry) {
+		return o.token, nil
+	}
+	form := url.Values{"client_id": {o.ClientID}}
+	if o.ClientSecret != "" {
+		form.Set("client_secret", o.ClientSecret)
+	}
+	if o.RefreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", o.RefreshToken)
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+	if o.Scope != "" {
+		form.Set("scope", o.Scope)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	client := o.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return "", &APIError{Provider: "OAuth2 token endpoint", StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	var token struct {
+		AccessToken  string `json:"access_token"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("oauth2: decode token response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("oauth2: token response has no access_token")
+	}
+	// Microsoft rotates refresh tokens; keep the newest for the next
+	// refresh.
+	if token.RefreshToken != "" && o.RefreshToken != "" {
+		o.RefreshToken = token.RefreshToken
+	}
+	o.token = token.AccessToken
+	o.expiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - tokenExpiryMargin)
+	return o.token, nil
+}
+
+// Invalidate drops the cached token, e.g. after the server rejected it, so
+// the next Token call fetches a fresh one.
+func (o *OAuth2) Invalidate() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.token = ""
+}
+
+// xoauth2Auth implements the SASL XOAUTH2 mechanism used by Gmail and
+// Microsoft 365.
+type xoauth2Auth struct {
+	user, token, host string
+}
+
+func (a xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Like smtp.PlainAuth, only send the token over TLS or to localhost.
+	if !server.TLS && a.host != "localhost" && a.host != "127.0.0.1" && a.host != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "XOAUTH2", []byte("user=" + a.user + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Next answers the server's error challenge with an empty response so it
+// completes the exchange with the actual failure reply.
+func (a xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// auth returns the SMTP authentication for the mailer: XOAUTH2 when OAuth
+// is set, PLAIN otherwise.
+func (m Mailer) auth(ctx context.Context) (smtp.Auth, error) {
+	if m.OAuth == nil {
+		return smtp.PlainAuth("", m.User, m.Pass, m.Host), nil
+	}
+	token, err := m.OAuth.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return xoauth2Auth{user: m.User, token: token, host: m.Host}, nil
+}
@@ -0,0 +1,153 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const postmarkEndpoint = "https://api.postmarkapp.com/email"
+
+// postmarkInactiveRecipient is the Postmark error code for a recipient that
+// hard bounced or complained and is now suppressed on the stream.
+const postmarkInactiveRecipient = 406
+
+// ErrInactiveRecipient means the provider refused the address because it
+// previously bounced or complained. Retrying will not help until the
+// address is reactivated on the provider's side.
+var ErrInactiveRecipient = errors.New("recipient is inactive")
+
+// Postmark delivers messages through the Postmark email API.
+type Postmark struct {
+	ServerToken string
+	From        string
+	// MessageStream selects the Postmark stream; empty uses the server's
+	// default transactional stream ("outbound").
+	MessageStream string
+	// Endpoint overrides the API URL; empty uses the public endpoint.
+	Endpoint string
+	Client   *http.Client
+}
+
+type postmarkAttachment struct {
+	Name        string `json:"Name"`
+	Content     []byte `json:"Content"`
+	ContentType string `json:"ContentType"`
+	ContentID   string `json:"ContentID,omitempty"`
+}
+
+type postmarkHeader struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+type postmarkRequest struct {
+	From          string               `json:"From"`
+	To            string               `json:"To"`
+	Cc            string               `json:"Cc,omitempty"`
+	Bcc           string               `json:"Bcc,omitempty"`
+	ReplyTo       string               `json:"ReplyTo,omitempty"`
+	Subject       string               `json:"Subject"`
+	HtmlBody      string               `json:"HtmlBody"`
+	TextBody      string               `json:"TextBody"`
+	MessageStream string               `json:"MessageStream,omitempty"`
+	Attachments   []postmarkAttachment `json:"Attachments,omitempty"`
+	Headers       []postmarkHeader     `json:"Headers,omitempty"`
+	Metadata      map[string]string    `json:"Metadata,omitempty"`
+}
+
+type postmarkReply struct {
+	ErrorCode int    `json:"ErrorCode"`
+	Message   string `json:"Message"`
+}
+
+// postmarkContentID formats an inline part's Content-ID the way Postmark
+// expects it, with the "cid:" prefix.
+func postmarkContentID(id string) string {
+	if id == "" {
+		return ""
+	}
+	return "cid:" + id
+}
+
+func (p Postmark) Enabled() bool {
+	return p.ServerToken != "" && p.From != ""
+}
+
+func (p Postmark) SendMessage(ctx context.Context, msg Message) error {
+	if !p.Enabled() {
+		return fmt.Errorf("Postmark is not configured")
+	}
+	request := postmarkRequest{
+		From:          p.From,
+		To:            msg.To,
+		Cc:            strings.Join(msg.Cc, ","),
+		Bcc:           strings.Join(msg.Bcc, ","),
+		ReplyTo:       msg.ReplyTo,
+		Subject:       msg.Subject,
+		HtmlBody:      msg.HTML,
+		TextBody:      msg.PlainText(),
+		MessageStream: p.MessageStream,
+	}
+	if msg.Reference != "" {
+		request.Metadata = map[string]string{ReferenceKey: msg.Reference}
+	}
+	for _, name := range msg.headerNames() {
+		request.Headers = append(request.Headers, postmarkHeader{Name: name, Value: msg.Headers[name]})
+	}
+	if msg.MessageID != "" {
+		request.Headers = append(request.Headers, postmarkHeader{Name: "Message-ID", Value: msg.MessageID})
+	}
+	for _, att := range msg.Attachments {
+		request.Attachments = append(request.Attachments, postmarkAttachment{
+			Name:        att.Filename,
+			Content:     att.Data,
+			ContentType: att.MediaType(),
+			ContentID:   postmarkContentID(att.ContentID),
+		})
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = postmarkEndpoint
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Postmark-Server-Token", p.ServerToken)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	var reply postmarkReply
+	if json.Unmarshal(body, &reply) != nil || reply.Message == "" {
+		reply.Message = string(bytes.TrimSpace(body))
+	}
+	if reply.ErrorCode == postmarkInactiveRecipient {
+		return fmt.Errorf("%w: %s", ErrInactiveRecipient, reply.Message)
+	}
+	if reply.ErrorCode != 0 {
+		reply.Message = fmt.Sprintf("error %d: %s", reply.ErrorCode, reply.Message)
+	}
+	return &APIError{Provider: "Postmark", StatusCode: resp.StatusCode, Body: reply.Message}
+}
@@ -0,0 +1,86 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RateLimitError means a RateLimited sender refused a message because a
+// limit was reached; nothing was sent. RetryAt is when a slot frees up.
+type RateLimitError struct {
+	Limit   string
+	RetryAt time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("send limit of %s reached, retry after %s", e.Limit, e.RetryAt.Format(time.RFC3339))
+}
+
+// RateLimited caps how many messages the wrapped sender delivers per
+// rolling minute and per rolling 24 hours, so a large scan doesn't get the
+// account blocked by the relay. Zero disables a limit. Failed sends don't
+// count against either limit.
+type RateLimited struct {
+	Sender
+	PerMinute int
+	PerDay    int
+
+	mu   sync.Mutex
+	sent []time.Time
+}
+
+// NewRateLimited wraps sender. sent lists earlier deliveries, e.g. from
+// the send history, so a restart doesn't reset the daily count.
+func NewRateLimited(sender Sender, perMinute, perDay int, sent []time.Time) *RateLimited {
+	return &RateLimited{Sender: sender, PerMinute: perMinute, PerDay: perDay, sent: append([]time.Time(nil), sent...)}
+}
+
+func (l *RateLimited) SendMessage(ctx context.Context, msg Message) error {
+	now := time.Now()
+	if err := l.reserve(now); err != nil {
+		return err
+	}
+	err := l.Sender.SendMessage(ctx, msg)
+	if err != nil {
+		l.release(now)
+	}
+	return err
+}
+
+// reserve counts a send at now, or returns a RateLimitError if that would
+// exceed a limit.
+func (l *RateLimited) reserve(now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kept := l.sent[:0]
+	for _, at := range l.sent {
+		if now.Sub(at) < 24*time.Hour {
+			kept = append(kept, at)
+		}
+	}
+	l.sent = kept
+	if l.PerDay > 0 && len(l.sent) >= l.PerDay {
+		return &RateLimitError{Limit: fmt.Sprintf("%d per day", l.PerDay), RetryAt: l.sent[len(l.sent)-l.PerDay].Add(24 * time.Hour)}
+	}
+	if l.PerMinute > 0 && len(l.sent) >= l.PerMinute {
+		if oldest := l.sent[len(l.sent)-l.PerMinute]; now.Sub(oldest) < time.Minute {
+			return &RateLimitError{Limit: fmt.Sprintf("%d per minute", l.PerMinute), RetryAt: oldest.Add(time.Minute)}
+		}
+	}
+	l.sent = append(l.sent, now)
+	return nil
+}
+
+// release forgets the send reserved at at.
+func (l *RateLimited) release(at time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := len(l.sent) - 1; i >= 0; i-- {
+		if l.sent[i].Equal(at) {
+			l.sent = append(l.sent[:i], l.sent[i+1:]...)
+			return
+		}
+	}
+}
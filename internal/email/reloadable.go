@@ -0,0 +1,40 @@
+package email
+
+import (
+	"context"
+	"sync"
+)
+
+// Reloadable passes messages to a sender that can be replaced while in use,
+// so a configuration reload takes effect without restarting. A send already
+// in progress finishes on the sender it started with.
+type Reloadable struct {
+	mu     sync.RWMutex
+	sender Sender
+}
+
+// NewReloadable wraps sender.
+func NewReloadable(sender Sender) *Reloadable {
+	return &Reloadable{sender: sender}
+}
+
+// Set replaces the sender used for later messages.
+func (r *Reloadable) Set(sender Sender) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sender = sender
+}
+
+func (r *Reloadable) current() Sender {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.sender
+}
+
+func (r *Reloadable) Enabled() bool {
+	return r.current().Enabled()
+}
+
+func (r *Reloadable) SendMessage(ctx context.Context, msg Message) error {
+	return r.current().SendMessage(ctx, msg)
+}
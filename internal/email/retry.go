@@ -0,0 +1,97 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// Failure classes returned by Classify.
+const (
+	FailureTransient  = "transient"
+	FailurePermanent  = "permanent"
+	FailureBadAddress = "bad_address"
+)
+
+// RecipientError is the SMTP server refusing one recipient address.
+type RecipientError struct {
+	Address string
+	Err     error
+}
+
+func (e *RecipientError) Error() string {
+	return fmt.Sprintf("recipient %s: %v", e.Address, e.Err)
+}
+
+func (e *RecipientError) Unwrap() error {
+	return e.Err
+}
+
+// Classify sorts a send error. Transient errors are worth retrying (see
+// IsTransient). A bad address is a recipient the server or provider
+// permanently refused, such as "550 5.1.1 user unknown", so sending to it
+// again is pointless. Anything else is permanent. It returns "" for nil.
+func Classify(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case IsTransient(err):
+		return FailureTransient
+	case errors.Is(err, ErrInactiveRecipient):
+		return FailureBadAddress
+	}
+	var rcptErr *RecipientError
+	var protoErr *textproto.Error
+	if errors.As(err, &rcptErr) && errors.As(err, &protoErr) && badAddressReply(protoErr) {
+		return FailureBadAddress
+	}
+	return FailurePermanent
+}
+
+// badAddressReply reports whether a permanent RCPT reply says the mailbox
+// doesn't exist or can't take mail, going by the RFC 3463 enhanced status
+// code when there is one: 5.1.x addressing errors and 5.2.1 disabled
+// mailboxes. Policy rejections such as 5.7.1 don't count.
+func badAddressReply(reply *textproto.Error) bool {
+	if reply.Code < 500 {
+		return false
+	}
+	status, _, _ := strings.Cut(strings.TrimSpace(reply.Msg), " ")
+	if strings.Count(status, ".") == 2 && strings.HasPrefix(status, "5.") {
+		return strings.HasPrefix(status, "5.1.") || status == "5.2.1"
+	}
+	return reply.Code == 550 || reply.Code == 551 || reply.Code == 553
+}
+
+// IsTransient reports whether a send error is worth retrying: network
+// failures and timeouts, a 4xx reply from the SMTP server, a 429 or 5xx
+// reply from a mail API, or an error whose Transient method says so, for
+// APIs that report failures in the reply body rather than the status.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 400 && protoErr.Code < 500
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == 429 || apiErr.StatusCode >= 500
+	}
+	var reported interface{ Transient() bool }
+	if errors.As(err, &reported) {
+		return reported.Transient()
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package email
+
+import (
+	"context"
+	"mime"
+	"path/filepath"
+	"sort"
+)
+
+// Sender delivers a single message. Mailer talks SMTP; SendGrid, Mailgun,
+// SES and Postmark use their HTTP APIs.
+type Sender interface {
+	// Enabled reports whether the sender is configured well enough to try.
+	Enabled() bool
+	SendMessage(ctx context.Context, msg Message) error
+}
+
+// Message is one outgoing email. Text is the plain-text alternative to
+// HTML; when empty it is derived from HTML by stripping the tags. Cc is
+// listed in the headers; Bcc only gets an envelope copy. ReplyTo, when
+// set, is where the recipient's replies go instead of the sender address.
+// Headers holds extra header fields such as List-Unsubscribe. Reference,
+// when set, is an opaque ID the HTTP APIs echo back in delivery event
+// webhooks under ReferenceKey. MessageID, when set, is sent as the
+// Message-ID instead of a generated one so later messages can refer to it
+// in In-Reply-To and References; SES ignores it and assigns its own.
+type Message struct {
+	To          string
+	Cc          []string
+	Bcc         []string
+	ReplyTo     string
+	Subject     string
+	HTML        string
+	Text        string
+	Attachments []Attachment
+	Headers     map[string]string
+	Reference   string
+	MessageID   string
+}
+
+// ReferenceKey names the custom argument, variable or tag that carries
+// Message.Reference to the provider.
+const ReferenceKey = "xf_ref"
+
+// LogoContentID is the Content-ID of the embedded company logo; templates
+// show it with <img src="cid:logo">.
+const LogoContentID = "logo"
+
+// Attachment is a file sent with a message. Setting ContentID makes it an
+// inline part that the HTML refers to as "cid:<ContentID>" instead of a
+// downloadable attachment.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+	ContentID   string
+}
+
+// recipients returns every envelope recipient: To, Cc and Bcc.
+func (m Message) recipients() []string {
+	out := []string{m.To}
+	out = append(out, m.Cc...)
+	return append(out, m.Bcc...)
+}
+
+// splitAttachments separates downloadable attachments from inline parts.
+func splitAttachments(all []Attachment) (files, inline []Attachment) {
+	for _, att := range all {
+		if att.ContentID != "" {
+			inline = append(inline, att)
+		} else {
+			files = append(files, att)
+		}
+	}
+	return files, inline
+}
+
+// MediaType returns the attachment's content type, guessing from the file
+// extension when none was given.
+func (a Attachment) MediaType() string {
+	if a.ContentType != "" {
+		return a.ContentType
+	}
+	if guessed := mime.TypeByExtension(filepath.Ext(a.Filename)); guessed != "" {
+		return guessed
+	}
+	return "application/octet-stream"
+}
+
+// PlainText returns the text/plain body to send alongside the HTML.
+func (m Message) PlainText() string {
+	if m.Text != "" {
+		return m.Text
+	}
+	return stripHTML(m.HTML)
+}
+
+// headerNames returns the names of the extra headers in a stable order.
+func (m Message) headerNames() []string {
+	names := make([]string, 0, len(m.Headers))
+	for name := range m.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
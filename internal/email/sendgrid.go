@@ -0,0 +1,164 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+)
+
+const sendGridEndpoint = "https://api.sendgrid.com/v3/mail/send"
+
+// SendGrid delivers messages through the SendGrid v3 mail API.
+type SendGrid struct {
+	APIKey string
+	From   string
+	// Endpoint overrides the API URL; empty uses the public endpoint.
+	Endpoint string
+	Client   *http.Client
+}
+
+// APIError is a non-2xx reply from an HTTP mail API. Provider names the
+// service in the error text when set.
+type APIError struct {
+	Provider   string
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	provider := e.Provider
+	if provider == "" {
+		provider = "mail API"
+	}
+	return fmt.Sprintf("%s returned %d: %s", provider, e.StatusCode, e.Body)
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridPersonalization struct {
+	To  []sendGridAddress `json:"to"`
+	Cc  []sendGridAddress `json:"cc,omitempty"`
+	Bcc []sendGridAddress `json:"bcc,omitempty"`
+}
+
+type sendGridAttachment struct {
+	Content     string `json:"content"`
+	Type        string `json:"type"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition"`
+	ContentID   string `json:"content_id,omitempty"`
+}
+
+type sendGridRequest struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	ReplyTo          *sendGridAddress          `json:"reply_to,omitempty"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Attachments      []sendGridAttachment      `json:"attachments,omitempty"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+	CustomArgs       map[string]string         `json:"custom_args,omitempty"`
+}
+
+func (g SendGrid) Enabled() bool {
+	return g.APIKey != "" && g.From != ""
+}
+
+func (g SendGrid) SendMessage(ctx context.Context, msg Message) error {
+	if !g.Enabled() {
+		return fmt.Errorf("SendGrid is not configured")
+	}
+	personalization := sendGridPersonalization{To: []sendGridAddress{parseAddress(msg.To)}}
+	for _, addr := range msg.Cc {
+		personalization.Cc = append(personalization.Cc, parseAddress(addr))
+	}
+	for _, addr := range msg.Bcc {
+		personalization.Bcc = append(personalization.Bcc, parseAddress(addr))
+	}
+	request := sendGridRequest{
+		Personalizations: []sendGridPersonalization{personalization},
+		From:             parseAddress(g.From),
+		Subject:          msg.Subject,
+		Content: []sendGridContent{
+			{Type: "text/plain", Value: msg.PlainText()},
+			{Type: "text/html", Value: msg.HTML},
+		},
+	}
+	if len(msg.Headers) > 0 || msg.MessageID != "" {
+		request.Headers = map[string]string{}
+		for name, value := range msg.Headers {
+			request.Headers[name] = value
+		}
+		if msg.MessageID != "" {
+			request.Headers["Message-ID"] = msg.MessageID
+		}
+	}
+	if msg.Reference != "" {
+		request.CustomArgs = map[string]string{ReferenceKey: msg.Reference}
+	}
+	if msg.ReplyTo != "" {
+		replyTo := parseAddress(msg.ReplyTo)
+		request.ReplyTo = &replyTo
+	}
+	for _, att := range msg.Attachments {
+		disposition := "attachment"
+		if att.ContentID != "" {
+			disposition = "inline"
+		}
+		request.Attachments = append(request.Attachments, sendGridAttachment{
+			Content:     base64.StdEncoding.EncodeToString(att.Data),
+			Type:        att.MediaType(),
+			Filename:    att.Filename,
+			Disposition: disposition,
+			ContentID:   att.ContentID,
+		})
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	endpoint := g.Endpoint
+	if endpoint == "" {
+		endpoint = sendGridEndpoint
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+g.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+	client := g.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &APIError{Provider: "SendGrid", StatusCode: resp.StatusCode, Body: string(bytes.TrimSpace(body))}
+	}
+	return nil
+}
+
+func parseAddress(input string) sendGridAddress {
+	if addr, err := mail.ParseAddress(input); err == nil {
+		return sendGridAddress{Email: addr.Address, Name: addr.Name}
+	}
+	return sendGridAddress{Email: extractAddress(input)}
+}
@@ -0,0 +1,222 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SES delivers messages through the Amazon SES v2 API, signing requests
+// with AWS Signature Version 4.
+type SES struct {
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is set when using temporary credentials.
+	SessionToken string
+	From         string
+	// ConfigurationSet, when set, applies that SES configuration set so its
+	// event destinations and dedicated IPs are used.
+	ConfigurationSet string
+	// Endpoint overrides the API base URL; empty derives it from Region.
+	Endpoint string
+	Client   *http.Client
+}
+
+type sesContent struct {
+	Data    string `json:"Data"`
+	Charset string `json:"Charset"`
+}
+
+type sesNameValue struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+type sesSimple struct {
+	Subject sesContent `json:"Subject"`
+	Body    struct {
+		Text sesContent `json:"Text"`
+		Html sesContent `json:"Html"`
+	} `json:"Body"`
+	Headers []sesNameValue `json:"Headers,omitempty"`
+}
+
+// sesRaw carries a complete MIME message, used when there are attachments.
+type sesRaw struct {
+	Data []byte `json:"Data"`
+}
+
+type sesRequest struct {
+	FromEmailAddress string `json:"FromEmailAddress"`
+	Destination      struct {
+		ToAddresses  []string `json:"ToAddresses"`
+		CcAddresses  []string `json:"CcAddresses,omitempty"`
+		BccAddresses []string `json:"BccAddresses,omitempty"`
+	} `json:"Destination"`
+	Content struct {
+		Simple *sesSimple `json:"Simple,omitempty"`
+		Raw    *sesRaw    `json:"Raw,omitempty"`
+	} `json:"Content"`
+	ReplyToAddresses     []string       `json:"ReplyToAddresses,omitempty"`
+	ConfigurationSetName string         `json:"ConfigurationSetName,omitempty"`
+	EmailTags            []sesNameValue `json:"EmailTags,omitempty"`
+}
+
+func (s SES) Enabled() bool {
+	return s.Region != "" && s.AccessKeyID != "" && s.SecretAccessKey != "" && s.From != ""
+}
+
+func (s SES) SendMessage(ctx context.Context, msg Message) error {
+	if !s.Enabled() {
+		return fmt.Errorf("SES is not configured")
+	}
+	var body sesRequest
+	body.FromEmailAddress = s.From
+	body.Destination.ToAddresses = []string{msg.To}
+	body.Destination.CcAddresses = msg.Cc
+	body.Destination.BccAddresses = msg.Bcc
+	if msg.ReplyTo != "" {
+		body.ReplyToAddresses = []string{msg.ReplyTo}
+	}
+	if len(msg.Attachments) > 0 {
+		body.Content.Raw = &sesRaw{Data: composeMessage(s.From, msg, time.Now())}
+	} else {
+		simple := &sesSimple{Subject: sesContent{Data: msg.Subject, Charset: "UTF-8"}}
+		simple.Body.Text = sesContent{Data: msg.PlainText(), Charset: "UTF-8"}
+		simple.Body.Html = sesContent{Data: msg.HTML, Charset: "UTF-8"}
+		for _, name := range msg.headerNames() {
+			simple.Headers = append(simple.Headers, sesNameValue{Name: name, Value: msg.Headers[name]})
+		}
+		body.Content.Simple = simple
+	}
+	body.ConfigurationSetName = s.ConfigurationSet
+	if msg.Reference != "" {
+		body.EmailTags = []sesNameValue{{Name: ReferenceKey, Value: msg.Reference}}
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://email.%s.amazonaws.com", s.Region)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(endpoint, "/")+"/v2/email/outbound-emails", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	s.sign(req, payload, time.Now())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		raw, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &APIError{Provider: "SES", StatusCode: resp.StatusCode, Body: sesErrorText(resp.Header.Get("X-Amzn-Errortype"), raw)}
+	}
+	return nil
+}
+
+// sign adds SigV4 headers for the "ses" service. The request must already
+// carry every header except the signing ones.
+func (s SES) sign(req *http.Request, payload []byte, now time.Time) {
+	now = now.UTC()
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+	signV4(req, s.Region, "ses", s.AccessKeyID, s.SecretAccessKey, payloadHash, now)
+}
+
+// signV4 adds the SigV4 Authorization header for service, signing the host
+// and every header the request carries. X-Amz-Date must already be set to
+// now, in UTC.
+func signV4(req *http.Request, region, service, accessKeyID, secretAccessKey, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+// sesErrorText combines the error type header with the JSON message so the
+// send log shows e.g. "MessageRejected: Email address is not verified."
+func sesErrorText(errorType string, body []byte) string {
+	var reply struct {
+		Message string `json:"message"`
+	}
+	message := string(bytes.TrimSpace(body))
+	if json.Unmarshal(body, &reply) == nil && reply.Message != "" {
+		message = reply.Message
+	}
+	if errorType, _, _ = strings.Cut(errorType, ":"); errorType != "" {
+		return errorType + ": " + message
+	}
+	return message
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
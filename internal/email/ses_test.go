@@ -0,0 +1,83 @@
+package email
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Cases from the AWS Signature Version 4 test suite, which signs for the
+// "service" service in us-east-1 with the example credentials below.
+func TestSignV4(t *testing.T) {
+	const (
+		accessKeyID     = "AKIDEXAMPLE"
+		secretAccessKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	)
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		method, url string
+		contentType string
+		body        string
+		want        string
+	}{
+		{
+			name:   "get-vanilla",
+			method: http.MethodGet, url: "https://example.amazonaws.com/",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:   "get-vanilla-query",
+			method: http.MethodGet, url: "https://example.amazonaws.com/?Param1=value1",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=a67d582fa61cc504c4bae71f336f98b97f1ea3c7a6bfe1b6e45aec72011b9aeb",
+		},
+		{
+			name:   "post-vanilla",
+			method: http.MethodPost, url: "https://example.amazonaws.com/",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			name:   "post-x-www-form-urlencoded",
+			method: http.MethodPost, url: "https://example.amazonaws.com/",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "Param1=value1",
+			want:        "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		req.Header.Set("X-Amz-Date", "20150830T123600Z")
+		signV4(req, "us-east-1", "service", accessKeyID, secretAccessKey, sha256Hex([]byte(tt.body)), now)
+		if got := req.Header.Get("Authorization"); got != tt.want {
+			t.Errorf("%s: Authorization = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSESSign(t *testing.T) {
+	s := SES{Region: "eu-west-1", AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret", SessionToken: "token"}
+	req, err := http.NewRequest(http.MethodPost, "https://email.eu-west-1.amazonaws.com/v2/email/outbound-emails", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.sign(req, []byte("{}"), time.Date(2015, 8, 30, 20, 36, 0, 0, time.FixedZone("CST", 8*60*60)))
+	if got, want := req.Header.Get("X-Amz-Date"), "20150830T123600Z"; got != want {
+		t.Errorf("X-Amz-Date = %s, want %s", got, want)
+	}
+	auth := req.Header.Get("Authorization")
+	for _, want := range []string{
+		"Credential=AKIDEXAMPLE/20150830/eu-west-1/ses/aws4_request,",
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-security-token,",
+	} {
+		if !strings.Contains(auth, want) {
+			t.Errorf("Authorization = %s, want it to contain %s", auth, want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+// Stages of an SMTP connection, as reported by VerifyError.
+const (
+	StageDNS  = "DNS"
+	StageTCP  = "TCP"
+	StageSMTP = "SMTP"
+	StageTLS  = "TLS"
+	StageAuth = "AUTH"
+)
+
+// VerifyError is a failed connection check and the stage it failed at.
+type VerifyError struct {
+	Stage string
+	Err   error
+}
+
+func (e *VerifyError) Error() string {
+	return e.Stage + ": " + e.Err.Error()
+}
+
+func (e *VerifyError) Unwrap() error {
+	return e.Err
+}
+
+// Verify checks that the server can be reached and the credentials are
+// accepted without sending anything: it resolves the host, connects,
+// negotiates TLS as SendMessage would and authenticates. Failures are
+// *VerifyError values naming the stage. Unlike SendMessage, a server that
+// doesn't offer AUTH is an error when a user is configured, since mail would
+// go out unauthenticated.
+func (m Mailer) Verify(ctx context.Context) error {
+	if !m.Enabled() {
+		return fmt.Errorf("SMTP is not configured")
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, m.Host)
+	if err != nil {
+		return &VerifyError{Stage: StageDNS, Err: err}
+	}
+	var dialer net.Dialer
+	var conn net.Conn
+	for _, addr := range addrs {
+		if conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, strconv.Itoa(m.Port))); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return &VerifyError{Stage: StageTCP, Err: err}
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if m.Encryption == EncryptionTLS {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: m.Host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return &VerifyError{Stage: StageTLS, Err: err}
+		}
+		conn = tlsConn
+	}
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		return &VerifyError{Stage: StageSMTP, Err: err}
+	}
+	defer client.Close()
+	if err := client.Hello("localhost"); err != nil {
+		return &VerifyError{Stage: StageSMTP, Err: err}
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok && m.startTLS() {
+		if err := client.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+			return &VerifyError{Stage: StageTLS, Err: err}
+		}
+	} else if m.Encryption == EncryptionSTARTTLS {
+		return &VerifyError{Stage: StageTLS, Err: fmt.Errorf("server does not offer STARTTLS")}
+	}
+	if m.User != "" {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return &VerifyError{Stage: StageAuth, Err: fmt.Errorf("server does not offer AUTH")}
+		}
+		auth, err := m.auth(ctx)
+		if err != nil {
+			return &VerifyError{Stage: StageAuth, Err: err}
+		}
+		if err := client.Auth(auth); err != nil {
+			if m.OAuth != nil {
+				m.OAuth.Invalidate()
+			}
+			return &VerifyError{Stage: StageAuth, Err: err}
+		}
+	}
+	return client.Quit()
+}
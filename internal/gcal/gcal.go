@@ -0,0 +1,211 @@
+// Package gcal keeps a Google Calendar event for each subscription's expiry
+// and carries dates moved in the calendar back to the subscriptions.
+package gcal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"xf/internal/email"
+)
+
+const (
+	apiURL   = "https://www.googleapis.com"
+	tokenURL = "https://oauth2.googleapis.com/token"
+)
+
+// Client calls the Google Calendar API for one calendar. Auth holds an
+// OAuth client and a refresh token with the
+// https://www.googleapis.com/auth/calendar.events scope.
+type Client struct {
+	Auth *email.OAuth2
+	// CalendarID is the calendar's ID, e.g. abc@group.calendar.google.com,
+	// or "primary" for the account's own calendar.
+	CalendarID string
+	// APIURL overrides the API server; empty uses the public one.
+	APIURL string
+	Client *http.Client
+}
+
+// NewClient returns a client authorised with a refresh token. apiURL, if
+// set, replaces both the API and the token endpoint's server.
+func NewClient(calendarID, clientID, clientSecret, refreshToken, apiURL string) Client {
+	auth := &email.OAuth2{TokenURL: tokenURL, ClientID: clientID, ClientSecret: clientSecret, RefreshToken: refreshToken}
+	if apiURL != "" {
+		auth.TokenURL = strings.TrimRight(apiURL, "/") + "/token"
+	}
+	return Client{Auth: auth, CalendarID: calendarID, APIURL: apiURL}
+}
+
+func (c Client) Enabled() bool {
+	return c.Auth != nil && c.CalendarID != ""
+}
+
+// Event is a calendar event reduced to the fields the sync uses. An
+// all-day event has Start.Date and an exclusive End.Date; a timed one has
+// DateTime and TimeZone.
+type Event struct {
+	ID                 string      `json:"id,omitempty"`
+	Status             string      `json:"status,omitempty"`
+	Summary            string      `json:"summary"`
+	Description        string      `json:"description"`
+	Start              EventTime   `json:"start"`
+	End                EventTime   `json:"end"`
+	ExtendedProperties *Properties `json:"extendedProperties,omitempty"`
+}
+
+type EventTime struct {
+	Date     string `json:"date,omitempty"`
+	DateTime string `json:"dateTime,omitempty"`
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+// Properties are an event's extended properties; the private ones are only
+// visible to the API.
+type Properties struct {
+	Private map[string]string `json:"private,omitempty"`
+}
+
+// ErrGone is returned for an event that no longer exists, having been
+// deleted in the calendar.
+var ErrGone = errors.New("event not found")
+
+// Insert creates an event and returns it with its ID.
+func (c Client) Insert(ctx context.Context, event Event) (Event, error) {
+	var out Event
+	err := c.call(ctx, http.MethodPost, c.eventsPath(""), nil, event, &out)
+	return out, err
+}
+
+// Update replaces the event with id.
+func (c Client) Update(ctx context.Context, id string, event Event) (Event, error) {
+	var out Event
+	err := c.call(ctx, http.MethodPut, c.eventsPath(id), nil, event, &out)
+	return out, err
+}
+
+// Delete deletes the event with id; an event that is already gone is not
+// an error.
+func (c Client) Delete(ctx context.Context, id string) error {
+	err := c.call(ctx, http.MethodDelete, c.eventsPath(id), nil, nil, nil)
+	if errors.Is(err, ErrGone) {
+		return nil
+	}
+	return err
+}
+
+// Changed returns the events whose private property key equals value that
+// were changed or deleted since the given time. Deleted events have Status
+// "cancelled".
+func (c Client) Changed(ctx context.Context, key, value string, since time.Time) ([]Event, error) {
+	query := url.Values{
+		"privateExtendedProperty": {key + "=" + value},
+		"updatedMin":              {since.UTC().Format(time.RFC3339)},
+		"showDeleted":             {"true"},
+		"maxResults":              {"2500"},
+	}
+	var events []Event
+	for {
+		var page struct {
+			Items         []Event `json:"items"`
+			NextPageToken string  `json:"nextPageToken"`
+		}
+		if err := c.call(ctx, http.MethodGet, c.eventsPath(""), query, nil, &page); err != nil {
+			return nil, err
+		}
+		events = append(events, page.Items...)
+		if page.NextPageToken == "" {
+			return events, nil
+		}
+		query.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// Verify checks the credential and that the calendar can be read.
+func (c Client) Verify(ctx context.Context) error {
+	var calendar struct{}
+	err := c.call(ctx, http.MethodGet, "/calendar/v3/calendars/"+url.PathEscape(c.CalendarID), nil, nil, &calendar)
+	if errors.Is(err, ErrGone) {
+		return fmt.Errorf("calendar %s not found or not shared with the account", c.CalendarID)
+	}
+	return err
+}
+
+func (c Client) eventsPath(id string) string {
+	path := "/calendar/v3/calendars/" + url.PathEscape(c.CalendarID) + "/events"
+	if id != "" {
+		path += "/" + url.PathEscape(id)
+	}
+	return path
+}
+
+func (c Client) call(ctx context.Context, method, path string, query url.Values, in, out any) error {
+	token, err := c.Auth.Token(ctx)
+	if err != nil {
+		return err
+	}
+	base := c.APIURL
+	if base == "" {
+		base = apiURL
+	}
+	endpoint := strings.TrimRight(base, "/") + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	var body io.Reader
+	if in != nil {
+		payload, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return ErrGone
+	}
+	if resp.StatusCode >= 300 {
+		detail := strings.TrimSpace(string(data))
+		var reply struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(data, &reply) == nil && reply.Error.Message != "" {
+			detail = reply.Error.Message
+		}
+		return &email.APIError{Provider: "Google Calendar", StatusCode: resp.StatusCode, Body: detail}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("Google Calendar: %w", err)
+	}
+	return nil
+}
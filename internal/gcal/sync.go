@@ -0,0 +1,275 @@
+package gcal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"xf/internal/calendar"
+	"xf/internal/db"
+	"xf/internal/logging"
+)
+
+const (
+	defaultInterval = 15 * time.Minute
+	syncTimeout     = 10 * time.Minute
+	// clockSkew widens the window of calendar changes read, so an edit
+	// made as the last sync ran isn't missed; reading one twice is
+	// harmless.
+	clockSkew = time.Minute
+	// timedLength is the length of the event of a subscription that
+	// expires at a time of day.
+	timedLength = 30 * time.Minute
+)
+
+// Private extended properties that mark the events the sync owns.
+const (
+	markerKey       = "xf"
+	subscriptionKey = "xf_subscription"
+)
+
+// Count is what a sync changed: events created, updated and deleted in
+// the calendar, and expiry dates moved there and applied here.
+type Count struct {
+	Created, Updated, Deleted, Moved int
+}
+
+// Syncer keeps an event for every subscription's expiry in a Google
+// Calendar. Moving an event to another date in the calendar moves the
+// subscription's expiry, unless the expiry was changed here too, in which
+// case the event is put back.
+type Syncer struct {
+	Store    *db.Store
+	Client   Client
+	Interval time.Duration
+	// PublicURL, if set, links each event to the subscription's page.
+	PublicURL string
+	// Location is the zone of subscriptions whose customer has none.
+	Location *time.Location
+}
+
+// Start syncs in the background until ctx is cancelled.
+func (s Syncer) Start(ctx context.Context) {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if count, err := s.Sync(ctx, time.Now()); err != nil {
+				slog.Error("google calendar sync error", "error", err)
+			} else if count != (Count{}) {
+				slog.Info("google calendar synced", "created", count.Created, "updated", count.Updated, "deleted", count.Deleted, "moved", count.Moved)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Sync applies the dates moved in the calendar since the last sync, then
+// writes the events of new and changed subscriptions and deletes those of
+// removed ones. It stops at the first failed call; what was done is kept
+// and the next sync carries on.
+func (s Syncer) Sync(ctx context.Context, now time.Time) (Count, error) {
+	ctx, cancel := context.WithTimeout(ctx, syncTimeout)
+	defer cancel()
+	var count Count
+	links, err := s.Store.ListCalendarEvents()
+	if err != nil {
+		return count, err
+	}
+	linked := map[int]db.CalendarEvent{}
+	for _, link := range links {
+		linked[link.SubscriptionID] = link
+	}
+	subs, err := s.Store.ListSubscriptions()
+	if err != nil {
+		return count, err
+	}
+	byID := map[int]db.SubscriptionDetail{}
+	for _, sub := range subs {
+		byID[sub.ID] = sub
+	}
+
+	if since := s.Store.GoogleCalendarSyncedAt(); !since.IsZero() {
+		events, err := s.Client.Changed(ctx, markerKey, "1", since.Add(-clockSkew))
+		if err != nil {
+			return count, err
+		}
+		for _, event := range events {
+			id, _ := strconv.Atoi(event.ExtendedProperties.private(subscriptionKey))
+			link, ok := linked[id]
+			if !ok || link.EventID != event.ID {
+				continue
+			}
+			if event.Status == "cancelled" {
+				// Deleted in the calendar; it is added again below.
+				if err := s.Store.DeleteCalendarEvent(id); err != nil {
+					return count, err
+				}
+				delete(linked, id)
+				continue
+			}
+			sub, ok := byID[id]
+			expires, err := s.expiresAt(event, sub)
+			if !ok || err != nil || expires == link.ExpiresAt || sub.ExpiresAt != link.ExpiresAt {
+				continue
+			}
+			if err := s.Store.MoveExpiry(id, sub.ExpiresAt, expires, now); err != nil {
+				continue
+			}
+			logging.From(ctx).Info("subscription expiry moved in google calendar", logging.SubscriptionID, id, "old_expires_at", sub.ExpiresAt, "new_expires_at", expires)
+			count.Moved++
+			sub.ExpiresAt = expires
+			byID[id] = sub
+			link.ExpiresAt = expires
+			if err := s.Store.PutCalendarEvent(link); err != nil {
+				return count, err
+			}
+			linked[id] = link
+		}
+	}
+	if err := s.Store.SetGoogleCalendarSyncedAt(now); err != nil {
+		return count, err
+	}
+
+	for _, sub := range byID {
+		event, err := s.event(sub)
+		if err != nil {
+			logging.From(ctx).Warn("google calendar event skipped", logging.SubscriptionID, sub.ID, "error", err)
+			continue
+		}
+		hash := eventHash(event)
+		link, ok := linked[sub.ID]
+		if ok && link.ExpiresAt == sub.ExpiresAt && link.Hash == hash {
+			continue
+		}
+		var written Event
+		if ok {
+			written, err = s.Client.Update(ctx, link.EventID, event)
+			if err == nil {
+				count.Updated++
+			}
+		}
+		if !ok || errors.Is(err, ErrGone) {
+			written, err = s.Client.Insert(ctx, event)
+			if err == nil {
+				count.Created++
+			}
+		}
+		if err != nil {
+			return count, err
+		}
+		link = db.CalendarEvent{SubscriptionID: sub.ID, EventID: written.ID, ExpiresAt: sub.ExpiresAt, Hash: hash}
+		if err := s.Store.PutCalendarEvent(link); err != nil {
+			return count, err
+		}
+	}
+
+	for id, link := range linked {
+		if _, ok := byID[id]; ok {
+			continue
+		}
+		if err := s.Client.Delete(ctx, link.EventID); err != nil {
+			return count, err
+		}
+		if err := s.Store.DeleteCalendarEvent(id); err != nil {
+			return count, err
+		}
+		count.Deleted++
+	}
+	return count, nil
+}
+
+// event returns the calendar event of the subscription's expiry: an
+// all-day event, or a short one at the time of day it expires.
+func (s Syncer) event(sub db.SubscriptionDetail) (Event, error) {
+	summary := fmt.Sprintf("%s 到期：%s", sub.ProductName, sub.CustomerName)
+	if sub.Kind == db.KindTrial {
+		summary += "（试用）"
+	}
+	lines := []string{
+		fmt.Sprintf("客户：%s <%s>", sub.CustomerName, sub.CustomerEmail),
+		"产品：" + sub.ProductName,
+		"到期：" + sub.ExpiresAt,
+	}
+	if sub.Note != "" {
+		lines = append(lines, "备注："+sub.Note)
+	}
+	if s.PublicURL != "" {
+		lines = append(lines, fmt.Sprintf("详情：%s/subscriptions/%d", strings.TrimRight(s.PublicURL, "/"), sub.ID))
+	}
+	event := Event{
+		Summary:     summary,
+		Description: strings.Join(lines, "\n"),
+		ExtendedProperties: &Properties{Private: map[string]string{
+			markerKey:       "1",
+			subscriptionKey: strconv.Itoa(sub.ID),
+		}},
+	}
+	loc := s.zone(sub)
+	if t, err := time.ParseInLocation("2006-01-02 15:04", sub.ExpiresAt, loc); err == nil {
+		event.Start = EventTime{DateTime: t.Format("2006-01-02T15:04:05"), TimeZone: loc.String()}
+		event.End = EventTime{DateTime: t.Add(timedLength).Format("2006-01-02T15:04:05"), TimeZone: loc.String()}
+		return event, nil
+	}
+	day, err := time.Parse("2006-01-02", sub.ExpiresAt)
+	if err != nil {
+		return Event{}, fmt.Errorf("invalid expiry %q", sub.ExpiresAt)
+	}
+	event.Start = EventTime{Date: sub.ExpiresAt}
+	event.End = EventTime{Date: day.AddDate(0, 0, 1).Format("2006-01-02")}
+	return event, nil
+}
+
+// expiresAt reads the expiry an event shows, in the subscription's format:
+// a date for all-day events, otherwise the local date and time it starts.
+func (s Syncer) expiresAt(event Event, sub db.SubscriptionDetail) (string, error) {
+	if event.Start.Date != "" {
+		return event.Start.Date, nil
+	}
+	t, err := time.Parse(time.RFC3339, event.Start.DateTime)
+	if err != nil {
+		return "", err
+	}
+	return t.In(s.zone(sub)).Format("2006-01-02 15:04"), nil
+}
+
+// zone returns the customer's time zone, or Location if none is set.
+func (s Syncer) zone(sub db.SubscriptionDetail) *time.Location {
+	if sub.CustomerTimeZone != "" {
+		if loc, err := calendar.LoadZone(sub.CustomerTimeZone); err == nil {
+			return loc
+		}
+	}
+	if s.Location != nil {
+		return s.Location
+	}
+	return time.UTC
+}
+
+// eventHash is a digest of what an event shows besides its date, which
+// changes when the customer, product or note does.
+func eventHash(event Event) string {
+	sum := sha256.Sum256([]byte(event.Summary + "\x00" + event.Description))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (p *Properties) private(key string) string {
+	if p == nil {
+		return ""
+	}
+	return p.Private[key]
+}
@@ -0,0 +1,191 @@
+package ldap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BER tags used by LDAP (RFC 4511). Application tags are constructed
+// unless noted.
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+	tagSet         = 0x31
+
+	tagBindRequest      = 0x60
+	tagBindResponse     = 0x61
+	tagUnbindRequest    = 0x42 // primitive
+	tagSearchRequest    = 0x63
+	tagSearchEntry      = 0x64
+	tagSearchDone       = 0x65
+	tagSearchReference  = 0x73
+	tagExtendedRequest  = 0x77
+	tagExtendedResponse = 0x78
+	tagControls         = 0xa0
+)
+
+// maxPacket bounds a message read from the server.
+const maxPacket = 16 << 20
+
+// packet is a BER element: a primitive value or constructed children.
+type packet struct {
+	tag      byte
+	value    []byte
+	children []*packet
+}
+
+func constructed(tag byte, children ...*packet) *packet {
+	return &packet{tag: tag, children: children}
+}
+
+func primitive(tag byte, value []byte) *packet {
+	return &packet{tag: tag, value: value}
+}
+
+func octetString(s string) *packet {
+	return primitive(tagOctetString, []byte(s))
+}
+
+func integer(tag byte, n int64) *packet {
+	var b []byte
+	for {
+		b = append([]byte{byte(n)}, b...)
+		n >>= 8
+		if (n == 0 && b[0]&0x80 == 0) || (n == -1 && b[0]&0x80 != 0) {
+			break
+		}
+	}
+	return primitive(tag, b)
+}
+
+func boolean(v bool) *packet {
+	if v {
+		return primitive(tagBoolean, []byte{0xff})
+	}
+	return primitive(tagBoolean, []byte{0})
+}
+
+func (p *packet) isConstructed() bool {
+	return p.tag&0x20 != 0
+}
+
+func (p *packet) bytes() []byte {
+	content := p.value
+	if p.isConstructed() {
+		content = nil
+		for _, c := range p.children {
+			content = append(content, c.bytes()...)
+		}
+	}
+	out := []byte{p.tag}
+	if n := len(content); n < 0x80 {
+		out = append(out, byte(n))
+	} else {
+		var l []byte
+		for ; n > 0; n >>= 8 {
+			l = append([]byte{byte(n)}, l...)
+		}
+		out = append(out, 0x80|byte(len(l)))
+		out = append(out, l...)
+	}
+	return append(out, content...)
+}
+
+func (p *packet) int() int64 {
+	var n int64
+	for i, b := range p.value {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int64(b)
+	}
+	return n
+}
+
+func (p *packet) str() string {
+	return string(p.value)
+}
+
+// child returns the i-th child, or an empty packet if there is none, so
+// that a malformed response reads as empty values instead of panicking.
+func (p *packet) child(i int) *packet {
+	if i < len(p.children) {
+		return p.children[i]
+	}
+	return &packet{}
+}
+
+// readPacket reads one BER element.
+func readPacket(r *bufio.Reader) (*packet, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		n := int(first & 0x7f)
+		if n == 0 || n > 4 {
+			return nil, errors.New("ldap: unsupported BER length")
+		}
+		length = 0
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxPacket {
+		return nil, fmt.Errorf("ldap: message of %d bytes is too large", length)
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	return parsePacket(tag, content)
+}
+
+func parsePacket(tag byte, content []byte) (*packet, error) {
+	p := &packet{tag: tag}
+	if !p.isConstructed() {
+		p.value = content
+		return p, nil
+	}
+	for len(content) > 0 {
+		if len(content) < 2 {
+			return nil, errors.New("ldap: truncated BER element")
+		}
+		childTag, length, header := content[0], int(content[1]), 2
+		if content[1]&0x80 != 0 {
+			n := int(content[1] & 0x7f)
+			if n == 0 || n > 4 || len(content) < 2+n {
+				return nil, errors.New("ldap: bad BER length")
+			}
+			length = 0
+			for _, b := range content[2 : 2+n] {
+				length = length<<8 | int(b)
+			}
+			header += n
+		}
+		if length < 0 || len(content) < header+length {
+			return nil, errors.New("ldap: truncated BER element")
+		}
+		child, err := parsePacket(childTag, content[header:header+length])
+		if err != nil {
+			return nil, err
+		}
+		p.children = append(p.children, child)
+		content = content[header+length:]
+	}
+	return p, nil
+}
@@ -0,0 +1,88 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Integer encodings from the examples of X.690 section 8.3.
+func TestInteger(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "020100"},
+		{127, "02017f"},
+		{128, "02020080"},
+		{256, "02020100"},
+		{-128, "020180"},
+		{-129, "0202ff7f"},
+	}
+	for _, tt := range tests {
+		p := integer(tagInteger, tt.n)
+		if got := hex.EncodeToString(p.bytes()); got != tt.want {
+			t.Errorf("integer(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+		if got := p.int(); got != tt.n {
+			t.Errorf("integer(%d).int() = %d", tt.n, got)
+		}
+	}
+}
+
+// X.690 section 8.1.3.5 gives 81 c9 as the long form of the length 201.
+func TestLongLength(t *testing.T) {
+	p := octetString(strings.Repeat("x", 201))
+	encoded := p.bytes()
+	if got := hex.EncodeToString(encoded[:3]); got != "0481c9" {
+		t.Errorf("header = %s, want 0481c9", got)
+	}
+	read, err := readPacket(bufio.NewReader(bytes.NewReader(encoded)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.str() != p.str() {
+		t.Errorf("read back %d bytes, want 201", len(read.value))
+	}
+}
+
+// An anonymous simple bind with message ID 1 and its successful response,
+// as exchanged by any LDAPv3 client and server (RFC 4511 sections 4.2 and
+// 4.2.2).
+func TestBindMessages(t *testing.T) {
+	bind := constructed(tagSequence, integer(tagInteger, 1),
+		constructed(tagBindRequest, integer(tagInteger, 3), octetString(""), primitive(0x80, nil)))
+	if got, want := hex.EncodeToString(bind.bytes()), "300c020101600702010304008000"; got != want {
+		t.Errorf("bind request = %s, want %s", got, want)
+	}
+
+	raw, _ := hex.DecodeString("300c02010161070a010004000400")
+	msg, err := readPacket(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := msg.child(0).int(); id != 1 {
+		t.Errorf("message ID = %d, want 1", id)
+	}
+	resp := msg.child(1)
+	if resp.tag != tagBindResponse {
+		t.Errorf("tag = %#x, want %#x", resp.tag, tagBindResponse)
+	}
+	if code := resp.child(0).int(); code != 0 {
+		t.Errorf("result code = %d, want 0", code)
+	}
+	if !bytes.Equal(msg.bytes(), raw) {
+		t.Errorf("re-encoded = %x, want %x", msg.bytes(), raw)
+	}
+}
+
+func TestParsePacketTruncated(t *testing.T) {
+	for _, content := range []string{"04", "0405ab", "0482ff"} {
+		raw, _ := hex.DecodeString(content)
+		if _, err := parsePacket(tagSequence, raw); err == nil {
+			t.Errorf("parsePacket(%s) succeeded, want an error", content)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Filter choice tags (RFC 4511 section 4.5.1).
+const (
+	filterAnd        = 0xa0
+	filterOr         = 0xa1
+	filterNot        = 0xa2
+	filterEquality   = 0xa3
+	filterSubstrings = 0xa4
+	filterGreater    = 0xa5
+	filterLess       = 0xa6
+	filterPresent    = 0x87
+	filterApprox     = 0xa8
+	filterExtensible = 0xa9
+)
+
+// parseFilter compiles a search filter in the string form of RFC 4515,
+// such as (&(objectClass=user)(mail=*)).
+func parseFilter(s string) (*packet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "(") {
+		s = "(" + s + ")"
+	}
+	p, rest, err := parseFilterAt(s)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("ldap filter: unexpected %q", rest)
+	}
+	return p, nil
+}
+
+func parseFilterAt(s string) (*packet, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", fmt.Errorf("ldap filter: expected ( at %q", s)
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, "", fmt.Errorf("ldap filter: unexpected end")
+	}
+	switch s[0] {
+	case '&', '|':
+		tag := byte(filterAnd)
+		if s[0] == '|' {
+			tag = filterOr
+		}
+		p := constructed(tag)
+		s = s[1:]
+		for strings.HasPrefix(s, "(") {
+			child, rest, err := parseFilterAt(s)
+			if err != nil {
+				return nil, "", err
+			}
+			p.children = append(p.children, child)
+			s = rest
+		}
+		if !strings.HasPrefix(s, ")") {
+			return nil, "", fmt.Errorf("ldap filter: expected ) at %q", s)
+		}
+		return p, s[1:], nil
+	case '!':
+		child, rest, err := parseFilterAt(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", fmt.Errorf("ldap filter: expected ) at %q", rest)
+		}
+		return constructed(filterNot, child), rest[1:], nil
+	}
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", fmt.Errorf("ldap filter: missing )")
+	}
+	item, rest := s[:end], s[end+1:]
+	p, err := parseItem(item)
+	return p, rest, err
+}
+
+func parseItem(item string) (*packet, error) {
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, fmt.Errorf("ldap filter: bad item %q", item)
+	}
+	attr, value := item[:eq], item[eq+1:]
+	tag := byte(filterEquality)
+	switch attr[len(attr)-1] {
+	case '>':
+		tag, attr = filterGreater, attr[:len(attr)-1]
+	case '<':
+		tag, attr = filterLess, attr[:len(attr)-1]
+	case '~':
+		tag, attr = filterApprox, attr[:len(attr)-1]
+	case ':':
+		return parseExtensible(attr[:len(attr)-1], value)
+	}
+	if attr == "" {
+		return nil, fmt.Errorf("ldap filter: bad item %q", item)
+	}
+	if tag == filterEquality && value == "*" {
+		return primitive(filterPresent, []byte(attr)), nil
+	}
+	if tag == filterEquality && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		subs := constructed(tagSequence)
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			v, err := unescape(part)
+			if err != nil {
+				return nil, err
+			}
+			choice := byte(0x81) // any
+			if i == 0 {
+				choice = 0x80 // initial
+			} else if i == len(parts)-1 {
+				choice = 0x82 // final
+			}
+			subs.children = append(subs.children, primitive(choice, v))
+		}
+		return constructed(filterSubstrings, octetString(attr), subs), nil
+	}
+	v, err := unescape(value)
+	if err != nil {
+		return nil, err
+	}
+	return constructed(tag, octetString(attr), primitive(tagOctetString, v)), nil
+}
+
+// parseExtensible compiles an extensible match, attr[:dn][:rule]:=value,
+// as Active Directory uses for bit tests on userAccountControl.
+func parseExtensible(attr, value string) (*packet, error) {
+	fields := strings.Split(attr, ":")
+	p := constructed(filterExtensible)
+	var rule string
+	dnAttributes := false
+	for _, f := range fields[1:] {
+		if strings.EqualFold(f, "dn") {
+			dnAttributes = true
+		} else {
+			rule = f
+		}
+	}
+	if rule == "" && fields[0] == "" {
+		return nil, fmt.Errorf("ldap filter: extensible match needs an attribute or a rule")
+	}
+	if rule != "" {
+		p.children = append(p.children, primitive(0x81, []byte(rule)))
+	}
+	if fields[0] != "" {
+		p.children = append(p.children, primitive(0x82, []byte(fields[0])))
+	}
+	v, err := unescape(value)
+	if err != nil {
+		return nil, err
+	}
+	p.children = append(p.children, primitive(0x83, v))
+	if dnAttributes {
+		p.children = append(p.children, primitive(0x84, []byte{0xff}))
+	}
+	return p, nil
+}
+
+// unescape decodes the \XX escapes of a filter value.
+func unescape(s string) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			out = append(out, s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return nil, fmt.Errorf("ldap filter: bad escape in %q", s)
+		}
+		b, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return nil, fmt.Errorf("ldap filter: bad escape in %q", s)
+		}
+		out = append(out, b...)
+		i += 2
+	}
+	return out, nil
+}
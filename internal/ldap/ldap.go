@@ -0,0 +1,292 @@
+// Package ldap reads directory entries over LDAP v3 (RFC 4511): a simple
+// bind and a paged subtree search, over ldap://, ldap:// with StartTLS or
+// ldaps://. It covers what importing contacts needs and nothing more.
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	oidStartTLS     = "1.3.6.1.4.1.1466.20037"
+	oidPagedResults = "1.2.840.113556.1.4.319"
+	// pageSize stays under Active Directory's default MaxPageSize of 1000.
+	pageSize    = 500
+	dialTimeout = 15 * time.Second
+)
+
+// resultNames names the result codes an admin is likely to meet.
+var resultNames = map[int64]string{
+	4:  "size limit exceeded",
+	10: "referral",
+	32: "no such object",
+	34: "invalid DN syntax",
+	49: "invalid credentials",
+	50: "insufficient access rights",
+	52: "unavailable",
+	53: "unwilling to perform",
+}
+
+// Error is a failed LDAP operation.
+type Error struct {
+	Op         string
+	ResultCode int64
+	Message    string
+}
+
+func (e *Error) Error() string {
+	name := resultNames[e.ResultCode]
+	if name == "" {
+		name = fmt.Sprintf("result code %d", e.ResultCode)
+	}
+	if e.Message != "" {
+		return fmt.Sprintf("ldap %s: %s: %s", e.Op, name, e.Message)
+	}
+	return fmt.Sprintf("ldap %s: %s", e.Op, name)
+}
+
+// Client searches a directory. URL is ldap://host[:389] or
+// ldaps://host[:636]; StartTLS upgrades an ldap:// connection. An empty
+// BindDN binds anonymously.
+type Client struct {
+	URL      string
+	BindDN   string
+	Password string
+	StartTLS bool
+}
+
+// Entry is a search result: its DN and its attributes, keyed in lower
+// case.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Get returns the first value of the attribute, or "".
+func (e Entry) Get(name string) string {
+	if values := e.Attributes[strings.ToLower(name)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c Client) Enabled() bool {
+	return c.URL != ""
+}
+
+// Verify connects and binds.
+func (c Client) Verify(ctx context.Context) error {
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	conn.close()
+	return nil
+}
+
+// Search returns the entries under base that match filter, reading the
+// given attributes, a page at a time.
+func (c Client) Search(ctx context.Context, base, filter string, attributes []string) ([]Entry, error) {
+	compiled, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+	attrs := constructed(tagSequence)
+	for _, a := range attributes {
+		attrs.children = append(attrs.children, octetString(a))
+	}
+	var entries []Entry
+	cookie := ""
+	for {
+		request := constructed(tagSearchRequest,
+			octetString(base),
+			integer(tagEnumerated, 2), // wholeSubtree
+			integer(tagEnumerated, 0), // neverDerefAliases
+			integer(tagInteger, 0),
+			integer(tagInteger, 0),
+			boolean(false),
+			compiled,
+			attrs,
+		)
+		paging := constructed(tagSequence, integer(tagInteger, pageSize), octetString(cookie))
+		control := constructed(tagSequence, octetString(oidPagedResults), primitive(tagOctetString, paging.bytes()))
+		id, err := conn.send(request, constructed(tagControls, control))
+		if err != nil {
+			return nil, err
+		}
+		cookie = ""
+		for {
+			msg, err := conn.read(id)
+			if err != nil {
+				return nil, err
+			}
+			op := msg.child(1)
+			switch op.tag {
+			case tagSearchEntry:
+				entry := Entry{DN: op.child(0).str(), Attributes: map[string][]string{}}
+				for _, attr := range op.child(1).children {
+					key := strings.ToLower(attr.child(0).str())
+					for _, v := range attr.child(1).children {
+						entry.Attributes[key] = append(entry.Attributes[key], v.str())
+					}
+				}
+				entries = append(entries, entry)
+				continue
+			case tagSearchReference:
+				// Referrals to other servers aren't followed.
+				continue
+			case tagSearchDone:
+				if err := result("search", op); err != nil {
+					return nil, err
+				}
+				cookie = pagedCookie(msg.child(2))
+			default:
+				return nil, fmt.Errorf("ldap search: unexpected response tag 0x%02x", op.tag)
+			}
+			break
+		}
+		if cookie == "" {
+			return entries, nil
+		}
+	}
+}
+
+// pagedCookie returns the cookie of the paged results control among
+// controls, which is empty on the last page or if the server doesn't page.
+func pagedCookie(controls *packet) string {
+	for _, control := range controls.children {
+		if control.child(0).str() != oidPagedResults {
+			continue
+		}
+		// The control value is an encoded searchControlValue; parsing it
+		// as the content of a sequence yields that one element.
+		value, err := parsePacket(tagSequence, control.child(len(control.children)-1).value)
+		if err != nil {
+			return ""
+		}
+		return value.child(0).child(1).str()
+	}
+	return ""
+}
+
+type conn struct {
+	net.Conn
+	r      *bufio.Reader
+	nextID int64
+}
+
+// connect dials the server, upgrades the connection if asked and binds.
+func (c Client) connect(ctx context.Context) (*conn, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Hostname()
+	port := u.Port()
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var raw net.Conn
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = "389"
+		}
+		raw, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	case "ldaps":
+		if port == "" {
+			port = "636"
+		}
+		tlsDialer := tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}
+		raw, err = tlsDialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	default:
+		return nil, fmt.Errorf("ldap: unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		raw.SetDeadline(deadline)
+	}
+	cn := &conn{Conn: raw, r: bufio.NewReader(raw)}
+	if c.StartTLS && u.Scheme == "ldap" {
+		id, err := cn.send(constructed(tagExtendedRequest, primitive(0x80, []byte(oidStartTLS))))
+		if err == nil {
+			var msg *packet
+			if msg, err = cn.read(id); err == nil {
+				err = result("StartTLS", msg.child(1))
+			}
+		}
+		if err != nil {
+			raw.Close()
+			return nil, err
+		}
+		secure := tls.Client(raw, &tls.Config{ServerName: host})
+		if err := secure.HandshakeContext(ctx); err != nil {
+			raw.Close()
+			return nil, err
+		}
+		cn.Conn, cn.r = secure, bufio.NewReader(secure)
+	}
+	bind := constructed(tagBindRequest, integer(tagInteger, 3), octetString(c.BindDN), primitive(0x80, []byte(c.Password)))
+	id, err := cn.send(bind)
+	if err == nil {
+		var msg *packet
+		if msg, err = cn.read(id); err == nil {
+			err = result("bind", msg.child(1))
+		}
+	}
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+func (cn *conn) send(op *packet, controls ...*packet) (int64, error) {
+	cn.nextID++
+	msg := constructed(tagSequence, append([]*packet{integer(tagInteger, cn.nextID), op}, controls...)...)
+	_, err := cn.Write(msg.bytes())
+	return cn.nextID, err
+}
+
+// read returns the next message for id, skipping unsolicited ones such as
+// a notice of disconnection, which the next read then fails on.
+func (cn *conn) read(id int64) (*packet, error) {
+	for {
+		msg, err := readPacket(cn.r)
+		if err != nil {
+			return nil, err
+		}
+		if msg.tag != tagSequence || len(msg.children) < 2 {
+			return nil, errors.New("ldap: malformed message")
+		}
+		if msg.child(0).int() == id {
+			return msg, nil
+		}
+	}
+}
+
+func (cn *conn) close() {
+	cn.send(primitive(tagUnbindRequest, nil))
+	cn.Close()
+}
+
+// result turns a non-success LDAPResult into an error.
+func result(op string, p *packet) error {
+	if code := p.child(0).int(); code != 0 {
+		return &Error{Op: op, ResultCode: code, Message: p.child(2).str()}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package ldap
+
+import (
+	"context"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"time"
+
+	"xf/internal/db"
+)
+
+const (
+	defaultInterval = time.Hour
+	syncTimeout     = 5 * time.Minute
+	// DefaultFilter picks the entries that have an email address.
+	DefaultFilter = "(mail=*)"
+)
+
+var attributes = []string{"mail", "displayName", "cn", "department"}
+
+// Syncer imports directory contacts under BaseDN as customers on a
+// schedule. OUTags maps organizational unit names to customer tags; when
+// it is empty every OU between BaseDN and the entry becomes a tag.
+type Syncer struct {
+	Store    *db.Store
+	Client   Client
+	BaseDN   string
+	Filter   string
+	OUTags   map[string]string
+	Interval time.Duration
+}
+
+// Start syncs in the background until ctx is cancelled.
+func (s Syncer) Start(ctx context.Context) {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if count, err := s.Sync(ctx, time.Now()); err != nil {
+				slog.Error("ldap sync error", "error", err)
+			} else if count.Added > 0 || count.Updated > 0 {
+				slog.Info("ldap sync changed customers", "added", count.Added, "updated", count.Updated, "skipped", count.Skipped)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Sync searches the directory once and applies the entries to the store.
+// Nothing is changed unless the search completed.
+func (s Syncer) Sync(ctx context.Context, now time.Time) (db.LDAPCount, error) {
+	ctx, cancel := context.WithTimeout(ctx, syncTimeout)
+	defer cancel()
+	filter := s.Filter
+	if filter == "" {
+		filter = DefaultFilter
+	}
+	entries, err := s.Client.Search(ctx, s.BaseDN, filter, attributes)
+	if err != nil {
+		return db.LDAPCount{}, err
+	}
+	var contacts []db.LDAPContact
+	for _, entry := range entries {
+		name := entry.Get("displayName")
+		if name == "" {
+			name = entry.Get("cn")
+		}
+		contacts = append(contacts, db.LDAPContact{
+			DN:         entry.DN,
+			Email:      entry.Get("mail"),
+			Name:       name,
+			Department: entry.Get("department"),
+			Tags:       s.tags(entry.DN),
+		})
+	}
+	return s.Store.SyncLDAP(contacts, now)
+}
+
+// tags returns the customer tags for the OUs in dn.
+func (s Syncer) tags(dn string) []string {
+	var tags []string
+	ous := organizationalUnits(dn)
+	if len(s.OUTags) == 0 {
+		// The OUs of the base are shared by every entry.
+		ous = ous[:max(len(ous)-len(organizationalUnits(s.BaseDN)), 0)]
+	}
+	for _, ou := range ous {
+		if len(s.OUTags) == 0 {
+			tags = append(tags, ou)
+			continue
+		}
+		for name, tag := range s.OUTags {
+			if strings.EqualFold(name, ou) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// organizationalUnits returns the OU values in dn, nearest first, such as
+// ["Sales", "Customers"] for "CN=Ann,OU=Sales,OU=Customers,DC=example,DC=com".
+func organizationalUnits(dn string) []string {
+	var ous []string
+	for _, rdn := range splitDN(dn) {
+		// A multi-valued RDN joins attributes with "+"; OUs are rarely
+		// among them and are only taken as the whole RDN.
+		key, value, ok := strings.Cut(rdn, "=")
+		if ok && strings.EqualFold(strings.TrimSpace(key), "ou") {
+			ous = append(ous, unescapeDN(strings.TrimSpace(value)))
+		}
+	}
+	return ous
+}
+
+// splitDN splits dn at the commas that aren't escaped (RFC 4514).
+func splitDN(dn string) []string {
+	var rdns []string
+	start := 0
+	for i := 0; i < len(dn); i++ {
+		switch dn[i] {
+		case '\\':
+			i++
+		case ',':
+			rdns = append(rdns, dn[start:i])
+			start = i + 1
+		}
+	}
+	return append(rdns, dn[start:])
+}
+
+// unescapeDN resolves the \c and \XX escapes of an RDN value.
+func unescapeDN(v string) string {
+	if !strings.Contains(v, `\`) {
+		return v
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' || i+1 >= len(v) {
+			b.WriteByte(v[i])
+			continue
+		}
+		if i+2 < len(v) {
+			if decoded, err := hex.DecodeString(v[i+1 : i+3]); err == nil {
+				b.Write(decoded)
+				i += 2
+				continue
+			}
+		}
+		i++
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
+
+// ParseOUTags reads OU=tag entries, as in LDAP_OU_TAGS; entries without a
+// tag are ignored.
+func ParseOUTags(entries []string) map[string]string {
+	tags := map[string]string{}
+	for _, entry := range entries {
+		ou, tag, _ := strings.Cut(entry, "=")
+		if ou, tag = strings.TrimSpace(ou), strings.TrimSpace(tag); ou != "" && tag != "" {
+			tags[ou] = tag
+		}
+	}
+	return tags
+}
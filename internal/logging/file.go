@@ -0,0 +1,150 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupLayout is the timestamp in rotated file names, e.g.
+// xf-2024-05-01T08-30-00.000.log for xf.log. It sorts by time and has no
+// colons, which some NAS file systems refuse.
+const backupLayout = "2006-01-02T15-04-05.000"
+
+// File is a log file that is renamed aside once it grows past maxSize and
+// started afresh, keeping the newest maxBackups rotated files that are no
+// older than maxAge. A zero limit disables it.
+type File struct {
+	path string
+
+	mu         sync.Mutex
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// OpenFile opens path for appending, creating it and its directory.
+func OpenFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*File, error) {
+	lf := &File{path: path}
+	lf.setLimits(maxSize, maxAge, maxBackups)
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	lf.prune(time.Now())
+	return lf, nil
+}
+
+func (lf *File) setLimits(maxSize int64, maxAge time.Duration, maxBackups int) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	lf.maxSize, lf.maxAge, lf.maxBackups = maxSize, maxAge, maxBackups
+}
+
+func (lf *File) open() error {
+	if err := os.MkdirAll(filepath.Dir(lf.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	lf.f, lf.size = f, info.Size()
+	return nil
+}
+
+// Write appends p, rotating first when it would take the file past
+// maxSize. A line longer than maxSize still goes into a file of its own.
+func (lf *File) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if lf.maxSize > 0 && lf.size > 0 && lf.size+int64(len(p)) > lf.maxSize {
+		if err := lf.rotate(time.Now()); err != nil {
+			return 0, err
+		}
+	}
+	n, err := lf.f.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
+
+func (lf *File) rotate(now time.Time) error {
+	if err := lf.f.Close(); err != nil {
+		return err
+	}
+	lf.f = nil
+	ext := filepath.Ext(lf.path)
+	backup := strings.TrimSuffix(lf.path, ext) + "-" + now.Format(backupLayout) + ext
+	if err := os.Rename(lf.path, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := lf.open(); err != nil {
+		return err
+	}
+	lf.prune(now)
+	return nil
+}
+
+// prune deletes rotated files beyond the limits, newest kept first. Errors
+// are ignored: a leftover file is retried on the next rotation.
+func (lf *File) prune(now time.Time) {
+	if lf.maxAge <= 0 && lf.maxBackups <= 0 {
+		return
+	}
+	dir := filepath.Dir(lf.path)
+	ext := filepath.Ext(lf.path)
+	prefix := strings.TrimSuffix(filepath.Base(lf.path), ext) + "-"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	type backup struct {
+		name    string
+		rotated time.Time
+	}
+	var backups []backup
+	for _, e := range entries {
+		stamp, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		if stamp, ok = strings.CutSuffix(stamp, ext); !ok {
+			continue
+		}
+		rotated, err := time.ParseInLocation(backupLayout, stamp, time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{e.Name(), rotated})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].rotated.After(backups[j].rotated) })
+	for i, b := range backups {
+		if (lf.maxBackups > 0 && i >= lf.maxBackups) || (lf.maxAge > 0 && now.Sub(b.rotated) > lf.maxAge) {
+			os.Remove(filepath.Join(dir, b.name))
+		}
+	}
+}
+
+// Close closes the file; later writes fail.
+func (lf *File) Close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.f == nil {
+		return nil
+	}
+	err := lf.f.Close()
+	lf.f = nil
+	return err
+}
@@ -0,0 +1,110 @@
+// Package logging sets up the process-wide slog logger and carries the
+// attributes of a scan or request through contexts, so every line about
+// the same work can be found by one field.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Keys shared by log lines across packages.
+const (
+	SubscriptionID = "subscription_id"
+	CustomerEmail  = "customer_email"
+	ScanID         = "scan_id"
+)
+
+// Options configure Setup.
+type Options struct {
+	// Format is "text" or "json".
+	Format string
+	// Level is the lowest level logged; see ParseLevel.
+	Level string
+	// File, when set, is written instead of standard error and rotated as
+	// described at File.
+	File       string
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+}
+
+var (
+	// level is shared by every logger Setup builds, so a reload can
+	// change it without replacing the handler.
+	level slog.LevelVar
+
+	setupMu sync.Mutex
+	// file is the log file Setup opened, kept across calls with the same
+	// path.
+	file *File
+)
+
+// Setup makes slog.Default, and the standard log package through it, write
+// as opts say. It may be called again to apply new options.
+func Setup(opts Options) error {
+	l, err := ParseLevel(opts.Level)
+	if err != nil {
+		return err
+	}
+	if opts.Format != "text" && opts.Format != "json" {
+		return fmt.Errorf("invalid log format %q: want text or json", opts.Format)
+	}
+	setupMu.Lock()
+	defer setupMu.Unlock()
+	var w io.Writer = os.Stderr
+	previous := file
+	if opts.File != "" {
+		if file != nil && file.path == opts.File {
+			file.setLimits(opts.MaxSize, opts.MaxAge, opts.MaxBackups)
+		} else if file, err = OpenFile(opts.File, opts.MaxSize, opts.MaxAge, opts.MaxBackups); err != nil {
+			file = previous
+			return fmt.Errorf("log file: %w", err)
+		}
+		w = file
+	} else {
+		file = nil
+	}
+	handlerOpts := &slog.HandlerOptions{Level: &level}
+	var h slog.Handler
+	if opts.Format == "json" {
+		h = slog.NewJSONHandler(w, handlerOpts)
+	} else {
+		h = slog.NewTextHandler(w, handlerOpts)
+	}
+	level.Set(l)
+	slog.SetDefault(slog.New(h))
+	if previous != nil && previous != file {
+		previous.Close()
+	}
+	return nil
+}
+
+// ParseLevel parses debug, info, warn or error.
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return l, fmt.Errorf("invalid log level %q: want debug, info, warn or error", s)
+	}
+	return l, nil
+}
+
+type loggerKey struct{}
+
+// With returns ctx carrying a logger that adds args to every line.
+func With(ctx context.Context, args ...any) context.Context {
+	return context.WithValue(ctx, loggerKey{}, From(ctx).With(args...))
+}
+
+// From returns the logger With attached to ctx, or slog.Default.
+func From(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
@@ -0,0 +1,156 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"xf/internal/email"
+)
+
+// dingtalkLimit is the longest markdown text a DingTalk robot accepts, in
+// bytes.
+const dingtalkLimit = 20000
+
+// DingTalk posts markdown messages to the group of a DingTalk (钉钉) custom
+// robot. With Secret set, each request is signed as the robot's 加签
+// security setting requires. Message.To lists the members to @-mention,
+// separated by commas: mobile numbers, or DingTalk user IDs.
+type DingTalk struct {
+	WebhookURL string
+	Secret     string
+	Client     *http.Client
+}
+
+func (d DingTalk) Enabled() bool {
+	return d.WebhookURL != ""
+}
+
+// DingTalkError is a reply with a non-zero errcode; like WeCom, the robot
+// answers 200 for failures.
+type DingTalkError struct {
+	Code    int
+	Message string
+}
+
+func (e *DingTalkError) Error() string {
+	return fmt.Sprintf("DingTalk returned errcode %d: %s", e.Code, e.Message)
+}
+
+// Transient reports whether DingTalk was busy or the robot went over its
+// limit of 20 messages a minute.
+func (e *DingTalkError) Transient() bool {
+	return e.Code == -1 || e.Code == 130101
+}
+
+func (d DingTalk) SendMessage(ctx context.Context, msg email.Message) error {
+	text := plainText(msg)
+	if msg.Subject != "" {
+		text = "### " + msg.Subject + "\n\n" + text
+	}
+	title := msg.Subject
+	if title == "" {
+		title = truncate(strings.SplitN(text, "\n", 2)[0], 64)
+	}
+	mobiles, userIDs := []string{}, []string{}
+	var mentions []string
+	for _, at := range strings.Split(msg.To, ",") {
+		at = strings.TrimSpace(at)
+		if at == "" {
+			continue
+		}
+		if isMobile(at) {
+			mobiles = append(mobiles, at)
+		} else {
+			userIDs = append(userIDs, at)
+		}
+		// The robot only highlights members whose @ is in the text.
+		mentions = append(mentions, "@"+at)
+	}
+	if len(mentions) > 0 {
+		suffix := "\n\n" + strings.Join(mentions, " ")
+		text = truncateBytes(text, dingtalkLimit-len(suffix)) + suffix
+	} else {
+		text = truncateBytes(text, dingtalkLimit)
+	}
+	payload, err := json.Marshal(map[string]any{
+		"msgtype":  "markdown",
+		"markdown": map[string]string{"title": title, "text": text},
+		"at":       map[string][]string{"atMobiles": mobiles, "atUserIds": userIDs},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.signedURL(time.Now()), bytes.NewReader(payload))
+	if err != nil {
+		return redact(err, "DingTalk")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return redact(err, "DingTalk")
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 300 {
+		return &email.APIError{Provider: "DingTalk", StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(data))}
+	}
+	var reply struct {
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	}
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return fmt.Errorf("DingTalk: %w", err)
+	}
+	if reply.ErrCode != 0 {
+		return &DingTalkError{Code: reply.ErrCode, Message: reply.ErrMsg}
+	}
+	return nil
+}
+
+// signedURL adds the timestamp and signature to the webhook URL: the
+// signature is the base64 HMAC-SHA256 of the timestamp in milliseconds and
+// the secret, keyed with the secret. DingTalk rejects it an hour later.
+func (d DingTalk) signedURL(now time.Time) string {
+	if d.Secret == "" {
+		return d.WebhookURL
+	}
+	timestamp := strconv.FormatInt(now.UnixMilli(), 10)
+	mac := hmac.New(sha256.New, []byte(d.Secret))
+	mac.Write([]byte(timestamp + "\n" + d.Secret))
+	sign := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	sep := "?"
+	if strings.Contains(d.WebhookURL, "?") {
+		sep = "&"
+	}
+	return d.WebhookURL + sep + "timestamp=" + timestamp + "&sign=" + url.QueryEscape(sign)
+}
+
+// isMobile reports whether a mention is a mobile number rather than a
+// user ID.
+func isMobile(s string) bool {
+	s = strings.TrimPrefix(s, "+")
+	if len(s) < 5 {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
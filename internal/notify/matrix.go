@@ -0,0 +1,119 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"xf/internal/email"
+)
+
+// matrixLimit keeps an event under the 64 KB a homeserver accepts, with
+// room for the HTML copy of the text, in bytes.
+const matrixLimit = 24000
+
+// Matrix posts messages to a Matrix room as the user whose access token is
+// Token, usually a bot account invited to the room. Message.To is the room
+// ID (!abc:example.org). The subject is sent in bold above the text; the
+// plain body carries the same for clients without HTML.
+type Matrix struct {
+	// HomeserverURL is the client API base, e.g. https://matrix.example.org.
+	HomeserverURL string
+	Token         string
+	Client        *http.Client
+}
+
+func (m Matrix) Enabled() bool {
+	return m.HomeserverURL != "" && m.Token != ""
+}
+
+// MatrixError is an error reply from the homeserver, such as M_FORBIDDEN
+// when the account isn't in the room.
+type MatrixError struct {
+	StatusCode int
+	Code       string `json:"errcode"`
+	Message    string `json:"error"`
+}
+
+func (e *MatrixError) Error() string {
+	return "Matrix returned " + e.Code + ": " + e.Message
+}
+
+// Transient reports whether the account went over the homeserver's rate
+// limit or the homeserver failed.
+func (e *MatrixError) Transient() bool {
+	return e.Code == "M_LIMIT_EXCEEDED" || e.StatusCode >= 500
+}
+
+func (m Matrix) SendMessage(ctx context.Context, msg email.Message) error {
+	text := truncateBytes(plainText(msg), matrixLimit)
+	body, formatted := text, strings.ReplaceAll(html.EscapeString(text), "\n", "<br/>")
+	if msg.Subject != "" {
+		body = msg.Subject + "\n\n" + body
+		formatted = "<strong>" + html.EscapeString(msg.Subject) + "</strong><br/><br/>" + formatted
+	}
+	payload, err := json.Marshal(map[string]string{
+		"msgtype":        "m.text",
+		"body":           body,
+		"format":         "org.matrix.custom.html",
+		"formatted_body": formatted,
+	})
+	if err != nil {
+		return err
+	}
+	// The transaction ID lets the homeserver drop a request it has already
+	// handled; each message gets its own.
+	txn := make([]byte, 12)
+	if _, err := rand.Read(txn); err != nil {
+		return err
+	}
+	path := "/rooms/" + url.PathEscape(msg.To) + "/send/m.room.message/" + hex.EncodeToString(txn)
+	return m.call(ctx, http.MethodPut, path, payload)
+}
+
+// Verify checks that the token is accepted and the account has joined
+// room, without sending anything.
+func (m Matrix) Verify(ctx context.Context, room string) error {
+	return m.call(ctx, http.MethodGet, "/rooms/"+url.PathEscape(room)+"/joined_members", nil)
+}
+
+func (m Matrix) call(ctx context.Context, method, path string, payload []byte) error {
+	endpoint := strings.TrimRight(m.HomeserverURL, "/") + "/_matrix/client/v3" + path
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return redact(err, "Matrix")
+	}
+	req.Header.Set("Authorization", "Bearer "+m.Token)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := m.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return redact(err, "Matrix")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	reply, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	matrixErr := &MatrixError{StatusCode: resp.StatusCode}
+	if json.Unmarshal(reply, matrixErr) != nil || matrixErr.Code == "" {
+		return &email.APIError{Provider: "Matrix", StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(reply))}
+	}
+	return matrixErr
+}
@@ -0,0 +1,61 @@
+// Package notify delivers reminders, digests and alerts to chat services
+// and by SMS. Each service is an email.Sender whose Message.To is the chat
+// to post in or the phone number, so the outbox, retries and send log
+// treat it like another mail provider.
+package notify
+
+import (
+	"html"
+	"net/url"
+	"strings"
+
+	"xf/internal/email"
+)
+
+// plainText returns the message body as plain text with the blank lines
+// and indentation of the HTML template squeezed out.
+func plainText(msg email.Message) string {
+	var lines []string
+	blank := false
+	for _, line := range strings.Split(html.UnescapeString(msg.PlainText()), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			blank = len(lines) > 0
+			continue
+		}
+		if blank {
+			lines = append(lines, "")
+			blank = false
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// truncate cuts s to at most limit runes, marking the cut.
+func truncate(s string, limit int) string {
+	runes := []rune(s)
+	if len(runes) <= limit {
+		return s
+	}
+	return string(runes[:limit-1]) + "…"
+}
+
+// truncateBytes cuts s to at most limit bytes without splitting a
+// character, marking the cut.
+func truncateBytes(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	const mark = "…"
+	return strings.ToValidUTF8(s[:limit-len(mark)], "") + mark
+}
+
+// redact strips the URL, which holds the credentials, from a request
+// error. The result is still a net.Error, so email.IsTransient retries it.
+func redact(err error, provider string) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return &url.Error{Op: urlErr.Op, URL: provider, Err: urlErr.Err}
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"xf/internal/email"
+)
+
+// pushLimit keeps a push under the 4 KB ntfy accepts as a message before
+// turning the body into an attachment, in bytes. Gotify has no limit, but
+// a phone shows far less.
+const pushLimit = 4000
+
+// Push priorities. Only alerts and expiries go to push services, so every
+// message is sent with a priority that makes the phone sound.
+const (
+	gotifyPriority = 8
+	ntfyPriority   = "high"
+)
+
+// Gotify posts messages to a Gotify server as the application whose token
+// is Token. The subject is the message title; Message.To is not used.
+type Gotify struct {
+	// URL is the server's base URL, e.g. https://push.example.com.
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+func (g Gotify) Enabled() bool {
+	return g.URL != "" && g.Token != ""
+}
+
+func (g Gotify) SendMessage(ctx context.Context, msg email.Message) error {
+	payload, err := json.Marshal(map[string]any{
+		"title":    msg.Subject,
+		"message":  truncateBytes(plainText(msg), pushLimit),
+		"priority": gotifyPriority,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(g.URL, "/")+"/message", bytes.NewReader(payload))
+	if err != nil {
+		return redact(err, "Gotify")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", g.Token)
+	return sendPush(g.Client, req, "Gotify")
+}
+
+// Ntfy publishes messages to an ntfy topic, on ntfy.sh or a self-hosted
+// server. The subject is the notification title; Message.To is not used.
+type Ntfy struct {
+	// TopicURL is the topic to publish to, e.g. https://ntfy.sh/xf-alerts.
+	TopicURL string
+	// Token is an access token for topics that need one; empty publishes
+	// anonymously.
+	Token  string
+	Client *http.Client
+}
+
+func (n Ntfy) Enabled() bool {
+	return n.TopicURL != ""
+}
+
+func (n Ntfy) SendMessage(ctx context.Context, msg email.Message) error {
+	body := truncateBytes(plainText(msg), pushLimit)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.TopicURL, strings.NewReader(body))
+	if err != nil {
+		return redact(err, "ntfy")
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if msg.Subject != "" {
+		// Header values are ASCII; ntfy decodes RFC 2047 encoded words.
+		req.Header.Set("Title", mime.BEncoding.Encode("utf-8", msg.Subject))
+	}
+	req.Header.Set("Priority", ntfyPriority)
+	if n.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+	return sendPush(n.Client, req, "ntfy")
+}
+
+func sendPush(client *http.Client, req *http.Request, provider string) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return redact(err, provider)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	// Both reply with a JSON error naming the problem, e.g. an unknown
+	// token or a topic that needs authentication.
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	return &email.APIError{Provider: provider, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+}
@@ -0,0 +1,59 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"xf/internal/email"
+)
+
+// slackLimit is the longest text Slack shows in full, in characters.
+const slackLimit = 40000
+
+// Slack posts messages to the channel of an incoming webhook; Message.To is
+// not used. The subject, if any, is sent in bold above the text, which is
+// Slack mrkdwn.
+type Slack struct {
+	WebhookURL string
+	Client     *http.Client
+}
+
+func (s Slack) Enabled() bool {
+	return s.WebhookURL != ""
+}
+
+func (s Slack) SendMessage(ctx context.Context, msg email.Message) error {
+	text := plainText(msg)
+	if msg.Subject != "" {
+		text = "*" + msg.Subject + "*\n" + text
+	}
+	payload, err := json.Marshal(map[string]string{"text": truncate(text, slackLimit)})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.WebhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return redact(err, "Slack")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return redact(err, "Slack")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	// Errors come back as a short code such as invalid_payload or
+	// channel_not_found.
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	return &email.APIError{Provider: "Slack", StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+}
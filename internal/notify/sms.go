@@ -0,0 +1,13 @@
+package notify
+
+import "regexp"
+
+// phoneNumber matches a mobile number: digits, optionally with a leading
+// + and country code, as both Twilio and Aliyun take them.
+var phoneNumber = regexp.MustCompile(`^\+?[0-9]{6,15}$`)
+
+// ValidPhone reports whether phone looks like a mobile number an SMS can
+// be sent to.
+func ValidPhone(phone string) bool {
+	return phoneNumber.MatchString(phone)
+}
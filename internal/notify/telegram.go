@@ -0,0 +1,108 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"xf/internal/email"
+)
+
+const (
+	telegramAPI = "https://api.telegram.org"
+	// telegramLimit is the longest text sendMessage accepts, in characters.
+	telegramLimit = 4096
+)
+
+// telegramChat matches a chat ID: a user, group or channel number, or the
+// @username of a public channel.
+var telegramChat = regexp.MustCompile(`^(-?[0-9]+|@[A-Za-z][A-Za-z0-9_]{4,31})$`)
+
+// ValidTelegramChat reports whether id looks like a Telegram chat ID.
+func ValidTelegramChat(id string) bool {
+	return telegramChat.MatchString(id)
+}
+
+// Telegram posts messages through a bot. Message.To is the chat ID: a
+// number for users and groups, or @name for public channels. The subject
+// is sent in bold above the text.
+type Telegram struct {
+	Token string
+	// APIURL overrides the Bot API server; empty uses the public one.
+	APIURL string
+	Client *http.Client
+}
+
+func (t Telegram) Enabled() bool {
+	return t.Token != ""
+}
+
+type telegramReply struct {
+	OK          bool   `json:"ok"`
+	ErrorCode   int    `json:"error_code"`
+	Description string `json:"description"`
+}
+
+func (t Telegram) SendMessage(ctx context.Context, msg email.Message) error {
+	// The limit applies to the text once the markup is parsed.
+	text := html.EscapeString(truncate(plainText(msg), telegramLimit-len([]rune(msg.Subject))-2))
+	if msg.Subject != "" {
+		text = "<b>" + html.EscapeString(msg.Subject) + "</b>\n\n" + text
+	}
+	payload, err := json.Marshal(map[string]any{
+		"chat_id":                  msg.To,
+		"text":                     text,
+		"parse_mode":               "HTML",
+		"disable_web_page_preview": true,
+	})
+	if err != nil {
+		return err
+	}
+	return t.call(ctx, "sendMessage", payload)
+}
+
+// Verify checks the token by asking the Bot API who the bot is, without
+// sending anything.
+func (t Telegram) Verify(ctx context.Context) error {
+	return t.call(ctx, "getMe", []byte("{}"))
+}
+
+func (t Telegram) call(ctx context.Context, method string, payload []byte) error {
+	base := t.APIURL
+	if base == "" {
+		base = telegramAPI
+	}
+	endpoint := strings.TrimRight(base, "/") + "/bot" + t.Token + "/" + method
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return redact(err, "Telegram")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return redact(err, "Telegram")
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var reply telegramReply
+	if json.Unmarshal(body, &reply) == nil && reply.OK {
+		return nil
+	}
+	if reply.Description == "" {
+		reply.Description = strings.TrimSpace(string(body))
+	}
+	if resp.StatusCode < 300 {
+		return fmt.Errorf("Telegram: %s", reply.Description)
+	}
+	return &email.APIError{Provider: "Telegram", StatusCode: resp.StatusCode, Body: reply.Description}
+}
@@ -0,0 +1,75 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"xf/internal/email"
+)
+
+const twilioAPI = "https://api.twilio.com"
+
+// Twilio sends SMS through the Twilio Messages API. Message.To is the
+// phone number, in E.164 form such as +8613800138000, and the text is the
+// message body; the subject is not used. From is the sending number, or a
+// Messaging Service SID starting with MG.
+type Twilio struct {
+	AccountSID string
+	AuthToken  string
+	From       string
+	// APIURL overrides the API server; empty uses the public one.
+	APIURL string
+	Client *http.Client
+}
+
+func (t Twilio) Enabled() bool {
+	return t.AccountSID != "" && t.AuthToken != "" && t.From != ""
+}
+
+func (t Twilio) SendMessage(ctx context.Context, msg email.Message) error {
+	form := url.Values{"To": {msg.To}, "Body": {plainText(msg)}}
+	if strings.HasPrefix(t.From, "MG") {
+		form.Set("MessagingServiceSid", t.From)
+	} else {
+		form.Set("From", t.From)
+	}
+	base := t.APIURL
+	if base == "" {
+		base = twilioAPI
+	}
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", strings.TrimRight(base, "/"), url.PathEscape(t.AccountSID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(t.AccountSID, t.AuthToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	// Errors carry a Twilio code, e.g. 21211 for an invalid To number.
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	var reply struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	detail := strings.TrimSpace(string(body))
+	if json.Unmarshal(body, &reply) == nil && reply.Message != "" {
+		detail = fmt.Sprintf("%d %s", reply.Code, reply.Message)
+	}
+	return &email.APIError{Provider: "Twilio", StatusCode: resp.StatusCode, Body: detail}
+}
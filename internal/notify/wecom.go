@@ -0,0 +1,183 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"xf/internal/email"
+)
+
+const (
+	wecomAPI = "https://qyapi.weixin.qq.com"
+	// wecomLimit is the longest markdown content WeCom accepts, in bytes.
+	wecomLimit = 2048
+)
+
+// WeCom errcodes that mean the access token has to be fetched again.
+const (
+	wecomInvalidToken = 40014
+	wecomExpiredToken = 42001
+)
+
+// WeCom sends application messages through a WeCom (企业微信) app.
+// Message.To lists the member IDs to send to, separated by "|", or "@all"
+// for everyone the app is visible to. Messages go out as markdown, which
+// the WeCom client renders; the subject is a heading above the text. The
+// access token is fetched with the app secret and kept until it expires.
+type WeCom struct {
+	CorpID  string
+	AgentID int
+	Secret  string
+	// APIURL overrides the API server; empty uses the public one.
+	APIURL string
+	Client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (w *WeCom) Enabled() bool {
+	return w.CorpID != "" && w.AgentID != 0 && w.Secret != ""
+}
+
+// WeComError is a reply with a non-zero errcode. WeCom answers 200 even
+// for failures, so the code is all there is to go by.
+type WeComError struct {
+	Code    int
+	Message string
+}
+
+func (e *WeComError) Error() string {
+	return fmt.Sprintf("WeCom returned errcode %d: %s", e.Code, e.Message)
+}
+
+// Transient reports whether WeCom was busy or the app hit its call limits.
+func (e *WeComError) Transient() bool {
+	return e.Code == -1 || e.Code == 45009 || e.Code == 45033
+}
+
+type wecomReply struct {
+	ErrCode     int    `json:"errcode"`
+	ErrMsg      string `json:"errmsg"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	// InvalidUser lists the member IDs the message could not go to.
+	InvalidUser string `json:"invaliduser"`
+}
+
+func (w *WeCom) SendMessage(ctx context.Context, msg email.Message) error {
+	content := plainText(msg)
+	if msg.Subject != "" {
+		content = "### " + msg.Subject + "\n" + content
+	}
+	payload, err := json.Marshal(map[string]any{
+		"touser":   msg.To,
+		"msgtype":  "markdown",
+		"agentid":  w.AgentID,
+		"markdown": map[string]string{"content": truncateBytes(content, wecomLimit)},
+	})
+	if err != nil {
+		return err
+	}
+	reply, err := w.send(ctx, payload)
+	var wecomErr *WeComError
+	if errors.As(err, &wecomErr) && (wecomErr.Code == wecomInvalidToken || wecomErr.Code == wecomExpiredToken) {
+		// Revoked or expired early, e.g. after the secret was reset.
+		w.mu.Lock()
+		w.token = ""
+		w.mu.Unlock()
+		reply, err = w.send(ctx, payload)
+	}
+	if err != nil {
+		return err
+	}
+	if reply.InvalidUser != "" {
+		return fmt.Errorf("WeCom could not deliver to %s", reply.InvalidUser)
+	}
+	return nil
+}
+
+// Verify fetches an access token, which checks the corp ID and secret
+// without sending anything.
+func (w *WeCom) Verify(ctx context.Context) error {
+	w.mu.Lock()
+	w.token = ""
+	w.mu.Unlock()
+	_, err := w.accessToken(ctx)
+	return err
+}
+
+func (w *WeCom) send(ctx context.Context, payload []byte) (wecomReply, error) {
+	token, err := w.accessToken(ctx)
+	if err != nil {
+		return wecomReply{}, err
+	}
+	return w.call(ctx, http.MethodPost, "/cgi-bin/message/send?access_token="+url.QueryEscape(token), payload)
+}
+
+// accessToken returns the cached token, fetching a new one a minute
+// before the old one expires.
+func (w *WeCom) accessToken(ctx context.Context) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.token != "" && time.Now().Before(w.expires) {
+		return w.token, nil
+	}
+	query := url.Values{"corpid": {w.CorpID}, "corpsecret": {w.Secret}}
+	reply, err := w.call(ctx, http.MethodGet, "/cgi-bin/gettoken?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	w.token = reply.AccessToken
+	w.expires = time.Now().Add(time.Duration(reply.ExpiresIn)*time.Second - time.Minute)
+	return w.token, nil
+}
+
+func (w *WeCom) call(ctx context.Context, method, path string, payload []byte) (wecomReply, error) {
+	base := w.APIURL
+	if base == "" {
+		base = wecomAPI
+	}
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(base, "/")+path, body)
+	if err != nil {
+		return wecomReply{}, redact(err, "WeCom")
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return wecomReply{}, redact(err, "WeCom")
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 300 {
+		return wecomReply{}, &email.APIError{Provider: "WeCom", StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(data))}
+	}
+	var reply wecomReply
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return wecomReply{}, fmt.Errorf("WeCom: %w", err)
+	}
+	if reply.ErrCode != 0 {
+		return wecomReply{}, &WeComError{Code: reply.ErrCode, Message: reply.ErrMsg}
+	}
+	return reply, nil
+}
@@ -0,0 +1,494 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	"xf/internal/calendar"
+	"xf/internal/db"
+	"xf/internal/email"
+	"xf/internal/logging"
+)
+
+const (
+	defaultWorkers      = 2
+	defaultPollInterval = 5 * time.Second
+	defaultSendTimeout  = time.Minute
+)
+
+// maxRetryBackoff caps the doubling wait between retries.
+const maxRetryBackoff = 24 * time.Hour
+
+// pruneInterval is how often failed messages past KeepFailed are removed.
+const pruneInterval = time.Hour
+
+// Dispatcher delivers messages from the store's outbox in the background.
+// RatePerMinute caps deliveries across all workers; zero means unlimited.
+// After AlertAfter consecutive send errors across all workers Alert is
+// called once; the count starts over after the next successful send. Zero
+// disables alerting. Bcc is copied on every customer email, i.e. those
+// queued for a subscription. ReplyTo applies to messages that don't set
+// their own. Messages a rate-limited Mailer refuses stay queued until the
+// limit allows them. With TrackOpens, customer emails carry a tracking
+// pixel served from PublicURL; with TrackClicks, their links go through a
+// redirect there. Headers are added to every message that doesn't set the
+// same header itself. With Archive, a copy of each sent message, composed as
+// sent from From, is kept for the send log. Channels deliver the messages
+// queued for a chat service, keyed by db.OutboxEmail.Channel; those go out
+// as they are, without tracking, attachments or archiving, and stay queued
+// while their channel is not configured. Messages that failed for good are
+// removed once they are older than KeepFailed; zero keeps them.
+type Dispatcher struct {
+	Store         *db.Store
+	Mailer        email.Sender
+	Channels      map[string]email.Sender
+	Workers       int
+	RatePerMinute int
+	Retries       int
+	RetryBackoff  time.Duration
+	KeepFailed    time.Duration
+	PollInterval  time.Duration
+	SendTimeout   time.Duration
+	Location      *time.Location
+	AlertAfter    int
+	Alert         func(ctx context.Context, failures int, lastErr error)
+	Bcc           []string
+	ReplyTo       string
+	PublicURL     string
+	TrackOpens    bool
+	TrackClicks   bool
+	Headers       map[string]string
+	Archive       bool
+	From          string
+}
+
+// Running is a started dispatcher whose settings can be replaced while it
+// runs, so a configuration reload takes effect without restarting. Workers
+// and RatePerMinute stay as they were at Start; a message already being
+// delivered finishes with the settings it started with.
+type Running struct {
+	mu         sync.RWMutex
+	dispatcher Dispatcher
+}
+
+// Update replaces the settings used for later deliveries.
+func (r *Running) Update(d Dispatcher) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dispatcher = d
+}
+
+func (r *Running) current() Dispatcher {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.dispatcher
+}
+
+// Start launches the workers; they stop once ctx is cancelled, leaving any
+// unsent messages queued for the next start.
+func (d Dispatcher) Start(ctx context.Context) *Running {
+	workers := d.Workers
+	if workers < 1 {
+		workers = defaultWorkers
+	}
+	r := &Running{dispatcher: d}
+	limiter := newRateLimiter(d.RatePerMinute)
+	streak := &failureStreak{}
+	for i := 0; i < workers; i++ {
+		go r.run(ctx, limiter, streak)
+	}
+	go r.prune(ctx)
+	return r
+}
+
+// prune removes failed messages older than KeepFailed now and then every
+// pruneInterval until ctx is cancelled. It does nothing while KeepFailed is
+// zero.
+func (r *Running) prune(ctx context.Context) {
+	for {
+		if keep := r.current().KeepFailed; keep > 0 {
+			if n, err := r.current().Store.PruneFailedOutbox(time.Now().Add(-keep)); err != nil {
+				slog.Error("outbox prune error", "error", err)
+			} else if n > 0 {
+				slog.Info("pruned failed messages from the outbox", "count", n)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pruneInterval):
+		}
+	}
+}
+
+// retryDelay returns how long to wait before retrying a message after its
+// attempt-th failed attempt: base, doubled for each earlier attempt, up to
+// maxRetryBackoff.
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryBackoff)
+}
+
+// Drain delivers the messages that are due now, one at a time, and returns
+// how many it handled once none are left, the send window is closed for the
+// rest or ctx is cancelled. Retries scheduled for later stay queued. It
+// serves one-off runs such as the scan command, where no workers are
+// running.
+func (d Dispatcher) Drain(ctx context.Context) int {
+	limiter := newRateLimiter(d.RatePerMinute)
+	streak := &failureStreak{}
+	handled := 0
+	for {
+		if err := limiter.wait(ctx); err != nil {
+			break
+		}
+		if !d.deliverNext(ctx, time.Now(), streak) {
+			break
+		}
+		handled++
+	}
+	return handled
+}
+
+func (r *Running) run(ctx context.Context, limiter *rateLimiter, streak *failureStreak) {
+	for {
+		if err := limiter.wait(ctx); err != nil {
+			return
+		}
+		d := r.current()
+		if d.deliverNext(ctx, time.Now(), streak) {
+			continue
+		}
+		interval := d.PollInterval
+		if interval <= 0 {
+			interval = defaultPollInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// sendAllowed returns which messages may go out at now: those with a
+// configured sender whose recipient's local time is outside the configured
+// quiet hours and blackout dates. Messages stay queued until the window
+// opens again.
+func (d Dispatcher) sendAllowed(now time.Time) func(db.OutboxEmail) bool {
+	// A window that fails to load allows every message.
+	var window calendar.Window
+	settings, err := d.Store.GetSendWindow()
+	if err == nil {
+		window, err = calendar.ParseWindow(settings.QuietHours, settings.BlackoutDates)
+	}
+	if err != nil {
+		slog.Error("queue send window error", "error", err)
+	}
+	return func(msg db.OutboxEmail) bool {
+		if sender := d.sender(msg); sender == nil || !sender.Enabled() {
+			return false
+		}
+		return window.Allows(now.In(d.zone(msg.TimeZone)))
+	}
+}
+
+// sender returns what delivers msg: Mailer for email, or the channel's
+// sender, nil if there is none.
+func (d Dispatcher) sender(msg db.OutboxEmail) email.Sender {
+	if msg.Channel == "" {
+		return d.Mailer
+	}
+	return d.Channels[msg.Channel]
+}
+
+// Enabled reports whether any queued message can be delivered.
+func (d Dispatcher) Enabled() bool {
+	if d.Mailer != nil && d.Mailer.Enabled() {
+		return true
+	}
+	for _, sender := range d.Channels {
+		if sender.Enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+func (d Dispatcher) location() *time.Location {
+	if d.Location == nil {
+		return time.Local
+	}
+	return d.Location
+}
+
+// zone returns the recipient's time zone, or Location if none is set.
+func (d Dispatcher) zone(name string) *time.Location {
+	if name != "" {
+		if loc, err := calendar.LoadZone(name); err == nil {
+			return loc
+		}
+	}
+	return d.location()
+}
+
+// deliverNext sends one due message and reports whether there was one.
+func (d Dispatcher) deliverNext(ctx context.Context, now time.Time, streak *failureStreak) bool {
+	msg, ok, err := d.Store.ClaimOutboxEmail(ctx, now, d.sendAllowed(now))
+	if err != nil {
+		if ctx.Err() != nil {
+			return false
+		}
+		slog.Error("queue claim error", "error", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	logger := slog.With("outbox_id", msg.ID, logging.SubscriptionID, msg.SubscriptionID, logging.CustomerEmail, msg.To)
+	timeout := d.SendTimeout
+	if timeout <= 0 {
+		timeout = defaultSendTimeout
+	}
+	message, links, sendErr := d.message(msg)
+	if d.Archive && msg.Channel == "" && message.MessageID == "" {
+		// Fix the Message-ID up front so the archived copy matches what
+		// the recipient got.
+		message.MessageID = email.NewMessageID(d.From, now)
+	}
+	if sendErr == nil {
+		sendCtx, cancel := context.WithTimeout(ctx, timeout)
+		sendErr = d.sender(msg).SendMessage(sendCtx, message)
+		cancel()
+	}
+	var limited *email.RateLimitError
+	if errors.As(sendErr, &limited) {
+		// Nothing went out; wait for the limit window without using up an
+		// attempt or counting towards the failure alert.
+		if err := d.Store.DeferOutboxEmail(msg.ID, sendErr.Error(), limited.RetryAt); err != nil {
+			logger.Error("queue update error", "error", err)
+		}
+		return false
+	}
+	class := email.Classify(sendErr)
+	if ctx.Err() == nil && class != email.FailureBadAddress && msg.Channel == "" {
+		// A refused address says nothing about the mail setup, so it
+		// doesn't count towards the failure alert, and neither do chat
+		// messages.
+		d.trackFailure(ctx, streak, sendErr)
+	}
+	switch {
+	case sendErr == nil:
+		logger.Debug("email sent", "attempt", msg.Attempts)
+		archived := msg.Channel == "" && d.archive(message, now)
+		d.record(msg, message.Reference, links, archived, db.DeliverySent, nil, now)
+		err = d.Store.CompleteOutboxEmail(msg.ID)
+	case ctx.Err() != nil:
+		// Interrupted by shutdown: put it back without waiting so the next
+		// start picks it up straight away.
+		err = d.Store.RetryOutboxEmail(msg.ID, sendErr.Error(), now)
+	case errors.Is(sendErr, email.ErrInactiveRecipient):
+		logger.Warn("queue send suppressed", "error", sendErr)
+		d.record(msg, message.Reference, nil, false, db.DeliverySuppressed, sendErr, now)
+		err = d.Store.FailOutboxEmail(msg.ID, sendErr.Error(), now)
+	case class == email.FailureBadAddress:
+		// Not retried: the address will be refused again. Flag the
+		// customer so the admin can fix it.
+		logger.Warn("queue send refused the address", "error", sendErr)
+		d.record(msg, message.Reference, nil, false, db.DeliveryFailed, sendErr, now)
+		d.flagBadAddress(msg, sendErr, now)
+		err = d.Store.FailOutboxEmail(msg.ID, sendErr.Error(), now)
+	case class == email.FailureTransient && msg.Attempts <= d.Retries:
+		backoff := retryDelay(d.RetryBackoff, msg.Attempts)
+		logger.Info("queue send failed, will retry", "attempt", msg.Attempts, "retry_in", backoff, "error", sendErr)
+		err = d.Store.RetryOutboxEmail(msg.ID, sendErr.Error(), now.Add(backoff))
+	default:
+		logger.Error("queue send failed", "attempts", msg.Attempts, "error", sendErr)
+		d.record(msg, message.Reference, nil, false, db.DeliveryFailed, sendErr, now)
+		err = d.Store.FailOutboxEmail(msg.ID, sendErr.Error(), now)
+	}
+	if err != nil {
+		logger.Error("queue update error", "error", err)
+	}
+	return true
+}
+
+// message loads the outbox entry's attachments and builds the message to
+// send, along with the original targets of any links rewritten for click
+// tracking. Attachments deleted since the entry was queued are left out.
+// The company logo is embedded when the HTML refers to it.
+func (d Dispatcher) message(msg db.OutboxEmail) (email.Message, []string, error) {
+	if msg.Channel != "" {
+		return email.Message{To: msg.To, Subject: msg.Subject, HTML: msg.HTML, Text: msg.Text, Reference: newReference()}, nil, nil
+	}
+	var links []string
+	message := email.Message{To: msg.To, Cc: msg.Cc, ReplyTo: msg.ReplyTo, Subject: msg.Subject, HTML: msg.HTML, Text: msg.Text, Headers: msg.Headers, Reference: newReference(), MessageID: msg.MessageID}
+	if message.ReplyTo == "" {
+		message.ReplyTo = d.ReplyTo
+	}
+	if len(d.Headers) > 0 {
+		message.Headers = maps.Clone(d.Headers)
+		maps.Copy(message.Headers, msg.Headers)
+	}
+	if msg.SubscriptionID != 0 {
+		message.Bcc = d.Bcc
+		if d.TrackClicks {
+			message.HTML, links = rewriteLinks(message.HTML, d.PublicURL, d.PublicURL+"/track/click/"+message.Reference)
+		}
+		if d.TrackOpens && message.HTML != "" {
+			message.HTML = addOpenPixel(message.HTML, d.PublicURL+"/track/open/"+message.Reference+".gif")
+		}
+	}
+	for _, id := range msg.AttachmentIDs {
+		att, data, ok, err := d.Store.ReadAttachment(id)
+		if err != nil {
+			return message, nil, fmt.Errorf("读取附件 #%d 失败: %w", id, err)
+		}
+		if !ok {
+			slog.Warn("queue attachment no longer exists, sending without it", "attachment_id", id, logging.SubscriptionID, msg.SubscriptionID, logging.CustomerEmail, msg.To)
+			continue
+		}
+		message.Attachments = append(message.Attachments, email.Attachment{
+			Filename:    att.Name,
+			ContentType: att.ContentType,
+			Data:        data,
+		})
+	}
+	if strings.Contains(msg.HTML, "cid:"+email.LogoContentID) {
+		att, data, ok, err := d.Store.GetLogo()
+		if err != nil {
+			return message, nil, fmt.Errorf("读取 Logo 失败: %w", err)
+		}
+		if ok {
+			message.Attachments = append(message.Attachments, email.Attachment{
+				Filename:    att.Name,
+				ContentType: att.ContentType,
+				Data:        data,
+				ContentID:   email.LogoContentID,
+			})
+		}
+	}
+	return message, links, nil
+}
+
+// trackFailure updates the consecutive failure count and raises the alert
+// when it reaches AlertAfter.
+func (d Dispatcher) trackFailure(ctx context.Context, streak *failureStreak, sendErr error) {
+	if d.AlertAfter <= 0 || d.Alert == nil {
+		return
+	}
+	if n := streak.add(sendErr); n == d.AlertAfter {
+		d.Alert(ctx, n, sendErr)
+	}
+}
+
+// failureStreak counts consecutive send errors shared by all workers.
+type failureStreak struct {
+	mu sync.Mutex
+	n  int
+}
+
+// add resets the streak on success and returns the updated count.
+func (s *failureStreak) add(err error) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.n = 0
+	} else {
+		s.n++
+	}
+	return s.n
+}
+
+// archive stores a copy of a sent message and reports whether it did.
+func (d Dispatcher) archive(message email.Message, now time.Time) bool {
+	if !d.Archive {
+		return false
+	}
+	if err := d.Store.ArchiveMessage(message.Reference, email.Compose(d.From, message, now)); err != nil {
+		slog.Error("queue archive error", "reference", message.Reference, "error", err)
+		return false
+	}
+	return true
+}
+
+// flagBadAddress marks customers using the refused address as bouncing.
+// The refused address may be a Cc rather than msg.To.
+func (d Dispatcher) flagBadAddress(msg db.OutboxEmail, sendErr error, now time.Time) {
+	address := msg.To
+	var rcptErr *email.RecipientError
+	if errors.As(sendErr, &rcptErr) {
+		address = rcptErr.Address
+	}
+	if _, err := d.Store.FlagInvalidAddress(address, sendErr.Error(), now); err != nil {
+		slog.Error("queue flag address error", logging.SubscriptionID, msg.SubscriptionID, logging.CustomerEmail, address, "error", err)
+	}
+}
+
+func (d Dispatcher) record(msg db.OutboxEmail, reference string, links []string, archived bool, status string, sendErr error, now time.Time) {
+	var errText string
+	if sendErr != nil {
+		errText = sendErr.Error()
+	}
+	err := d.Store.RecordDelivery(db.Delivery{
+		SubscriptionID: msg.SubscriptionID,
+		To:             msg.To,
+		Subject:        msg.Subject,
+		Status:         status,
+		Error:          errText,
+		FailureClass:   email.Classify(sendErr),
+		Date:           now.In(d.location()).Format("2006-01-02"),
+		At:             now.Format(time.RFC3339),
+		Reference:      reference,
+		Links:          links,
+		Archived:       archived,
+		Channel:        msg.Channel,
+	})
+	if err != nil {
+		slog.Error("queue record error", logging.SubscriptionID, msg.SubscriptionID, logging.CustomerEmail, msg.To, "error", err)
+	}
+}
+
+// newReference returns a random ID tying delivery events back to the send
+// log entry.
+func newReference() string {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// rateLimiter spaces deliveries evenly so no more than perMinute go out in
+// any minute. A nil limiter never blocks.
+type rateLimiter struct {
+	ticks <-chan time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &rateLimiter{ticks: time.NewTicker(time.Minute / time.Duration(perMinute)).C}
+}
+
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return ctx.Err()
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-l.ticks:
+		return nil
+	}
+}
@@ -0,0 +1,44 @@
+package queue
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// hrefPattern matches absolute http(s) link targets in anchor tags.
+var hrefPattern = regexp.MustCompile(`(?i)(<a\s[^>]*?href\s*=\s*)(["'])(https?://[^"']+)(["'])`)
+
+// addOpenPixel inserts a 1x1 image loading pixelURL just before </body>, or
+// at the end when the HTML has no body tag.
+func addOpenPixel(body, pixelURL string) string {
+	img := `<img src="` + html.EscapeString(pixelURL) + `" width="1" height="1" alt="" style="display:block;border:0;width:1px;height:1px">`
+	if i := strings.LastIndex(strings.ToLower(body), "</body>"); i != -1 {
+		return body[:i] + img + body[i:]
+	}
+	return body + img
+}
+
+// rewriteLinks points each http(s) link in body at redirectBase/<n>, where n
+// indexes the returned original targets. Links to publicURL itself, such as
+// the unsubscribe page, are left alone.
+func rewriteLinks(body, publicURL, redirectBase string) (string, []string) {
+	var links []string
+	index := map[string]int{}
+	out := hrefPattern.ReplaceAllStringFunc(body, func(m string) string {
+		parts := hrefPattern.FindStringSubmatch(m)
+		target := html.UnescapeString(parts[3])
+		if parts[2] != parts[4] || strings.HasPrefix(target, publicURL+"/") {
+			return m
+		}
+		n, ok := index[target]
+		if !ok {
+			n = len(links)
+			index[target] = n
+			links = append(links, target)
+		}
+		return parts[1] + parts[2] + html.EscapeString(fmt.Sprintf("%s/%d", redirectBase, n)) + parts[4]
+	})
+	return out, links
+}
@@ -0,0 +1,314 @@
+// Package quote renders renewal quotes as PDF. Text is set in
+// STSong-Light, one of the Chinese fonts PDF readers supply themselves, so
+// nothing is embedded and a quote stays a few kilobytes.
+package quote
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Quote is one quote: the lines of a reminder and what to pay.
+type Quote struct {
+	Number   string
+	Date     string
+	Company  string
+	Customer string
+	Email    string
+	Lines    []Line
+	// Totals are the sums per currency, formatted.
+	Totals []string
+	// Payment is how to pay, one instruction per line.
+	Payment string
+}
+
+// Line is a subscription being quoted for renewal.
+type Line struct {
+	Product string
+	// Detail is shown under the product, such as the domain or note.
+	Detail        string
+	Period        string
+	CurrentExpiry string
+	NewExpiry     string
+	Amount        string
+}
+
+const (
+	pageWidth  = 595 // A4 in points
+	pageHeight = 842
+	margin     = 50
+	bottom     = 90
+)
+
+// Table columns: left edges, and the right edge of the amount.
+const (
+	colProduct = margin
+	colPeriod  = 262
+	colCurrent = 322
+	colNew     = 414
+	colAmount  = pageWidth - margin
+)
+
+// Render lays the quote out on as many A4 pages as it needs.
+func Render(q Quote) []byte {
+	var r renderer
+	r.page()
+	r.text(margin, 780, 18, q.Company)
+	r.textRight(colAmount, 780, 18, "续费报价单")
+	r.rule(margin, 766, colAmount, 766, 1)
+	r.text(margin, 742, 10, "报价单号："+q.Number)
+	r.textRight(colAmount, 742, 10, "日期："+q.Date)
+	customer := q.Customer
+	if q.Email != "" {
+		if customer != "" {
+			customer += "  "
+		}
+		customer += q.Email
+	}
+	r.text(margin, 724, 10, "客户："+customer)
+	r.y = 690
+	r.header()
+	for _, line := range q.Lines {
+		height := 22.0
+		if line.Detail != "" {
+			height = 34
+		}
+		if r.y-height < bottom {
+			r.page()
+			r.y = 780
+			r.header()
+		}
+		r.text(colProduct, r.y, 10, fit(line.Product, colPeriod-colProduct-8, 10))
+		r.text(colPeriod, r.y, 10, line.Period)
+		r.text(colCurrent, r.y, 10, line.CurrentExpiry)
+		r.text(colNew, r.y, 10, line.NewExpiry)
+		r.textRight(colAmount, r.y, 10, line.Amount)
+		if line.Detail != "" {
+			r.gray(true)
+			r.text(colProduct, r.y-13, 8, fit(line.Detail, colPeriod-colProduct-8, 8))
+			r.gray(false)
+		}
+		r.rule(margin, r.y-height+12, colAmount, r.y-height+12, 0.3)
+		r.y -= height
+	}
+	for i, total := range q.Totals {
+		if r.y-18 < bottom {
+			r.page()
+			r.y = 780
+		}
+		label := ""
+		if i == 0 {
+			label = "合计"
+		}
+		r.text(colNew, r.y-4, 11, label)
+		r.textRight(colAmount, r.y-4, 11, total)
+		r.y -= 18
+	}
+	if payment := strings.TrimSpace(q.Payment); payment != "" {
+		r.y -= 16
+		lines := wrap(payment, colAmount-margin, 10)
+		if r.y-16-float64(len(lines))*15 < bottom && r.y < 500 {
+			r.page()
+			r.y = 780
+		}
+		r.text(margin, r.y, 11, "付款说明")
+		r.y -= 18
+		for _, line := range lines {
+			if r.y < bottom {
+				r.page()
+				r.y = 780
+			}
+			r.text(margin, r.y, 10, line)
+			r.y -= 15
+		}
+	}
+	return r.bytes()
+}
+
+type renderer struct {
+	pages []*bytes.Buffer
+	y     float64
+}
+
+func (r *renderer) page() {
+	r.pages = append(r.pages, &bytes.Buffer{})
+}
+
+func (r *renderer) current() *bytes.Buffer {
+	return r.pages[len(r.pages)-1]
+}
+
+func (r *renderer) header() {
+	r.text(colProduct, r.y, 10, "产品")
+	r.text(colPeriod, r.y, 10, "服务期")
+	r.text(colCurrent, r.y, 10, "当前到期")
+	r.text(colNew, r.y, 10, "续费后到期")
+	r.textRight(colAmount, r.y, 10, "金额")
+	r.rule(margin, r.y-8, colAmount, r.y-8, 0.6)
+	r.y -= 26
+}
+
+func (r *renderer) text(x, y, size float64, s string) {
+	if s == "" {
+		return
+	}
+	fmt.Fprintf(r.current(), "BT /F1 %s Tf %s %s Td <%s> Tj ET\n", num(size), num(x), num(y), ucs2(s))
+}
+
+func (r *renderer) textRight(x, y, size float64, s string) {
+	r.text(x-width(s, size), y, size, s)
+}
+
+func (r *renderer) rule(x1, y1, x2, y2, w float64) {
+	fmt.Fprintf(r.current(), "%s w %s %s m %s %s l S\n", num(w), num(x1), num(y1), num(x2), num(y2))
+}
+
+func (r *renderer) gray(on bool) {
+	if on {
+		r.current().WriteString("0.4 g\n")
+	} else {
+		r.current().WriteString("0 g\n")
+	}
+}
+
+// bytes writes the document: catalog, page tree, pages with their content
+// streams, and the font.
+func (r *renderer) bytes() []byte {
+	var objects []string
+	add := func(s string) int {
+		objects = append(objects, s)
+		return len(objects)
+	}
+	catalog := add("")
+	pages := add("")
+	descriptor := add("<< /Type /FontDescriptor /FontName /STSong-Light /Flags 6 /FontBBox [-25 -254 1000 880] " +
+		"/ItalicAngle 0 /Ascent 880 /Descent -120 /CapHeight 880 /StemV 93 >>")
+	// CIDs 1 to 95 are the half-width ASCII glyphs.
+	cidFont := add(fmt.Sprintf("<< /Type /Font /Subtype /CIDFontType0 /BaseFont /STSong-Light "+
+		"/CIDSystemInfo << /Registry (Adobe) /Ordering (GB1) /Supplement 2 >> /FontDescriptor %d 0 R /DW 1000 /W [1 95 500] >>", descriptor))
+	font := add(fmt.Sprintf("<< /Type /Font /Subtype /Type0 /BaseFont /STSong-Light /Encoding /UniGB-UCS2-H /DescendantFonts [%d 0 R] >>", cidFont))
+	var kids []string
+	for _, content := range r.pages {
+		stream := add(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+		page := add(fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 %d 0 R >> >> /Contents %d 0 R >>",
+			pages, pageWidth, pageHeight, font, stream))
+		kids = append(kids, fmt.Sprintf("%d 0 R", page))
+	}
+	objects[catalog-1] = fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pages)
+	objects[pages-1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids))
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, catalog, xref)
+	return out.Bytes()
+}
+
+// ucs2 encodes s as the hex of its UTF-16BE code units, which
+// UniGB-UCS2-H maps to glyphs; characters outside the BMP become "?".
+func ucs2(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if c > 0xffff || c < 0x20 {
+			c = '?'
+		}
+		fmt.Fprintf(&b, "%04X", c)
+	}
+	return b.String()
+}
+
+// width is the advance of s in points: half an em for ASCII, a full em
+// for the rest.
+func width(s string, size float64) float64 {
+	w := 0.0
+	for _, c := range s {
+		if c < 0x80 {
+			w += size / 2
+		} else {
+			w += size
+		}
+	}
+	return w
+}
+
+// fit shortens s with an ellipsis to at most max points wide.
+func fit(s string, max, size float64) string {
+	if width(s, size) <= max {
+		return s
+	}
+	for s != "" && width(s, size)+size > max {
+		_, n := utf8.DecodeLastRuneInString(s)
+		s = s[:len(s)-n]
+	}
+	return s + "…"
+}
+
+// wrap breaks text into lines at most max points wide, keeping its line
+// breaks; ASCII words are not split unless longer than a line.
+func wrap(text string, max, size float64) []string {
+	var lines []string
+	for _, para := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		para = strings.TrimRight(para, " \t")
+		line, lineWidth := "", 0.0
+		for _, token := range tokens(para) {
+			w := width(token, size)
+			if lineWidth+w > max && line != "" {
+				lines = append(lines, strings.TrimRight(line, " "))
+				line, lineWidth = "", 0
+				if token == " " {
+					continue
+				}
+			}
+			for w > max {
+				// A word wider than a line: cut it at the edge.
+				cut := fit(token, max, size)
+				cut = strings.TrimSuffix(cut, "…")
+				lines = append(lines, cut)
+				token = token[len(cut):]
+				w = width(token, size)
+			}
+			line += token
+			lineWidth += w
+		}
+		lines = append(lines, strings.TrimRight(line, " "))
+	}
+	return lines
+}
+
+// tokens splits s into ASCII words, single spaces and single other
+// characters, the units wrap breaks between.
+func tokens(s string) []string {
+	var out []string
+	word := ""
+	for _, c := range s {
+		if c < 0x80 && c != ' ' {
+			word += string(c)
+			continue
+		}
+		if word != "" {
+			out = append(out, word)
+			word = ""
+		}
+		out = append(out, string(c))
+	}
+	if word != "" {
+		out = append(out, word)
+	}
+	return out
+}
+
+func num(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,127 @@
+package reminder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"xf/internal/config"
+	"xf/internal/db"
+)
+
+// Chat is a chat to post to: Channel is one of the db.Channel* values and
+// To the chat on that service. With Expiries, an admin chat also gets a
+// card for each subscription sent a reminder.
+type Chat struct {
+	Channel  string
+	To       string
+	Expiries bool
+}
+
+// AdminChats returns the admin chats set in the configuration.
+func AdminChats(cfg config.Config) []Chat {
+	var chats []Chat
+	if cfg.TelegramBotToken != "" && cfg.TelegramAdminChat != "" {
+		chats = append(chats, Chat{Channel: db.ChannelTelegram, To: cfg.TelegramAdminChat})
+	}
+	if cfg.WeComCorpID != "" {
+		// Staff read WeCom on their phones, so it carries the expiries too.
+		chats = append(chats, Chat{Channel: db.ChannelWeCom, To: cfg.WeComToUser, Expiries: true})
+	}
+	if cfg.FeishuWebhookURL != "" {
+		// Expiries go to Feishu as one card per scan rather than one per
+		// subscription; see postExpiringCard.
+		chats = append(chats, Chat{Channel: db.ChannelFeishu})
+	}
+	return chats
+}
+
+// customerChats returns the chats that get a copy of the customer's
+// reminders besides the email.
+func (s Service) customerChats(sub db.SubscriptionDetail) []Chat {
+	var chats []Chat
+	if s.Telegram && sub.CustomerTelegramChatID != "" {
+		chats = append(chats, Chat{Channel: db.ChannelTelegram, To: sub.CustomerTelegramChatID})
+	}
+	return chats
+}
+
+// chatMessage is msg addressed to chat. Chat services take only the
+// subject and text, so the copy has no copies, headers or attachments.
+func chatMessage(msg db.OutboxEmail, chat Chat) db.OutboxEmail {
+	return db.OutboxEmail{
+		SubscriptionID: msg.SubscriptionID,
+		Channel:        chat.Channel,
+		To:             chat.To,
+		Subject:        msg.Subject,
+		HTML:           msg.HTML,
+		Text:           msg.Text,
+		TimeZone:       msg.TimeZone,
+	}
+}
+
+// queueAdminChats queues msg, an admin email, to every admin chat.
+func (s Service) queueAdminChats(ctx context.Context, msg db.OutboxEmail, now time.Time) error {
+	for _, chat := range s.AdminChats {
+		if err := s.Store.EnqueueEmail(ctx, chatMessage(msg, chat), now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueExpiryCards queues a card with the subscription details to each
+// admin chat that takes expiries, for every subscription in a reminder
+// that was just queued. The cards are WeCom markdown.
+func (s Service) queueExpiryCards(ctx context.Context, group []dueReminder, now time.Time) error {
+	for _, chat := range s.AdminChats {
+		if !chat.Expiries {
+			continue
+		}
+		for _, d := range group {
+			msg := db.OutboxEmail{
+				SubscriptionID: d.sub.ID,
+				Channel:        chat.Channel,
+				To:             chat.To,
+				Subject:        "订阅到期提醒：" + d.sub.ProductName,
+				Text:           s.expiryCard(d),
+			}
+			if err := s.Store.EnqueueEmail(ctx, msg, now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s Service) expiryCard(d dueReminder) string {
+	sub := d.sub
+	var b strings.Builder
+	customer := sub.CustomerName
+	if customer == "" {
+		customer = sub.CustomerEmail
+	} else {
+		customer += "（" + sub.CustomerEmail + "）"
+	}
+	fmt.Fprintf(&b, "> 客户：%s\n", customer)
+	fmt.Fprintf(&b, "> 产品：%s\n", sub.ProductName)
+	if d.daysLeft < 0 {
+		fmt.Fprintf(&b, "> 到期日：<font color=\"warning\">%s</font>（已过期 %d 天）\n", sub.ExpiresAt, -d.daysLeft)
+	} else {
+		fmt.Fprintf(&b, "> 到期日：<font color=\"warning\">%s</font>（剩余 %d 天）\n", sub.ExpiresAt, d.daysLeft)
+	}
+	if sub.Priority == db.PriorityHigh {
+		b.WriteString("> 优先级：<font color=\"warning\">高</font>\n")
+	}
+	if sub.Kind == db.KindTrial {
+		b.WriteString("> 类型：试用\n")
+	}
+	if note := strings.TrimSpace(sub.Note); note != "" {
+		fmt.Fprintf(&b, "> 备注：%s\n", strings.ReplaceAll(note, "\n", " "))
+	}
+	if s.PublicURL != "" {
+		fmt.Fprintf(&b, "\n[查看订阅](%s/subscriptions/%d)", strings.TrimRight(s.PublicURL, "/"), sub.ID)
+	}
+	return b.String()
+}
@@ -0,0 +1,103 @@
+package reminder
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"xf/internal/db"
+)
+
+const digestSettingKey = "digest_last_date"
+
+var digestTemplate = db.Template{
+	Subject: "【每日汇总】{{ .Date }} 发送客户邮件 {{ len .Sent }} 封，失败 {{ len .Failed }} 项",
+	HTML: `<p>{{ .Date }} 的发送汇总：</p>
+<p>成功发送客户邮件 <b>{{ len .Sent }}</b> 封：</p>
+{{ if .Sent }}<ul>{{ range .Sent }}<li>{{ .To }} — {{ .Subject }}</li>{{ end }}</ul>{{ else }}<p>无</p>{{ end }}
+<p>其他消息（群聊通知、扫描摘要、汇总等）<b>{{ len .Other }}</b> 条：</p>
+{{ if .Other }}<ul>{{ range .Other }}<li>{{ if .Channel }}[{{ .Channel }}] {{ end }}{{ .To }} — {{ .Subject }}</li>{{ end }}</ul>{{ else }}<p>无</p>{{ end }}
+<p>失败 <b>{{ len .Failed }}</b> 项：</p>
+{{ if .Failed }}<ul>{{ range .Failed }}<li>{{ if .SubscriptionID }}订阅 #{{ .SubscriptionID }} {{ end }}{{ if .Channel }}[{{ .Channel }}] {{ end }}{{ .To }}：{{ if eq .Status "suppressed" }}【收件人已停用】{{ else if eq .Status "bounced" }}【退信】{{ end }}{{ .Error }}</li>{{ end }}</ul>{{ else }}<p>无</p>{{ end }}
+<hr/>
+<p>— {{ .Company }}</p>
+`,
+}
+
+// SendDailyDigest queues a summary of the previous day's deliveries and
+// failures to the admin, by email unless to is empty, and to the admin
+// chats. It is safe to call on every scan; the digest for a
+// given day is only queued once.
+func (s Service) SendDailyDigest(ctx context.Context, to string, now time.Time) error {
+	day := now.In(s.Location).AddDate(0, 0, -1).Format("2006-01-02")
+	last, err := s.Store.GetSetting(digestSettingKey)
+	if err != nil {
+		return err
+	}
+	if last >= day {
+		return nil
+	}
+	deliveries, err := s.Store.ListDeliveries(day)
+	if err != nil {
+		return err
+	}
+	if err := s.sortByPriority(ctx, deliveries); err != nil {
+		return err
+	}
+	// Only emails to customers count as sent; chat posts and the admin's
+	// own summaries are listed apart.
+	var sent, other, failed []db.Delivery
+	for _, d := range deliveries {
+		switch {
+		case d.Status != db.DeliverySent:
+			failed = append(failed, d)
+		case d.SubscriptionID != 0 && d.Channel == "":
+			sent = append(sent, d)
+		default:
+			other = append(other, d)
+		}
+	}
+	subject, html, _, err := s.Render.RenderTemplate(digestTemplate, map[string]any{
+		"Date":    day,
+		"Sent":    sent,
+		"Other":   other,
+		"Failed":  failed,
+		"Company": s.Company,
+	})
+	if err != nil {
+		return err
+	}
+	msg := db.OutboxEmail{To: to, Subject: subject, HTML: html}
+	if to != "" {
+		if err := s.Store.EnqueueEmail(ctx, msg, now); err != nil {
+			return err
+		}
+	}
+	if err := s.queueAdminChats(ctx, msg, now); err != nil {
+		return err
+	}
+	return s.Store.SetSetting(digestSettingKey, day)
+}
+
+// sortByPriority moves deliveries for higher-priority subscriptions to the
+// front, keeping their order otherwise.
+func (s Service) sortByPriority(ctx context.Context, deliveries []db.Delivery) error {
+	subs, err := s.Store.ListDueSubscriptions(ctx)
+	if err != nil {
+		return err
+	}
+	ranks := map[int]int{}
+	for _, sub := range subs {
+		ranks[sub.ID] = db.PriorityRank(sub.Priority)
+	}
+	rank := func(d db.Delivery) int {
+		if r, ok := ranks[d.SubscriptionID]; ok {
+			return r
+		}
+		return db.PriorityRank(db.PriorityNormal)
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return rank(deliveries[i]) < rank(deliveries[j])
+	})
+	return nil
+}
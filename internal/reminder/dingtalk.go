@@ -0,0 +1,69 @@
+package reminder
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"xf/internal/db"
+)
+
+// dingtalkScanTemplate renders the DingTalk scan summary as DingTalk
+// markdown.
+var dingtalkScanTemplate = db.Template{
+	Subject: "{{ .Company }} {{ if eq .Trigger \"manual\" }}手动{{ else if eq .Trigger \"cli\" }}命令行{{ else }}定时{{ end }}扫描{{ if .Error }}出错{{ else }}完成{{ end }}",
+	Text: `{{ .StartedAt }} 开始，检查 {{ .Total }} 个订阅：
+
+- 入队 **{{ .Queued }}**
+- 跳过 {{ .Skipped }}
+- 失败 **{{ .Failed }}**{{ if .Renewed }}
+- 自动续费 {{ .Renewed }}{{ end }}
+{{ if .Error }}
+扫描出错：{{ .Error }}
+{{ end }}{{ if .Failures }}
+失败明细：
+
+{{ range .Failures }}- {{ . }}
+{{ end }}{{ end }}`,
+}
+
+// postDingTalk queues the DingTalk summary of a scan, @-mentioning the
+// operators of the products it queued reminders for or failed on.
+func (s Service) postDingTalk(ctx context.Context, data map[string]any, res Result, now time.Time) error {
+	subject, _, text, err := s.Render.RenderTemplate(dingtalkScanTemplate, data)
+	if err != nil {
+		return err
+	}
+	operators, err := s.productOperators(res.products)
+	if err != nil {
+		return err
+	}
+	msg := db.OutboxEmail{Channel: db.ChannelDingTalk, To: strings.Join(operators, ","), Subject: subject, Text: text}
+	return s.Store.EnqueueEmail(ctx, msg, now)
+}
+
+// productOperators returns the operators of the given products, each once,
+// in product order.
+func (s Service) productOperators(ids map[int]bool) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	products, err := s.Store.ListProducts()
+	if err != nil {
+		return nil, err
+	}
+	var operators []string
+	seen := map[string]bool{}
+	for _, p := range products {
+		if !ids[p.ID] {
+			continue
+		}
+		for _, op := range strings.Split(p.Operators, ",") {
+			if op = strings.TrimSpace(op); op != "" && !seen[op] {
+				seen[op] = true
+				operators = append(operators, op)
+			}
+		}
+	}
+	return operators, nil
+}
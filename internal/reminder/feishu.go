@@ -0,0 +1,71 @@
+package reminder
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"xf/internal/db"
+)
+
+// feishuCardLimit is how many subscriptions a Feishu card lists; the rest
+// are counted at the end.
+const feishuCardLimit = 30
+
+// postExpiringCard queues a Feishu card listing the subscriptions a scan
+// sent reminders for, soonest expiry first.
+func (s Service) postExpiringCard(ctx context.Context, reminded []dueReminder, now time.Time) error {
+	if !s.Feishu || len(reminded) == 0 {
+		return nil
+	}
+	reminded = append([]dueReminder(nil), reminded...)
+	sort.SliceStable(reminded, func(i, j int) bool {
+		return reminded[i].daysLeft < reminded[j].daysLeft
+	})
+	var sections []string
+	for i, d := range reminded {
+		if i == feishuCardLimit {
+			sections = append(sections, fmt.Sprintf("另有 %d 个订阅已发送提醒，详见发送记录。", len(reminded)-i))
+			break
+		}
+		sections = append(sections, s.feishuSection(d))
+	}
+	msg := db.OutboxEmail{
+		Channel: db.ChannelFeishu,
+		Subject: fmt.Sprintf("%d 个订阅即将到期，已发送续费提醒", len(reminded)),
+		Text:    strings.Join(sections, "\n---\n"),
+	}
+	return s.Store.EnqueueEmail(ctx, msg, now)
+}
+
+// feishuSection describes one subscription in Feishu card markdown.
+func (s Service) feishuSection(d dueReminder) string {
+	sub := d.sub
+	var b strings.Builder
+	customer := sub.CustomerName
+	if customer == "" {
+		customer = sub.CustomerEmail
+	}
+	fmt.Fprintf(&b, "**%s** · %s", customer, sub.ProductName)
+	if sub.Priority == db.PriorityHigh {
+		b.WriteString(" <font color='red'>高优先级</font>")
+	}
+	if sub.Kind == db.KindTrial {
+		b.WriteString(" 试用")
+	}
+	b.WriteString("\n")
+	if d.daysLeft < 0 {
+		fmt.Fprintf(&b, "到期日：<font color='red'>%s</font>（已过期 %d 天）", sub.ExpiresAt, -d.daysLeft)
+	} else {
+		fmt.Fprintf(&b, "到期日：<font color='orange'>%s</font>（剩余 %d 天）", sub.ExpiresAt, d.daysLeft)
+	}
+	if note := strings.TrimSpace(sub.Note); note != "" {
+		fmt.Fprintf(&b, "\n备注：%s", strings.ReplaceAll(note, "\n", " "))
+	}
+	if s.PublicURL != "" {
+		fmt.Fprintf(&b, "\n[查看订阅](%s/subscriptions/%d)", strings.TrimRight(s.PublicURL, "/"), sub.ID)
+	}
+	return b.String()
+}
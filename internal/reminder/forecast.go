@@ -0,0 +1,156 @@
+package reminder
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"xf/internal/db"
+)
+
+const (
+	forecastSettingKey = "forecast_last_week"
+	forecastDays       = 30
+)
+
+var forecastTemplate = db.Template{
+	Subject: "【到期预测】未来 {{ .Days }} 天有 {{ .Total }} 个订阅到期",
+	HTML: `<p>未来 {{ .Days }} 天内到期的订阅（不含自动续费）：</p>
+{{ range .Weeks }}<h3>{{ .From }} ~ {{ .To }}（{{ len .Items }} 个）</h3>
+<table>
+<tr><th align="left">到期日</th><th align="left">客户</th><th align="left">产品</th><th align="left">剩余天数</th></tr>
+{{ range .Items }}<tr><td>{{ .ExpiresAt }}</td><td>{{ if .CustomerName }}{{ .CustomerName }}{{ else }}{{ .CustomerEmail }}{{ end }}</td><td>{{ .ProductName }}{{ if eq .Priority "high" }}（高优先级）{{ end }}</td><td>{{ .DaysLeft }}</td></tr>
+{{ end }}</table>
+{{ else }}<p>无</p>{{ end }}
+<hr/>
+<p>— {{ .Company }}</p>
+`,
+}
+
+// ForecastWeek lists the subscriptions expiring in one calendar week,
+// starting on Monday.
+type ForecastWeek struct {
+	From  string
+	To    string
+	Items []ForecastItem
+}
+
+type ForecastItem struct {
+	SubscriptionID int
+	Priority       string
+	CustomerName   string
+	CustomerEmail  string
+	ProductName    string
+	ExpiresAt      string
+	DaysLeft       int
+}
+
+// SendWeeklyForecast queues the expiring-soon pipeline to the forecast
+// recipients, or to fallbackTo when none are set, and to the admin chats. It
+// does nothing unless the
+// forecast is enabled, and is safe to call on every scan; each ISO week's
+// forecast is only queued once.
+func (s Service) SendWeeklyForecast(ctx context.Context, fallbackTo string, now time.Time) error {
+	settings, err := s.Store.GetForecast()
+	if err != nil || !settings.Enabled {
+		return err
+	}
+	recipients := splitRecipients(settings.Recipients)
+	if len(recipients) == 0 && fallbackTo != "" {
+		recipients = []string{fallbackTo}
+	}
+	if len(recipients) == 0 && len(s.AdminChats) == 0 {
+		return nil
+	}
+	year, week := now.In(s.Location).ISOWeek()
+	key := fmt.Sprintf("%d-W%02d", year, week)
+	last, err := s.Store.GetSetting(forecastSettingKey)
+	if err != nil {
+		return err
+	}
+	if last >= key {
+		return nil
+	}
+	weeks, total, err := s.Forecast(ctx, now)
+	if err != nil {
+		return err
+	}
+	subject, html, _, err := s.Render.RenderTemplate(forecastTemplate, map[string]any{
+		"Days":    forecastDays,
+		"Total":   total,
+		"Weeks":   weeks,
+		"Company": s.Company,
+	})
+	if err != nil {
+		return err
+	}
+	for _, to := range recipients {
+		if err := s.Store.EnqueueEmail(ctx, db.OutboxEmail{To: to, Subject: subject, HTML: html}, now); err != nil {
+			return err
+		}
+	}
+	if err := s.queueAdminChats(ctx, db.OutboxEmail{Subject: subject, HTML: html}, now); err != nil {
+		return err
+	}
+	return s.Store.SetSetting(forecastSettingKey, key)
+}
+
+// Forecast groups the subscriptions expiring within the next forecastDays
+// by week, high-priority ones first within each week, leaving out
+// auto-renew subscriptions.
+func (s Service) Forecast(ctx context.Context, now time.Time) ([]ForecastWeek, int, error) {
+	subs, err := s.Store.ListDueSubscriptions(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	var items []ForecastItem
+	for _, sub := range subs {
+		if sub.AutoRenewMonths > 0 {
+			continue
+		}
+		daysLeft, err := daysUntil(sub.ExpiresAt, now, s.zone(sub))
+		if err != nil || daysLeft < 0 || daysLeft > forecastDays {
+			continue
+		}
+		items = append(items, ForecastItem{
+			SubscriptionID: sub.ID,
+			Priority:       sub.Priority,
+			CustomerName:   sub.CustomerName,
+			CustomerEmail:  sub.CustomerEmail,
+			ProductName:    sub.ProductName,
+			ExpiresAt:      sub.ExpiresAt,
+			DaysLeft:       daysLeft,
+		})
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].ExpiresAt < items[j].ExpiresAt })
+
+	var weeks []ForecastWeek
+	for _, item := range items {
+		expires, _, _ := ParseExpiry(item.ExpiresAt, s.Location)
+		monday := expires.AddDate(0, 0, -((int(expires.Weekday()) + 6) % 7))
+		from := monday.Format("2006-01-02")
+		if len(weeks) == 0 || weeks[len(weeks)-1].From != from {
+			weeks = append(weeks, ForecastWeek{From: from, To: monday.AddDate(0, 0, 6).Format("2006-01-02")})
+		}
+		weeks[len(weeks)-1].Items = append(weeks[len(weeks)-1].Items, item)
+	}
+	for _, week := range weeks {
+		sort.SliceStable(week.Items, func(i, j int) bool {
+			return db.PriorityRank(week.Items[i].Priority) < db.PriorityRank(week.Items[j].Priority)
+		})
+	}
+	return weeks, len(items), nil
+}
+
+// splitRecipients parses a comma- or newline-separated address list.
+func splitRecipients(value string) []string {
+	var out []string
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if addr := strings.TrimSpace(field); addr != "" {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
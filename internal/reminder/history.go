@@ -0,0 +1,45 @@
+package reminder
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"xf/internal/db"
+	"xf/internal/logging"
+)
+
+// StartRun reserves the ID RecordRun stores a scan under and returns ctx
+// with it added to the scan's log lines.
+func (s Service) StartRun(ctx context.Context) (context.Context, int) {
+	id := s.Store.ReserveScanRunID()
+	return logging.With(ctx, logging.ScanID, id), id
+}
+
+// RecordRun stores a finished scan in the scan history under the ID from
+// StartRun and posts its summary to the chats.
+func (s Service) RecordRun(id int, trigger string, started, finished time.Time, res Result, runErr error) error {
+	run := db.ScanRun{
+		ID:         id,
+		Trigger:    trigger,
+		StartedAt:  started.Format(time.RFC3339),
+		FinishedAt: finished.Format(time.RFC3339),
+		Total:      res.Total,
+		Queued:     res.Queued,
+		Skipped:    res.Skipped,
+		Failed:     res.Failed,
+		Failures:   res.Failures,
+	}
+	attrs := []any{logging.ScanID, id, "trigger", trigger, "total", res.Total, "queued", res.Queued,
+		"skipped", res.Skipped, "failed", res.Failed, "renewed", res.Renewed}
+	if runErr != nil {
+		run.Error = runErr.Error()
+		slog.Error("scan failed", append(attrs, "error", runErr)...)
+	} else {
+		slog.Info("scan finished", attrs...)
+	}
+	if err := s.postScanSummary(context.Background(), trigger, started, res, runErr, finished); err != nil {
+		slog.Error("scan summary error", logging.ScanID, id, "error", err)
+	}
+	return s.Store.RecordScanRun(run)
+}
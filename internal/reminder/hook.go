@@ -0,0 +1,50 @@
+package reminder
+
+import (
+	"context"
+
+	"xf/internal/db"
+)
+
+// Hook lets a deployment run its own logic around every reminder a scan
+// queues, e.g. pushing it to a CRM or opening a ticket. Hooks are not called
+// on dry runs.
+type Hook interface {
+	// BeforeSend is called before the reminder is queued. Returning an error
+	// drops the reminder and counts it as failed.
+	BeforeSend(ctx context.Context, out Outgoing) error
+	// AfterSend is called once the reminder was queued or failed to queue.
+	AfterSend(ctx context.Context, result SendResult)
+}
+
+// Outgoing is a reminder about to be queued. Subscriptions lists every
+// subscription the email covers; there is more than one for a combined
+// reminder.
+type Outgoing struct {
+	Email         db.OutboxEmail
+	Subscriptions []db.SubscriptionDetail
+	Template      string
+	EscalateTo    []string
+}
+
+// SendResult reports the outcome of queuing an Outgoing reminder. Err is nil
+// when the email was queued.
+type SendResult struct {
+	Outgoing
+	Err error
+}
+
+func (s Service) beforeSend(ctx context.Context, out Outgoing) error {
+	for _, h := range s.Hooks {
+		if err := h.BeforeSend(ctx, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s Service) afterSend(ctx context.Context, out Outgoing, err error) {
+	for _, h := range s.Hooks {
+		h.AfterSend(ctx, SendResult{Outgoing: out, Err: err})
+	}
+}
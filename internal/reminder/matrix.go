@@ -0,0 +1,93 @@
+package reminder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"xf/internal/db"
+)
+
+// urgentDays is how close to its expiry a subscription sent a reminder
+// has to be for the Matrix room to get an alert about it; high-priority
+// subscriptions always do.
+const urgentDays = 1
+
+// matrixScanTemplate renders the Matrix scan summary as plain text.
+var matrixScanTemplate = db.Template{
+	Subject: "{{ .Company }} {{ if eq .Trigger \"manual\" }}手动{{ else if eq .Trigger \"cli\" }}命令行{{ else }}定时{{ end }}扫描{{ if .Error }}出错{{ else }}完成{{ end }}",
+	Text: `{{ .StartedAt }} 开始，检查 {{ .Total }} 个订阅：入队 {{ .Queued }}，跳过 {{ .Skipped }}，失败 {{ .Failed }}{{ if .Renewed }}，自动续费 {{ .Renewed }}{{ end }}。
+{{ if .Error }}
+扫描出错：{{ .Error }}
+{{ end }}{{ if .Failures }}
+失败明细：
+{{ range .Failures }}- {{ . }}
+{{ end }}{{ end }}`,
+}
+
+// postMatrixScan queues the Matrix summary of a scan.
+func (s Service) postMatrixScan(ctx context.Context, data map[string]any, now time.Time) error {
+	subject, _, text, err := s.Render.RenderTemplate(matrixScanTemplate, data)
+	if err != nil {
+		return err
+	}
+	msg := db.OutboxEmail{Channel: db.ChannelMatrix, To: s.MatrixRoom, Subject: subject, Text: text}
+	return s.Store.EnqueueEmail(ctx, msg, now)
+}
+
+// postUrgentExpiries queues a Matrix alert for each subscription in a
+// reminder that was just queued that is high priority or expires by
+// tomorrow.
+func (s Service) postUrgentExpiries(ctx context.Context, group []dueReminder, now time.Time) error {
+	if s.MatrixRoom == "" {
+		return nil
+	}
+	for _, d := range group {
+		if d.sub.Priority != db.PriorityHigh && d.daysLeft > urgentDays {
+			continue
+		}
+		msg := db.OutboxEmail{
+			SubscriptionID: d.sub.ID,
+			Channel:        db.ChannelMatrix,
+			To:             s.MatrixRoom,
+			Subject:        "紧急到期提醒：" + d.sub.ProductName,
+			Text:           s.urgentText(d),
+		}
+		if err := s.Store.EnqueueEmail(ctx, msg, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s Service) urgentText(d dueReminder) string {
+	sub := d.sub
+	var b strings.Builder
+	customer := sub.CustomerName
+	if customer == "" {
+		customer = sub.CustomerEmail
+	} else {
+		customer += "（" + sub.CustomerEmail + "）"
+	}
+	fmt.Fprintf(&b, "客户：%s\n", customer)
+	fmt.Fprintf(&b, "产品：%s\n", sub.ProductName)
+	switch {
+	case d.daysLeft < 0:
+		fmt.Fprintf(&b, "到期日：%s（已过期 %d 天）\n", sub.ExpiresAt, -d.daysLeft)
+	case d.daysLeft == 0:
+		fmt.Fprintf(&b, "到期日：%s（今天到期）\n", sub.ExpiresAt)
+	default:
+		fmt.Fprintf(&b, "到期日：%s（剩余 %d 天）\n", sub.ExpiresAt, d.daysLeft)
+	}
+	if sub.Priority == db.PriorityHigh {
+		b.WriteString("优先级：高\n")
+	}
+	if note := strings.TrimSpace(sub.Note); note != "" {
+		fmt.Fprintf(&b, "备注：%s\n", strings.ReplaceAll(note, "\n", " "))
+	}
+	if s.PublicURL != "" {
+		fmt.Fprintf(&b, "%s/subscriptions/%d\n", strings.TrimRight(s.PublicURL, "/"), sub.ID)
+	}
+	return b.String()
+}
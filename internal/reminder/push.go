@@ -0,0 +1,74 @@
+package reminder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"xf/internal/db"
+)
+
+// pushLimit is how many subscriptions a push lists; the rest are counted
+// at the end.
+const pushLimit = 20
+
+// pushExpiringToday queues a push listing the subscriptions that expire
+// today and haven't been pushed yet. Auto-renew subscriptions are left
+// out, as they renew by themselves. The push goes out whatever the
+// reminder rules and off days, since it is for the admin, not customers.
+func (s Service) pushExpiringToday(ctx context.Context, subs []db.SubscriptionDetail, now time.Time) error {
+	if !s.Push {
+		return nil
+	}
+	var today []db.SubscriptionDetail
+	for _, sub := range subs {
+		if sub.AutoRenewMonths > 0 {
+			continue
+		}
+		if daysLeft, err := daysUntil(sub.ExpiresAt, now, s.zone(sub)); err != nil || daysLeft != 0 {
+			continue
+		}
+		pushed, err := s.Store.HasExpiryPush(sub.ID, sub.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		if !pushed {
+			today = append(today, sub)
+		}
+	}
+	if len(today) == 0 {
+		return nil
+	}
+	var lines []string
+	for i, sub := range today {
+		if i == pushLimit {
+			lines = append(lines, fmt.Sprintf("另有 %d 个订阅今天到期。", len(today)-i))
+			break
+		}
+		customer := sub.CustomerName
+		if customer == "" {
+			customer = sub.CustomerEmail
+		}
+		line := fmt.Sprintf("%s · %s", customer, sub.ProductName)
+		if t, timed, _ := ParseExpiry(sub.ExpiresAt, s.zone(sub)); timed {
+			line += "（" + t.Format("15:04") + "）"
+		}
+		if sub.Priority == db.PriorityHigh {
+			line += " [高优先级]"
+		}
+		lines = append(lines, line)
+	}
+	if s.PublicURL != "" {
+		lines = append(lines, "", strings.TrimRight(s.PublicURL, "/")+"/subscriptions")
+	}
+	msg := db.OutboxEmail{
+		Channel: db.ChannelPush,
+		Subject: fmt.Sprintf("%d 个订阅今天到期", len(today)),
+		Text:    strings.Join(lines, "\n"),
+	}
+	if err := s.Store.EnqueueEmail(ctx, msg, now); err != nil {
+		return err
+	}
+	return s.Store.RecordExpiryPushes(today, now)
+}
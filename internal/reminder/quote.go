@@ -0,0 +1,109 @@
+package reminder
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"xf/internal/db"
+	"xf/internal/quote"
+)
+
+// Quote renders the PDF quote for renewing subs, which belong to one
+// customer, and names the file. It returns nil when none of the products
+// has a price.
+func (s Service) Quote(subs []db.SubscriptionDetail, now time.Time) ([]byte, string, error) {
+	settings, err := s.Store.GetQuoteSettings()
+	if err != nil {
+		return nil, "", err
+	}
+	loc := s.zone(subs[0])
+	number := fmt.Sprintf("Q%s-%d", now.In(loc).Format("20060102"), subs[0].ID)
+	q := quote.Quote{
+		Number:   number,
+		Date:     now.In(loc).Format(dateLayout),
+		Company:  s.Company,
+		Customer: subs[0].CustomerName,
+		Email:    subs[0].CustomerEmail,
+		Payment:  settings.Payment,
+	}
+	totals := map[string]int64{}
+	var currencies []string
+	for _, sub := range subs {
+		if sub.ProductPrice == "" {
+			continue
+		}
+		expires, timed, err := ParseExpiry(sub.ExpiresAt, s.zone(sub))
+		if err != nil {
+			return nil, "", err
+		}
+		months := sub.ProductRenewalMonths
+		if months <= 0 {
+			months = defaultRenewalMonths
+		}
+		layout := dateLayout
+		if timed {
+			layout = dateTimeLayout
+		}
+		currency := sub.ProductCurrency
+		if currency == "" {
+			currency = db.DefaultCurrency
+		}
+		cents := db.PriceCents(sub.ProductPrice)
+		if _, ok := totals[currency]; !ok {
+			currencies = append(currencies, currency)
+		}
+		totals[currency] += cents
+		q.Lines = append(q.Lines, quote.Line{
+			Product:       sub.ProductName,
+			Detail:        quoteDetail(sub),
+			Period:        fmt.Sprintf("%d 个月", months),
+			CurrentExpiry: sub.ExpiresAt,
+			NewExpiry:     expires.AddDate(0, months, 0).Format(layout),
+			Amount:        currency + " " + db.FormatCents(cents, ","),
+		})
+	}
+	if len(q.Lines) == 0 {
+		return nil, "", nil
+	}
+	for _, currency := range currencies {
+		q.Totals = append(q.Totals, currency+" "+db.FormatCents(totals[currency], ","))
+	}
+	return quote.Render(q), "报价单-" + number + ".pdf", nil
+}
+
+// quoteDetail tells a customer's subscriptions of the same product apart:
+// the domain or certificate host, or else the first line of the note.
+func quoteDetail(sub db.SubscriptionDetail) string {
+	if name := sub.DomainName(); name != "" {
+		return name
+	}
+	if sub.CertHost != "" {
+		return sub.CertHost
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(sub.Note), "\n")
+	return strings.TrimSpace(line)
+}
+
+// attachQuote saves the group's quote as a one-off attachment of msg and
+// returns its ID, or zero if quotes are off or there is no quote.
+func (s Service) attachQuote(msg *db.OutboxEmail, group []dueReminder, now time.Time) (int, error) {
+	settings, err := s.Store.GetQuoteSettings()
+	if err != nil || !settings.Enabled {
+		return 0, err
+	}
+	subs := make([]db.SubscriptionDetail, 0, len(group))
+	for _, d := range group {
+		subs = append(subs, d.sub)
+	}
+	data, name, err := s.Quote(subs, now)
+	if err != nil || data == nil {
+		return 0, err
+	}
+	att, err := s.Store.SaveAttachment(0, name, "application/pdf", data, now)
+	if err != nil {
+		return 0, err
+	}
+	msg.AttachmentIDs = append(msg.AttachmentIDs, att.ID)
+	return att.ID, nil
+}
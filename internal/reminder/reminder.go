@@ -1,37 +1,140 @@
 package reminder
 
 import (
+	"context"
 	"fmt"
+	"maps"
+	"math"
+	"slices"
 	"sort"
 	"strings"
 	"time"
 
+	"xf/internal/calendar"
 	"xf/internal/db"
 	"xf/internal/email"
+	"xf/internal/logging"
+	"xf/internal/stripe"
 )
 
 type Renderer interface {
-	RenderTemplate(tpl db.Template, data any) (subject, html string, err error)
+	RenderTemplate(tpl db.Template, data any) (subject, html, text string, err error)
 }
 
 type Service struct {
 	Store    *db.Store
-	Mailer   email.Mailer
 	Company  string
 	Location *time.Location
 	Render   Renderer
+	Hooks    []Hook
+	// PublicURL is the externally reachable base URL of the admin server.
+	// When set, reminders carry a one-click List-Unsubscribe link.
+	PublicURL string
+	// From is the sender address; its domain is used for the Message-IDs
+	// that thread a subscription's reminders together.
+	From string
+	// Telegram is whether a Telegram bot is configured; customers with a
+	// chat ID then get their reminders there as well.
+	Telegram bool
+	// AdminChats receive the daily digest and weekly forecast along with
+	// the admin email.
+	AdminChats []Chat
+	// Slack is whether a Slack webhook is configured; scan summaries and
+	// alerts for high-priority subscriptions are then posted there.
+	Slack bool
+	// DingTalk is whether a DingTalk robot is configured; scan summaries
+	// are then posted to its group.
+	DingTalk bool
+	// Feishu is whether a Feishu bot is configured; each scan that sends
+	// reminders then posts a card listing the expiring subscriptions.
+	Feishu bool
+	// SMS is whether an SMS provider is configured; customers with a phone
+	// number then get an SMS at the SMS rules.
+	SMS bool
+	// MatrixRoom is the Matrix room that gets scan summaries and alerts
+	// for urgent expiries; empty when Matrix isn't configured.
+	MatrixRoom string
+	// Push is whether a Gotify or ntfy push service is configured; the
+	// subscriptions expiring today are then pushed to it once a day.
+	Push bool
+	// Stripe creates the payment links put in reminders for products with
+	// a Stripe price; a zero Client creates none.
+	Stripe stripe.Client
 }
 
 type Result struct {
 	Total    int
-	Sent     int
+	Queued   int
 	Skipped  int
 	Failed   int
+	Renewed  int
 	Failures []string
+	Planned  []Planned
+
+	// failureRanks holds the priority rank of each entry in Failures.
+	failureRanks []int
+	// products holds the products with a reminder queued or a failure, whose
+	// operators the DingTalk summary mentions.
+	products map[int]bool
+	// reminded holds the subscriptions sent a reminder, for the Feishu card.
+	reminded []dueReminder
+}
+
+func (res *Result) addProduct(id int) {
+	if res.products == nil {
+		res.products = map[int]bool{}
+	}
+	res.products[id] = true
+}
+
+func (res *Result) addFailure(ctx context.Context, sub db.SubscriptionDetail, text string) {
+	logging.From(ctx).Warn("scan failure", logging.SubscriptionID, sub.ID, logging.CustomerEmail, sub.CustomerEmail, "reason", text)
+	res.Failures = append(res.Failures, text)
+	res.failureRanks = append(res.failureRanks, db.PriorityRank(sub.Priority))
+	res.addProduct(sub.ProductID)
+}
+
+// sortFailures lists failures of higher-priority subscriptions first,
+// keeping the scan order otherwise.
+func (res *Result) sortFailures() {
+	index := make([]int, len(res.Failures))
+	for i := range index {
+		index[i] = i
+	}
+	sort.SliceStable(index, func(i, j int) bool {
+		return res.failureRanks[index[i]] < res.failureRanks[index[j]]
+	})
+	failures := make([]string, len(index))
+	ranks := make([]int, len(index))
+	for i, from := range index {
+		failures[i], ranks[i] = res.Failures[from], res.failureRanks[from]
+	}
+	res.Failures, res.failureRanks = failures, ranks
 }
 
-func (s Service) ScanAndSend(now time.Time) (Result, error) {
-	subs, err := s.Store.ListDueSubscriptions()
+// Planned describes a reminder that a dry run would have queued.
+type Planned struct {
+	SubscriptionID int
+	CustomerEmail  string
+	ProductName    string
+	DaysLeft       int
+	Template       string
+	Subject        string
+	EscalateTo     []string
+}
+
+// ScanAndSend queues reminders according to the configured rules. Each rule
+// is sent at most once per subscription and expiry date; a rule missed while
+// the scanner was down is sent on the next run, unless a tighter rule has
+// since been reached. Trial subscriptions follow the trial rules instead of
+// the regular ones, and high-priority subscriptions also follow the extra
+// high-priority rules. With SMS set, customers with a phone number also
+// follow the SMS rules, which send an SMS instead of or as well as the email.
+// Auto-renew subscriptions get no reminders; once their expiry passes they
+// are renewed and sent a renewal confirmation instead. With dryRun set nothing is queued or recorded; the would-be messages are
+// listed in Result.Planned instead.
+func (s Service) ScanAndSend(ctx context.Context, now time.Time, dryRun bool) (Result, error) {
+	subs, err := s.Store.ListDueSubscriptions(ctx)
 	if err != nil {
 		return Result{}, err
 	}
@@ -39,102 +142,728 @@ func (s Service) ScanAndSend(now time.Time) (Result, error) {
 	if err != nil {
 		return Result{}, err
 	}
-	maxRule := maxInt(rules)
+	trialRules, err := s.Store.GetTrialRules()
+	if err != nil {
+		return Result{}, err
+	}
+	highRules, err := s.Store.GetHighPriorityRules()
+	if err != nil {
+		return Result{}, err
+	}
+	hourRules, err := s.Store.GetHourRules()
+	if err != nil {
+		return Result{}, err
+	}
+	var smsRules []int
+	if s.SMS {
+		if smsRules, err = s.Store.GetSMSRules(); err != nil {
+			return Result{}, err
+		}
+	}
+	graceDays, err := s.Store.GetGraceDays()
+	if err != nil {
+		return Result{}, err
+	}
+	offDay, lookahead, err := s.offDayPolicy(now)
+	if err != nil {
+		return Result{}, err
+	}
 
 	var res Result
+	var due []dueReminder
 	for _, sub := range subs {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
 		res.Total++
-		daysLeft, err := daysUntil(sub.ExpiresAt, now, s.Location)
+		loc := s.zone(sub)
+		today := now.In(loc).Format("2006-01-02")
+		daysLeft, err := daysUntil(sub.ExpiresAt, now, loc)
 		if err != nil {
-			res.Failed++
-			res.Failures = append(res.Failures, fmt.Sprintf("订阅 #%d 日期格式错误", sub.ID))
+			s.fail(ctx, &res, sub, "日期格式错误", now, dryRun)
 			continue
 		}
-		if daysLeft < -1 {
+		hoursLeft, timed, _ := hoursUntil(sub.ExpiresAt, now, loc)
+		if sub.AutoRenewMonths > 0 {
+			if daysLeft < 0 || (timed && hoursLeft < 0) {
+				s.autoRenew(ctx, &res, sub, now, dryRun)
+			} else {
+				res.Skipped++
+			}
+			continue
+		}
+		// Off days hold back reminders only; auto-renewals above still run.
+		if offDay || daysLeft < -graceDays {
 			res.Skipped++
 			continue
 		}
-		if daysLeft > maxRule {
+		subRules := rules
+		if sub.Kind == db.KindTrial {
+			subRules = trialRules
+		}
+		if sub.Priority == db.PriorityHigh {
+			subRules = append(append([]int(nil), subRules...), highRules...)
+		}
+		mailRules := subRules
+		texting := len(smsRules) > 0 && sub.CustomerPhone != ""
+		if texting {
+			subRules = append(append([]int(nil), subRules...), smsRules...)
+		}
+		// Before off days, the rules that fall on them are sent today. They
+		// collapse with today's rule into one reminder, recorded as the
+		// tightest of them: a Saturday expiry gets a single reminder on
+		// Friday, not both the one-day and the expiry-day ones.
+		rule, ok := activeRule(subRules, daysLeft-lookahead)
+		// Without negative rules each day of the grace window counts as a
+		// rule of its own, so reminders keep going out daily after expiry.
+		if daysLeft < 0 && !slices.ContainsFunc(subRules, func(r int) bool { return r < 0 }) {
+			rule, ok = max(daysLeft-lookahead, -graceDays), true
+		}
+		hourly := false
+		if timed {
+			if hourRule, found := activeRule(hourRules, hoursLeft); found {
+				rule, ok, hourly = hourRule, true, true
+			}
+		}
+		if !ok || snoozed(sub, today) || sub.CustomerOptedOut || sub.ReplyPending {
 			res.Skipped++
 			continue
 		}
-		sentDate := now.In(s.Location).Format("2006-01-02")
-		exists, err := s.Store.HasDailySend(sub.ID, sentDate)
+		exists, err := s.Store.HasRuleSend(sub.ID, sub.ExpiresAt, rule, hourly)
 		if err != nil {
-			res.Failed++
-			res.Failures = append(res.Failures, fmt.Sprintf("订阅 #%d 检查发送记录失败", sub.ID))
+			s.fail(ctx, &res, sub, "检查发送记录失败", now, dryRun)
 			continue
 		}
 		if exists {
 			res.Skipped++
 			continue
 		}
-		if err := s.sendReminder(sub, daysLeft); err != nil {
-			res.Failed++
-			res.Failures = append(res.Failures, fmt.Sprintf("订阅 #%d 发送失败: %s", sub.ID, err))
+		d := dueReminder{sub: sub, daysLeft: daysLeft, hoursLeft: hoursLeft, rule: rule, hourly: hourly}
+		if texting && !hourly && slices.Contains(smsRules, rule) {
+			d.sms = true
+			d.smsOnly = !slices.Contains(mailRules, rule)
+		}
+		due = append(due, d)
+	}
+	for _, group := range groupByCustomer(due) {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		var mail, texts []dueReminder
+		for _, d := range group {
+			if !d.smsOnly {
+				mail = append(mail, d)
+			}
+			if d.sms {
+				texts = append(texts, d)
+			}
+		}
+		mailed := len(mail) > 0 && s.queueReminder(ctx, &res, mail, now, dryRun)
+		texted := len(texts) > 0 && s.queueSMS(ctx, &res, texts, now, dryRun)
+		if dryRun {
 			continue
 		}
-		if err := s.Store.RecordDailySend(sub.ID, sentDate, now); err != nil {
-			res.Failures = append(res.Failures, fmt.Sprintf("订阅 #%d 记录发送失败", sub.ID))
+		for _, d := range group {
+			if (d.smsOnly || !mailed) && (!d.sms || !texted) {
+				continue
+			}
+			if err := s.Store.RecordRuleSend(d.sub.ID, d.sub.ExpiresAt, d.rule, d.hourly, now); err != nil {
+				res.addFailure(ctx, d.sub, fmt.Sprintf("订阅 #%d 记录发送失败", d.sub.ID))
+			}
 		}
-		res.Sent++
 	}
+	if !dryRun {
+		if err := s.pushExpiringToday(ctx, subs, now); err != nil {
+			logging.From(ctx).Error("expiry push error", "error", err)
+		}
+	}
+	res.sortFailures()
 	return res, nil
 }
 
-func (s Service) SendNow(threshold int, now time.Time) (Result, error) {
-	subs, err := s.Store.ListDueSubscriptions()
+func (s Service) SendNow(ctx context.Context, threshold int, now time.Time, dryRun bool) (Result, error) {
+	subs, err := s.Store.ListDueSubscriptions(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	graceDays, err := s.Store.GetGraceDays()
 	if err != nil {
 		return Result{}, err
 	}
 	var res Result
+	var due []dueReminder
 	for _, sub := range subs {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
 		res.Total++
-		daysLeft, err := daysUntil(sub.ExpiresAt, now, s.Location)
-		if err != nil || daysLeft < -1 {
+		loc := s.zone(sub)
+		today := now.In(loc).Format("2006-01-02")
+		daysLeft, err := daysUntil(sub.ExpiresAt, now, loc)
+		if err != nil || daysLeft < -graceDays {
 			res.Skipped++
 			continue
 		}
-		if daysLeft > threshold {
+		if daysLeft > threshold || snoozed(sub, today) || sub.AutoRenewMonths > 0 || sub.CustomerOptedOut || sub.ReplyPending {
 			res.Skipped++
 			continue
 		}
-		if err := s.sendReminder(sub, daysLeft); err != nil {
-			res.Failed++
-			res.Failures = append(res.Failures, fmt.Sprintf("订阅 #%d 发送失败: %s", sub.ID, err))
-			continue
+		hoursLeft, _, _ := hoursUntil(sub.ExpiresAt, now, loc)
+		due = append(due, dueReminder{sub: sub, daysLeft: daysLeft, hoursLeft: hoursLeft})
+	}
+	for _, group := range groupByCustomer(due) {
+		if err := ctx.Err(); err != nil {
+			return res, err
 		}
-		res.Sent++
+		s.queueReminder(ctx, &res, group, now, dryRun)
 	}
+	res.sortFailures()
 	return res, nil
 }
 
-func (s Service) SendRenewalConfirm(sub db.SubscriptionDetail, oldExpires, newExpires string) error {
-	tpl, err := s.Store.GetRenewalTemplate()
+// SendRenewalConfirm queues the renewal confirmation unless one was already
+// queued for the same idempotency key or for the same new expiry date.
+// attachmentIDs are sent in addition to the product's attachments, e.g. an
+// invoice uploaded for this renewal.
+func (s Service) SendRenewalConfirm(ctx context.Context, sub db.SubscriptionDetail, key, oldExpires, newExpires string, attachmentIDs []int, now time.Time) error {
+	msg, err := s.renewalMessage(sub, oldExpires, newExpires)
 	if err != nil {
 		return err
 	}
+	msg.AttachmentIDs = append(msg.AttachmentIDs, attachmentIDs...)
+	claimed, err := s.Store.ClaimRenewalConfirm(sub.ID, key, newExpires, now)
+	if err != nil || !claimed {
+		return err
+	}
+	if err := s.Store.EnqueueEmail(ctx, msg, now); err != nil {
+		_ = s.Store.ReleaseRenewalConfirm(sub.ID, newExpires)
+		return err
+	}
+	return nil
+}
+
+func (s Service) renewalMessage(sub db.SubscriptionDetail, oldExpires, newExpires string) (db.OutboxEmail, error) {
+	tpl, err := s.Store.GetRenewalTemplate()
+	if err != nil {
+		return db.OutboxEmail{}, err
+	}
 	data := buildTemplateData(sub, s.Company, 0)
 	data["OldExpiresAt"] = oldExpires
 	data["NewExpiresAt"] = newExpires
-	subject, html, err := s.Render.RenderTemplate(tpl, data)
+	return s.buildMessage(sub, tpl, data)
+}
+
+// autoRenew advances an expired auto-renew subscription by whole billing
+// cycles until the expiry is today or later, then queues the renewal
+// confirmation.
+func (s Service) autoRenew(ctx context.Context, res *Result, sub db.SubscriptionDetail, now time.Time, dryRun bool) {
+	loc := s.zone(sub)
+	expires, timed, err := ParseExpiry(sub.ExpiresAt, loc)
 	if err != nil {
-		return err
+		s.fail(ctx, res, sub, "日期格式错误", now, dryRun)
+		return
+	}
+	layout := dateLayout
+	if timed {
+		layout = dateTimeLayout
+	}
+	today := now.In(loc).Format(dateLayout)
+	passed := func(t time.Time) bool {
+		if timed {
+			return t.Before(now)
+		}
+		return t.Format(dateLayout) < today
+	}
+	next := expires
+	for cycles := 1; passed(next); cycles++ {
+		next = expires.AddDate(0, sub.AutoRenewMonths*cycles, 0)
+	}
+	oldExpires, newExpires := sub.ExpiresAt, next.Format(layout)
+	sub.ExpiresAt = newExpires
+	msg, err := s.renewalMessage(sub, oldExpires, newExpires)
+	if err != nil {
+		s.fail(ctx, res, sub, fmt.Sprintf("续费确认生成失败: %s", err), now, dryRun)
+		return
+	}
+	if dryRun {
+		res.Renewed++
+		res.Planned = append(res.Planned, Planned{
+			SubscriptionID: sub.ID,
+			CustomerEmail:  sub.CustomerEmail,
+			ProductName:    sub.ProductName,
+			Template:       "自动续费",
+			Subject:        msg.Subject,
+		})
+		return
+	}
+	if err := s.Store.AutoRenewSubscription(sub.ID, oldExpires, newExpires, now); err != nil {
+		s.fail(ctx, res, sub, fmt.Sprintf("自动续费失败: %s", err), now, dryRun)
+		return
+	}
+	res.Renewed++
+	logging.From(ctx).Info("subscription auto-renewed", logging.SubscriptionID, sub.ID, logging.CustomerEmail, sub.CustomerEmail,
+		"old_expires_at", oldExpires, "new_expires_at", newExpires)
+	if err := s.Store.EnqueueEmail(ctx, msg, now); err != nil {
+		res.addFailure(ctx, sub, fmt.Sprintf("订阅 #%d 续费确认入队失败: %s", sub.ID, err))
 	}
-	return s.Mailer.Send(sub.CustomerEmail, subject, html)
 }
 
-func (s Service) sendReminder(sub db.SubscriptionDetail, daysLeft int) error {
+// offDayPolicy reports whether today is a weekend day or holiday on which
+// scheduled reminders are held back, and how many extra days to look ahead
+// when the off days' reminders are brought forward to the last workday.
+func (s Service) offDayPolicy(now time.Time) (offDay bool, lookahead int, err error) {
+	days, err := s.Store.GetBusinessDays()
+	if err != nil || days.WeekendShift == db.WeekendShiftNone {
+		return false, 0, err
+	}
+	weekend, err := calendar.ParseWeekend(days.Weekend)
+	if err != nil {
+		return false, 0, err
+	}
+	holidays, err := calendar.ParseHolidays(days.Holidays)
+	if err != nil {
+		return false, 0, err
+	}
+	off := calendar.OffDays{Weekend: weekend, Holidays: holidays}
+	today := now.In(s.Location)
+	if off.Contains(today) {
+		return true, 0, nil
+	}
+	if days.WeekendShift == db.WeekendShiftBefore {
+		return false, off.FollowingDays(today), nil
+	}
+	return false, 0, nil
+}
+
+// snoozed reports whether reminders for sub are suppressed on the given day.
+func snoozed(sub db.SubscriptionDetail, today string) bool {
+	return sub.SnoozedUntil != "" && today < sub.SnoozedUntil
+}
+
+// activeRule returns the tightest rule the subscription has reached, i.e.
+// the smallest rule that daysLeft has dropped to or below.
+func activeRule(rules []int, daysLeft int) (int, bool) {
+	best, found := 0, false
+	for _, r := range rules {
+		if daysLeft <= r && (!found || r < best) {
+			best, found = r, true
+		}
+	}
+	return best, found
+}
+
+// Preview renders the reminder a subscription would receive with the given
+// number of days left, without queuing anything.
+func (s Service) Preview(sub db.SubscriptionDetail, daysLeft int) (subject, html, text string, err error) {
+	tpl, _, err := s.reminderTemplate(sub)
+	if err != nil {
+		return "", "", "", err
+	}
+	unsubscribe, err := s.UnsubscribeURL(sub.CustomerID)
+	if err != nil {
+		return "", "", "", err
+	}
+	data := buildReminderData([]dueReminder{{sub: sub, daysLeft: daysLeft, hoursLeft: daysLeft * 24}}, s.Company)
+	data["UnsubscribeURL"] = unsubscribe
+	return s.Render.RenderTemplate(tpl, data)
+}
+
+// SampleData returns template data for a made-up subscription, covering
+// every field a reminder or renewal confirmation can use, so templates can
+// be test-rendered when they are saved.
+func SampleData(company string) map[string]any {
+	sub := db.SubscriptionDetail{
+		Subscription: db.Subscription{ID: 1, CustomerID: 1, ProductID: 1, ExpiresAt: "2030-01-31", Note: "示例备注",
+			PaymentLink: "https://buy.stripe.com/example", PaymentLinkFor: "2030-01-31"},
+		CustomerName:  "示例客户",
+		CustomerEmail: "customer@example.com",
+		ProductName:   "示例产品",
+	}
+	data := buildReminderData([]dueReminder{{sub: sub, daysLeft: 7, hoursLeft: 168}}, company)
+	data["UnsubscribeURL"] = "https://example.com/unsubscribe"
+	data["OldExpiresAt"] = "2029-01-31"
+	data["NewExpiresAt"] = sub.ExpiresAt
+	return data
+}
+
+// DaysLeft returns the number of days until the subscription expires, in
+// the customer's time zone.
+func (s Service) DaysLeft(sub db.SubscriptionDetail, now time.Time) (int, error) {
+	return daysUntil(sub.ExpiresAt, now, s.zone(sub))
+}
+
+// zone returns the customer's time zone, or Location if none is set.
+func (s Service) zone(sub db.SubscriptionDetail) *time.Location {
+	if sub.CustomerTimeZone != "" {
+		if loc, err := calendar.LoadZone(sub.CustomerTimeZone); err == nil {
+			return loc
+		}
+	}
+	return s.Location
+}
+
+// dueReminder is a subscription that passed the scan filters. rule is the
+// reminder rule it satisfied; manual scans leave it at zero. sms is set when
+// the rule is an SMS rule and smsOnly when it sends no email.
+type dueReminder struct {
+	sub       db.SubscriptionDetail
+	daysLeft  int
+	hoursLeft int
+	rule      int
+	hourly    bool
+	sms       bool
+	smsOnly   bool
+}
+
+// groupByCustomer collects each customer's due paid subscriptions together
+// so they receive a single email, keeping the scan order otherwise. Trials
+// always get their own email so they keep the trial wording.
+func groupByCustomer(due []dueReminder) [][]dueReminder {
+	index := map[int]int{}
+	var groups [][]dueReminder
+	for _, d := range due {
+		if d.sub.Kind == db.KindTrial {
+			groups = append(groups, []dueReminder{d})
+			continue
+		}
+		i, ok := index[d.sub.CustomerID]
+		if !ok {
+			i = len(groups)
+			index[d.sub.CustomerID] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], d)
+	}
+	return groups
+}
+
+// customerHeaders belong to the customer's own copy of a reminder and are
+// left off escalated copies.
+var customerHeaders = []string{"List-Unsubscribe", "List-Unsubscribe-Post", "In-Reply-To", "References"}
+
+// queueReminder renders one customer's reminder and queues it, or only lists
+// it in res.Planned for a dry run. It reports whether the reminder went through.
+func (s Service) queueReminder(ctx context.Context, res *Result, group []dueReminder, now time.Time, dryRun bool) bool {
+	if !dryRun {
+		s.addPaymentLinks(ctx, group)
+	}
+	msg, label, err := s.reminderMessage(group)
+	if err == nil {
+		err = s.thread(&msg, group[0].sub, now)
+	}
+	var escalateTo []string
+	if err == nil {
+		escalateTo, err = s.escalationRecipients(group)
+	}
+	quoteID := 0
+	if err == nil && !dryRun {
+		if quoteID, err = s.attachQuote(&msg, group, now); err != nil {
+			err = fmt.Errorf("生成报价单失败: %w", err)
+		}
+	}
+	if err == nil && !dryRun {
+		out := Outgoing{Email: msg, Template: label, EscalateTo: escalateTo}
+		for _, d := range group {
+			out.Subscriptions = append(out.Subscriptions, d.sub)
+		}
+		if err = s.beforeSend(ctx, out); err != nil {
+			err = fmt.Errorf("发送前钩子拒绝: %w", err)
+		} else {
+			err = s.Store.EnqueueEmail(ctx, msg, now)
+			s.afterSend(ctx, out, err)
+		}
+	}
+	if err != nil {
+		if quoteID != 0 {
+			_ = s.Store.DeleteAttachment(quoteID)
+		}
+		for _, d := range group {
+			s.fail(ctx, res, d.sub, fmt.Sprintf("入队失败: %s", err), now, dryRun)
+		}
+		return false
+	}
+	if !dryRun {
+		for _, d := range group {
+			if err := s.Store.AddThreadMessage(d.sub.ID, d.sub.ExpiresAt, msg.MessageID); err != nil {
+				res.addFailure(ctx, d.sub, fmt.Sprintf("订阅 #%d 记录邮件会话失败", d.sub.ID))
+			}
+		}
+		for _, to := range escalateTo {
+			escalated := msg
+			escalated.To = to
+			escalated.Cc = nil
+			escalated.Headers = maps.Clone(msg.Headers)
+			for _, name := range customerHeaders {
+				delete(escalated.Headers, name)
+			}
+			escalated.MessageID = ""
+			escalated.Subject = "【升级提醒】" + msg.Subject
+			if err := s.Store.EnqueueEmail(ctx, escalated, now); err != nil {
+				res.addFailure(ctx, group[0].sub, fmt.Sprintf("订阅 #%d 升级提醒入队失败: %s", msg.SubscriptionID, err))
+			}
+		}
+		for _, chat := range s.customerChats(group[0].sub) {
+			if err := s.Store.EnqueueEmail(ctx, chatMessage(msg, chat), now); err != nil {
+				res.addFailure(ctx, group[0].sub, fmt.Sprintf("订阅 #%d %s 提醒入队失败: %s", msg.SubscriptionID, chat.Channel, err))
+			}
+		}
+		if err := s.postHighPriority(ctx, group, now); err != nil {
+			res.addFailure(ctx, group[0].sub, fmt.Sprintf("订阅 #%d Slack 提醒入队失败: %s", msg.SubscriptionID, err))
+		}
+		if err := s.postUrgentExpiries(ctx, group, now); err != nil {
+			res.addFailure(ctx, group[0].sub, fmt.Sprintf("订阅 #%d Matrix 提醒入队失败: %s", msg.SubscriptionID, err))
+		}
+		if err := s.queueExpiryCards(ctx, group, now); err != nil {
+			res.addFailure(ctx, group[0].sub, fmt.Sprintf("订阅 #%d 到期卡片入队失败: %s", msg.SubscriptionID, err))
+		}
+	}
+	for _, d := range group {
+		if dryRun {
+			res.Planned = append(res.Planned, Planned{
+				SubscriptionID: d.sub.ID,
+				CustomerEmail:  d.sub.CustomerEmail,
+				ProductName:    d.sub.ProductName,
+				DaysLeft:       d.daysLeft,
+				Template:       label,
+				Subject:        msg.Subject,
+				EscalateTo:     escalateTo,
+			})
+		} else {
+			logging.From(ctx).Debug("reminder queued", logging.SubscriptionID, d.sub.ID, logging.CustomerEmail, d.sub.CustomerEmail,
+				"days_left", d.daysLeft, "template", label)
+			res.reminded = append(res.reminded, d)
+		}
+		res.Queued++
+		res.addProduct(d.sub.ProductID)
+	}
+	return true
+}
+
+// escalationRecipients returns who gets a copy of the reminder because one
+// of the group's subscriptions has already had the configured number of
+// reminders for its current expiry date without being renewed.
+func (s Service) escalationRecipients(group []dueReminder) ([]string, error) {
+	escalation, err := s.Store.GetEscalation()
+	if err != nil || escalation.AfterReminders <= 0 {
+		return nil, err
+	}
+	escalate := false
+	for _, d := range group {
+		sent, err := s.Store.CountRuleSends(d.sub.ID, d.sub.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		if sent >= escalation.AfterReminders {
+			escalate = true
+			break
+		}
+	}
+	if !escalate {
+		return nil, nil
+	}
+	var to []string
+	if secondary := strings.TrimSpace(group[0].sub.CustomerSecondaryEmail); secondary != "" {
+		to = append(to, secondary)
+	}
+	if manager := strings.TrimSpace(escalation.ManagerEmail); manager != "" {
+		to = append(to, manager)
+	}
+	return to, nil
+}
+
+// fail counts a failed subscription and, outside dry runs, logs it for the
+// admin digest.
+func (s Service) fail(ctx context.Context, res *Result, sub db.SubscriptionDetail, reason string, now time.Time, dryRun bool) {
+	res.Failed++
+	res.addFailure(ctx, sub, fmt.Sprintf("订阅 #%d %s", sub.ID, reason))
+	if dryRun {
+		return
+	}
+	_ = s.Store.RecordFailure(db.Delivery{
+		SubscriptionID: sub.ID,
+		To:             sub.CustomerEmail,
+		Error:          reason,
+		Date:           now.In(s.Location).Format("2006-01-02"),
+		At:             now.Format(time.RFC3339),
+	})
+}
+
+// reminderMessage renders the regular reminder template for a single
+// subscription and the combined template when a customer has several due.
+// It also returns a label naming the template used.
+func (s Service) reminderMessage(group []dueReminder) (db.OutboxEmail, string, error) {
+	unsubscribe, err := s.UnsubscribeURL(group[0].sub.CustomerID)
+	if err != nil {
+		return db.OutboxEmail{}, "", err
+	}
+	data := buildReminderData(group, s.Company)
+	data["UnsubscribeURL"] = unsubscribe
+	if len(group) == 1 {
+		tpl, label, err := s.reminderTemplate(group[0].sub)
+		if err != nil {
+			return db.OutboxEmail{}, "", err
+		}
+		msg, err := s.buildMessage(group[0].sub, tpl, data)
+		if err != nil {
+			return db.OutboxEmail{}, "", err
+		}
+		maps.Copy(msg.Headers, unsubscribeHeaders(unsubscribe))
+		return msg, label, nil
+	}
+	tpl, err := s.Store.GetCombinedTemplate()
+	if err != nil {
+		return db.OutboxEmail{}, "", err
+	}
+	msg, err := s.buildMessage(group[0].sub, tpl, data)
+	if err != nil {
+		return db.OutboxEmail{}, "", err
+	}
+	maps.Copy(msg.Headers, unsubscribeHeaders(unsubscribe))
+	seen := map[int]bool{group[0].sub.ProductID: true}
+	for _, d := range group[1:] {
+		if seen[d.sub.ProductID] {
+			continue
+		}
+		seen[d.sub.ProductID] = true
+		ids, err := s.productAttachments(d.sub)
+		if err != nil {
+			return db.OutboxEmail{}, "", err
+		}
+		msg.AttachmentIDs = append(msg.AttachmentIDs, ids...)
+	}
+	return msg, "合并提醒", nil
+}
+
+// reminderTemplate returns the trial template for trial subscriptions, and
+// otherwise the template assigned to the subscription's product, falling
+// back to the global template when none is assigned or the name no longer
+// exists.
+func (s Service) reminderTemplate(sub db.SubscriptionDetail) (db.Template, string, error) {
+	if sub.Kind == db.KindTrial {
+		tpl, err := s.Store.GetTrialTemplate()
+		return tpl, "试用到期提醒", err
+	}
+	if sub.ProductTemplate != "" {
+		tpl, ok, err := s.Store.GetNamedTemplate(sub.ProductTemplate)
+		if err != nil {
+			return db.Template{}, "", err
+		}
+		if ok {
+			return tpl, "续费提醒（" + sub.ProductTemplate + "）", nil
+		}
+	}
 	tpl, err := s.Store.GetTemplate()
+	return tpl, "续费提醒", err
+}
+
+func (s Service) buildMessage(sub db.SubscriptionDetail, tpl db.Template, data map[string]any) (db.OutboxEmail, error) {
+	subject, html, text, err := s.Render.RenderTemplate(tpl, data)
 	if err != nil {
-		return err
+		return db.OutboxEmail{}, err
 	}
-	data := buildTemplateData(sub, s.Company, daysLeft)
-	subject, html, err := s.Render.RenderTemplate(tpl, data)
+	attachmentIDs, err := s.productAttachments(sub)
 	if err != nil {
-		return err
+		return db.OutboxEmail{}, err
 	}
-	return s.Mailer.Send(sub.CustomerEmail, subject, html)
+	to, cc, err := s.recipients(sub)
+	if err != nil {
+		return db.OutboxEmail{}, err
+	}
+	headers, err := email.ParseHeaders(tpl.Headers)
+	if err != nil {
+		return db.OutboxEmail{}, err
+	}
+	return db.OutboxEmail{
+		Headers:        headers,
+		SubscriptionID: sub.ID,
+		To:             to,
+		Cc:             cc,
+		ReplyTo:        tpl.ReplyTo,
+		Subject:        subject,
+		HTML:           html,
+		Text:           text,
+		AttachmentIDs:  attachmentIDs,
+		TimeZone:       sub.CustomerTimeZone,
+	}, nil
+}
+
+// recipients picks the customer's addresses in the reminder roles. The
+// first is the To address; the rest are copied along with the customer's CC
+// list. Without any address in those roles the primary email is used.
+func (s Service) recipients(sub db.SubscriptionDetail) (string, []string, error) {
+	roles, err := s.Store.GetReminderRoles()
+	if err != nil {
+		return "", nil, err
+	}
+	var addrs []string
+	seen := map[string]bool{}
+	add := func(addr string) {
+		if key := strings.ToLower(addr); addr != "" && !seen[key] {
+			seen[key] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	for _, role := range roles {
+		if role == db.RolePrimary {
+			add(sub.CustomerEmail)
+			continue
+		}
+		for _, contact := range sub.CustomerContacts {
+			if contact.Role == role {
+				add(contact.Email)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		add(sub.CustomerEmail)
+	}
+	for _, cc := range splitRecipients(sub.CustomerCC) {
+		add(cc)
+	}
+	if len(addrs) == 0 {
+		return sub.CustomerEmail, nil, nil
+	}
+	return addrs[0], addrs[1:], nil
+}
+
+// productAttachments returns the IDs of the files attached to the
+// subscription's product.
+func (s Service) productAttachments(sub db.SubscriptionDetail) ([]int, error) {
+	attachments, err := s.Store.ListProductAttachments(sub.ProductID)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, att := range attachments {
+		ids = append(ids, att.ID)
+	}
+	return ids, nil
+}
+
+// buildReminderData uses the first subscription for the top-level fields and
+// the smallest DaysLeft of the group, and lists every subscription in Items.
+func buildReminderData(group []dueReminder, company string) map[string]any {
+	minDays, minHours := group[0].daysLeft, group[0].hoursLeft
+	items := make([]map[string]any, 0, len(group))
+	for _, d := range group {
+		itemData := buildTemplateData(d.sub, company, d.daysLeft)
+		items = append(items, map[string]any{
+			"Product":      itemData["Product"],
+			"Subscription": itemData["Subscription"],
+			"DaysLeft":     d.daysLeft,
+			"HoursLeft":    d.hoursLeft,
+		})
+		if d.daysLeft < minDays {
+			minDays = d.daysLeft
+		}
+		if d.hoursLeft < minHours {
+			minHours = d.hoursLeft
+		}
+	}
+	data := buildTemplateData(group[0].sub, company, minDays)
+	data["HoursLeft"] = minHours
+	data["Items"] = items
+	return data
 }
 
 func buildTemplateData(sub db.SubscriptionDetail, company string, daysLeft int) map[string]any {
@@ -159,6 +888,8 @@ func buildTemplateData(sub db.SubscriptionDetail, company string, daysLeft int)
 		"ProductID":  sub.ProductID,
 		"ExpiresAt":  sub.ExpiresAt,
 		"Note":       sub.Note,
+		// Empty unless a Stripe link was created for the current expiry.
+		"PaymentLink": paymentLinkURL(sub),
 	}
 	return map[string]any{
 		"Customer":     customer,
@@ -172,16 +903,45 @@ func buildTemplateData(sub db.SubscriptionDetail, company string, daysLeft int)
 	}
 }
 
-func daysUntil(date string, now time.Time, loc *time.Location) (int, error) {
-	t, err := time.ParseInLocation("2006-01-02", date, loc)
+const (
+	dateLayout     = "2006-01-02"
+	dateTimeLayout = "2006-01-02 15:04"
+)
+
+// ParseExpiry parses an ExpiresAt value in loc. Date-only values expire at
+// the start of that day; timed reports whether a time of day was given.
+func ParseExpiry(value string, loc *time.Location) (t time.Time, timed bool, err error) {
+	if t, err := time.ParseInLocation(dateTimeLayout, value, loc); err == nil {
+		return t, true, nil
+	}
+	t, err = time.ParseInLocation(dateLayout, value, loc)
+	return t, false, err
+}
+
+// daysUntil counts calendar days in loc from now to the expiry date,
+// ignoring any time of day.
+func daysUntil(expiresAt string, now time.Time, loc *time.Location) (int, error) {
+	t, _, err := ParseExpiry(expiresAt, loc)
 	if err != nil {
 		return 0, err
 	}
-	start := now.In(loc).Truncate(24 * time.Hour)
-	target := t.Truncate(24 * time.Hour)
+	y, m, d := now.In(loc).Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	y, m, d = t.Date()
+	target := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
 	return int(target.Sub(start).Hours() / 24), nil
 }
 
+// hoursUntil returns the whole hours from now to the expiry, rounded down,
+// and whether the expiry has a time of day.
+func hoursUntil(expiresAt string, now time.Time, loc *time.Location) (int, bool, error) {
+	t, timed, err := ParseExpiry(expiresAt, loc)
+	if err != nil {
+		return 0, false, err
+	}
+	return int(math.Floor(t.Sub(now).Hours())), timed, nil
+}
+
 func ParseRules(input string) ([]int, error) {
 	input = strings.TrimSpace(input)
 	if input == "" {
@@ -206,13 +966,3 @@ func ParseRules(input string) ([]int, error) {
 	sort.Ints(rules)
 	return rules, nil
 }
-
-func maxInt(values []int) int {
-	max := values[0]
-	for _, v := range values {
-		if v > max {
-			max = v
-		}
-	}
-	return max
-}
@@ -0,0 +1,100 @@
+package reminder
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"xf/internal/db"
+)
+
+// plainRenderer returns the templates unrendered, which is enough to queue
+// messages.
+type plainRenderer struct{}
+
+func (plainRenderer) RenderTemplate(tpl db.Template, data any) (string, string, string, error) {
+	return tpl.Subject, tpl.HTML, tpl.Text, nil
+}
+
+// newTestService opens an empty store with one customer and one product,
+// both with ID 1, and skips weekends by the given shift.
+func newTestService(t *testing.T, shift string) Service {
+	t.Helper()
+	store, err := db.Open(filepath.Join(t.TempDir(), "data.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	if err := store.CreateCustomer("alice@example.com", "Alice", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateProduct("Hosting", "", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateBusinessDays(db.BusinessDays{WeekendShift: shift, Weekend: "6,7"}); err != nil {
+		t.Fatal(err)
+	}
+	return Service{Store: store, Location: time.UTC, Render: plainRenderer{}}
+}
+
+func TestAutoRenewOnOffDay(t *testing.T) {
+	s := newTestService(t, db.WeekendShiftAfter)
+	if err := s.Store.CreateSubscription(1, 1, "2026-10-16", "", "", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store.SetAutoRenew(1, 12); err != nil {
+		t.Fatal(err)
+	}
+	saturday := time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)
+	res, err := s.ScanAndSend(context.Background(), saturday, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Renewed != 1 {
+		t.Errorf("Renewed = %d, want 1", res.Renewed)
+	}
+	sub, err := s.Store.GetSubscription(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.ExpiresAt != "2027-10-16" {
+		t.Errorf("ExpiresAt = %s, want 2027-10-16", sub.ExpiresAt)
+	}
+}
+
+// With reminders moved before the weekend, a Saturday expiry gets one
+// reminder on Friday that stands for both the one-day and the expiry-day
+// rules.
+func TestWeekendShiftBeforeCollapsesRules(t *testing.T) {
+	s := newTestService(t, db.WeekendShiftBefore)
+	if err := s.Store.UpdateRules([]int{1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store.CreateSubscription(1, 1, "2026-10-17", "", "", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	friday := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	for run, want := range []int{1, 0} {
+		res, err := s.ScanAndSend(context.Background(), friday.Add(time.Duration(run)*time.Hour), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Queued != want {
+			t.Errorf("run %d: Queued = %d, want %d", run+1, res.Queued, want)
+		}
+	}
+	for _, tt := range []struct {
+		rule int
+		want bool
+	}{{0, true}, {1, false}} {
+		sent, err := s.Store.HasRuleSend(1, "2026-10-17", tt.rule, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sent != tt.want {
+			t.Errorf("rule %d recorded = %v, want %v", tt.rule, sent, tt.want)
+		}
+	}
+}
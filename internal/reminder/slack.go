@@ -0,0 +1,112 @@
+package reminder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"xf/internal/db"
+)
+
+// postScanSummary queues the Slack, DingTalk and Matrix summaries of a
+// finished scan and the Feishu card of its expiring subscriptions. Scans that
+// queued, renewed and failed nothing are not posted, so the chats aren't
+// filled with a message every scan interval.
+func (s Service) postScanSummary(ctx context.Context, trigger string, started time.Time, res Result, runErr error, now time.Time) error {
+	if runErr == nil && res.Queued == 0 && res.Renewed == 0 && res.Failed == 0 {
+		return nil
+	}
+	data := scanData(s.Company, trigger, started.In(s.Location), res, runErr)
+	if s.Slack {
+		tpl, err := s.Store.GetSlackTemplate()
+		if err != nil {
+			return err
+		}
+		if err := s.postSlack(ctx, tpl.Scan, data, 0, now); err != nil {
+			return err
+		}
+	}
+	if s.DingTalk {
+		if err := s.postDingTalk(ctx, data, res, now); err != nil {
+			return err
+		}
+	}
+	if s.MatrixRoom != "" {
+		if err := s.postMatrixScan(ctx, data, now); err != nil {
+			return err
+		}
+	}
+	return s.postExpiringCard(ctx, res.reminded, now)
+}
+
+// postHighPriority queues a Slack alert for each high-priority
+// subscription in a reminder that was just queued.
+func (s Service) postHighPriority(ctx context.Context, group []dueReminder, now time.Time) error {
+	if !s.Slack {
+		return nil
+	}
+	for _, d := range group {
+		if d.sub.Priority != db.PriorityHigh {
+			continue
+		}
+		tpl, err := s.Store.GetSlackTemplate()
+		if err != nil {
+			return err
+		}
+		data := buildTemplateData(d.sub, s.Company, d.daysLeft)
+		data["URL"] = ""
+		if s.PublicURL != "" {
+			data["URL"] = fmt.Sprintf("%s/subscriptions/%d", strings.TrimRight(s.PublicURL, "/"), d.sub.ID)
+		}
+		if err := s.postSlack(ctx, tpl.HighPriority, data, d.sub.ID, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s Service) postSlack(ctx context.Context, tpl string, data map[string]any, subscriptionID int, now time.Time) error {
+	_, _, text, err := s.Render.RenderTemplate(db.Template{Text: tpl}, data)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	return s.Store.EnqueueEmail(ctx, db.OutboxEmail{SubscriptionID: subscriptionID, Channel: db.ChannelSlack, Text: text}, now)
+}
+
+func scanData(company, trigger string, started time.Time, res Result, runErr error) map[string]any {
+	var errText string
+	if runErr != nil {
+		errText = runErr.Error()
+	}
+	return map[string]any{
+		"Company":   company,
+		"Trigger":   trigger,
+		"StartedAt": started.Format(dateTimeLayout),
+		"Total":     res.Total,
+		"Queued":    res.Queued,
+		"Skipped":   res.Skipped,
+		"Failed":    res.Failed,
+		"Renewed":   res.Renewed,
+		"Failures":  res.Failures,
+		"Error":     errText,
+	}
+}
+
+// SampleScanData returns template data for a made-up scan with a failure,
+// so the Slack scan template can be test-rendered when it is saved.
+func SampleScanData(company string) map[string]any {
+	res := Result{Total: 12, Queued: 3, Skipped: 8, Failed: 1, Failures: []string{"订阅 #7 日期格式错误"}}
+	return scanData(company, db.TriggerScheduled, time.Date(2030, 1, 31, 9, 0, 0, 0, time.UTC), res, nil)
+}
+
+// SampleAlertData returns template data for a made-up high-priority
+// subscription, for test-rendering the Slack alert template.
+func SampleAlertData(company string) map[string]any {
+	data := SampleData(company)
+	data["URL"] = "https://example.com/subscriptions/1"
+	return data
+}
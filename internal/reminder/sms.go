@@ -0,0 +1,80 @@
+package reminder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"xf/internal/db"
+	"xf/internal/logging"
+)
+
+// queueSMS renders one customer's SMS reminder from the SMS template and
+// queues it to their phone, or only lists it in res.Planned for a dry run.
+// Subscriptions that get no email at this rule are counted as queued here;
+// the others were counted with the email. It reports whether the SMS went
+// through.
+func (s Service) queueSMS(ctx context.Context, res *Result, group []dueReminder, now time.Time, dryRun bool) bool {
+	text, err := s.smsText(group)
+	if err == nil && !dryRun {
+		msg := db.OutboxEmail{
+			SubscriptionID: group[0].sub.ID,
+			Channel:        db.ChannelSMS,
+			To:             group[0].sub.CustomerPhone,
+			Text:           text,
+			TimeZone:       group[0].sub.CustomerTimeZone,
+		}
+		err = s.Store.EnqueueEmail(ctx, msg, now)
+	}
+	if err != nil {
+		for _, d := range group {
+			s.fail(ctx, res, d.sub, fmt.Sprintf("短信入队失败: %s", err), now, dryRun)
+		}
+		return false
+	}
+	for _, d := range group {
+		if dryRun {
+			res.Planned = append(res.Planned, Planned{
+				SubscriptionID: d.sub.ID,
+				CustomerEmail:  d.sub.CustomerEmail,
+				ProductName:    d.sub.ProductName,
+				DaysLeft:       d.daysLeft,
+				Template:       "短信",
+				Subject:        text,
+			})
+		} else {
+			logging.From(ctx).Debug("sms reminder queued", logging.SubscriptionID, d.sub.ID, "days_left", d.daysLeft)
+		}
+		if d.smsOnly {
+			res.Queued++
+			res.addProduct(d.sub.ProductID)
+			if !dryRun {
+				res.reminded = append(res.reminded, d)
+			}
+		}
+	}
+	return true
+}
+
+// smsText renders the SMS reminder for group, using the trial template for
+// a trial.
+func (s Service) smsText(group []dueReminder) (string, error) {
+	tpl, err := s.Store.GetSMSTemplate()
+	if err != nil {
+		return "", err
+	}
+	text := tpl.Reminder
+	if group[0].sub.Kind == db.KindTrial {
+		text = tpl.Trial
+	}
+	_, _, out, err := s.Render.RenderTemplate(db.Template{Text: text}, buildReminderData(group, s.Company))
+	if err != nil {
+		return "", err
+	}
+	if out = strings.TrimSpace(out); out == "" {
+		return "", errors.New("短信模板渲染结果为空")
+	}
+	return out, nil
+}
@@ -0,0 +1,132 @@
+package reminder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"xf/internal/db"
+	"xf/internal/logging"
+	"xf/internal/stripe"
+)
+
+// defaultRenewalMonths is how far a payment extends a subscription whose
+// product doesn't say.
+const defaultRenewalMonths = 12
+
+// zeroDecimal are the currencies Stripe counts in whole units rather than
+// hundredths.
+var zeroDecimal = map[string]bool{"JPY": true, "KRW": true, "VND": true, "CLP": true}
+
+// ErrStalePayment is returned by RenewPaid for a payment made through a link
+// for an expiry the subscription no longer has.
+var ErrStalePayment = errors.New("payment is for an earlier expiry")
+
+// PaymentLink returns the Stripe payment link that renews sub from its
+// current expiry, creating one if the subscription has none yet or only a
+// stale one for an earlier expiry, which is deactivated. It returns "" for
+// products without a Stripe price.
+func (s Service) PaymentLink(ctx context.Context, sub db.SubscriptionDetail) (string, error) {
+	if err := s.ensurePaymentLink(ctx, &sub); err != nil {
+		return "", err
+	}
+	return paymentLinkURL(sub), nil
+}
+
+// ensurePaymentLink creates the link PaymentLink returns if needed and sets
+// it on sub.
+func (s Service) ensurePaymentLink(ctx context.Context, sub *db.SubscriptionDetail) error {
+	if !s.Stripe.Enabled() || sub.ProductStripePriceID == "" || paymentLinkURL(*sub) != "" {
+		return nil
+	}
+	if sub.PaymentLinkID != "" {
+		if err := s.Stripe.DeactivatePaymentLink(ctx, sub.PaymentLinkID); err != nil {
+			logging.From(ctx).Warn("stripe payment link not deactivated", logging.SubscriptionID, sub.ID, "link", sub.PaymentLinkID, "error", err)
+		}
+	}
+	link, err := s.Stripe.CreatePaymentLink(ctx, sub.ProductStripePriceID, map[string]string{
+		"subscription_id": strconv.Itoa(sub.ID),
+		"expires_at":      sub.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.Store.SetPaymentLink(sub.ID, link.URL, link.ID, sub.ExpiresAt); err != nil {
+		return err
+	}
+	sub.PaymentLink, sub.PaymentLinkID, sub.PaymentLinkFor = link.URL, link.ID, sub.ExpiresAt
+	return nil
+}
+
+// addPaymentLinks fills in the payment links of a reminder's subscriptions.
+// A link that can't be created is logged and left out; the reminder still
+// goes out without it.
+func (s Service) addPaymentLinks(ctx context.Context, group []dueReminder) {
+	for i := range group {
+		if err := s.ensurePaymentLink(ctx, &group[i].sub); err != nil {
+			logging.From(ctx).Warn("stripe payment link failed", logging.SubscriptionID, group[i].sub.ID, "error", err)
+		}
+	}
+}
+
+// paymentLinkURL returns the subscription's payment link with the
+// customer's email filled in on the checkout page, or "" if it has none
+// for its current expiry.
+func paymentLinkURL(sub db.SubscriptionDetail) string {
+	if sub.PaymentLink == "" || sub.PaymentLinkFor != sub.ExpiresAt {
+		return ""
+	}
+	return sub.PaymentLink + "?prefilled_email=" + url.QueryEscape(sub.CustomerEmail)
+}
+
+// RenewPaid extends the subscription paid for in a Stripe Checkout Session
+// by the product's renewal months and queues the renewal confirmation. The
+// session's expires_at metadata is the expiry the link was made for; a
+// payment for an expiry that has since changed is not applied and returns
+// ErrStalePayment, so the admin can settle it by hand. A session that was
+// already applied is ignored.
+func (s Service) RenewPaid(ctx context.Context, sub db.SubscriptionDetail, session stripe.CheckoutSession, now time.Time) error {
+	if s.Store.PaymentApplied(session.ID) {
+		return nil
+	}
+	oldExpires := session.Metadata["expires_at"]
+	if oldExpires == "" {
+		oldExpires = sub.ExpiresAt
+	}
+	if oldExpires != sub.ExpiresAt {
+		return fmt.Errorf("%w: paid for %s, now expires %s", ErrStalePayment, oldExpires, sub.ExpiresAt)
+	}
+	expires, timed, err := ParseExpiry(oldExpires, s.zone(sub))
+	if err != nil {
+		return err
+	}
+	months := sub.ProductRenewalMonths
+	if months <= 0 {
+		months = defaultRenewalMonths
+	}
+	layout := dateLayout
+	if timed {
+		layout = dateTimeLayout
+	}
+	newExpires := expires.AddDate(0, months, 0).Format(layout)
+	currency := strings.ToUpper(session.Currency)
+	amount := db.FormatCents(session.AmountTotal, "")
+	if zeroDecimal[currency] {
+		amount = strconv.FormatInt(session.AmountTotal, 10)
+	}
+	renewed, err := s.Store.PaidRenewSubscription(sub.ID, oldExpires, newExpires, session.ID, amount, currency, now)
+	if err != nil || !renewed {
+		return err
+	}
+	logging.From(ctx).Info("subscription renewed by payment", logging.SubscriptionID, sub.ID, "session", session.ID,
+		"amount", amount, "currency", currency, "old_expires_at", oldExpires, "new_expires_at", newExpires)
+	after, err := s.Store.GetSubscription(sub.ID)
+	if err != nil {
+		return err
+	}
+	return s.SendRenewalConfirm(ctx, after, "stripe:"+session.ID, oldExpires, newExpires, nil, now)
+}
@@ -0,0 +1,37 @@
+package reminder
+
+import (
+	"strings"
+	"time"
+
+	"xf/internal/db"
+	"xf/internal/email"
+)
+
+// maxReferences bounds the References header. The first reminder, which
+// roots the thread, and the most recent ones are kept.
+const maxReferences = 10
+
+// thread gives msg its own Message-ID and, when reminders already went out
+// for the subscription's current expiry date, In-Reply-To and References
+// headers pointing at them, so the 30-, 7- and 1-day reminders show up as
+// one conversation in the customer's mail client.
+func (s Service) thread(msg *db.OutboxEmail, sub db.SubscriptionDetail, now time.Time) error {
+	earlier, err := s.Store.ThreadMessageIDs(sub.ID, sub.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	msg.MessageID = email.NewMessageID(s.From, now)
+	if len(earlier) == 0 {
+		return nil
+	}
+	if len(earlier) > maxReferences {
+		earlier = append(earlier[:1], earlier[len(earlier)-maxReferences+1:]...)
+	}
+	if msg.Headers == nil {
+		msg.Headers = map[string]string{}
+	}
+	msg.Headers["In-Reply-To"] = earlier[len(earlier)-1]
+	msg.Headers["References"] = strings.Join(earlier, " ")
+	return nil
+}
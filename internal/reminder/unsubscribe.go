@@ -0,0 +1,76 @@
+package reminder
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const unsubscribeSecretKey = "unsubscribe_secret"
+
+// unsubscribeHeaders returns the RFC 8058 one-click unsubscribe headers
+// for link, or nil when there is no link.
+func unsubscribeHeaders(link string) map[string]string {
+	if link == "" {
+		return nil
+	}
+	return map[string]string{
+		"List-Unsubscribe":      "<" + link + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+}
+
+// UnsubscribeURL returns the tokenized link that opts the customer out of
+// reminders, or "" when PublicURL is not configured.
+func (s Service) UnsubscribeURL(customerID int) (string, error) {
+	if s.PublicURL == "" {
+		return "", nil
+	}
+	secret, err := s.unsubscribeSecret()
+	if err != nil {
+		return "", err
+	}
+	token := strconv.Itoa(customerID) + "." + signCustomer(secret, customerID)
+	return strings.TrimRight(s.PublicURL, "/") + "/unsubscribe?token=" + url.QueryEscape(token), nil
+}
+
+// VerifyUnsubscribeToken returns the customer a token from UnsubscribeURL
+// was issued for, reporting false if it is malformed or forged.
+func (s Service) VerifyUnsubscribeToken(token string) (int, bool, error) {
+	idText, sig, found := strings.Cut(token, ".")
+	id, err := strconv.Atoi(idText)
+	if !found || err != nil {
+		return 0, false, nil
+	}
+	secret, err := s.unsubscribeSecret()
+	if err != nil {
+		return 0, false, err
+	}
+	return id, hmac.Equal([]byte(sig), []byte(signCustomer(secret, id))), nil
+}
+
+// unsubscribeSecret returns the key tokens are signed with, creating and
+// storing a random one on first use.
+func (s Service) unsubscribeSecret() (string, error) {
+	secret, err := s.Store.GetSetting(unsubscribeSecretKey)
+	if err != nil || secret != "" {
+		return secret, err
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	secret = hex.EncodeToString(buf)
+	return secret, s.Store.SetSetting(unsubscribeSecretKey, secret)
+}
+
+func signCustomer(secret string, customerID int) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "unsubscribe:%d", customerID)
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
@@ -0,0 +1,172 @@
+// Package stripe creates Stripe payment links for subscription renewals and
+// verifies the webhook events Stripe sends when they are paid. It talks to
+// the REST API directly rather than through the Stripe SDK.
+package stripe
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"xf/internal/email"
+)
+
+const apiURL = "https://api.stripe.com"
+
+// Client calls the Stripe API with a secret or restricted key.
+type Client struct {
+	SecretKey string
+	// APIURL overrides the API server; empty uses the public one.
+	APIURL string
+	Client *http.Client
+}
+
+func (c Client) Enabled() bool {
+	return c.SecretKey != ""
+}
+
+// PaymentLink is a link created by CreatePaymentLink.
+type PaymentLink struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+}
+
+// CreatePaymentLink creates a payment link for one unit of priceID that can
+// be paid once, after which Stripe deactivates it. metadata is copied to the
+// Checkout Session of the payment, where the webhook reads it back.
+func (c Client) CreatePaymentLink(ctx context.Context, priceID string, metadata map[string]string) (PaymentLink, error) {
+	form := url.Values{
+		"line_items[0][price]":                    {priceID},
+		"line_items[0][quantity]":                 {"1"},
+		"restrictions[completed_sessions][limit]": {"1"},
+	}
+	for key, value := range metadata {
+		form.Set("metadata["+key+"]", value)
+	}
+	var link PaymentLink
+	err := c.call(ctx, "/v1/payment_links", form, &link)
+	return link, err
+}
+
+// DeactivatePaymentLink turns off a link that is no longer wanted, e.g.
+// because the subscription was renewed by other means.
+func (c Client) DeactivatePaymentLink(ctx context.Context, id string) error {
+	return c.call(ctx, "/v1/payment_links/"+url.PathEscape(id), url.Values{"active": {"false"}}, nil)
+}
+
+func (c Client) call(ctx context.Context, path string, form url.Values, out any) error {
+	base := c.APIURL
+	if base == "" {
+		base = apiURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(base, "/")+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.SecretKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 300 {
+		var reply struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		detail := strings.TrimSpace(string(data))
+		if json.Unmarshal(data, &reply) == nil && reply.Error.Message != "" {
+			detail = reply.Error.Message
+		}
+		return &email.APIError{Provider: "Stripe", StatusCode: resp.StatusCode, Body: detail}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("Stripe: %w", err)
+	}
+	return nil
+}
+
+// signatureTolerance is how old a webhook signature may be, which keeps a
+// captured request from being replayed later.
+const signatureTolerance = 5 * time.Minute
+
+// Event is a webhook event reduced to the fields the renewal needs.
+type Event struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object CheckoutSession `json:"object"`
+	} `json:"data"`
+}
+
+// CheckoutSession is the object of the checkout.session.* events.
+type CheckoutSession struct {
+	ID            string            `json:"id"`
+	PaymentStatus string            `json:"payment_status"`
+	PaymentLink   string            `json:"payment_link"`
+	Metadata      map[string]string `json:"metadata"`
+	AmountTotal   int64             `json:"amount_total"`
+	Currency      string            `json:"currency"`
+}
+
+// ParseEvent checks the Stripe-Signature header against the endpoint's
+// signing secret and decodes the event. The header holds a timestamp t and
+// one or more v1 signatures, each a hex HMAC-SHA256 of "t.payload".
+func ParseEvent(payload []byte, header, secret string, now time.Time) (Event, error) {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return Event{}, errors.New("malformed Stripe-Signature header")
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > signatureTolerance || age < -signatureTolerance {
+		return Event{}, errors.New("Stripe-Signature timestamp is outside the tolerance")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+	valid := false
+	for _, sig := range signatures {
+		if decoded, err := hex.DecodeString(sig); err == nil && hmac.Equal(decoded, expected) {
+			valid = true
+		}
+	}
+	if !valid {
+		return Event{}, errors.New("Stripe-Signature does not match")
+	}
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return Event{}, err
+	}
+	return event, nil
+}
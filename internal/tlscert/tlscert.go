@@ -0,0 +1,190 @@
+// Package tlscert keeps the expiry of subscriptions that track a TLS
+// certificate on the certificate's NotAfter, and flags certificates that
+// don't verify for their host.
+package tlscert
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"xf/internal/calendar"
+	"xf/internal/db"
+	"xf/internal/logging"
+)
+
+const (
+	defaultInterval = 12 * time.Hour
+	dialTimeout     = 15 * time.Second
+)
+
+// Count is what a check run did: certificates read, expiries moved to
+// theirs, certificates read that don't verify, and hosts that couldn't be
+// read.
+type Count struct {
+	Checked, Moved, Flagged, Failed int
+}
+
+// Syncer checks the certificates of subscriptions with a CertHost.
+type Syncer struct {
+	Store    *db.Store
+	Interval time.Duration
+	// Location is the zone of subscriptions whose customer has none.
+	Location *time.Location
+	// Roots verifies certificates; nil uses the system's.
+	Roots *x509.CertPool
+}
+
+// Start checks in the background until ctx is cancelled.
+func (s Syncer) Start(ctx context.Context) {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if count, err := s.Sync(ctx, time.Now()); err != nil {
+				slog.Error("certificate check error", "error", err)
+			} else if count.Moved > 0 || count.Flagged > 0 || count.Failed > 0 {
+				slog.Info("certificates checked", "checked", count.Checked, "moved", count.Moved, "flagged", count.Flagged, "failed", count.Failed)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Sync checks every subscription's certificate and moves its expiry to
+// the certificate's, at the time of day it expires in the customer's
+// zone. A problem is recorded on the subscription and the others go on;
+// an expiry changed here during the check is left alone.
+func (s Syncer) Sync(ctx context.Context, now time.Time) (Count, error) {
+	var count Count
+	subs, err := s.Store.ListSubscriptions()
+	if err != nil {
+		return count, err
+	}
+	for _, sub := range subs {
+		if sub.CertHost == "" {
+			continue
+		}
+		if err := s.Check(ctx, sub, now, &count); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// Check checks one subscription's certificate, adding to count.
+func (s Syncer) Check(ctx context.Context, sub db.SubscriptionDetail, now time.Time, count *Count) error {
+	count.Checked++
+	leaf, problem, err := s.read(ctx, sub.CertHost)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		count.Failed++
+		logging.From(ctx).Warn("certificate check failed", logging.SubscriptionID, sub.ID, "host", sub.CertHost, "error", err)
+		_, err := s.Store.RecordCertCheck(sub.ID, sub.ExpiresAt, "", "", "无法读取证书: "+err.Error(), now)
+		return err
+	}
+	if problem != "" {
+		count.Flagged++
+		logging.From(ctx).Warn("certificate does not verify", logging.SubscriptionID, sub.ID, "host", sub.CertHost, "problem", problem)
+	}
+	expires := leaf.NotAfter.In(s.zone(sub)).Format("2006-01-02 15:04")
+	moved, err := s.Store.RecordCertCheck(sub.ID, sub.ExpiresAt, expires, expires, problem, now)
+	if err != nil {
+		return err
+	}
+	if moved {
+		count.Moved++
+		logging.From(ctx).Info("subscription expiry moved to the certificate's", logging.SubscriptionID, sub.ID, "host", sub.CertHost, "old_expires_at", sub.ExpiresAt, "new_expires_at", expires)
+	}
+	return nil
+}
+
+// read connects to host and returns the certificate it serves, and what
+// keeps it from verifying for the host, if anything.
+func (s Syncer) read(ctx context.Context, host string) (*x509.Certificate, string, error) {
+	addr, name := host, host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	} else {
+		addr = net.JoinHostPort(host, "443")
+	}
+	config := &tls.Config{InsecureSkipVerify: true}
+	if net.ParseIP(name) == nil {
+		config.ServerName = name
+	}
+	dialer := tls.Dialer{NetDialer: &net.Dialer{Timeout: dialTimeout}, Config: config}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Close()
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, "", errors.New("no certificate presented")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = certs[0].Verify(x509.VerifyOptions{DNSName: name, Roots: s.Roots, Intermediates: intermediates})
+	return certs[0], describe(err), nil
+}
+
+// describe explains a verification error for the subscription page.
+func describe(err error) string {
+	var hostErr x509.HostnameError
+	var authErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &hostErr):
+		return fmt.Sprintf("证书与主机名不匹配，证书适用于: %s", strings.Join(certNames(hostErr.Certificate), ", "))
+	case errors.As(err, &authErr):
+		return "证书不受信任（自签名或缺少中间证书）"
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return "证书已过期"
+	default:
+		return "证书验证失败: " + err.Error()
+	}
+}
+
+func certNames(cert *x509.Certificate) []string {
+	names := append([]string(nil), cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 && cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+// zone returns the customer's time zone, or Location if none is set.
+func (s Syncer) zone(sub db.SubscriptionDetail) *time.Location {
+	if sub.CustomerTimeZone != "" {
+		if loc, err := calendar.LoadZone(sub.CustomerTimeZone); err == nil {
+			return loc
+		}
+	}
+	if s.Location != nil {
+		return s.Location
+	}
+	return time.UTC
+}
@@ -0,0 +1,88 @@
+// Package version reports which build the binary is. Release builds set
+// the variables with the linker:
+//
+//	go build -ldflags "-X xf/internal/version.Version=1.4.0 -X xf/internal/version.Commit=$(git rev-parse HEAD) -X xf/internal/version.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd/server
+//
+// Without them the commit, and its time as the date, come from the VCS
+// stamp go build adds when it runs in a git checkout.
+package version
+
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+var (
+	Version = "dev"
+	Commit  = ""
+	Date    = ""
+)
+
+// pseudoVersion matches the timestamp and commit go puts in the module
+// version of an untagged build; the commit is reported on its own.
+var pseudoVersion = regexp.MustCompile(`\d{14}-[0-9a-f]{12}$`)
+
+// Info describes the running build.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build information, filling in what the linker flags
+// left unset from the VCS stamp.
+func Get() Info {
+	info := Info{Version: Version, Commit: Commit, Date: Date, GoVersion: runtime.Version()}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	// A tagged checkout or go install xf/cmd/server@version.
+	main := strings.TrimSuffix(build.Main.Version, "+dirty")
+	if info.Version == "dev" && main != "" && main != "(devel)" && !pseudoVersion.MatchString(main) {
+		info.Version = main
+	}
+	for _, s := range build.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if info.Commit == "" {
+				info.Commit = s.Value
+			}
+		case "vcs.time":
+			if info.Date == "" {
+				info.Date = s.Value
+			}
+		case "vcs.modified":
+			info.Modified = s.Value == "true" && Commit == ""
+		}
+	}
+	return info
+}
+
+// Short is the version with the abbreviated commit, for the page footer.
+func (i Info) Short() string {
+	if i.Commit == "" {
+		return i.Version
+	}
+	commit := i.Commit
+	if len(commit) > 7 {
+		commit = commit[:7]
+	}
+	if i.Modified {
+		commit += "-dirty"
+	}
+	return i.Version + " (" + commit + ")"
+}
+
+func (i Info) String() string {
+	s := i.Short()
+	if i.Date != "" {
+		s += ", built " + i.Date
+	}
+	return fmt.Sprintf("%s, %s", s, i.GoVersion)
+}
@@ -0,0 +1,36 @@
+package web
+
+import (
+	"net/http"
+)
+
+// handleChangePassword serves the change-password page at
+// /account/password for the logged-in user.
+func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	user, _, _ := r.BasicAuth()
+	data := PageData{Title: "修改密码", Username: user}
+	if s.store.MustChangePassword(user) {
+		data.Flash = "当前密码为初始密码或已被重置，请先设置新密码再继续使用面板"
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.render(w, "password.html", data)
+	case http.MethodPost:
+		current, next := r.FormValue("current"), r.FormValue("new")
+		if next != r.FormValue("confirm") {
+			data.Flash = "两次输入的新密码不一致"
+			s.render(w, "password.html", data)
+			return
+		}
+		if err := s.store.ChangePassword(user, current, next); err != nil {
+			data.Flash = err.Error()
+			s.render(w, "password.html", data)
+			return
+		}
+		s.logins.Delete(user)
+		// The browser keeps sending the old password until it asks again.
+		s.renderMessage(w, "密码已修改，请使用新密码重新登录", "/")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
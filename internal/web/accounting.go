@@ -0,0 +1,138 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"xf/internal/accounting"
+	"xf/internal/db"
+)
+
+// accountingMonths is how many months back the settings page offers
+// batches for.
+const accountingMonths = 12
+
+// accountingPage is what the accounting export card shows.
+type accountingPage struct {
+	Export      db.AccountingExport
+	Columns     string
+	Fields      []struct{ Name, Label string }
+	DateFormats []string
+	Months      []accountingMonth
+}
+
+// accountingMonth is a month's batch: how many renewals it has and their
+// sums per currency.
+type accountingMonth struct {
+	Month  string
+	Count  int
+	Totals string
+}
+
+func (s *Server) accountingPage(now time.Time) accountingPage {
+	export, _ := s.store.GetAccountingExport()
+	page := accountingPage{
+		Export:      export,
+		Columns:     export.Columns,
+		Fields:      accounting.Fields,
+		DateFormats: accounting.DateFormats,
+	}
+	if page.Columns == "" {
+		page.Columns = accounting.DefaultColumns
+	}
+	loc := s.conf().TimeZone
+	month := time.Date(now.In(loc).Year(), now.In(loc).Month(), 1, 0, 0, 0, 0, loc)
+	for i := 0; i < accountingMonths; i++ {
+		key := month.AddDate(0, -i, 0).Format("2006-01")
+		entries, err := accounting.Batch(s.store, key, loc)
+		if err != nil {
+			break
+		}
+		sums := map[string]int64{}
+		for _, e := range entries {
+			if e.Amount != "" {
+				sums[e.Currency] += db.PriceCents(e.Amount)
+			}
+		}
+		var totals []string
+		for currency, cents := range sums {
+			totals = append(totals, currency+" "+db.FormatCents(cents, ","))
+		}
+		sort.Strings(totals)
+		page.Months = append(page.Months, accountingMonth{Month: key, Count: len(entries), Totals: strings.Join(totals, "，")})
+	}
+	return page
+}
+
+// handleAccountingSettings saves the column mapping and file format.
+func (s *Server) handleAccountingSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.renderError(w, err)
+		return
+	}
+	export := db.AccountingExport{
+		Columns:    strings.TrimSpace(strings.ReplaceAll(r.FormValue("columns"), "\r\n", "\n")),
+		Delimiter:  r.FormValue("delimiter"),
+		DateFormat: r.FormValue("date_format"),
+		Encoding:   r.FormValue("encoding"),
+	}
+	if _, err := accounting.ParseColumns(export.Columns); err != nil {
+		s.renderMessage(w, "列设置有误："+err.Error(), "/settings")
+		return
+	}
+	switch export.Delimiter {
+	case ",", ";", "tab":
+	default:
+		s.renderMessage(w, "无效的分隔符", "/settings")
+		return
+	}
+	valid := false
+	for _, layout := range accounting.DateFormats {
+		valid = valid || layout == export.DateFormat
+	}
+	if !valid {
+		s.renderMessage(w, "无效的日期格式", "/settings")
+		return
+	}
+	if export.Encoding != "utf-8" {
+		export.Encoding = ""
+	}
+	if err := s.store.UpdateAccountingExport(export); err != nil {
+		s.renderMessage(w, fmt.Sprintf("更新会计导出设置失败: %s", err), "/settings")
+		return
+	}
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
+
+// handleRenewalExport serves GET /exports/renewals?month=2026-10, the
+// month's renewals as CSV for the accounting tool.
+func (s *Server) handleRenewalExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	month := r.URL.Query().Get("month")
+	loc := s.conf().TimeZone
+	entries, err := accounting.Batch(s.store, month, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	export, err := s.store.GetAccountingExport()
+	if err != nil {
+		s.renderError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="renewals-%s.csv"`, month))
+	if err := accounting.Write(w, entries, export, loc); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
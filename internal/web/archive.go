@@ -0,0 +1,38 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+)
+
+// handleArchivedMessage serves the archived copy of a sent message at
+// /deliveries/<reference>.eml: as plain text to view it in the browser, or
+// as a .eml file to open in a mail client with ?download=1.
+func (s *Server) handleArchivedMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reference, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/deliveries/"), ".eml")
+	if !ok || !validReference(reference) {
+		http.NotFound(w, r)
+		return
+	}
+	raw, ok, err := s.store.ReadArchivedMessage(reference)
+	if err != nil {
+		s.renderError(w, err)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Query().Get("download") == "1" {
+		w.Header().Set("Content-Type", "message/rfc822")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+reference+`.eml"`)
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(raw)
+}
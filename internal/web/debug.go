@@ -0,0 +1,71 @@
+package web
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+
+	"xf/internal/db"
+	"xf/internal/version"
+)
+
+// DebugRoutes serves net/http/pprof under /debug/pprof/ and a runtime
+// summary at /debug/state. It has no authentication and is meant for a
+// separate listener bound to localhost.
+func (s *Server) DebugRoutes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/state", s.handleDebugState)
+	return mux
+}
+
+type debugState struct {
+	Build      version.Info `json:"build"`
+	Goroutines int          `json:"goroutines"`
+	Memory     struct {
+		HeapAlloc   uint64 `json:"heap_alloc"`
+		HeapObjects uint64 `json:"heap_objects"`
+		Sys         uint64 `json:"sys"`
+		NumGC       uint32 `json:"num_gc"`
+	} `json:"memory"`
+	Store     db.StoreSize `json:"store"`
+	Scheduler struct {
+		// Leader is whether this process holds the scheduler lock and
+		// runs scheduled scans.
+		Leader      bool        `json:"leader"`
+		Paused      bool        `json:"paused"`
+		PausedAt    string      `json:"paused_at,omitempty"`
+		RunningJobs int         `json:"running_jobs"`
+		LastRun     *db.ScanRun `json:"last_run,omitempty"`
+	} `json:"scheduler"`
+}
+
+func (s *Server) handleDebugState(w http.ResponseWriter, r *http.Request) {
+	var state debugState
+	state.Build = build
+	state.Goroutines = runtime.NumGoroutine()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	state.Memory.HeapAlloc = mem.HeapAlloc
+	state.Memory.HeapObjects = mem.HeapObjects
+	state.Memory.Sys = mem.Sys
+	state.Memory.NumGC = mem.NumGC
+
+	size, err := s.store.Size()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	state.Store = size
+	state.Scheduler.Leader = s.store.HoldsSchedulerLock()
+	state.Scheduler.Paused, state.Scheduler.PausedAt, _ = s.store.SchedulerPaused()
+	state.Scheduler.RunningJobs = s.jobs.running()
+	if runs, _ := s.store.ListScanRuns(1); len(runs) > 0 {
+		state.Scheduler.LastRun = &runs[0]
+	}
+	writeJSON(w, http.StatusOK, state)
+}
@@ -0,0 +1,71 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"xf/internal/domain"
+	"xf/internal/tlscert"
+)
+
+// domainCheckTimeout bounds the lookup made when a domain or certificate
+// host is saved.
+const domainCheckTimeout = 30 * time.Second
+
+// handleSubscriptionDomain sets the domain a subscription's expiry follows
+// and looks it up right away, so a typo shows before the next sync.
+func (s *Server) handleSubscriptionDomain(w http.ResponseWriter, r *http.Request, id int) {
+	back := fmt.Sprintf("/subscriptions/%d", id)
+	if err := s.store.SetSubscriptionDomain(id, r.FormValue("domain")); err != nil {
+		s.renderMessage(w, fmt.Sprintf("设置域名失败: %s", err), back)
+		return
+	}
+	sub, err := s.store.GetSubscription(id)
+	if err != nil {
+		s.renderError(w, err)
+		return
+	}
+	if sub.DomainName() == "" {
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	cfg := s.conf()
+	ctx, cancel := context.WithTimeout(r.Context(), domainCheckTimeout)
+	defer cancel()
+	syncer := domain.Syncer{Store: s.store, Client: domain.Client{BootstrapURL: cfg.RDAPBootstrapURL, WHOISServer: cfg.WHOISServer}}
+	if _, err := syncer.Check(ctx, sub, time.Now()); err != nil {
+		s.renderMessage(w, fmt.Sprintf("域名已保存，但查询失败: %s", err), back)
+		return
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// handleSubscriptionCertHost sets the host whose certificate expiry the
+// subscription follows and reads the certificate right away.
+func (s *Server) handleSubscriptionCertHost(w http.ResponseWriter, r *http.Request, id int) {
+	back := fmt.Sprintf("/subscriptions/%d", id)
+	if err := s.store.SetSubscriptionCertHost(id, r.FormValue("cert_host")); err != nil {
+		s.renderMessage(w, fmt.Sprintf("设置证书主机失败: %s", err), back)
+		return
+	}
+	sub, err := s.store.GetSubscription(id)
+	if err != nil {
+		s.renderError(w, err)
+		return
+	}
+	if sub.CertHost == "" {
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), domainCheckTimeout)
+	defer cancel()
+	var count tlscert.Count
+	syncer := tlscert.Syncer{Store: s.store, Location: s.conf().TimeZone}
+	if err := syncer.Check(ctx, sub, time.Now(), &count); err != nil {
+		s.renderMessage(w, fmt.Sprintf("证书主机已保存，但检查失败: %s", err), back)
+		return
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
@@ -0,0 +1,302 @@
+package web
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"xf/internal/db"
+	"xf/internal/email"
+	"xf/internal/logging"
+)
+
+// maxEventBody bounds a webhook request body.
+const maxEventBody = 5 << 20
+
+// deliveryEvent is a provider event reduced to what the send log keeps.
+type deliveryEvent struct {
+	Reference string
+	Recipient string
+	Event     string
+	Detail    string
+	At        time.Time
+}
+
+// handleEvents receives delivery, bounce and complaint events from the
+// mail APIs at /webhooks/<provider>?token=<WEBHOOK_TOKEN>. The token stands
+// in for admin auth, which the providers can't send; without one set the
+// endpoints are disabled.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	token := s.conf().WebhookToken
+	if token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxEventBody))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	var events []deliveryEvent
+	switch provider := strings.TrimPrefix(r.URL.Path, "/webhooks/"); provider {
+	case "sendgrid":
+		events, err = parseSendGridEvents(body)
+	case "mailgun":
+		events, err = parseMailgunEvent(body)
+	case "ses":
+		events, err = parseSESEvent(r, body)
+	case "postmark":
+		events, err = parsePostmarkEvent(body)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	matched := 0
+	for _, event := range events {
+		if event.At.IsZero() {
+			event.At = time.Now()
+		}
+		ok, err := s.store.RecordDeliveryEvent(event.Reference, event.Recipient, event.Event, event.Detail, event.At)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if ok {
+			matched++
+		} else {
+			slog.Warn("delivery event matches no send", "event", event.Event, logging.CustomerEmail, event.Recipient, "reference", event.Reference)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"received": len(events), "matched": matched})
+}
+
+// parseSendGridEvents reads a SendGrid Event Webhook batch. Custom args are
+// flattened into each event object.
+func parseSendGridEvents(body []byte) ([]deliveryEvent, error) {
+	var batch []map[string]any
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil, err
+	}
+	var events []deliveryEvent
+	for _, raw := range batch {
+		event := deliveryEvent{
+			Reference: stringField(raw, email.ReferenceKey),
+			Recipient: stringField(raw, "email"),
+			Detail:    stringField(raw, "reason"),
+		}
+		if ts, ok := raw["timestamp"].(float64); ok {
+			event.At = time.Unix(int64(ts), 0)
+		}
+		switch stringField(raw, "event") {
+		case "delivered":
+			event.Event = db.EventDelivered
+		case "bounce", "dropped":
+			event.Event = db.EventBounced
+		case "spamreport":
+			event.Event = db.EventComplained
+		default:
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// parseMailgunEvent reads a Mailgun webhook. Temporary failures are left
+// out since Mailgun keeps retrying those itself.
+func parseMailgunEvent(body []byte) ([]deliveryEvent, error) {
+	var payload struct {
+		EventData struct {
+			Event          string            `json:"event"`
+			Severity       string            `json:"severity"`
+			Recipient      string            `json:"recipient"`
+			Timestamp      float64           `json:"timestamp"`
+			UserVariables  map[string]string `json:"user-variables"`
+			DeliveryStatus struct {
+				Message     string `json:"message"`
+				Description string `json:"description"`
+			} `json:"delivery-status"`
+		} `json:"event-data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	data := payload.EventData
+	event := deliveryEvent{
+		Reference: data.UserVariables[email.ReferenceKey],
+		Recipient: data.Recipient,
+		Detail:    strings.TrimSpace(data.DeliveryStatus.Message + " " + data.DeliveryStatus.Description),
+		At:        time.Unix(int64(data.Timestamp), 0),
+	}
+	switch {
+	case data.Event == "delivered":
+		event.Event = db.EventDelivered
+	case data.Event == "failed" && data.Severity == "permanent":
+		event.Event = db.EventBounced
+	case data.Event == "complained":
+		event.Event = db.EventComplained
+	default:
+		return nil, nil
+	}
+	return []deliveryEvent{event}, nil
+}
+
+// parsePostmarkEvent reads a Postmark delivery, bounce or spam complaint
+// webhook.
+func parsePostmarkEvent(body []byte) ([]deliveryEvent, error) {
+	var payload struct {
+		RecordType  string            `json:"RecordType"`
+		Recipient   string            `json:"Recipient"`
+		Email       string            `json:"Email"`
+		Type        string            `json:"Type"`
+		Description string            `json:"Description"`
+		Details     string            `json:"Details"`
+		DeliveredAt time.Time         `json:"DeliveredAt"`
+		BouncedAt   time.Time         `json:"BouncedAt"`
+		Metadata    map[string]string `json:"Metadata"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	event := deliveryEvent{Reference: payload.Metadata[email.ReferenceKey], Recipient: payload.Recipient}
+	switch payload.RecordType {
+	case "Delivery":
+		event.Event, event.Detail, event.At = db.EventDelivered, payload.Details, payload.DeliveredAt
+	case "Bounce":
+		if payload.Type != "HardBounce" && payload.Type != "BadEmailAddress" {
+			return nil, nil
+		}
+		event.Event, event.Recipient, event.At = db.EventBounced, payload.Email, payload.BouncedAt
+		event.Detail = strings.TrimSpace(payload.Description + " " + payload.Details)
+	case "SpamComplaint":
+		event.Event, event.Recipient, event.At = db.EventComplained, payload.Email, payload.BouncedAt
+	default:
+		return nil, nil
+	}
+	return []deliveryEvent{event}, nil
+}
+
+// parseSESEvent reads an SNS message carrying SES configuration set events
+// or identity notifications, confirming the topic subscription on first
+// contact.
+func parseSESEvent(r *http.Request, body []byte) ([]deliveryEvent, error) {
+	var envelope struct {
+		Type         string `json:"Type"`
+		Message      string `json:"Message"`
+		SubscribeURL string `json:"SubscribeURL"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+	if envelope.Type == "SubscriptionConfirmation" {
+		return nil, confirmSNSSubscription(r, envelope.SubscribeURL)
+	}
+	if envelope.Type != "Notification" {
+		return nil, nil
+	}
+	var message struct {
+		EventType        string `json:"eventType"`
+		NotificationType string `json:"notificationType"`
+		Mail             struct {
+			Tags map[string][]string `json:"tags"`
+		} `json:"mail"`
+		Bounce struct {
+			BounceType        string `json:"bounceType"`
+			BouncedRecipients []struct {
+				EmailAddress   string `json:"emailAddress"`
+				DiagnosticCode string `json:"diagnosticCode"`
+			} `json:"bouncedRecipients"`
+			Timestamp time.Time `json:"timestamp"`
+		} `json:"bounce"`
+		Complaint struct {
+			ComplainedRecipients []struct {
+				EmailAddress string `json:"emailAddress"`
+			} `json:"complainedRecipients"`
+			Timestamp time.Time `json:"timestamp"`
+		} `json:"complaint"`
+		Delivery struct {
+			Recipients   []string  `json:"recipients"`
+			SMTPResponse string    `json:"smtpResponse"`
+			Timestamp    time.Time `json:"timestamp"`
+		} `json:"delivery"`
+	}
+	if err := json.Unmarshal([]byte(envelope.Message), &message); err != nil {
+		return nil, err
+	}
+	var reference string
+	if tags := message.Mail.Tags[email.ReferenceKey]; len(tags) > 0 {
+		reference = tags[0]
+	}
+	kind := message.EventType
+	if kind == "" {
+		kind = message.NotificationType
+	}
+	var events []deliveryEvent
+	switch kind {
+	case "Delivery":
+		for _, to := range message.Delivery.Recipients {
+			events = append(events, deliveryEvent{Reference: reference, Recipient: to, Event: db.EventDelivered,
+				Detail: message.Delivery.SMTPResponse, At: message.Delivery.Timestamp})
+		}
+	case "Bounce":
+		if message.Bounce.BounceType != "Permanent" {
+			return nil, nil
+		}
+		for _, to := range message.Bounce.BouncedRecipients {
+			events = append(events, deliveryEvent{Reference: reference, Recipient: to.EmailAddress, Event: db.EventBounced,
+				Detail: to.DiagnosticCode, At: message.Bounce.Timestamp})
+		}
+	case "Complaint":
+		for _, to := range message.Complaint.ComplainedRecipients {
+			events = append(events, deliveryEvent{Reference: reference, Recipient: to.EmailAddress, Event: db.EventComplained,
+				At: message.Complaint.Timestamp})
+		}
+	}
+	return events, nil
+}
+
+// confirmSNSSubscription visits the SubscribeURL SNS sends when the topic
+// subscription is created, after checking it points at AWS.
+func confirmSNSSubscription(r *http.Request, subscribeURL string) error {
+	target, err := url.Parse(subscribeURL)
+	if err != nil || target.Scheme != "https" || !strings.HasSuffix(target.Hostname(), ".amazonaws.com") {
+		return fmt.Errorf("unexpected SubscribeURL %q", subscribeURL)
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("SNS subscription confirmation returned %d", resp.StatusCode)
+	}
+	slog.Info("confirmed SNS subscription for SES events")
+	return nil
+}
+
+func stringField(m map[string]any, key string) string {
+	value, _ := m[key].(string)
+	return value
+}
@@ -0,0 +1,114 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"xf/internal/db"
+)
+
+const (
+	defaultFeedLimit = 100
+	maxFeedLimit     = 500
+)
+
+// feedEvent is a feed event as the API returns it, flattened with the
+// subscription's current details so no-code tools can map its fields
+// directly. They are empty if the subscription has since been deleted.
+type feedEvent struct {
+	db.FeedEvent
+	CustomerID      int    `json:"customer_id,omitempty"`
+	CustomerName    string `json:"customer_name,omitempty"`
+	CustomerEmail   string `json:"customer_email,omitempty"`
+	ProductID       int    `json:"product_id,omitempty"`
+	ProductName     string `json:"product_name,omitempty"`
+	Kind            string `json:"kind,omitempty"`
+	Note            string `json:"note,omitempty"`
+	SubscriptionURL string `json:"subscription_url,omitempty"`
+}
+
+// handleAPIEvents serves GET /api/v1/events, the event feed for polling
+// triggers such as Zapier's and n8n's. With since=<id> it returns the
+// events after that cursor, oldest first, and next_since to pass on the
+// next poll; without it, the latest events newest first, which is what
+// tools that deduplicate by id expect. type=a,b filters by event type and
+// limit caps the page (default 100, at most 500).
+func (s *Server) handleAPIEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	since := -1
+	if value := query.Get("since"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("since 必须为非负整数"))
+			return
+		}
+		since = n
+	}
+	limit := defaultFeedLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxFeedLimit {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("limit 必须为 1 到 %d 之间的整数", maxFeedLimit))
+			return
+		}
+		limit = n
+	}
+	var types []string
+	for _, t := range strings.Split(query.Get("type"), ",") {
+		switch t = strings.TrimSpace(t); t {
+		case "":
+		case db.FeedCreated, db.FeedRenewed, db.FeedExpiring:
+			types = append(types, t)
+		default:
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("未知事件类型: %s", t))
+			return
+		}
+	}
+	events, err := s.store.ListFeedEvents(since, limit, types)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	subs, err := s.store.ListSubscriptions()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	byID := map[int]db.SubscriptionDetail{}
+	for _, sub := range subs {
+		byID[sub.ID] = sub
+	}
+	publicURL := strings.TrimRight(s.conf().PublicURL, "/")
+	out := make([]feedEvent, 0, len(events))
+	for _, event := range events {
+		item := feedEvent{FeedEvent: event}
+		if sub, ok := byID[event.SubscriptionID]; ok {
+			item.CustomerID, item.CustomerName, item.CustomerEmail = sub.CustomerID, sub.CustomerName, sub.CustomerEmail
+			item.ProductID, item.ProductName = sub.ProductID, sub.ProductName
+			item.Kind, item.Note = sub.Kind, sub.Note
+			if publicURL != "" {
+				item.SubscriptionURL = fmt.Sprintf("%s/subscriptions/%d", publicURL, sub.ID)
+			}
+		}
+		out = append(out, item)
+	}
+	next := since
+	if len(events) > 0 {
+		next = events[len(events)-1].ID
+	}
+	if since < 0 {
+		for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+			out[i], out[j] = out[j], out[i]
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"events":     out,
+		"next_since": max(next, 0),
+	})
+}
@@ -0,0 +1,248 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"xf/internal/db"
+)
+
+// Metrics served to the Grafana JSON datasource.
+const (
+	metricSends        = "sends"
+	metricSendFailures = "send_failures"
+	metricRenewals     = "renewals"
+	metricUpcoming     = "upcoming_expirations"
+)
+
+const (
+	// maxGrafanaPoints bounds a time series when Grafana doesn't say how
+	// many points it wants.
+	maxGrafanaPoints = 2000
+	// defaultUpcomingDays is how far ahead the expirations table looks
+	// unless the query's payload sets days.
+	defaultUpcomingDays = 30
+)
+
+var grafanaMetrics = []string{metricSends, metricSendFailures, metricRenewals, metricUpcoming}
+
+// grafanaQuery is the body of a /query request from the datasource.
+type grafanaQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	IntervalMs    int64 `json:"intervalMs"`
+	MaxDataPoints int   `json:"maxDataPoints"`
+	Targets       []struct {
+		Target  string          `json:"target"`
+		Hide    bool            `json:"hide"`
+		Payload json.RawMessage `json:"payload"`
+	} `json:"targets"`
+}
+
+type grafanaSeries struct {
+	Target     string     `json:"target"`
+	Datapoints [][2]int64 `json:"datapoints"`
+}
+
+type grafanaTable struct {
+	Type    string          `json:"type"`
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]any         `json:"rows"`
+}
+
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+// handleGrafana serves the API of the Grafana JSON datasource plugin under
+// /api/grafana: the connection test at /, the metric list at /search and
+// /metrics, and /query, which returns sends, failed sends and renewals as
+// time series over the dashboard's range, and the subscriptions expiring in
+// the next 30 days (or payload {"days": N}) as a table.
+func (s *Server) handleGrafana(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, "/api/grafana") {
+	case "", "/":
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	case "/search":
+		writeJSON(w, http.StatusOK, grafanaMetrics)
+	case "/metrics":
+		out := make([]map[string]string, 0, len(grafanaMetrics))
+		for _, metric := range grafanaMetrics {
+			out = append(out, map[string]string{"label": metric, "value": metric})
+		}
+		writeJSON(w, http.StatusOK, out)
+	case "/query":
+		s.handleGrafanaQuery(w, r)
+	default:
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("not found"))
+	}
+}
+
+func (s *Server) handleGrafanaQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var query grafanaQuery
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&query); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	from, to := query.Range.From, query.Range.To
+	if from.IsZero() || !to.After(from) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("时间范围无效"))
+		return
+	}
+	out := []any{}
+	for _, target := range query.Targets {
+		if target.Hide || target.Target == "" {
+			continue
+		}
+		var result any
+		var err error
+		switch target.Target {
+		case metricSends, metricSendFailures:
+			result, err = s.grafanaSends(target.Target, from, to, query.IntervalMs, query.MaxDataPoints)
+		case metricRenewals:
+			result, err = s.grafanaRenewals(from, to, query.IntervalMs, query.MaxDataPoints)
+		case metricUpcoming:
+			var payload struct {
+				Days int `json:"days"`
+			}
+			// Older plugin versions send the payload as a string; only an
+			// object carries options.
+			_ = json.Unmarshal(target.Payload, &payload)
+			result, err = s.grafanaUpcoming(payload.Days, time.Now())
+		default:
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("未知指标: %s", target.Target))
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		out = append(out, result)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// grafanaSends counts the sends on every channel, or the failed ones, in
+// each interval of the range. A bounced email counts as sent.
+func (s *Server) grafanaSends(target string, from, to time.Time, intervalMs int64, maxPoints int) (grafanaSeries, error) {
+	deliveries, err := s.store.ListDeliveriesBetween(from, to)
+	if err != nil {
+		return grafanaSeries{}, err
+	}
+	var times []time.Time
+	for _, d := range deliveries {
+		if (d.Status == db.DeliveryFailed) != (target == metricSendFailures) {
+			continue
+		}
+		if at, err := time.Parse(time.RFC3339, d.At); err == nil {
+			times = append(times, at)
+		}
+	}
+	return grafanaBuckets(target, times, from, to, intervalMs, maxPoints), nil
+}
+
+// grafanaRenewals counts the renewals in each interval of the range: any
+// expiry moved later, by hand, by auto-renew or by a payment.
+func (s *Server) grafanaRenewals(from, to time.Time, intervalMs int64, maxPoints int) (grafanaSeries, error) {
+	events, err := s.store.ListFeedEventsBetween(db.FeedRenewed, from, to)
+	if err != nil {
+		return grafanaSeries{}, err
+	}
+	var times []time.Time
+	for _, e := range events {
+		if at, err := time.Parse(time.RFC3339, e.At); err == nil {
+			times = append(times, at)
+		}
+	}
+	return grafanaBuckets(metricRenewals, times, from, to, intervalMs, maxPoints), nil
+}
+
+// grafanaUpcoming lists the subscriptions expiring within days, soonest
+// first.
+func (s *Server) grafanaUpcoming(days int, now time.Time) (grafanaTable, error) {
+	if days <= 0 {
+		days = defaultUpcomingDays
+	}
+	subs, err := s.store.ListSubscriptions()
+	if err != nil {
+		return grafanaTable{}, err
+	}
+	type row struct {
+		sub      db.SubscriptionDetail
+		daysLeft int
+	}
+	var rows []row
+	service := s.service()
+	for _, sub := range subs {
+		daysLeft, err := service.DaysLeft(sub, now)
+		if err != nil || daysLeft < 0 || daysLeft > days {
+			continue
+		}
+		rows = append(rows, row{sub, daysLeft})
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].daysLeft != rows[j].daysLeft {
+			return rows[i].daysLeft < rows[j].daysLeft
+		}
+		return rows[i].sub.ExpiresAt < rows[j].sub.ExpiresAt
+	})
+	table := grafanaTable{
+		Type: "table",
+		Columns: []grafanaColumn{
+			{Text: "订阅", Type: "number"},
+			{Text: "客户", Type: "string"},
+			{Text: "邮箱", Type: "string"},
+			{Text: "产品", Type: "string"},
+			{Text: "到期", Type: "string"},
+			{Text: "剩余天数", Type: "number"},
+			{Text: "类型", Type: "string"},
+		},
+		Rows: [][]any{},
+	}
+	for _, r := range rows {
+		kind := "付费"
+		if r.sub.Kind == db.KindTrial {
+			kind = "试用"
+		}
+		table.Rows = append(table.Rows, []any{r.sub.ID, r.sub.CustomerName, r.sub.CustomerEmail, r.sub.ProductName, r.sub.ExpiresAt, r.daysLeft, kind})
+	}
+	return table, nil
+}
+
+// grafanaBuckets counts times into intervals of the range, at least a
+// minute long and no more than Grafana asked for, including the empty ones
+// so the graph drops to zero.
+func grafanaBuckets(target string, times []time.Time, from, to time.Time, intervalMs int64, maxPoints int) grafanaSeries {
+	if maxPoints <= 0 || maxPoints > maxGrafanaPoints {
+		maxPoints = maxGrafanaPoints
+	}
+	step := max(time.Duration(intervalMs)*time.Millisecond, time.Minute)
+	if span := to.Sub(from); span/step >= time.Duration(maxPoints) {
+		step = (span/time.Duration(maxPoints) + time.Minute).Truncate(time.Minute)
+	}
+	start := from.Truncate(step)
+	n := int(to.Sub(start)/step) + 1
+	counts := make([]int64, n)
+	for _, at := range times {
+		if i := int(at.Sub(start) / step); i >= 0 && i < n {
+			counts[i]++
+		}
+	}
+	series := grafanaSeries{Target: target, Datapoints: make([][2]int64, n)}
+	for i, count := range counts {
+		series.Datapoints[i] = [2]int64{count, start.Add(time.Duration(i) * step).UnixMilli()}
+	}
+	return series
+}
@@ -0,0 +1,129 @@
+package web
+
+import (
+	"sync"
+	"time"
+
+	"xf/internal/db"
+	"xf/internal/logging"
+	"xf/internal/reminder"
+)
+
+const (
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// maxScanJobs bounds how many finished jobs are kept for status lookups.
+const maxScanJobs = 50
+
+// ScanJob is a manual scan running in the background. Jobs live in memory
+// only; the persisted scan history covers finished runs.
+type ScanJob struct {
+	ID         int             `json:"id"`
+	Mode       string          `json:"mode"`
+	Threshold  int             `json:"threshold"`
+	DryRun     bool            `json:"dry_run"`
+	Status     string          `json:"status"`
+	Error      string          `json:"error,omitempty"`
+	StartedAt  string          `json:"started_at"`
+	FinishedAt string          `json:"finished_at,omitempty"`
+	Result     reminder.Result `json:"result"`
+}
+
+// Running reports whether the job has not finished yet.
+func (j ScanJob) Running() bool {
+	return j.Status == jobRunning
+}
+
+type scanJobs struct {
+	mu   sync.Mutex
+	next int
+	jobs []*ScanJob
+}
+
+func (q *scanJobs) add(job ScanJob) *ScanJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.next++
+	job.ID = q.next
+	stored := &job
+	q.jobs = append(q.jobs, stored)
+	if len(q.jobs) > maxScanJobs {
+		q.jobs = append([]*ScanJob(nil), q.jobs[len(q.jobs)-maxScanJobs:]...)
+	}
+	return stored
+}
+
+// running counts the jobs that have not finished.
+func (q *scanJobs) running() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, job := range q.jobs {
+		if job.Running() {
+			n++
+		}
+	}
+	return n
+}
+
+func (q *scanJobs) get(id int) (ScanJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, job := range q.jobs {
+		if job.ID == id {
+			return *job, true
+		}
+	}
+	return ScanJob{}, false
+}
+
+func (q *scanJobs) finish(job *ScanJob, res reminder.Result, err error, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job.Result = res
+	job.FinishedAt = now.Format(time.RFC3339)
+	job.Status = jobDone
+	if err != nil {
+		job.Status = jobFailed
+		job.Error = err.Error()
+	}
+}
+
+// startScan registers a scan job and runs it in the background. The job is
+// bound to the server's context, not the request, so it keeps going after
+// the response is sent and stops on shutdown.
+func (s *Server) startScan(mode string, threshold int, dryRun bool) ScanJob {
+	started := time.Now()
+	job := s.jobs.add(ScanJob{
+		Mode:      mode,
+		Threshold: threshold,
+		DryRun:    dryRun,
+		Status:    jobRunning,
+		StartedAt: started.Format(time.RFC3339),
+	})
+	snapshot := *job
+	go func() {
+		service := s.service()
+		ctx, runID := s.ctx, 0
+		if !dryRun {
+			ctx, runID = service.StartRun(s.ctx)
+		}
+		var res reminder.Result
+		var err error
+		if mode == "scheduled" {
+			res, err = service.ScanAndSend(ctx, started, dryRun)
+		} else {
+			res, err = service.SendNow(ctx, threshold, started, dryRun)
+		}
+		if !dryRun {
+			if err := service.RecordRun(runID, db.TriggerManual, started, time.Now(), res, err); err != nil {
+				logging.From(ctx).Error("scan history error", "error", err)
+			}
+		}
+		s.jobs.finish(job, res, err, time.Now())
+	}()
+	return snapshot
+}
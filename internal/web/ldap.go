@@ -0,0 +1,40 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"xf/internal/ldap"
+)
+
+// handleLDAPSync imports the directory contacts right away instead of
+// waiting for the scheduled import.
+func (s *Server) handleLDAPSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := s.conf()
+	syncer := ldap.Syncer{
+		Store:  s.store,
+		Client: ldap.Client{URL: cfg.LDAPURL, BindDN: cfg.LDAPBindDN, Password: cfg.LDAPBindPass, StartTLS: cfg.LDAPStartTLS},
+		BaseDN: cfg.LDAPBaseDN,
+		Filter: cfg.LDAPFilter,
+		OUTags: ldap.ParseOUTags(cfg.LDAPOUTags),
+	}
+	if !syncer.Client.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+	count, err := syncer.Sync(r.Context(), time.Now())
+	if err != nil {
+		s.renderMessage(w, fmt.Sprintf("LDAP 导入失败: %s", err), "/customers")
+		return
+	}
+	message := fmt.Sprintf("LDAP 导入完成：新增客户 %d 个、更新 %d 个。", count.Added, count.Updated)
+	if count.Skipped > 0 {
+		message += fmt.Sprintf("另有 %d 个条目的邮箱与已有客户重复，未导入。", count.Skipped)
+	}
+	s.renderMessage(w, message, "/customers")
+}
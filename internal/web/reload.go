@@ -0,0 +1,95 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+
+	"xf/internal/config"
+	"xf/internal/db"
+	"xf/internal/reminder"
+	"xf/internal/stripe"
+)
+
+// NewReminderService builds the reminder service for cfg, as used by both
+// the panel and the scheduler. Hooks are not set.
+func NewReminderService(cfg config.Config, store *db.Store) reminder.Service {
+	return reminder.Service{
+		Store:      store,
+		Company:    cfg.CompanyName,
+		Location:   cfg.TimeZone,
+		Render:     TemplateRenderer{},
+		PublicURL:  cfg.PublicURL,
+		From:       cfg.SMTPFrom,
+		Telegram:   cfg.TelegramBotToken != "",
+		AdminChats: reminder.AdminChats(cfg),
+		Slack:      cfg.SlackWebhookURL != "",
+		DingTalk:   cfg.DingTalkWebhookURL != "",
+		Feishu:     cfg.FeishuWebhookURL != "",
+		SMS:        cfg.SMSProvider != "",
+		MatrixRoom: cfg.MatrixRoomID,
+		Push:       cfg.PushProvider != "",
+		Stripe:     stripe.Client{SecretKey: cfg.StripeSecretKey, APIURL: cfg.StripeAPIURL},
+	}
+}
+
+// conf returns the current configuration.
+func (s *Server) conf() config.Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg
+}
+
+// service returns the reminder service for the current configuration.
+func (s *Server) service() reminder.Service {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.reminder
+}
+
+// UpdateConfig switches the server to a reloaded configuration. Requests
+// in progress finish with the one they started with. The reminder hooks
+// carry over.
+func (s *Server) UpdateConfig(cfg config.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg
+	hooks := s.reminder.Hooks
+	s.reminder = NewReminderService(cfg, s.store)
+	s.reminder.Hooks = hooks
+}
+
+// handleAPIReload serves POST /api/v1/config/reload, re-reading the
+// environment and config file as SIGHUP does.
+func (s *Server) handleAPIReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Reload == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("不支持重新加载配置"))
+		return
+	}
+	if err := s.Reload(); err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"reloaded": true})
+}
+
+func (s *Server) handleReloadForm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Reload == nil {
+		s.renderMessage(w, "不支持重新加载配置", "/settings")
+		return
+	}
+	err := s.Reload()
+	data := s.settingsData()
+	data.Flash = "配置已重新加载"
+	if err != nil {
+		data.Flash = fmt.Sprintf("重新加载配置失败，继续使用原配置：%s", err)
+	}
+	s.render(w, "settings.html", data)
+}
@@ -0,0 +1,300 @@
+package web
+
+import (
+	"strings"
+)
+
+// allowedTags are the elements kept in saved email templates: the usual
+// email layout and formatting markup. Any other tag is dropped while its
+// content is kept.
+var allowedTags = map[string]bool{
+	"html": true, "head": true, "body": true, "meta": true, "title": true, "style": true,
+	"div": true, "span": true, "p": true, "br": true, "hr": true, "center": true, "font": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"b": true, "strong": true, "i": true, "em": true, "u": true, "s": true, "small": true, "sup": true, "sub": true,
+	"a": true, "img": true, "blockquote": true, "pre": true, "code": true,
+	"ul": true, "ol": true, "li": true, "dl": true, "dt": true, "dd": true,
+	"table": true, "thead": true, "tbody": true, "tfoot": true, "tr": true, "td": true, "th": true,
+	"caption": true, "colgroup": true, "col": true,
+}
+
+// droppedWithContent are elements removed together with everything up to
+// their closing tag, since their content is code or embedded documents.
+var droppedWithContent = map[string]bool{
+	"script": true, "iframe": true, "object": true, "embed": true, "applet": true,
+	"noscript": true, "svg": true, "math": true, "frameset": true, "template": true,
+}
+
+// allowedAttrs are the attributes kept on allowed elements; event handlers
+// and anything else not listed are dropped.
+var allowedAttrs = map[string]bool{
+	"href": true, "src": true, "alt": true, "title": true, "name": true, "target": true, "rel": true,
+	"width": true, "height": true, "style": true, "class": true, "id": true, "dir": true, "lang": true,
+	"align": true, "valign": true, "bgcolor": true, "background": true, "color": true, "face": true, "size": true,
+	"border": true, "cellpadding": true, "cellspacing": true, "colspan": true, "rowspan": true,
+	"charset": true, "content": true, "type": true, "media": true,
+}
+
+// urlAttrs hold URLs and are checked for script schemes.
+var urlAttrs = map[string]bool{"href": true, "src": true, "background": true}
+
+// htmlToken is a template action or an attribute inside a start tag. Raw
+// is the source text, written back unchanged when the token is kept.
+type htmlToken struct {
+	raw   string
+	name  string
+	value string
+}
+
+// sanitizeHTML applies the template allow-list to src and returns the
+// cleaned HTML with a description of each kind of content removed. Template
+// actions are copied through untouched; html/template escapes the values
+// they produce when the email is rendered.
+func sanitizeHTML(src string) (string, []string) {
+	var out strings.Builder
+	var removed []string
+	note := func(what string) {
+		for _, r := range removed {
+			if r == what {
+				return
+			}
+		}
+		removed = append(removed, what)
+	}
+	i := 0
+	for i < len(src) {
+		switch {
+		case strings.HasPrefix(src[i:], "{{"):
+			end := actionEnd(src, i)
+			out.WriteString(src[i:end])
+			i = end
+		case strings.HasPrefix(src[i:], "<!--"):
+			end := strings.Index(src[i+4:], "-->")
+			if end == -1 {
+				end = len(src)
+			} else {
+				end += i + 4 + 3
+			}
+			out.WriteString(src[i:end])
+			i = end
+		case src[i] == '<' && i+1 < len(src) && (isTagNameByte(src[i+1]) || src[i+1] == '/'):
+			name, closing, tokens, selfClose, end, ok := parseTag(src, i)
+			if !ok {
+				out.WriteString("&lt;")
+				i++
+				continue
+			}
+			i = end
+			if droppedWithContent[name] {
+				note("<" + name + "> 标签")
+				if !closing && !selfClose {
+					i = skipElement(src, i, name)
+				}
+				continue
+			}
+			if !allowedTags[name] {
+				note("<" + name + "> 标签")
+				continue
+			}
+			if name == "style" && !closing {
+				close := indexFold(src[i:], "</style")
+				body := src[i:]
+				if close != -1 {
+					body = src[i : i+close]
+				}
+				if unsafeCSS(body) {
+					note("<style> 中的脚本")
+					i = skipElement(src, i, name)
+					continue
+				}
+			}
+			out.WriteByte('<')
+			if closing {
+				out.WriteByte('/')
+			}
+			out.WriteString(name)
+			for _, tok := range tokens {
+				if strings.HasPrefix(tok.raw, "{{") {
+					out.WriteString(" " + tok.raw)
+					continue
+				}
+				if reason := unsafeAttr(name, tok); reason != "" {
+					note(reason)
+					continue
+				}
+				out.WriteString(" " + tok.raw)
+			}
+			if selfClose {
+				out.WriteString(" /")
+			}
+			out.WriteByte('>')
+		default:
+			out.WriteByte(src[i])
+			i++
+		}
+	}
+	return out.String(), removed
+}
+
+// unsafeAttr returns why an attribute on the named element must go, or ""
+// to keep it.
+func unsafeAttr(element string, tok htmlToken) string {
+	switch {
+	case strings.HasPrefix(tok.name, "on"):
+		return tok.name + " 事件属性"
+	case !allowedAttrs[tok.name]:
+		return tok.name + " 属性"
+	case urlAttrs[tok.name] && unsafeURL(element, tok.value):
+		return "脚本链接"
+	case tok.name == "style" && unsafeCSS(tok.value):
+		return "style 中的脚本"
+	}
+	return ""
+}
+
+// unsafeURL reports whether a literal URL uses a scheme that can run
+// script. Images may use data: URLs.
+func unsafeURL(element, value string) bool {
+	v := strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, value))
+	switch {
+	case strings.HasPrefix(v, "javascript:"), strings.HasPrefix(v, "vbscript:"):
+		return true
+	case strings.HasPrefix(v, "data:"):
+		return element != "img" || !strings.HasPrefix(v, "data:image/")
+	}
+	return false
+}
+
+func unsafeCSS(value string) bool {
+	v := strings.ToLower(strings.Join(strings.Fields(value), ""))
+	return strings.Contains(v, "expression(") || strings.Contains(v, "javascript:") ||
+		strings.Contains(v, "behavior:") || strings.Contains(v, "-moz-binding")
+}
+
+// parseTag reads the tag starting at src[start] == '<'. It returns the
+// lower-cased name, whether it is an end tag, the attribute tokens,
+// whether it ends in "/>", and the index after '>'.
+func parseTag(src string, start int) (name string, closing bool, tokens []htmlToken, selfClose bool, end int, ok bool) {
+	i := start + 1
+	if src[i] == '/' {
+		closing = true
+		i++
+	}
+	nameStart := i
+	if i < len(src) && !isTagNameByte(src[i]) {
+		return "", false, nil, false, 0, false
+	}
+	for i < len(src) && (isTagNameByte(src[i]) || src[i] >= '0' && src[i] <= '9' || src[i] == '-' || src[i] == ':') {
+		i++
+	}
+	if i == nameStart {
+		return "", false, nil, false, 0, false
+	}
+	name = strings.ToLower(src[nameStart:i])
+	for i < len(src) {
+		switch c := src[i]; {
+		case c == '>':
+			return name, closing, tokens, selfClose, i + 1, true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+		case c == '/':
+			selfClose = true
+			i++
+		case strings.HasPrefix(src[i:], "{{"):
+			end := actionEnd(src, i)
+			tokens = append(tokens, htmlToken{raw: src[i:end]})
+			i = end
+		default:
+			selfClose = false
+			tok, next := parseAttr(src, i)
+			tokens = append(tokens, tok)
+			i = next
+		}
+	}
+	return "", false, nil, false, 0, false
+}
+
+// parseAttr reads one name[=value] attribute starting at src[i].
+func parseAttr(src string, i int) (htmlToken, int) {
+	start := i
+	for i < len(src) && !strings.ContainsRune(" \t\n\r\f/>=", rune(src[i])) && !strings.HasPrefix(src[i:], "{{") {
+		i++
+	}
+	tok := htmlToken{name: strings.ToLower(src[start:i])}
+	j := i
+	for j < len(src) && (src[j] == ' ' || src[j] == '\t' || src[j] == '\n' || src[j] == '\r') {
+		j++
+	}
+	if j >= len(src) || src[j] != '=' {
+		tok.raw = src[start:i]
+		return tok, i
+	}
+	j++
+	for j < len(src) && (src[j] == ' ' || src[j] == '\t' || src[j] == '\n' || src[j] == '\r') {
+		j++
+	}
+	valueStart := j
+	if j < len(src) && (src[j] == '"' || src[j] == '\'') {
+		quote := src[j]
+		j++
+		for j < len(src) && src[j] != quote {
+			if strings.HasPrefix(src[j:], "{{") {
+				j = actionEnd(src, j)
+				continue
+			}
+			j++
+		}
+		tok.value = src[valueStart+1 : min(j, len(src))]
+		if j < len(src) {
+			j++
+		}
+	} else {
+		for j < len(src) && !strings.ContainsRune(" \t\n\r\f>", rune(src[j])) {
+			if strings.HasPrefix(src[j:], "{{") {
+				j = actionEnd(src, j)
+				continue
+			}
+			j++
+		}
+		tok.value = src[valueStart:j]
+	}
+	tok.raw = src[start:j]
+	return tok, j
+}
+
+// skipElement returns the index after the end tag of the element whose
+// start tag ended at i, or len(src) when it is never closed.
+func skipElement(src string, i int, name string) int {
+	close := indexFold(src[i:], "</"+name)
+	if close == -1 {
+		return len(src)
+	}
+	end := strings.IndexByte(src[i+close:], '>')
+	if end == -1 {
+		return len(src)
+	}
+	return i + close + end + 1
+}
+
+// actionEnd returns the index after the "}}" closing the template action
+// at src[i].
+func actionEnd(src string, i int) int {
+	end := strings.Index(src[i+2:], "}}")
+	if end == -1 {
+		return len(src)
+	}
+	return i + 2 + end + 2
+}
+
+func indexFold(s, substr string) int {
+	return strings.Index(strings.ToLower(s), substr)
+}
+
+func isTagNameByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
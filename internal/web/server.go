@@ -1,77 +1,153 @@
 package web
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"log/slog"
+	"mime"
 	"net/http"
+	"net/mail"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	texttemplate "text/template"
 	"time"
+	"unicode"
 
+	"xf/internal/calendar"
 	"xf/internal/config"
 	"xf/internal/db"
 	"xf/internal/email"
+	"xf/internal/notify"
 	"xf/internal/reminder"
 )
 
 var assetsFS embed.FS
 
+// maxAttachmentSize bounds a single uploaded attachment.
+const maxAttachmentSize = 10 << 20
+
 type Server struct {
+	// Reload reloads the configuration for the reload endpoint and settings
+	// button; nil disables them.
+	Reload func() error
+
+	ctx    context.Context
+	store  *db.Store
+	mailer email.Sender
+	jobs   *scanJobs
+	// logins caches, by user name, a digest of the stored hash and the
+	// password that last passed checkLogin, since every request is
+	// authenticated and password hashes are slow.
+	logins sync.Map
+
+	mu       sync.RWMutex
 	cfg      config.Config
-	store    *db.Store
-	mailer   email.Mailer
 	reminder reminder.Service
 }
 
 type PageData struct {
-	Title           string
-	Company         string
-	Flash           string
-	Stats           struct{ Customers, Products, Subscriptions int }
-	Rules           []int
-	RulesInput      string
-	ScanThreshold   int
-	Customers       []db.Customer
-	Products        []db.Product
-	Subscriptions   []db.SubscriptionDetail
-	Customer        db.Customer
-	Product         db.Product
-	Subscription    db.SubscriptionDetail
-	Template        db.Template
-	RenewalTemplate db.Template
+	Title            string
+	Company          string
+	Flash            string
+	Username         string
+	Version          string
+	Refresh          int
+	Stats            struct{ Customers, Products, Subscriptions int }
+	Rules            []int
+	RulesInput       string
+	HighRulesInput   string
+	HourRulesInput   string
+	TrialRulesInput  string
+	SMSRulesInput    string
+	GraceDays        int
+	ScanThreshold    int
+	Customers        []db.Customer
+	Products         []db.Product
+	Subscriptions    []db.SubscriptionDetail
+	Customer         db.Customer
+	Product          db.Product
+	Subscription     db.SubscriptionDetail
+	Template         db.Template
+	RenewalTemplate  db.Template
+	TrialTemplate    db.Template
+	CombinedTemplate db.Template
+	NamedTemplates   []db.NamedTemplate
+	Attachments      []db.Attachment
+	ScanResult       reminder.Result
+	Job              ScanJob
+	ScanRuns         []db.ScanRun
+	Renewals         []db.Renewal
+	Deliveries       []db.Delivery
+	Replies          []db.RenewalReply
+	PendingReplies   []db.ReplyListItem
+	ReplyRenewTo     string
+	IdempotencyKey   string
+	Paused           bool
+	PausedAt         string
+	SendWindow       db.SendWindow
+	BusinessDays     db.BusinessDays
+	Escalation       db.Escalation
+	Quote            db.QuoteSettings
+	Accounting       accountingPage
+	Forecast         db.Forecast
+	SlackTemplate    db.SlackTemplate
+	SlackEnabled     bool
+	SMSTemplate      db.SMSTemplate
+	SMSProvider      string
+	StripeEnabled    bool
+	WHMCSEnabled     bool
+	LDAPEnabled      bool
+	Tag              string
+	SMTPProfiles     []string
+	ReminderRoles    map[string]bool
 }
 
 type TemplateRenderer struct{}
 
-func (TemplateRenderer) RenderTemplate(tpl db.Template, data any) (string, string, error) {
+// RenderTemplate renders the subject, HTML body and, when the template has
+// one, the plain-text body. The text body is not HTML-escaped.
+func (TemplateRenderer) RenderTemplate(tpl db.Template, data any) (string, string, string, error) {
 	subject, err := renderText(tpl.Subject, data)
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
 	htmlBody, err := renderHTML(tpl.HTML, data)
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
+	}
+	var textBody string
+	if strings.TrimSpace(tpl.Text) != "" {
+		if textBody, err = renderPlain(tpl.Text, data); err != nil {
+			return "", "", "", err
+		}
 	}
-	return subject, htmlBody, nil
+	return subject, htmlBody, textBody, nil
 }
 
-func NewServer(cfg config.Config, store *db.Store, mailer email.Mailer) (*Server, error) {
-	renderer := TemplateRenderer{}
-	reminderService := reminder.Service{
-		Store:    store,
-		Mailer:   mailer,
-		Company:  cfg.CompanyName,
-		Location: cfg.TimeZone,
-		Render:   renderer,
-	}
+// NewServer builds the web server. Background work started from requests,
+// such as manual scans, runs until ctx is cancelled. The hooks are called
+// around the reminders those scans queue and are kept across reloads.
+func NewServer(ctx context.Context, cfg config.Config, store *db.Store, mailer email.Sender, hooks []reminder.Hook) (*Server, error) {
+	service := NewReminderService(cfg, store)
+	service.Hooks = hooks
 	return &Server{
+		ctx:      ctx,
 		cfg:      cfg,
 		store:    store,
 		mailer:   mailer,
-		reminder: reminderService,
+		reminder: service,
+		jobs:     &scanJobs{},
 	}, nil
 }
 
@@ -80,28 +156,109 @@ func (s *Server) Routes() http.Handler {
 	mux.HandleFunc("/", s.auth(s.handleDashboard))
 	mux.HandleFunc("/customers", s.auth(s.handleCustomers))
 	mux.HandleFunc("/customers/", s.auth(s.handleCustomerDetail))
+	mux.HandleFunc("/customers/ldap-sync", s.auth(s.handleLDAPSync))
 	mux.HandleFunc("/products", s.auth(s.handleProducts))
 	mux.HandleFunc("/products/", s.auth(s.handleProductDetail))
+	mux.HandleFunc("/products/whmcs-sync", s.auth(s.handleWHMCSSync))
 	mux.HandleFunc("/subscriptions", s.auth(s.handleSubscriptions))
 	mux.HandleFunc("/subscriptions/", s.auth(s.handleSubscriptionDetail))
+	mux.HandleFunc("/deliveries/", s.auth(s.handleArchivedMessage))
+	mux.HandleFunc("/exports/renewals", s.auth(s.handleRenewalExport))
 	mux.HandleFunc("/settings", s.auth(s.handleSettings))
 	mux.HandleFunc("/settings/", s.auth(s.handleSettingsActions))
 	mux.HandleFunc("/scan", s.auth(s.handleScan))
+	mux.HandleFunc("/scan/jobs/", s.auth(s.handleScanJob))
+	mux.HandleFunc("/api/v1/scheduler", s.auth(s.handleAPIScheduler))
+	// The scheduler API predates the /api/v1 prefix; keep its first path.
+	mux.HandleFunc("/api/scheduler", s.auth(s.handleAPIScheduler))
+	mux.HandleFunc("/api/v1/scan-jobs", s.auth(s.handleAPIScanJobs))
+	mux.HandleFunc("/api/v1/scan-jobs/", s.auth(s.handleAPIScanJobs))
+	mux.HandleFunc("/api/v1/subscriptions/", s.auth(s.handleAPISubscription))
+	mux.HandleFunc("/api/v1/subscriptions:bulkUpsert", s.auth(s.handleAPIBulkUpsert))
+	mux.HandleFunc("/api/v1/events", s.auth(s.handleAPIEvents))
+	mux.HandleFunc("/api/grafana", s.auth(s.handleGrafana))
+	mux.HandleFunc("/api/grafana/", s.auth(s.handleGrafana))
+	mux.HandleFunc("/api/v1/smtp/verify", s.auth(s.handleAPISMTPVerify))
+	mux.HandleFunc("/api/v1/config/reload", s.auth(s.handleAPIReload))
+	mux.HandleFunc("/api/version", s.auth(s.handleAPIVersion))
+	mux.HandleFunc("/account/password", s.auth(s.handleChangePassword))
+	mux.HandleFunc("/unsubscribe", s.handleUnsubscribe)
+	mux.HandleFunc("/webhooks/stripe", s.handleStripeWebhook)
+	mux.HandleFunc("/webhooks/", s.handleEvents)
+	mux.HandleFunc("/track/open/", s.handleOpen)
+	mux.HandleFunc("/track/click/", s.handleClick)
 	return mux
 }
 
+// checkLogin checks the credentials against the stored users. The user
+// is looked up on every request, which rereads the data file if another
+// process such as "xf user" has changed it, and the cache is keyed on the
+// stored hash, so a removed user or a reset password stops working at
+// once.
+func (s *Server) checkLogin(user, pass string) bool {
+	hash, ok := s.store.PasswordHash(user)
+	if !ok {
+		return false
+	}
+	digest := sha256.Sum256([]byte(hash + "\x00" + pass))
+	if cached, ok := s.logins.Load(user); ok && cached.([sha256.Size]byte) == digest {
+		return true
+	}
+	if !db.CheckPassword(hash, pass) {
+		return false
+	}
+	s.logins.Store(user, digest)
+	return true
+}
+
+// auth requires a login, sends users who still have a password someone
+// else set to the change-password page first, and turns viewers away from
+// everything that changes data.
 func (s *Server) auth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user, pass, ok := r.BasicAuth()
-		if !ok || user != s.cfg.AdminUser || pass != s.cfg.AdminPass {
+		if !ok || !s.checkLogin(user, pass) {
 			w.Header().Set("WWW-Authenticate", `Basic realm="Renewal Panel"`)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
+		if r.URL.Path != "/account/password" && s.store.MustChangePassword(user) {
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				writeJSONError(w, http.StatusForbidden, fmt.Errorf("请先登录面板修改初始密码"))
+				return
+			}
+			http.Redirect(w, r, "/account/password", http.StatusSeeOther)
+			return
+		}
+		if !readOnly(r) && s.store.UserRole(user) == db.RoleViewer {
+			err := fmt.Errorf("只读账号不能修改数据")
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				writeJSONError(w, http.StatusForbidden, err)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		next(w, r)
 	}
 }
 
+// readOnly reports whether r can't change anything: every handler changes
+// data only on POST, apart from a user's own password and the Grafana
+// queries, which are POSTs that only read.
+func readOnly(r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	return r.URL.Path == "/account/password" || strings.HasPrefix(r.URL.Path, "/api/grafana")
+}
+
+// viewer reports whether the logged-in user is read-only.
+func (s *Server) viewer(r *http.Request) bool {
+	user, _, _ := r.BasicAuth()
+	return s.store.UserRole(user) == db.RoleViewer
+}
+
 func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		http.NotFound(w, r)
@@ -113,11 +270,18 @@ func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	rules, _ := s.store.GetRules()
+	paused, pausedAt, _ := s.store.SchedulerPaused()
+	runs, _ := s.store.ListScanRuns(10)
+	replies, _ := s.store.ListPendingReplies()
 	data := PageData{
-		Title:         "概览",
-		Company:       s.cfg.CompanyName,
-		Rules:         rules,
-		ScanThreshold: maxInt(rules),
+		Title:          "概览",
+		Company:        s.conf().CompanyName,
+		Rules:          rules,
+		ScanThreshold:  maxInt(rules),
+		Paused:         paused,
+		PausedAt:       pausedAt,
+		ScanRuns:       runs,
+		PendingReplies: replies,
 	}
 	data.Stats.Customers = customers
 	data.Stats.Products = products
@@ -133,10 +297,22 @@ func (s *Server) handleCustomers(w http.ResponseWriter, r *http.Request) {
 			s.renderError(w, err)
 			return
 		}
+		tag := strings.TrimSpace(r.URL.Query().Get("tag"))
+		if tag != "" {
+			tagged := customers[:0]
+			for _, c := range customers {
+				if c.HasTag(tag) {
+					tagged = append(tagged, c)
+				}
+			}
+			customers = tagged
+		}
 		data := PageData{
-			Title:     "客户管理",
-			Company:   s.cfg.CompanyName,
-			Customers: customers,
+			Title:       "客户管理",
+			Company:     s.conf().CompanyName,
+			Customers:   customers,
+			Tag:         tag,
+			LDAPEnabled: s.conf().LDAPURL != "",
 		}
 		s.render(w, "customers.html", data)
 	case http.MethodPost:
@@ -166,6 +342,84 @@ func (s *Server) handleCustomerDetail(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+	if strings.HasSuffix(r.URL.Path, "/update") {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			s.renderError(w, err)
+			return
+		}
+		name := strings.TrimSpace(r.FormValue("name"))
+		secondaryEmail := strings.TrimSpace(r.FormValue("secondary_email"))
+		ccEmails := strings.TrimSpace(r.FormValue("cc_emails"))
+		contacts, err := parseContacts(r.FormValue("contacts"))
+		if err != nil {
+			s.renderMessage(w, err.Error(), fmt.Sprintf("/customers/%d", id))
+			return
+		}
+		timeZone := strings.TrimSpace(r.FormValue("time_zone"))
+		if timeZone != "" {
+			if _, err := calendar.LoadZone(timeZone); err != nil {
+				s.renderMessage(w, err.Error(), fmt.Sprintf("/customers/%d", id))
+				return
+			}
+		}
+		telegramChat := strings.TrimSpace(r.FormValue("telegram_chat_id"))
+		if telegramChat != "" && !notify.ValidTelegramChat(telegramChat) {
+			s.renderMessage(w, "无效的 Telegram Chat ID: "+telegramChat, fmt.Sprintf("/customers/%d", id))
+			return
+		}
+		phone := strings.Join(strings.Fields(r.FormValue("phone")), "")
+		if phone != "" && !notify.ValidPhone(phone) {
+			s.renderMessage(w, "无效的手机号: "+phone, fmt.Sprintf("/customers/%d", id))
+			return
+		}
+		if err := s.store.UpdateCustomer(id, name, secondaryEmail, ccEmails, contacts, timeZone, telegramChat, phone); err != nil {
+			s.renderMessage(w, fmt.Sprintf("更新客户失败: %s", err), fmt.Sprintf("/customers/%d", id))
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/customers/%d", id), http.StatusSeeOther)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/tags") {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.store.SetCustomerTags(id, db.ParseTags(r.FormValue("tags"))); err != nil {
+			s.renderMessage(w, fmt.Sprintf("设置标签失败: %s", err), fmt.Sprintf("/customers/%d", id))
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/customers/%d", id), http.StatusSeeOther)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/clear-bounce") {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.store.ClearCustomerBounce(id); err != nil {
+			s.renderMessage(w, fmt.Sprintf("清除退信标记失败: %s", err), fmt.Sprintf("/customers/%d", id))
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/customers/%d", id), http.StatusSeeOther)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/opt-out") {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		optedOut := r.FormValue("opted_out") == "1"
+		if err := s.store.SetCustomerOptOut(id, optedOut, time.Now()); err != nil {
+			s.renderMessage(w, fmt.Sprintf("更新退订状态失败: %s", err), fmt.Sprintf("/customers/%d", id))
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/customers/%d", id), http.StatusSeeOther)
+		return
+	}
 	if strings.HasSuffix(r.URL.Path, "/delete") {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -189,7 +443,7 @@ func (s *Server) handleCustomerDetail(w http.ResponseWriter, r *http.Request) {
 	}
 	data := PageData{
 		Title:    "客户详情",
-		Company:  s.cfg.CompanyName,
+		Company:  s.conf().CompanyName,
 		Customer: customer,
 	}
 	s.render(w, "customer_detail.html", data)
@@ -204,9 +458,10 @@ func (s *Server) handleProducts(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		data := PageData{
-			Title:    "产品库",
-			Company:  s.cfg.CompanyName,
-			Products: products,
+			Title:        "产品库",
+			Company:      s.conf().CompanyName,
+			Products:     products,
+			WHMCSEnabled: s.whmcsClient().Enabled(),
 		}
 		s.render(w, "products.html", data)
 	case http.MethodPost:
@@ -236,6 +491,10 @@ func (s *Server) handleProductDetail(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+	if strings.HasSuffix(r.URL.Path, "/attachments") || strings.HasSuffix(r.URL.Path, "/attachments/delete") {
+		s.handleProductAttachments(w, r, id)
+		return
+	}
 	if strings.HasSuffix(r.URL.Path, "/delete") {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -248,6 +507,110 @@ func (s *Server) handleProductDetail(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/products", http.StatusSeeOther)
 		return
 	}
+	if strings.HasSuffix(r.URL.Path, "/template") {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.store.SetProductTemplate(id, r.FormValue("template_name")); err != nil {
+			s.renderMessage(w, fmt.Sprintf("设置模板失败: %s", err), fmt.Sprintf("/products/%d", id))
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/products/%d", id), http.StatusSeeOther)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/operators") {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.store.SetProductOperators(id, normalizeOperators(r.FormValue("operators"))); err != nil {
+			s.renderMessage(w, fmt.Sprintf("设置负责人失败: %s", err), fmt.Sprintf("/products/%d", id))
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/products/%d", id), http.StatusSeeOther)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/whmcs") {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ids, err := parseWHMCSProducts(r.FormValue("whmcs_products"))
+		if err == nil {
+			err = s.store.SetProductWHMCS(id, ids)
+		}
+		if err != nil {
+			s.renderMessage(w, fmt.Sprintf("设置 WHMCS 产品失败: %s", err), fmt.Sprintf("/products/%d", id))
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/products/%d", id), http.StatusSeeOther)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/domain") {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.store.SetProductDomain(id, r.FormValue("domain") == "1"); err != nil {
+			s.renderMessage(w, fmt.Sprintf("设置域名产品失败: %s", err), fmt.Sprintf("/products/%d", id))
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/products/%d", id), http.StatusSeeOther)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/price") {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		back := fmt.Sprintf("/products/%d", id)
+		months := 0
+		if value := strings.TrimSpace(r.FormValue("renewal_months")); value != "" {
+			var err error
+			if months, err = strconv.Atoi(value); err != nil || months < 1 || months > 120 {
+				s.renderMessage(w, "续费月数须为 1 到 120 之间的整数", back)
+				return
+			}
+		}
+		price, currency := strings.TrimSpace(r.FormValue("price")), ""
+		if price != "" {
+			var err error
+			if price, err = db.ParsePrice(price); err == nil {
+				currency, err = db.ParseCurrency(r.FormValue("currency"))
+			}
+			if err != nil {
+				s.renderMessage(w, err.Error(), back)
+				return
+			}
+		}
+		if err := s.store.SetProductPrice(id, price, currency, months); err != nil {
+			s.renderMessage(w, fmt.Sprintf("设置价格失败: %s", err), back)
+			return
+		}
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/stripe") {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		months := 0
+		if value := strings.TrimSpace(r.FormValue("renewal_months")); value != "" {
+			var err error
+			if months, err = strconv.Atoi(value); err != nil || months < 1 || months > 120 {
+				s.renderMessage(w, "续费月数须为 1 到 120 之间的整数", fmt.Sprintf("/products/%d", id))
+				return
+			}
+		}
+		if err := s.store.SetProductStripe(id, strings.TrimSpace(r.FormValue("stripe_price_id")), months); err != nil {
+			s.renderMessage(w, fmt.Sprintf("设置在线支付失败: %s", err), fmt.Sprintf("/products/%d", id))
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/products/%d", id), http.StatusSeeOther)
+		return
+	}
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -257,14 +620,70 @@ func (s *Server) handleProductDetail(w http.ResponseWriter, r *http.Request) {
 		s.renderError(w, err)
 		return
 	}
+	namedTemplates, _ := s.store.ListNamedTemplates()
+	attachments, _ := s.store.ListProductAttachments(id)
 	data := PageData{
-		Title:   "产品详情",
-		Company: s.cfg.CompanyName,
-		Product: product,
+		Title:          "产品详情",
+		Company:        s.conf().CompanyName,
+		Product:        product,
+		NamedTemplates: namedTemplates,
+		Attachments:    attachments,
+		StripeEnabled:  s.conf().StripeSecretKey != "",
+		WHMCSEnabled:   s.whmcsClient().Enabled(),
 	}
 	s.render(w, "product_detail.html", data)
 }
 
+// handleProductAttachments uploads or deletes files sent with the
+// product's reminders and renewal confirmations.
+func (s *Server) handleProductAttachments(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	back := fmt.Sprintf("/products/%d", id)
+	if strings.HasSuffix(r.URL.Path, "/delete") {
+		attachmentID, _ := strconv.Atoi(r.FormValue("attachment_id"))
+		if err := s.store.DeleteAttachment(attachmentID); err != nil {
+			s.renderMessage(w, fmt.Sprintf("删除附件失败: %s", err), back)
+			return
+		}
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	_, ok, err := s.saveUpload(r, "attachment", id)
+	if err == nil && !ok {
+		err = fmt.Errorf("请选择文件")
+	}
+	if err != nil {
+		s.renderMessage(w, fmt.Sprintf("上传附件失败: %s", err), back)
+		return
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// saveUpload stores the file posted in field as an attachment, reporting
+// false if the form had no file.
+func (s *Server) saveUpload(r *http.Request, field string, productID int) (db.Attachment, bool, error) {
+	file, header, err := r.FormFile(field)
+	if errors.Is(err, http.ErrMissingFile) || errors.Is(err, http.ErrNotMultipart) {
+		return db.Attachment{}, false, nil
+	}
+	if err != nil {
+		return db.Attachment{}, false, err
+	}
+	defer file.Close()
+	if header.Size > maxAttachmentSize {
+		return db.Attachment{}, false, fmt.Errorf("附件不能超过 %d MB", maxAttachmentSize>>20)
+	}
+	data, err := io.ReadAll(io.LimitReader(file, maxAttachmentSize))
+	if err != nil {
+		return db.Attachment{}, false, err
+	}
+	att, err := s.store.SaveAttachment(productID, path.Base(header.Filename), header.Header.Get("Content-Type"), data, time.Now())
+	return att, err == nil, err
+}
+
 func (s *Server) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
@@ -285,7 +704,7 @@ func (s *Server) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
 		}
 		data := PageData{
 			Title:         "订阅管理",
-			Company:       s.cfg.CompanyName,
+			Company:       s.conf().CompanyName,
 			Customers:     customers,
 			Products:      products,
 			Subscriptions: subs,
@@ -298,13 +717,21 @@ func (s *Server) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
 		}
 		customerID, _ := strconv.Atoi(r.FormValue("customer_id"))
 		productID, _ := strconv.Atoi(r.FormValue("product_id"))
-		expiresAt := strings.TrimSpace(r.FormValue("expires_at"))
+		expiresAt, err := s.expiryFromForm(r)
+		if err != nil {
+			s.renderMessage(w, err.Error(), "/subscriptions")
+			return
+		}
 		note := strings.TrimSpace(r.FormValue("note"))
 		if customerID == 0 || productID == 0 || expiresAt == "" {
 			s.renderMessage(w, "客户、产品、到期日不能为空", "/subscriptions")
 			return
 		}
-		if err := s.store.CreateSubscription(customerID, productID, expiresAt, note, time.Now()); err != nil {
+		kind := r.FormValue("kind")
+		if kind != db.KindTrial {
+			kind = db.KindPaid
+		}
+		if err := s.store.CreateSubscription(customerID, productID, expiresAt, note, kind, time.Now()); err != nil {
 			s.renderMessage(w, fmt.Sprintf("创建订阅失败: %s", err), "/subscriptions")
 			return
 		}
@@ -336,11 +763,15 @@ func (s *Server) handleSubscriptionDetail(w http.ResponseWriter, r *http.Request
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		if err := r.ParseForm(); err != nil {
+		if err := r.ParseMultipartForm(maxAttachmentSize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
 			s.renderError(w, err)
 			return
 		}
-		expiresAt := strings.TrimSpace(r.FormValue("expires_at"))
+		expiresAt, err := s.expiryFromForm(r)
+		if err != nil {
+			s.renderMessage(w, err.Error(), fmt.Sprintf("/subscriptions/%d", id))
+			return
+		}
 		note := strings.TrimSpace(r.FormValue("note"))
 		sendConfirm := r.FormValue("send_confirm") == "1"
 		before, err := s.store.GetSubscription(id)
@@ -348,13 +779,157 @@ func (s *Server) handleSubscriptionDetail(w http.ResponseWriter, r *http.Request
 			s.renderError(w, err)
 			return
 		}
-		if err := s.store.UpdateSubscription(id, expiresAt, note); err != nil {
+		if err := s.store.UpdateSubscription(id, expiresAt, note, time.Now()); err != nil {
 			s.renderMessage(w, fmt.Sprintf("更新订阅失败: %s", err), fmt.Sprintf("/subscriptions/%d", id))
 			return
 		}
+		// Renewing from a customer's reply confirms the reply.
+		if replyID, err := strconv.Atoi(r.FormValue("reply_id")); err == nil {
+			if err := s.store.ResolveReply(replyID, db.ReplyConfirmed, time.Now()); err != nil {
+				slog.Error("reply confirm error", "reply_id", replyID, "error", err)
+			}
+		}
 		if sendConfirm && s.mailer.Enabled() {
+			var attachmentIDs []int
+			att, ok, err := s.saveUpload(r, "attachment", 0)
+			if err != nil {
+				s.renderMessage(w, fmt.Sprintf("订阅已更新，但附件上传失败，未发送续费确认: %s", err), fmt.Sprintf("/subscriptions/%d", id))
+				return
+			}
+			if ok {
+				attachmentIDs = append(attachmentIDs, att.ID)
+			}
 			after, _ := s.store.GetSubscription(id)
-			_ = s.reminder.SendRenewalConfirm(after, before.ExpiresAt, expiresAt)
+			key := r.FormValue("idempotency_key")
+			_ = s.service().SendRenewalConfirm(r.Context(), after, key, before.ExpiresAt, expiresAt, attachmentIDs, time.Now())
+		}
+		http.Redirect(w, r, fmt.Sprintf("/subscriptions/%d", id), http.StatusSeeOther)
+	case strings.HasSuffix(r.URL.Path, "/kind"):
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			s.renderError(w, err)
+			return
+		}
+		if err := s.store.SetSubscriptionKind(id, r.FormValue("kind")); err != nil {
+			s.renderMessage(w, fmt.Sprintf("更新订阅类型失败: %s", err), fmt.Sprintf("/subscriptions/%d", id))
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/subscriptions/%d", id), http.StatusSeeOther)
+	case strings.HasSuffix(r.URL.Path, "/priority"):
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			s.renderError(w, err)
+			return
+		}
+		if err := s.store.SetPriority(id, r.FormValue("priority")); err != nil {
+			s.renderMessage(w, fmt.Sprintf("更新优先级失败: %s", err), fmt.Sprintf("/subscriptions/%d", id))
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/subscriptions/%d", id), http.StatusSeeOther)
+	case strings.HasSuffix(r.URL.Path, "/auto-renew"):
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			s.renderError(w, err)
+			return
+		}
+		months, _ := strconv.Atoi(r.FormValue("auto_renew_months"))
+		if err := s.store.SetAutoRenew(id, months); err != nil {
+			s.renderMessage(w, fmt.Sprintf("更新自动续费失败: %s", err), fmt.Sprintf("/subscriptions/%d", id))
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/subscriptions/%d", id), http.StatusSeeOther)
+	case strings.HasSuffix(r.URL.Path, "/domain"):
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleSubscriptionDomain(w, r, id)
+	case strings.HasSuffix(r.URL.Path, "/cert-host"):
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleSubscriptionCertHost(w, r, id)
+	case strings.HasSuffix(r.URL.Path, "/payment-link"):
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		subscription, err := s.store.GetSubscription(id)
+		if err != nil {
+			s.renderError(w, err)
+			return
+		}
+		if _, err := s.service().PaymentLink(r.Context(), subscription); err != nil {
+			s.renderMessage(w, fmt.Sprintf("生成支付链接失败: %s", err), fmt.Sprintf("/subscriptions/%d", id))
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/subscriptions/%d", id), http.StatusSeeOther)
+	case strings.HasSuffix(r.URL.Path, "/quote.pdf"):
+		subscription, err := s.store.GetSubscription(id)
+		if err != nil {
+			s.renderError(w, err)
+			return
+		}
+		data, name, err := s.service().Quote([]db.SubscriptionDetail{subscription}, time.Now())
+		if err != nil {
+			s.renderMessage(w, fmt.Sprintf("生成报价单失败: %s", err), fmt.Sprintf("/subscriptions/%d", id))
+			return
+		}
+		if data == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": name}))
+		w.Write(data)
+	case strings.HasSuffix(r.URL.Path, "/reply-dismiss"):
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			s.renderError(w, err)
+			return
+		}
+		replyID, _ := strconv.Atoi(r.FormValue("reply_id"))
+		if err := s.store.ResolveReply(replyID, db.ReplyDismissed, time.Now()); err != nil {
+			s.renderMessage(w, fmt.Sprintf("忽略回复失败: %s", err), fmt.Sprintf("/subscriptions/%d", id))
+			return
+		}
+		next := r.FormValue("next")
+		if next != "/" {
+			next = fmt.Sprintf("/subscriptions/%d", id)
+		}
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	case strings.HasSuffix(r.URL.Path, "/snooze"):
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			s.renderError(w, err)
+			return
+		}
+		until := strings.TrimSpace(r.FormValue("snoozed_until"))
+		if until != "" {
+			if _, err := time.Parse("2006-01-02", until); err != nil {
+				s.renderMessage(w, "暂停日期格式错误", fmt.Sprintf("/subscriptions/%d", id))
+				return
+			}
+		}
+		if err := s.store.SnoozeSubscription(id, until); err != nil {
+			s.renderMessage(w, fmt.Sprintf("暂停提醒失败: %s", err), fmt.Sprintf("/subscriptions/%d", id))
+			return
 		}
 		http.Redirect(w, r, fmt.Sprintf("/subscriptions/%d", id), http.StatusSeeOther)
 	default:
@@ -367,15 +942,54 @@ func (s *Server) handleSubscriptionDetail(w http.ResponseWriter, r *http.Request
 			s.renderError(w, err)
 			return
 		}
+		renewals, _ := s.store.ListRenewals(id)
+		deliveries, _ := s.store.ListSubscriptionDeliveries(id)
+		replies, _ := s.store.ListSubscriptionReplies(id)
 		data := PageData{
-			Title:        "订阅详情",
-			Company:      s.cfg.CompanyName,
-			Subscription: subscription,
+			Title:          "订阅详情",
+			Company:        s.conf().CompanyName,
+			Subscription:   subscription,
+			Renewals:       renewals,
+			Deliveries:     deliveries,
+			Replies:        replies,
+			ReplyRenewTo:   nextExpiryDate(subscription),
+			IdempotencyKey: newIdempotencyKey(),
+			StripeEnabled:  s.conf().StripeSecretKey != "",
 		}
 		s.render(w, "subscription_detail.html", data)
 	}
 }
 
+// nextExpiryDate is the date one renewal period after the subscription's
+// expiry, offered when confirming a customer's reply.
+func nextExpiryDate(sub db.SubscriptionDetail) string {
+	expires, err := time.Parse("2006-01-02", sub.ExpiresDate())
+	if err != nil {
+		return sub.ExpiresDate()
+	}
+	months := sub.ProductRenewalMonths
+	if months <= 0 {
+		months = 12
+	}
+	return expires.AddDate(0, months, 0).Format("2006-01-02")
+}
+
+// expiryFromForm joins the expires_at date and the optional expires_time
+// into the stored ExpiresAt format. An empty date yields "".
+func (s *Server) expiryFromForm(r *http.Request) (string, error) {
+	value := strings.TrimSpace(r.FormValue("expires_at"))
+	if value == "" {
+		return "", nil
+	}
+	if clock := strings.TrimSpace(r.FormValue("expires_time")); clock != "" {
+		value += " " + clock
+	}
+	if _, _, err := reminder.ParseExpiry(value, s.conf().TimeZone); err != nil {
+		return "", fmt.Errorf("到期时间格式错误")
+	}
+	return value, nil
+}
+
 func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/settings" {
 		http.NotFound(w, r)
@@ -385,18 +999,74 @@ func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	data := s.settingsData()
+	if s.viewer(r) {
+		// The SMTP check reports the server and login errors, which are
+		// for admins.
+		data.SMTPProfiles = nil
+		data.Flash = "当前为只读账号，可以查看规则与模板，但无法保存修改。"
+	}
+	s.render(w, "settings.html", data)
+}
+
+// settingsData loads everything the settings page shows.
+func (s *Server) settingsData() PageData {
 	rules, _ := s.store.GetRules()
+	highRules, _ := s.store.GetHighPriorityRules()
+	hourRules, _ := s.store.GetHourRules()
 	template, _ := s.store.GetTemplate()
 	renewalTemplate, _ := s.store.GetRenewalTemplate()
+	trialTemplate, _ := s.store.GetTrialTemplate()
+	trialRules, _ := s.store.GetTrialRules()
+	combinedTemplate, _ := s.store.GetCombinedTemplate()
+	paused, pausedAt, _ := s.store.SchedulerPaused()
+	sendWindow, _ := s.store.GetSendWindow()
+	businessDays, _ := s.store.GetBusinessDays()
+	escalation, _ := s.store.GetEscalation()
+	quoteSettings, _ := s.store.GetQuoteSettings()
+	accounting := s.accountingPage(time.Now())
+	graceDays, _ := s.store.GetGraceDays()
+	namedTemplates, _ := s.store.ListNamedTemplates()
+	forecast, _ := s.store.GetForecast()
+	slackTemplate, _ := s.store.GetSlackTemplate()
+	smsRules, _ := s.store.GetSMSRules()
+	smsTemplate, _ := s.store.GetSMSTemplate()
+	roles, _ := s.store.GetReminderRoles()
+	reminderRoles := map[string]bool{}
+	for _, role := range roles {
+		reminderRoles[role] = true
+	}
 	data := PageData{
-		Title:           "规则与模板",
-		Company:         s.cfg.CompanyName,
-		Rules:           rules,
-		RulesInput:      joinInts(rules),
-		Template:        template,
-		RenewalTemplate: renewalTemplate,
+		Title:            "规则与模板",
+		Company:          s.conf().CompanyName,
+		Rules:            rules,
+		RulesInput:       joinInts(rules),
+		HighRulesInput:   joinInts(highRules),
+		HourRulesInput:   joinInts(hourRules),
+		TrialRulesInput:  joinInts(trialRules),
+		SMSRulesInput:    joinInts(smsRules),
+		GraceDays:        graceDays,
+		Template:         template,
+		RenewalTemplate:  renewalTemplate,
+		TrialTemplate:    trialTemplate,
+		CombinedTemplate: combinedTemplate,
+		NamedTemplates:   namedTemplates,
+		Paused:           paused,
+		PausedAt:         pausedAt,
+		SendWindow:       sendWindow,
+		BusinessDays:     businessDays,
+		Escalation:       escalation,
+		Quote:            quoteSettings,
+		Accounting:       accounting,
+		Forecast:         forecast,
+		SlackTemplate:    slackTemplate,
+		SlackEnabled:     s.conf().SlackWebhookURL != "",
+		SMSTemplate:      smsTemplate,
+		SMSProvider:      s.conf().SMSProvider,
+		SMTPProfiles:     s.smtpProfiles(),
+		ReminderRoles:    reminderRoles,
 	}
-	s.render(w, "settings.html", data)
+	return data
 }
 
 func (s *Server) handleSettingsActions(w http.ResponseWriter, r *http.Request) {
@@ -415,21 +1085,280 @@ func (s *Server) handleSettingsActions(w http.ResponseWriter, r *http.Request) {
 			s.renderMessage(w, err.Error(), "/settings")
 			return
 		}
+		var highRules []int
+		if input := strings.TrimSpace(r.FormValue("high_priority_rules")); input != "" {
+			if highRules, err = reminder.ParseRules(input); err != nil {
+				s.renderMessage(w, err.Error(), "/settings")
+				return
+			}
+		}
+		trialRules, err := reminder.ParseRules(r.FormValue("trial_rules"))
+		if err != nil {
+			s.renderMessage(w, "试用规则："+err.Error(), "/settings")
+			return
+		}
+		var hourRules []int
+		if input := strings.TrimSpace(r.FormValue("hour_rules")); input != "" {
+			if hourRules, err = reminder.ParseRules(input); err != nil {
+				s.renderMessage(w, err.Error(), "/settings")
+				return
+			}
+		}
+		var smsRules []int
+		if input := strings.TrimSpace(r.FormValue("sms_rules")); input != "" {
+			if smsRules, err = reminder.ParseRules(input); err != nil {
+				s.renderMessage(w, "短信规则："+err.Error(), "/settings")
+				return
+			}
+		}
+		graceDays, err := strconv.Atoi(strings.TrimSpace(r.FormValue("grace_days")))
+		if err != nil || graceDays < 0 {
+			s.renderMessage(w, "宽限天数必须为非负整数", "/settings")
+			return
+		}
 		if err := s.store.UpdateRules(rules); err != nil {
 			s.renderMessage(w, fmt.Sprintf("更新规则失败: %s", err), "/settings")
 			return
 		}
+		if err := s.store.UpdateHighPriorityRules(highRules); err != nil {
+			s.renderMessage(w, fmt.Sprintf("更新高优先级规则失败: %s", err), "/settings")
+			return
+		}
+		if err := s.store.UpdateHourRules(hourRules); err != nil {
+			s.renderMessage(w, fmt.Sprintf("更新小时规则失败: %s", err), "/settings")
+			return
+		}
+		if err := s.store.UpdateTrialRules(trialRules); err != nil {
+			s.renderMessage(w, fmt.Sprintf("更新试用规则失败: %s", err), "/settings")
+			return
+		}
+		if err := s.store.UpdateSMSRules(smsRules); err != nil {
+			s.renderMessage(w, fmt.Sprintf("更新短信规则失败: %s", err), "/settings")
+			return
+		}
+		if err := s.store.UpdateGraceDays(graceDays); err != nil {
+			s.renderMessage(w, fmt.Sprintf("更新宽限天数失败: %s", err), "/settings")
+			return
+		}
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+	case "/settings/send-window":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			s.renderError(w, err)
+			return
+		}
+		window := db.SendWindow{
+			QuietHours:    strings.TrimSpace(r.FormValue("quiet_hours")),
+			BlackoutDates: strings.TrimSpace(r.FormValue("blackout_dates")),
+		}
+		if _, err := calendar.ParseWindow(window.QuietHours, window.BlackoutDates); err != nil {
+			s.renderMessage(w, err.Error(), "/settings")
+			return
+		}
+		if err := s.store.UpdateSendWindow(window); err != nil {
+			s.renderMessage(w, fmt.Sprintf("更新发送时间窗口失败: %s", err), "/settings")
+			return
+		}
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+	case "/settings/business-days":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			s.renderError(w, err)
+			return
+		}
+		shift := r.FormValue("weekend_shift")
+		switch shift {
+		case db.WeekendShiftNone, db.WeekendShiftBefore, db.WeekendShiftAfter:
+		default:
+			s.renderMessage(w, "无效的周末调整方式", "/settings")
+			return
+		}
+		weekend, err := calendar.ParseWeekend(r.FormValue("weekend"))
+		if err != nil {
+			s.renderMessage(w, err.Error(), "/settings")
+			return
+		}
+		holidays := strings.TrimSpace(r.FormValue("holidays"))
+		if _, err := calendar.ParseHolidays(holidays); err != nil {
+			s.renderMessage(w, err.Error(), "/settings")
+			return
+		}
+		days := db.BusinessDays{WeekendShift: shift, Weekend: weekend.String(), Holidays: holidays}
+		if err := s.store.UpdateBusinessDays(days); err != nil {
+			s.renderMessage(w, fmt.Sprintf("更新工作日设置失败: %s", err), "/settings")
+			return
+		}
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+	case "/settings/holidays/import":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		file, _, err := r.FormFile("ics")
+		if err != nil {
+			s.renderMessage(w, "请选择 ICS 文件", "/settings")
+			return
+		}
+		defer file.Close()
+		entries, err := calendar.ParseICS(file)
+		if err != nil {
+			s.renderMessage(w, fmt.Sprintf("导入节假日失败: %s", err), "/settings")
+			return
+		}
+		days, err := s.store.GetBusinessDays()
+		if err != nil {
+			s.renderError(w, err)
+			return
+		}
+		days.Holidays = mergeLines(days.Holidays, entries)
+		if err := s.store.UpdateBusinessDays(days); err != nil {
+			s.renderMessage(w, fmt.Sprintf("导入节假日失败: %s", err), "/settings")
+			return
+		}
+		s.renderMessage(w, fmt.Sprintf("已导入 %d 个节假日", len(entries)), "/settings")
+	case "/settings/escalation":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			s.renderError(w, err)
+			return
+		}
+		afterReminders, err := strconv.Atoi(strings.TrimSpace(r.FormValue("after_reminders")))
+		if err != nil || afterReminders < 0 {
+			s.renderMessage(w, "提醒次数必须为非负整数", "/settings")
+			return
+		}
+		escalation := db.Escalation{
+			AfterReminders: afterReminders,
+			ManagerEmail:   strings.TrimSpace(r.FormValue("manager_email")),
+		}
+		if err := s.store.UpdateEscalation(escalation); err != nil {
+			s.renderMessage(w, fmt.Sprintf("更新升级设置失败: %s", err), "/settings")
+			return
+		}
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+	case "/settings/accounting":
+		s.handleAccountingSettings(w, r)
+	case "/settings/quote":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			s.renderError(w, err)
+			return
+		}
+		settings := db.QuoteSettings{
+			Enabled: r.FormValue("enabled") == "1",
+			Payment: strings.TrimSpace(r.FormValue("payment")),
+		}
+		if err := s.store.UpdateQuoteSettings(settings); err != nil {
+			s.renderMessage(w, fmt.Sprintf("更新报价单设置失败: %s", err), "/settings")
+			return
+		}
 		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+	case "/settings/smtp-verify":
+		s.handleSMTPVerifyForm(w, r)
+	case "/settings/reload":
+		s.handleReloadForm(w, r)
+	case "/settings/reminder-roles":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			s.renderError(w, err)
+			return
+		}
+		var roles []string
+		for _, role := range []string{db.RolePrimary, db.RoleBilling, db.RoleTechnical} {
+			if slices.Contains(r.Form["roles"], role) {
+				roles = append(roles, role)
+			}
+		}
+		if len(roles) == 0 {
+			s.renderMessage(w, "至少选择一个收件角色", "/settings")
+			return
+		}
+		if err := s.store.UpdateReminderRoles(roles); err != nil {
+			s.renderMessage(w, fmt.Sprintf("更新收件角色失败: %s", err), "/settings")
+			return
+		}
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+	case "/settings/forecast":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			s.renderError(w, err)
+			return
+		}
+		forecast := db.Forecast{
+			Enabled:    r.FormValue("enabled") == "1",
+			Recipients: strings.TrimSpace(r.FormValue("recipients")),
+		}
+		if err := s.store.UpdateForecast(forecast); err != nil {
+			s.renderMessage(w, fmt.Sprintf("更新到期预测设置失败: %s", err), "/settings")
+			return
+		}
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+	case "/settings/scheduler":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			s.renderError(w, err)
+			return
+		}
+		paused := r.FormValue("paused") == "1"
+		if err := s.store.SetSchedulerPaused(paused, time.Now()); err != nil {
+			s.renderMessage(w, fmt.Sprintf("更新调度状态失败: %s", err), "/settings")
+			return
+		}
+		http.Redirect(w, r, redirectBack(r, "/settings"), http.StatusSeeOther)
 	case "/settings/template":
-		s.saveTemplate(w, r, false)
+		s.saveTemplate(w, r, s.store.UpdateTemplate)
 	case "/settings/renewal-template":
-		s.saveTemplate(w, r, true)
+		s.saveTemplate(w, r, s.store.UpdateRenewalTemplate)
+	case "/settings/trial-template":
+		s.saveTemplate(w, r, s.store.UpdateTrialTemplate)
+	case "/settings/combined-template":
+		s.saveTemplate(w, r, s.store.UpdateCombinedTemplate)
+	case "/settings/slack-template":
+		s.saveSlackTemplate(w, r)
+	case "/settings/sms-template":
+		s.saveSMSTemplate(w, r)
+	case "/settings/named-template":
+		name := strings.TrimSpace(r.FormValue("name"))
+		s.saveTemplate(w, r, func(tpl db.Template) error {
+			return s.store.SaveNamedTemplate(name, tpl)
+		})
+	case "/settings/named-template/delete":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.store.DeleteNamedTemplate(r.FormValue("name")); err != nil {
+			s.renderMessage(w, fmt.Sprintf("删除模板失败: %s", err), "/settings")
+			return
+		}
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
 	default:
 		http.NotFound(w, r)
 	}
 }
 
-func (s *Server) saveTemplate(w http.ResponseWriter, r *http.Request, renewal bool) {
+func (s *Server) saveTemplate(w http.ResponseWriter, r *http.Request, update func(db.Template) error) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -440,14 +1369,101 @@ func (s *Server) saveTemplate(w http.ResponseWriter, r *http.Request, renewal bo
 	}
 	subject := r.FormValue("subject")
 	htmlBody := r.FormValue("html")
-	tpl := db.Template{Subject: subject, HTML: htmlBody}
-	var err error
-	if renewal {
-		err = s.store.UpdateRenewalTemplate(tpl)
-	} else {
-		err = s.store.UpdateTemplate(tpl)
+	replyTo := strings.TrimSpace(r.FormValue("reply_to"))
+	if replyTo != "" {
+		if _, err := mail.ParseAddress(replyTo); err != nil {
+			s.renderMessage(w, "回复地址格式错误", "/settings")
+			return
+		}
 	}
-	if err != nil {
+	headers := strings.TrimSpace(r.FormValue("headers"))
+	if _, err := email.ParseHeaders(headers); err != nil {
+		s.renderMessage(w, fmt.Sprintf("附加邮件头格式错误: %s", err), "/settings")
+		return
+	}
+	htmlBody, removed := sanitizeHTML(htmlBody)
+	tpl := db.Template{Subject: subject, HTML: htmlBody, Text: r.FormValue("text"), ReplyTo: replyTo, Headers: headers}
+	if err := validateTemplate(tpl, s.conf().CompanyName); err != nil {
+		s.renderMessage(w, fmt.Sprintf("模板语法错误: %s", err), "/settings")
+		return
+	}
+	if err := update(tpl); err != nil {
+		s.renderMessage(w, fmt.Sprintf("保存模板失败: %s", err), "/settings")
+		return
+	}
+	if len(removed) > 0 {
+		s.renderMessage(w, "模板已保存，已移除不安全的内容: "+strings.Join(removed, "、"), "/settings")
+		return
+	}
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
+
+// validateTemplate parses the template and renders it against sample data,
+// so a broken action or an escaping error is caught when the template is
+// saved rather than when every reminder fails to send.
+func validateTemplate(tpl db.Template, company string) error {
+	_, _, _, err := TemplateRenderer{}.RenderTemplate(tpl, reminder.SampleData(company))
+	return err
+}
+
+// saveSlackTemplate stores the Slack templates after test-rendering them.
+// A field left empty goes back to the default.
+func (s *Server) saveSlackTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.renderError(w, err)
+		return
+	}
+	tpl := db.SlackTemplate{
+		Scan:         strings.TrimSpace(r.FormValue("scan")),
+		HighPriority: strings.TrimSpace(r.FormValue("high_priority")),
+	}
+	company := s.conf().CompanyName
+	for _, check := range []struct {
+		text string
+		data map[string]any
+	}{
+		{tpl.Scan, reminder.SampleScanData(company)},
+		{tpl.HighPriority, reminder.SampleAlertData(company)},
+	} {
+		if _, err := renderPlain(check.text, check.data); err != nil {
+			s.renderMessage(w, fmt.Sprintf("模板语法错误: %s", err), "/settings")
+			return
+		}
+	}
+	if err := s.store.UpdateSlackTemplate(tpl); err != nil {
+		s.renderMessage(w, fmt.Sprintf("保存模板失败: %s", err), "/settings")
+		return
+	}
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
+
+// saveSMSTemplate stores the SMS templates after test-rendering them. A
+// field left empty goes back to the default.
+func (s *Server) saveSMSTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.renderError(w, err)
+		return
+	}
+	tpl := db.SMSTemplate{
+		Reminder: strings.TrimSpace(r.FormValue("reminder")),
+		Trial:    strings.TrimSpace(r.FormValue("trial")),
+	}
+	data := reminder.SampleData(s.conf().CompanyName)
+	for _, text := range []string{tpl.Reminder, tpl.Trial} {
+		if _, err := renderPlain(text, data); err != nil {
+			s.renderMessage(w, fmt.Sprintf("模板语法错误: %s", err), "/settings")
+			return
+		}
+	}
+	if err := s.store.UpdateSMSTemplate(tpl); err != nil {
 		s.renderMessage(w, fmt.Sprintf("保存模板失败: %s", err), "/settings")
 		return
 	}
@@ -464,18 +1480,162 @@ func (s *Server) handleScan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	threshold, _ := strconv.Atoi(r.FormValue("threshold"))
-	result, err := s.reminder.SendNow(threshold, time.Now())
+	job := s.startScan(r.FormValue("mode"), threshold, r.FormValue("dry_run") == "1")
+	http.Redirect(w, r, fmt.Sprintf("/scan/jobs/%d", job.ID), http.StatusSeeOther)
+}
+
+// handleScanJob shows a manual scan's progress, refreshing until it is done.
+func (s *Server) handleScanJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, ok := parseID(r.URL.Path, "/scan/jobs/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	job, ok := s.jobs.get(id)
+	if !ok {
+		s.renderMessage(w, "扫描任务不存在或已过期", "/")
+		return
+	}
+	data := PageData{
+		Title:      "扫描任务",
+		Company:    s.conf().CompanyName,
+		Job:        job,
+		ScanResult: job.Result,
+	}
+	if job.Running() {
+		data.Refresh = 2
+	}
+	s.render(w, "scan_job.html", data)
+}
+
+// handleAPIScanJobs starts a manual scan on POST /api/v1/scan-jobs (form
+// fields as for /scan) and reports one on GET /api/v1/scan-jobs/{id}.
+func (s *Server) handleAPIScanJobs(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/api/v1/scan-jobs" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		threshold, _ := strconv.Atoi(r.FormValue("threshold"))
+		job := s.startScan(r.FormValue("mode"), threshold, r.FormValue("dry_run") == "1")
+		writeJSON(w, http.StatusAccepted, job)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, ok := parseID(r.URL.Path, "/api/v1/scan-jobs/")
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("扫描任务不存在"))
+		return
+	}
+	job, ok := s.jobs.get(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("扫描任务不存在或已过期"))
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// handleAPIScheduler reports the scheduler state on GET and pauses or
+// resumes automated scans on POST with paused=true|false.
+func (s *Server) handleAPIScheduler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		paused, err := strconv.ParseBool(r.FormValue("paused"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("paused 必须为 true 或 false"))
+			return
+		}
+		if err := s.store.SetSchedulerPaused(paused, time.Now()); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	paused, pausedAt, err := s.store.SchedulerPaused()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	holder, err := s.store.SchedulerLockHolder()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"paused":          paused,
+		"paused_at":       pausedAt,
+		"leader":          s.store.HoldsSchedulerLock(),
+		"leader_instance": holder,
+	})
+}
+
+// handleAPISubscription serves
+// GET /api/v1/subscriptions/{id}/reminder-preview?days=N, rendering the
+// reminder for N days left (default: the subscription's actual days left).
+func (s *Server) handleAPISubscription(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/v1/subscriptions/")
+	idPart, action, _ := strings.Cut(rest, "/")
+	id, err := strconv.Atoi(idPart)
+	if err != nil || action != "reminder-preview" {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sub, err := s.store.GetSubscription(id)
 	if err != nil {
-		s.renderMessage(w, fmt.Sprintf("扫描失败: %s", err), "/")
+		writeJSONError(w, http.StatusNotFound, err)
 		return
 	}
-	msg := fmt.Sprintf("扫描完成：总计 %d，发送 %d，跳过 %d，失败 %d", result.Total, result.Sent, result.Skipped, result.Failed)
-	s.renderMessage(w, msg, "/")
+	var daysLeft int
+	if days := r.URL.Query().Get("days"); days != "" {
+		if daysLeft, err = strconv.Atoi(days); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("days 必须为整数"))
+			return
+		}
+	} else if daysLeft, err = s.service().DaysLeft(sub, time.Now()); err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	subject, htmlBody, textBody, err := s.service().Preview(sub, daysLeft)
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"subscription_id": sub.ID,
+		"to":              sub.CustomerEmail,
+		"days_left":       daysLeft,
+		"subject":         subject,
+		"html":            htmlBody,
+		"text":            textBody,
+	})
 }
 
 func (s *Server) render(w http.ResponseWriter, page string, data PageData) {
 	data.Title = strings.TrimSpace(data.Title)
-	data.Company = s.cfg.CompanyName
+	data.Company = s.conf().CompanyName
+	data.Version = build.Short()
 	tpl, err := template.New("layout.html").ParseFS(assetsFS, "templates/layout.html", path.Join("templates", page))
 	if err != nil {
 		s.renderError(w, err)
@@ -495,6 +1655,59 @@ func (s *Server) renderError(w http.ResponseWriter, err error) {
 	io.WriteString(w, fmt.Sprintf("错误: %s", err))
 }
 
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// redirectBack returns the form's "next" path when it is a local path, so
+// forms shared between pages can send the user back where they came from.
+func redirectBack(r *http.Request, fallback string) string {
+	next := r.FormValue("next")
+	if strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") {
+		return next
+	}
+	return fallback
+}
+
+// contactRoles maps the role names accepted in the contacts field, English
+// or Chinese, to the stored role.
+var contactRoles = map[string]string{
+	db.RoleBilling:   db.RoleBilling,
+	"财务":             db.RoleBilling,
+	db.RoleTechnical: db.RoleTechnical,
+	"技术":             db.RoleTechnical,
+}
+
+// parseContacts reads one "<role> <email>" contact per line, e.g.
+// "billing finance@example.com".
+func parseContacts(input string) ([]db.Contact, error) {
+	var contacts []db.Contact
+	for _, line := range strings.Split(input, "\n") {
+		fields := strings.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == '\t' || r == ',' || r == ':' || r == '：' || r == '\r' })
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("联系人格式错误: %q，应为“角色 邮箱”", strings.TrimSpace(line))
+		}
+		role, ok := contactRoles[strings.ToLower(fields[0])]
+		if !ok {
+			return nil, fmt.Errorf("未知的联系人角色 %q，可用 billing（财务）或 technical（技术）", fields[0])
+		}
+		if _, err := mail.ParseAddress(fields[1]); err != nil {
+			return nil, fmt.Errorf("联系人邮箱格式错误: %s", fields[1])
+		}
+		contacts = append(contacts, db.Contact{Email: fields[1], Role: role})
+	}
+	return contacts, nil
+}
+
 func parseID(fullPath, prefix string) (int, bool) {
 	trimmed := strings.TrimPrefix(fullPath, prefix)
 	trimmed = strings.TrimSuffix(trimmed, "/delete")
@@ -508,6 +1721,54 @@ func parseID(fullPath, prefix string) (int, bool) {
 	return id, err == nil
 }
 
+// newIdempotencyKey returns a random key that identifies one form render,
+// so a repeated post of the same form can be recognised.
+func newIdempotencyKey() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+// mergeLines appends entries that are not already listed in text, one per
+// line.
+func mergeLines(text string, entries []string) string {
+	seen := map[string]bool{}
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			seen[line] = true
+			lines = append(lines, line)
+		}
+	}
+	for _, entry := range entries {
+		if !seen[entry] {
+			seen[entry] = true
+			lines = append(lines, entry)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// normalizeOperators turns the operators typed into the product form,
+// separated by commas, Chinese commas or spaces and perhaps written as
+// @mentions, into the comma-separated list DingTalk mentions are read from.
+func normalizeOperators(text string) string {
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == '，' || r == '、' || unicode.IsSpace(r)
+	})
+	seen := map[string]bool{}
+	var operators []string
+	for _, field := range fields {
+		if field = strings.TrimPrefix(field, "@"); field != "" && !seen[field] {
+			seen[field] = true
+			operators = append(operators, field)
+		}
+	}
+	return strings.Join(operators, ",")
+}
+
 func joinInts(values []int) string {
 	var out []string
 	for _, v := range values {
@@ -541,6 +1802,18 @@ func renderText(tpl string, data any) (string, error) {
 	return buf.String(), nil
 }
 
+func renderPlain(tpl string, data any) (string, error) {
+	t, err := texttemplate.New("text").Parse(tpl)
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
 func renderHTML(tpl string, data any) (string, error) {
 	t, err := template.New("html").Parse(tpl)
 	if err != nil {
@@ -0,0 +1,134 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"xf/internal/email"
+)
+
+// smtpVerifyTimeout bounds one connection check.
+const smtpVerifyTimeout = 30 * time.Second
+
+// SMTP profiles that can be checked.
+const (
+	smtpPrimary   = "primary"
+	smtpSecondary = "secondary"
+)
+
+// smtpCheck is the outcome of checking one SMTP profile.
+type smtpCheck struct {
+	Profile string `json:"profile"`
+	Host    string `json:"host"`
+	OK      bool   `json:"ok"`
+	Stage   string `json:"stage,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// smtpProfiles lists the configured SMTP profiles: the primary one when
+// MAIL_PROVIDER is smtp and the failover one when it is set.
+func (s *Server) smtpProfiles() []string {
+	cfg := s.conf()
+	var profiles []string
+	if cfg.MailProvider == "smtp" && cfg.SMTPHost != "" {
+		profiles = append(profiles, smtpPrimary)
+	}
+	if cfg.SMTP2Host != "" {
+		profiles = append(profiles, smtpSecondary)
+	}
+	return profiles
+}
+
+func (s *Server) smtpMailer(profile string) (email.Mailer, bool) {
+	cfg := s.conf()
+	for _, p := range s.smtpProfiles() {
+		if p != profile {
+			continue
+		}
+		if profile == smtpSecondary {
+			return email.Mailer{Host: cfg.SMTP2Host, Port: cfg.SMTP2Port, User: cfg.SMTP2User, Pass: cfg.SMTP2Pass,
+				From: cfg.SMTP2From, Encryption: cfg.SMTP2Encryption}, true
+		}
+		mailer := email.Mailer{Host: cfg.SMTPHost, Port: cfg.SMTPPort, User: cfg.SMTPUser, Pass: cfg.SMTPPass,
+			From: cfg.SMTPFrom, Encryption: cfg.SMTPEncryption}
+		if cfg.SMTPOAuthTokenURL != "" {
+			mailer.OAuth = &email.OAuth2{TokenURL: cfg.SMTPOAuthTokenURL, ClientID: cfg.SMTPOAuthClientID,
+				ClientSecret: cfg.SMTPOAuthSecret, RefreshToken: cfg.SMTPOAuthRefresh, Scope: cfg.SMTPOAuthScope}
+		}
+		return mailer, true
+	}
+	return email.Mailer{}, false
+}
+
+// verifySMTP connects to the profile's server and authenticates without
+// sending anything.
+func (s *Server) verifySMTP(ctx context.Context, profile string) (smtpCheck, bool) {
+	mailer, ok := s.smtpMailer(profile)
+	if !ok {
+		return smtpCheck{}, false
+	}
+	check := smtpCheck{Profile: profile, Host: fmt.Sprintf("%s:%d", mailer.Host, mailer.Port), OK: true}
+	ctx, cancel := context.WithTimeout(ctx, smtpVerifyTimeout)
+	defer cancel()
+	if err := mailer.Verify(ctx); err != nil {
+		check.OK = false
+		check.Error = err.Error()
+		var verr *email.VerifyError
+		if errors.As(err, &verr) {
+			check.Stage = verr.Stage
+			check.Error = verr.Err.Error()
+		}
+	}
+	return check, true
+}
+
+// handleAPISMTPVerify serves POST /api/v1/smtp/verify with an optional
+// profile=primary|secondary, reporting which stage (DNS, TCP, SMTP, TLS or
+// AUTH) failed. A failed check answers 502.
+func (s *Server) handleAPISMTPVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	profile := r.FormValue("profile")
+	if profile == "" {
+		profile = smtpPrimary
+	}
+	check, ok := s.verifySMTP(r.Context(), profile)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("未配置 SMTP 通道 %q", profile))
+		return
+	}
+	status := http.StatusOK
+	if !check.OK {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, check)
+}
+
+// handleSMTPVerifyForm runs the check from the settings page and shows the
+// result there.
+func (s *Server) handleSMTPVerifyForm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	check, ok := s.verifySMTP(r.Context(), r.FormValue("profile"))
+	if !ok {
+		s.renderMessage(w, "未配置该 SMTP 通道", "/settings")
+		return
+	}
+	data := s.settingsData()
+	switch {
+	case check.OK:
+		data.Flash = fmt.Sprintf("SMTP 连接检测通过（%s）：连接、加密与登录均正常", check.Host)
+	case check.Stage != "":
+		data.Flash = fmt.Sprintf("SMTP 连接检测失败（%s），失败阶段 %s：%s", check.Host, check.Stage, check.Error)
+	default:
+		data.Flash = fmt.Sprintf("SMTP 连接检测失败（%s）：%s", check.Host, check.Error)
+	}
+	s.render(w, "settings.html", data)
+}
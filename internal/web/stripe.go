@@ -0,0 +1,73 @@
+package web
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"xf/internal/logging"
+	"xf/internal/reminder"
+	"xf/internal/stripe"
+)
+
+// handleStripeWebhook receives Stripe's checkout events at /webhooks/stripe
+// and renews the subscription a payment link was paid for. The event's
+// signature, checked against STRIPE_WEBHOOK_SECRET, stands in for admin
+// auth; without a secret the endpoint is disabled.
+func (s *Server) handleStripeWebhook(w http.ResponseWriter, r *http.Request) {
+	secret := s.conf().StripeWebhookSecret
+	if secret == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxEventBody))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	event, err := stripe.ParseEvent(body, r.Header.Get("Stripe-Signature"), secret, time.Now())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	session := event.Data.Object
+	// Card payments complete paid; bank debits complete unpaid and are
+	// followed by async_payment_succeeded.
+	if (event.Type != "checkout.session.completed" && event.Type != "checkout.session.async_payment_succeeded") || session.PaymentStatus != "paid" {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ignored"})
+		return
+	}
+	id, err := strconv.Atoi(session.Metadata["subscription_id"])
+	if err != nil {
+		var ok bool
+		if id, ok = s.store.SubscriptionByPaymentLink(session.PaymentLink); !ok {
+			slog.Warn("stripe payment matches no subscription", "event", event.ID, "session", session.ID, "link", session.PaymentLink)
+			writeJSON(w, http.StatusOK, map[string]string{"status": "unmatched"})
+			return
+		}
+	}
+	sub, err := s.store.GetSubscription(id)
+	if err != nil {
+		slog.Warn("stripe payment for missing subscription", "event", event.ID, "session", session.ID, logging.SubscriptionID, id)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "unmatched"})
+		return
+	}
+	if err := s.service().RenewPaid(r.Context(), sub, session, time.Now()); err != nil {
+		if errors.Is(err, reminder.ErrStalePayment) {
+			// Retrying won't help; the admin settles it by hand.
+			slog.Warn("stripe payment not applied", "event", event.ID, "session", session.ID, logging.SubscriptionID, id, "error", err)
+			writeJSON(w, http.StatusOK, map[string]string{"status": "stale"})
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "renewed"})
+}
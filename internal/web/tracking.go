@@ -0,0 +1,82 @@
+package web
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transparentGIF is a 1x1 transparent GIF.
+var transparentGIF = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\x00\x00\x00!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+
+// handleOpen serves the open-tracking pixel at /track/open/<reference>.gif
+// without admin auth and records the open against the send log. The image
+// is returned whether or not the reference matches, so the endpoint says
+// nothing about which references exist.
+func (s *Server) handleOpen(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reference, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/track/open/"), ".gif")
+	if !ok || !validReference(reference) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodGet {
+		if _, err := s.store.RecordOpen(reference, time.Now()); err != nil {
+			slog.Error("record open error", "reference", reference, "error", err)
+		}
+	}
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-store, max-age=0")
+	w.Write(transparentGIF)
+}
+
+// handleClick serves the click-tracking redirect at
+// /track/click/<reference>/<n>. Only links recorded for that send are
+// followed, so it can't be used as an open redirect. HEAD requests, which
+// mail security scanners send, are redirected without counting a click.
+func (s *Server) handleClick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reference, index, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/track/click/"), "/")
+	n, err := strconv.Atoi(index)
+	if err != nil || !validReference(reference) {
+		http.NotFound(w, r)
+		return
+	}
+	var target string
+	var ok bool
+	if r.Method == http.MethodGet {
+		target, ok, err = s.store.RecordClick(reference, n, time.Now())
+	} else {
+		target, ok, err = s.store.ClickTarget(reference, n)
+	}
+	if err != nil {
+		slog.Error("record click error", "reference", reference, "error", err)
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// validReference reports whether s looks like a queue send reference, i.e.
+// lower-case hex.
+func validReference(s string) bool {
+	if s == "" || len(s) > 64 {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
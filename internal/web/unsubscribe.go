@@ -0,0 +1,65 @@
+package web
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"xf/internal/logging"
+)
+
+// unsubscribePage is the data for the public unsubscribe page.
+type unsubscribePage struct {
+	Company string
+	Email   string
+	Token   string
+	Done    bool
+}
+
+// handleUnsubscribe serves the List-Unsubscribe link without admin auth;
+// the signed token is the credential. GET asks for confirmation so link
+// scanners can't opt customers out, while POST, which is also what mail
+// clients send for RFC 8058 one-click unsubscribe, records the opt-out.
+func (s *Server) handleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if token == "" && r.Method == http.MethodPost {
+		token = r.PostFormValue("token")
+	}
+	id, ok, err := s.service().VerifyUnsubscribeToken(token)
+	if err != nil {
+		s.renderError(w, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "退订链接无效", http.StatusNotFound)
+		return
+	}
+	customer, err := s.store.GetCustomer(id)
+	if err != nil {
+		http.Error(w, "退订链接无效", http.StatusNotFound)
+		return
+	}
+	page := unsubscribePage{Company: s.conf().CompanyName, Email: customer.Email, Token: token, Done: customer.OptedOut}
+	if r.Method == http.MethodPost && !customer.OptedOut {
+		if err := s.store.SetCustomerOptOut(id, true, time.Now()); err != nil {
+			s.renderError(w, err)
+			return
+		}
+		slog.Info("customer unsubscribed from reminders", "customer_id", id, logging.CustomerEmail, customer.Email)
+		page.Done = true
+	}
+	tpl, err := template.ParseFS(assetsFS, "templates/unsubscribe.html")
+	if err != nil {
+		s.renderError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tpl.Execute(w, page); err != nil {
+		slog.Error("render unsubscribe page", "error", err)
+	}
+}
@@ -0,0 +1,72 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"xf/internal/db"
+	"xf/internal/reminder"
+)
+
+const (
+	maxUpsertBody  = 32 << 20
+	maxUpsertItems = 5000
+)
+
+// handleAPIBulkUpsert serves POST /api/v1/subscriptions:bulkUpsert. The
+// body is a JSON array of db.UpsertItem; the batch is applied in one write
+// or, if any item fails, not at all. ?dry_run=1 reports what would happen
+// without applying it.
+func (s *Server) handleAPIBulkUpsert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var items []db.UpsertItem
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUpsertBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&items); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("请求体须为订阅数组: %w", err))
+		return
+	}
+	if len(items) > maxUpsertItems {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("每次最多 %d 条", maxUpsertItems))
+		return
+	}
+	// The store doesn't parse expiry dates, so bad ones are caught here
+	// and the batch is only tried, to report on the other items.
+	invalid := map[int]bool{}
+	for i := range items {
+		items[i].ExpiresAt = strings.TrimSpace(items[i].ExpiresAt)
+		if items[i].ExpiresAt == "" {
+			continue
+		}
+		if _, _, err := reminder.ParseExpiry(items[i].ExpiresAt, s.conf().TimeZone); err != nil {
+			invalid[i] = true
+		}
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "1"
+	results, err := s.store.BulkUpsert(items, dryRun || len(invalid) > 0, time.Now())
+	for i := range invalid {
+		msg := "到期时间格式错误，应为 2006-01-02 或 2006-01-02 15:04"
+		if results[i].Error != "" {
+			msg += "；" + results[i].Error
+		}
+		results[i].Status, results[i].Error = db.UpsertFailed, msg
+	}
+	if err == nil && len(invalid) > 0 {
+		err = db.ErrUpsertRejected
+	}
+	switch {
+	case errors.Is(err, db.ErrUpsertRejected):
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]any{"applied": false, "error": err.Error(), "results": results})
+	case err != nil:
+		writeJSONError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, map[string]any{"applied": !dryRun, "results": results})
+	}
+}
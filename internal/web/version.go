@@ -0,0 +1,20 @@
+package web
+
+import (
+	"net/http"
+
+	"xf/internal/version"
+)
+
+// build is read once; it can't change while the process runs.
+var build = version.Get()
+
+// handleAPIVersion serves GET /api/version. It sits outside /api/v1 so
+// clients can ask any release which API it speaks.
+func (s *Server) handleAPIVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, build)
+}
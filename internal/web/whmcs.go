@@ -0,0 +1,60 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"xf/internal/whmcs"
+)
+
+// handleWHMCSSync runs a WHMCS sync right away instead of waiting for the
+// scheduled one.
+func (s *Server) handleWHMCSSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	syncer := whmcs.Syncer{Store: s.store, Client: s.whmcsClient()}
+	if !syncer.Client.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+	count, err := syncer.Sync(r.Context(), time.Now())
+	if err != nil {
+		s.renderMessage(w, fmt.Sprintf("WHMCS 同步失败: %s", err), "/products")
+		return
+	}
+	message := fmt.Sprintf("WHMCS 同步完成：新增客户 %d 个、更新 %d 个；新增产品 %d 个；新增订阅 %d 个、更新 %d 个、移除 %d 个。",
+		count.CustomersAdded, count.CustomersUpdated, count.ProductsAdded,
+		count.SubscriptionsAdded, count.SubscriptionsUpdated, count.SubscriptionsRemoved)
+	if count.ClientsSkipped > 0 {
+		message += fmt.Sprintf("另有 %d 个客户的邮箱与已有客户重复，未导入。", count.ClientsSkipped)
+	}
+	s.renderMessage(w, message, "/products")
+}
+
+func (s *Server) whmcsClient() whmcs.Client {
+	cfg := s.conf()
+	return whmcs.Client{URL: cfg.WHMCSURL, Identifier: cfg.WHMCSIdentifier, Secret: cfg.WHMCSSecret, AccessKey: cfg.WHMCSAccessKey}
+}
+
+// parseWHMCSProducts reads a list of WHMCS product IDs separated by commas
+// or spaces.
+func parseWHMCSProducts(input string) ([]int, error) {
+	var ids []int
+	seen := map[int]bool{}
+	for _, field := range strings.FieldsFunc(input, func(r rune) bool { return r == ',' || r == '，' || r == ' ' }) {
+		id, err := strconv.Atoi(field)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("WHMCS 产品 ID 格式错误: %s", field)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
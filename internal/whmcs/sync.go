@@ -0,0 +1,94 @@
+package whmcs
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"xf/internal/db"
+)
+
+const (
+	defaultInterval = time.Hour
+	syncTimeout     = 5 * time.Minute
+)
+
+// syncedStatuses are the service statuses that keep a subscription; the
+// rest (Pending, Terminated, Cancelled, Fraud, Completed) have nothing to
+// renew.
+var syncedStatuses = map[string]bool{"Active": true, "Suspended": true}
+
+// Syncer imports WHMCS clients and services into the store on a schedule.
+type Syncer struct {
+	Store    *db.Store
+	Client   Client
+	Interval time.Duration
+}
+
+// Start syncs in the background until ctx is cancelled.
+func (s Syncer) Start(ctx context.Context) {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if count, err := s.Sync(ctx, time.Now()); err != nil {
+				slog.Error("whmcs sync error", "error", err)
+			} else if count != (db.WHMCSCount{ClientsSkipped: count.ClientsSkipped}) {
+				slog.Info("whmcs sync changed data", "customers_added", count.CustomersAdded, "customers_updated", count.CustomersUpdated,
+					"clients_skipped", count.ClientsSkipped, "products_added", count.ProductsAdded, "products_mapped", count.ProductsMapped,
+					"subscriptions_added", count.SubscriptionsAdded, "subscriptions_updated", count.SubscriptionsUpdated,
+					"subscriptions_removed", count.SubscriptionsRemoved)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Sync reads every client and service once and applies them to the store.
+// Nothing is changed unless both lists were read in full.
+func (s Syncer) Sync(ctx context.Context, now time.Time) (db.WHMCSCount, error) {
+	ctx, cancel := context.WithTimeout(ctx, syncTimeout)
+	defer cancel()
+	customers, err := s.Client.Customers(ctx)
+	if err != nil {
+		return db.WHMCSCount{}, err
+	}
+	services, err := s.Client.Services(ctx)
+	if err != nil {
+		return db.WHMCSCount{}, err
+	}
+	var data db.WHMCSData
+	for _, c := range customers {
+		data.Clients = append(data.Clients, db.WHMCSClient{ID: c.ID, Name: c.Name(), Email: c.Email})
+	}
+	for _, service := range services {
+		name := service.ProductName
+		if name == "" {
+			name = "WHMCS 产品 " + strconv.Itoa(service.ProductID)
+		}
+		expires := service.NextDueDate
+		if _, err := time.Parse("2006-01-02", expires); err != nil {
+			// Free and one-time services have no due date.
+			expires = ""
+		}
+		data.Services = append(data.Services, db.WHMCSService{
+			ID:          service.ID,
+			ClientID:    service.ClientID,
+			ProductID:   service.ProductID,
+			ProductName: name,
+			Domain:      service.Domain,
+			ExpiresAt:   expires,
+			Active:      syncedStatuses[service.Status],
+		})
+	}
+	return s.Store.SyncWHMCS(data, now)
+}
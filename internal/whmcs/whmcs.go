@@ -0,0 +1,230 @@
+// Package whmcs imports clients and services from a WHMCS billing system
+// through its API and keeps the subscriptions made from them in sync.
+package whmcs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"xf/internal/email"
+)
+
+// pageSize is how many records each API call asks for.
+const pageSize = 250
+
+// Client calls the WHMCS API with an API credential (Setup > Staff
+// Management > Manage API Credentials) whose role allows GetClients and
+// GetClientsProducts.
+type Client struct {
+	// URL is the address of the WHMCS install, e.g.
+	// https://billing.example.com; the API is includes/api.php under it.
+	URL        string
+	Identifier string
+	Secret     string
+	// AccessKey is the $api_access_key from configuration.php, which lets
+	// requests through from addresses not on the API IP allowlist.
+	AccessKey string
+	Client    *http.Client
+}
+
+func (c Client) Enabled() bool {
+	return c.URL != "" && c.Identifier != "" && c.Secret != ""
+}
+
+// Customer is a WHMCS client.
+type Customer struct {
+	ID          int
+	FirstName   string
+	LastName    string
+	CompanyName string
+	Email       string
+}
+
+// Name is the company name, or else the client's full name.
+func (c Customer) Name() string {
+	if c.CompanyName != "" {
+		return c.CompanyName
+	}
+	return strings.TrimSpace(c.FirstName + " " + c.LastName)
+}
+
+// Service is a WHMCS service ("product" in the API). NextDueDate is
+// "0000-00-00" for free and one-time services.
+type Service struct {
+	ID          int
+	ClientID    int
+	ProductID   int
+	ProductName string
+	GroupName   string
+	Domain      string
+	NextDueDate string
+	Status      string
+}
+
+// Verify checks the credential by reading one client.
+func (c Client) Verify(ctx context.Context) error {
+	var reply struct{}
+	return c.call(ctx, "GetClients", url.Values{"limitnum": {"1"}}, &reply)
+}
+
+// Customers returns every client.
+func (c Client) Customers(ctx context.Context) ([]Customer, error) {
+	var customers []Customer
+	for start := 0; ; start += pageSize {
+		var reply struct {
+			Total   number `json:"totalresults"`
+			Clients list[struct {
+				ID          number `json:"id"`
+				FirstName   string `json:"firstname"`
+				LastName    string `json:"lastname"`
+				CompanyName string `json:"companyname"`
+				Email       string `json:"email"`
+			}] `json:"clients"`
+		}
+		if err := c.call(ctx, "GetClients", url.Values{"limitstart": {strconv.Itoa(start)}}, &reply); err != nil {
+			return nil, err
+		}
+		for _, r := range reply.Clients.items {
+			customers = append(customers, Customer{
+				ID:          int(r.ID),
+				FirstName:   r.FirstName,
+				LastName:    r.LastName,
+				CompanyName: r.CompanyName,
+				Email:       r.Email,
+			})
+		}
+		if len(reply.Clients.items) == 0 || len(customers) >= int(reply.Total) {
+			return customers, nil
+		}
+	}
+}
+
+// Services returns every service of every client.
+func (c Client) Services(ctx context.Context) ([]Service, error) {
+	var services []Service
+	for start := 0; ; start += pageSize {
+		var reply struct {
+			Total    number `json:"totalresults"`
+			Products list[struct {
+				ID          number `json:"id"`
+				ClientID    number `json:"clientid"`
+				PID         number `json:"pid"`
+				Name        string `json:"name"`
+				GroupName   string `json:"groupname"`
+				Domain      string `json:"domain"`
+				NextDueDate string `json:"nextduedate"`
+				Status      string `json:"status"`
+			}] `json:"products"`
+		}
+		if err := c.call(ctx, "GetClientsProducts", url.Values{"limitstart": {strconv.Itoa(start)}}, &reply); err != nil {
+			return nil, err
+		}
+		for _, r := range reply.Products.items {
+			services = append(services, Service{
+				ID:          int(r.ID),
+				ClientID:    int(r.ClientID),
+				ProductID:   int(r.PID),
+				ProductName: r.Name,
+				GroupName:   r.GroupName,
+				Domain:      r.Domain,
+				NextDueDate: r.NextDueDate,
+				Status:      r.Status,
+			})
+		}
+		if len(reply.Products.items) == 0 || len(services) >= int(reply.Total) {
+			return services, nil
+		}
+	}
+}
+
+// call posts an API action and decodes the reply into out. WHMCS answers
+// 200 with result "error" for most failures.
+func (c Client) call(ctx context.Context, action string, form url.Values, out any) error {
+	form.Set("action", action)
+	form.Set("identifier", c.Identifier)
+	form.Set("secret", c.Secret)
+	form.Set("responsetype", "json")
+	if form.Get("limitnum") == "" {
+		form.Set("limitnum", strconv.Itoa(pageSize))
+	}
+	if c.AccessKey != "" {
+		form.Set("accesskey", c.AccessKey)
+	}
+	endpoint := strings.TrimRight(c.URL, "/") + "/includes/api.php"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 32<<20))
+	var result struct {
+		Result  string `json:"result"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		if resp.StatusCode >= 300 {
+			return &email.APIError{Provider: "WHMCS", StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(data))}
+		}
+		return fmt.Errorf("WHMCS %s: %w", action, err)
+	}
+	if result.Result != "success" {
+		return fmt.Errorf("WHMCS %s failed: %s", action, result.Message)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("WHMCS %s: %w", action, err)
+	}
+	return nil
+}
+
+// list is a result list such as {"clients": {"client": [...]}}: an object
+// with one key holding the items, or an empty string when there are none.
+type list[T any] struct {
+	items []T
+}
+
+func (l *list[T]) UnmarshalJSON(data []byte) error {
+	if len(data) == 0 || data[0] != '{' {
+		return nil
+	}
+	var wrapper map[string][]T
+	if err := json.Unmarshal(data, &wrapper); err != nil {
+		return err
+	}
+	for _, items := range wrapper {
+		l.items = append(l.items, items...)
+	}
+	return nil
+}
+
+// number is an ID or count, which WHMCS sends as a number or a string
+// depending on version and action.
+type number int
+
+func (n *number) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		*n = 0
+		return nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid number %s", data)
+	}
+	*n = number(v)
+	return nil
+}